@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"github.com/estecker/farm/internal/airflow"
+	"github.com/estecker/farm/internal/argo"
+	"github.com/estecker/farm/internal/backfill"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/state"
+	"github.com/spf13/cobra"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"time"
+)
+
+// backfillCmd replays historical runs through the normal sinks
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Publish historical Argo or Airflow runs",
+	Long: `Publish historical runs that started between --since and --until.
+Argo reads the workflow archive, Airflow reads the DAG runs of every DAG that passes the filter.
+Progress is checkpointed to the --state file, running the same command again resumes.`,
+	Example: `  farm backfill --source airflow --since 2026-01-01 --until 2026-02-01 --trace`,
+	Args:    cobra.NoArgs,
+	RunE:    runBackfill,
+}
+
+func init() {
+	backfillCmd.Flags().String("source", "", "argo or airflow")
+	backfillCmd.Flags().String("since", "", "start of the range, 2006-01-02 or RFC3339")
+	backfillCmd.Flags().String("until", "", "end of the range, 2006-01-02 or RFC3339 (default now)")
+	backfillCmd.Flags().Float64("rate", 5, "API calls per second")
+	backfillCmd.Flags().Bool("trace", false, "also send a trace for every completed run")
+	backfillCmd.Flags().String("state", "farm-backfill.json", "checkpoint file used to resume")
+	_ = backfillCmd.MarkFlagRequired("source")
+	_ = backfillCmd.MarkFlagRequired("since")
+	rootCmd.AddCommand(backfillCmd)
+}
+
+// parseTime accepts a date or a RFC3339 timestamp
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func runBackfill(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	source, _ := flags.GetString("source")
+	sinceFlag, _ := flags.GetString("since")
+	untilFlag, _ := flags.GetString("until")
+	perSecond, _ := flags.GetFloat64("rate")
+	withTrace, _ := flags.GetBool("trace")
+	statePath, _ := flags.GetString("state")
+
+	if source != "argo" && source != "airflow" {
+		return fmt.Errorf("unknown --source %q, want argo or airflow", source)
+	}
+	if perSecond <= 0 {
+		return fmt.Errorf("--rate %v is not positive", perSecond)
+	}
+	since, err := parseTime(sinceFlag)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	until := time.Now().UTC().Truncate(time.Second)
+	if untilFlag != "" {
+		if until, err = parseTime(untilFlag); err != nil {
+			return fmt.Errorf("--until: %w", err)
+		}
+	}
+	if !since.Before(until) {
+		return fmt.Errorf("--since %s is not before --until %s", since, until)
+	}
+	store, err := state.Open(statePath)
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Get()
+	opts := backfill.Options{
+		Since:   since,
+		Until:   until,
+		Trace:   withTrace,
+		Limiter: rate.NewLimiter(rate.Limit(perSecond), 1),
+		Store:   store,
+	}
+	em, err := newEmitter(cfg)
+	if err != nil {
+		return err
+	}
+	defer em.Metrics.Close()
+	opts.Emitter = em.For(source)
+	defer func() {
+		if err := sink.Close(em.Sink); err != nil {
+			slog.Error("Failed to close sinks", "error", err)
+		}
+	}()
+	if withTrace {
+		defer startTracer(cfg)()
+	}
+	slog.Info("Starting backfill", "source", source, "since", since, "until", until, "state", statePath)
+	if source == "argo" {
+		err = argo.Backfill(cmd.Context(), cfg, opts)
+	} else if cfg.Sources.Airflow.Host == "" {
+		err = fmt.Errorf("sources.airflow.host not set")
+	} else {
+		err = airflow.Backfill(cmd.Context(), cfg, opts)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Backfill done", "source", source)
+	return nil
+}
@@ -3,27 +3,36 @@ package main
 import (
 	"cloud.google.com/go/compute/metadata"
 	"context"
-	"fmt"
-	"github.com/estecker/farm/internal/airflow"
-	"github.com/estecker/farm/internal/argo"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/anomaly"
+	"github.com/estecker/farm/internal/bigquery"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/objectstore"
+	"github.com/estecker/farm/internal/pubsub"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/estecker/farm/internal/state"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	_ "go.uber.org/automaxprocs"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "farm",
-	Short: "Scrape metrics from Argo and Airflow and send them to Datadog",
-	Long:  `Scrape metrics from Argo and Airflow and send them to Datadog.`,
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
+	Short: "Scrape metrics from Argo, Airflow, Tekton, Kubernetes Jobs, Prefect, Dagster and Temporal and send them to Datadog",
+	Long:  `Scrape metrics from Argo, Airflow, Tekton, Kubernetes Jobs, Prefect, Dagster and Temporal and send them to Datadog.`,
+	// Without a subcommand FARM collects forever
 	Run: func(cmd *cobra.Command, args []string) {
-		slog.Info("cmd/farm/main called")
+		serve(cmd.Context())
 	},
 }
 
@@ -32,13 +41,11 @@ func init() {
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	_ = viper.BindPFlag("argo", rootCmd.Flags().Lookup("argo"))
-	_ = viper.BindPFlag("airflow", rootCmd.Flags().Lookup("airflow"))
-	_ = viper.BindPFlag("airflow_host", rootCmd.Flags().Lookup("airflow_host"))
-	_ = viper.BindPFlag("argo_namespace", rootCmd.Flags().Lookup("argo_namespace"))
-	_ = viper.BindPFlag("bq_project_id", rootCmd.Flags().Lookup("bq_project_id"))
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (YAML or TOML), see deployments/farm.yaml")
 }
 
+var cfgFile string
+
 // Get some information for publishing, but never change
 // getProjectID returns the GCE project ID if running in GCE
 func getProjectID() (string, error) {
@@ -58,58 +65,198 @@ func getServiceAccountEmail() (string, error) {
 		c := metadata.NewClient(nil)
 		return c.Email("default")
 	} else {
-		fmt.Println("Not on GCE")
+		slog.Info("Not on GCE")
 		return "", nil
 	}
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	viper.SetEnvPrefix("farm")
-	viper.AutomaticEnv() // read in environment variables that match
+	if err := config.Init(viper.GetViper(), cfgFile); err != nil {
+		slog.Error("FARM: Invalid config", "file", cfgFile, "error", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	slog.SetDefault(logger)
-	slog.Info("Starting FARM",
-		"DD_SERVICE", os.Getenv("DD_SERVICE"),
-		"tenant", os.Getenv("tenant"),
-		"DD_ENV", os.Getenv("DD_ENV"))
-	ctx := context.Background()
+// whoami returns the GCE identity FARM publishes as
+func whoami() (projectID string, saEmail string) {
+	projectID, _ = getProjectID()
+	saEmail, _ = getServiceAccountEmail()
+	slog.Info("whoami",
+		"projectID", projectID,
+		"saEmail", saEmail)
+	return projectID, saEmail
+}
 
-	err := rootCmd.Execute()
+// newSink returns the sinks enabled in the config
+func newSink(cfg *config.Config, projectID string) sink.Sink {
+	var sinks []sink.Sink
+	if cfg.Sinks.PubSub.Enabled {
+		topicProjectID := cfg.Sinks.PubSub.ProjectID
+		if topicProjectID == "" {
+			slog.Error("sinks.pubsub.project_id not set will use own project_id")
+			topicProjectID = projectID
+		}
+		sinks = append(sinks, pubsub.Sink{
+			ProjectID:   topicProjectID,
+			TopicID:     cfg.Sinks.PubSub.Topic,
+			Topics:      cfg.Sinks.PubSub.Topics,
+			CloudEvents: cfg.Sinks.PubSub.CloudEvents,
+			Encoding:    cfg.Sinks.PubSub.Encoding,
+		})
+	}
+	if cfg.Sinks.HTTP.Enabled {
+		sinks = append(sinks, sink.HTTP{
+			URL:         cfg.Sinks.HTTP.URL,
+			CloudEvents: cfg.Sinks.HTTP.CloudEvents,
+			Encoding:    cfg.Sinks.HTTP.Encoding,
+			Client:      &http.Client{Timeout: cfg.Sinks.HTTP.Timeout},
+		})
+	}
+	if cfg.Sinks.BigQuery.Enabled {
+		bqProjectID := cfg.Sinks.BigQuery.ProjectID
+		if bqProjectID == "" {
+			bqProjectID = projectID
+		}
+		sinks = append(sinks, &bigquery.Sink{
+			ProjectID: bqProjectID,
+			Dataset:   cfg.Sinks.BigQuery.Dataset,
+			Tables:    cfg.Sinks.BigQuery.Tables,
+			Location:  cfg.Sinks.BigQuery.Location,
+		})
+	}
+	if o := cfg.Sinks.ObjectStorage; o.Enabled {
+		bucket, err := objectstore.Open(context.Background(), o.URL)
+		if err != nil {
+			slog.Error("Failed to open object storage", "url", o.URL, "error", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, &objectstore.Sink{
+			Bucket:        bucket,
+			Format:        o.Format,
+			FlushSize:     o.FlushSize,
+			FlushInterval: o.FlushInterval,
+		})
+	}
+	if len(sinks) == 0 {
+		return sink.Discard{}
+	}
+	return &sink.Multi{Sinks: sinks}
+}
+
+// newMetrics returns the DogStatsD client if enabled, else a client that drops the metrics
+func newMetrics(cfg *config.Config) (statsd.ClientInterface, error) {
+	d := cfg.Metrics.DogStatsD
+	if !d.Enabled {
+		return &statsd.NoOpClient{}, nil
+	}
+	return statsd.New(d.Address, statsd.WithNamespace(d.Namespace))
+}
+
+// newEmitter returns the services shared by the sources, publishing to the sinks enabled in the config
+func newEmitter(cfg *config.Config) (*source.Emitter, error) {
+	projectID, saEmail := whoami()
+	metrics, err := newMetrics(cfg)
 	if err != nil {
-		os.Exit(1)
+		return nil, err
 	}
-	projectID, _ := getProjectID()
-	saEmail, _ := getServiceAccountEmail()
-	var topicProjectID string
-	if !viper.IsSet("topic_project_id") {
-		slog.Error("topic_project_id not set will use own project_id")
-		topicProjectID = projectID
-	} else {
-		topicProjectID = viper.GetString("topic_project_id")
+	store, err := state.Open(cfg.State.Path)
+	if err != nil {
+		return nil, err
 	}
+	return &source.Emitter{
+		Sink:      newSink(cfg, projectID),
+		ProjectID: projectID,
+		SAEmail:   saEmail,
+		State:     store,
+		Logger:    slog.Default(),
+		Metrics:   metrics,
+	}, nil
+}
 
-	logger.Info("whoami",
-		"projectID", projectID,
-		"saEmail", saEmail)
+// startTracer starts the Datadog tracer if enabled, the returned func stops it
+func startTracer(cfg *config.Config) func() {
+	if !cfg.Tracing.Datadog.Enabled {
+		return func() {}
+	}
 	opts := []tracer.StartOption{tracer.WithLogStartup(false), tracer.WithRuntimeMetrics()}
 	tracer.Start(opts...)
-	defer tracer.Stop()
+	return tracer.Stop
+}
+
+// serve runs the enabled collectors forever
+func serve(ctx context.Context) {
+	cfg := config.Get()
+	slog.Info("Starting FARM",
+		"DD_SERVICE", os.Getenv("DD_SERVICE"),
+		"tenant", cfg.Tenant,
+		"environment", cfg.Environment,
+		"config", cfgFile)
+	em, err := newEmitter(cfg)
+	if err != nil {
+		slog.Error("FARM: Failed to start", "error", err)
+		os.Exit(1)
+	}
+	defer em.Metrics.Close()
+	defer startTracer(cfg)()
+	em.SLO = &slo.Engine{
+		Sink:      em.Sink,
+		ProjectID: em.ProjectID,
+		SAEmail:   em.SAEmail,
+		State:     em.State,
+		Logger:    em.Logger.With("source", "slo"),
+		Metrics:   em.Metrics,
+	}
+	go em.SLO.Run(ctx)
+	// The samples of every workflow and step are much larger than the rest of the state, they have their own file
+	samples, err := state.Open(state.Sibling(cfg.State.Path, "anomaly"))
+	if err != nil {
+		slog.Error("FARM: Failed to start", "error", err)
+		os.Exit(1)
+	}
+	em.Anomaly = &anomaly.Detector{
+		Sink:      em.Sink,
+		ProjectID: em.ProjectID,
+		SAEmail:   em.SAEmail,
+		State:     samples,
+		Logger:    em.Logger.With("source", "anomaly"),
+		Metrics:   em.Metrics,
+	}
 	var wg sync.WaitGroup
-	if viper.GetBool("argo") {
-		go argo.Exec(ctx, projectID, saEmail, viper.GetString("argo_namespace"), topicProjectID)
+	for _, s := range source.Enabled(cfg) {
 		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Run(ctx, em.For(s.Name())); err != nil {
+				slog.Error("FARM: Source failed", "source", s.Name(), "error", err)
+				os.Exit(1)
+			}
+		}()
 	}
-	if viper.GetBool("airflow") {
-		if viper.GetString("airflow_host") == "" {
-			slog.Error("FARM: Airflow host not set")
-			os.Exit(1)
-		}
-		go airflow.Exec(ctx, projectID, saEmail, viper.GetString("airflow_host"), topicProjectID)
-		wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		slog.Info("Stopping FARM", "reason", context.Cause(ctx))
+	case <-done:
+	}
+	// Buffering sinks write what they have
+	if err := sink.Close(em.Sink); err != nil {
+		slog.Error("Failed to close sinks", "error", err)
+	}
+}
+
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	slog.SetDefault(logger)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := rootCmd.ExecuteContext(ctx)
+	if err != nil {
+		os.Exit(1)
 	}
-	wg.Wait()
 }
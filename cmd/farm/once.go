@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/spf13/cobra"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// onceCmd is a dry run of a single collection cycle
+var onceCmd = &cobra.Command{
+	Use:   "once",
+	Short: "Run a single collection cycle and print what would be published",
+	Long: `Run exactly one collection cycle and print the events that would be published and the spans that would be traced.
+Nothing is sent to Pub/Sub or Datadog. Logs go to stderr so stdout only has the results.
+Exits non-zero if a call to the API of a source failed.`,
+	Example: `  farm once --config deployments/farm.yaml --source argo`,
+	Args:    cobra.NoArgs,
+	RunE:    runOnce,
+}
+
+func init() {
+	onceCmd.Flags().StringSlice("source", nil, strings.Join(source.Names(), ", ")+" (default the sources enabled in the config)")
+	rootCmd.AddCommand(onceCmd)
+}
+
+func runOnce(cmd *cobra.Command, args []string) error {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	cfg := config.Get()
+	sources, _ := cmd.Flags().GetStringSlice("source")
+	if len(sources) == 0 {
+		for _, s := range source.Enabled(cfg) {
+			sources = append(sources, s.Name())
+		}
+	}
+	if len(sources) == 0 {
+		return errors.New("no source enabled, use --source or enable one in the config")
+	}
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	out := cmd.OutOrStdout()
+	projectID, saEmail := whoami()
+	em := &source.Emitter{Sink: &sink.Writer{W: out}, ProjectID: projectID, SAEmail: saEmail}
+	var errs []error
+	for _, name := range sources {
+		s, ok := source.Get(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown source %q, want one of %s", name, strings.Join(source.Names(), ", ")))
+			continue
+		}
+		if err := s.Once(cmd.Context(), cfg, em.For(name)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	printSpans(out, mt.FinishedSpans())
+	return errors.Join(errs...)
+}
+
+// printSpans renders the spans as an indented tree per trace, children sorted by start time
+func printSpans(w io.Writer, spans []mocktracer.Span) {
+	children := map[uint64][]mocktracer.Span{}
+	for _, s := range spans {
+		children[s.ParentID()] = append(children[s.ParentID()], s)
+	}
+	for _, c := range children {
+		slices.SortFunc(c, func(a, b mocktracer.Span) int {
+			return a.StartTime().Compare(b.StartTime())
+		})
+	}
+	var walk func(s mocktracer.Span, depth int)
+	walk = func(s mocktracer.Span, depth int) {
+		line := fmt.Sprintf("%s%s [%v] start=%s duration=%s",
+			strings.Repeat("  ", depth),
+			s.OperationName(),
+			s.Tag(ext.ResourceName),
+			s.StartTime().UTC().Format("2006-01-02T15:04:05Z"),
+			s.FinishTime().Sub(s.StartTime()))
+		if code := s.Tag(ext.HTTPCode); code != nil {
+			line += fmt.Sprintf(" http.status_code=%v", code)
+		}
+		_, _ = fmt.Fprintln(w, line)
+		for _, c := range children[s.SpanID()] {
+			walk(c, depth+1)
+		}
+	}
+	for _, root := range children[0] {
+		walk(root, 0)
+	}
+}
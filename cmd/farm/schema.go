@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/estecker/farm/internal/schema"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// schemaCmd writes the schemas generated from proto/farm/v1/events.proto
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Generate the BigQuery, JSON and Pub/Sub schemas of the events",
+	Long: `Generate the schemas in deployments from the event types, proto/farm/v1/events.proto:
+  deployments/<source>-schema.json                BigQuery table schema for bq mk
+  deployments/<source>-event.schema.json          JSON Schema of the json encoding
+  deployments/terraform/farm-<source>-schema.json BigQuery table schema for Terraform
+  deployments/terraform/farm-<source>.proto       Pub/Sub topic schema
+With --check nothing is written and it exits non-zero if a checked-in schema does not match the code, run it in CI.`,
+	Example: `  farm schema --check`,
+	Args:    cobra.NoArgs,
+	RunE:    runSchema,
+}
+
+func init() {
+	schemaCmd.Flags().String("dir", ".", "root of the repository")
+	schemaCmd.Flags().Bool("check", false, "only check the schemas are up to date")
+	rootCmd.AddCommand(schemaCmd)
+}
+
+func runSchema(cmd *cobra.Command, args []string) error {
+	dir, _ := cmd.Flags().GetString("dir")
+	check, _ := cmd.Flags().GetBool("check")
+	files, err := schema.Files()
+	if err != nil {
+		return err
+	}
+	var names, stale []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if !check {
+			if err := os.WriteFile(path, files[name], 0o644); err != nil {
+				return err
+			}
+			continue
+		}
+		current, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !bytes.Equal(current, files[name]) {
+			stale = append(stale, name)
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), name)
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("%d schemas do not match the event types, run farm schema", len(stale))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package main
+
+// The collectors register themselves with the source package in their init
+import (
+	_ "github.com/estecker/farm/internal/airflow"
+	_ "github.com/estecker/farm/internal/argo"
+	_ "github.com/estecker/farm/internal/dagster"
+	_ "github.com/estecker/farm/internal/job"
+	_ "github.com/estecker/farm/internal/prefect"
+	_ "github.com/estecker/farm/internal/tekton"
+	_ "github.com/estecker/farm/internal/temporal"
+)
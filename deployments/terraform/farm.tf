@@ -24,6 +24,106 @@ resource "google_bigquery_table" "airflow" {
     field = "publish_time"
   }
 }
+resource "google_bigquery_table" "tekton" {
+  deletion_protection = false
+  table_id            = "tekton"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-tekton-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "job" {
+  deletion_protection = false
+  table_id            = "job"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-job-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "prefect" {
+  deletion_protection = false
+  table_id            = "prefect"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-prefect-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "dagster" {
+  deletion_protection = false
+  table_id            = "dagster"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-dagster-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "temporal" {
+  deletion_protection = false
+  table_id            = "temporal"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-temporal-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "slo" {
+  deletion_protection = false
+  table_id            = "slo"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-slo-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "missed" {
+  deletion_protection = false
+  table_id            = "missed"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-missed-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "anomaly" {
+  deletion_protection = false
+  table_id            = "anomaly"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-anomaly-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "try" {
+  deletion_protection = false
+  table_id            = "try"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-try-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
+resource "google_bigquery_table" "failure" {
+  deletion_protection = false
+  table_id            = "failure"
+  dataset_id          = google_bigquery_dataset.farm.dataset_id
+  schema              = file("farm-failure-schema.json")
+  time_partitioning {
+    type  = "DAY"
+    field = "publish_time"
+  }
+}
 resource "google_bigquery_table" "argo" {
   deletion_protection = false
   table_id            = "argo"
@@ -36,15 +136,174 @@ resource "google_bigquery_table" "argo" {
 }
 
 ### PubSub Section
-resource "google_pubsub_topic" "farm" {
-  name                       = "farm"
+# Schemas are generated from proto/farm/v1/events.proto by farm schema
+# FARM publishes to these with sinks.pubsub.topics, argo: farm-argo, airflow: farm-airflow tekton: farm-tekton, job: farm-job, prefect: farm-prefect, dagster: farm-dagster, temporal: farm-temporal, slo: farm-slo, missed: farm-missed, anomaly: farm-anomaly, try: farm-try and failure: farm-failure
+resource "google_pubsub_schema" "argo" {
+  name       = "farm-argo"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-argo.proto")
+}
+resource "google_pubsub_schema" "airflow" {
+  name       = "farm-airflow"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-airflow.proto")
+}
+resource "google_pubsub_schema" "tekton" {
+  name       = "farm-tekton"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-tekton.proto")
+}
+resource "google_pubsub_schema" "job" {
+  name       = "farm-job"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-job.proto")
+}
+resource "google_pubsub_schema" "prefect" {
+  name       = "farm-prefect"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-prefect.proto")
+}
+resource "google_pubsub_schema" "dagster" {
+  name       = "farm-dagster"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-dagster.proto")
+}
+resource "google_pubsub_schema" "temporal" {
+  name       = "farm-temporal"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-temporal.proto")
+}
+resource "google_pubsub_schema" "slo" {
+  name       = "farm-slo"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-slo.proto")
+}
+resource "google_pubsub_schema" "missed" {
+  name       = "farm-missed"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-missed.proto")
+}
+resource "google_pubsub_schema" "anomaly" {
+  name       = "farm-anomaly"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-anomaly.proto")
+}
+
+resource "google_pubsub_schema" "try" {
+  name       = "farm-try"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-try.proto")
+}
+
+resource "google_pubsub_schema" "failure" {
+  name       = "farm-failure"
+  type       = "PROTOCOL_BUFFER"
+  definition = file("farm-failure.proto")
+}
+
+resource "google_pubsub_topic" "argo" {
+  name                       = "farm-argo"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.argo.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "airflow" {
+  name                       = "farm-airflow"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.airflow.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "tekton" {
+  name                       = "farm-tekton"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.tekton.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "job" {
+  name                       = "farm-job"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.job.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "prefect" {
+  name                       = "farm-prefect"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.prefect.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "dagster" {
+  name                       = "farm-dagster"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.dagster.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "temporal" {
+  name                       = "farm-temporal"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.temporal.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "slo" {
+  name                       = "farm-slo"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.slo.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "missed" {
+  name                       = "farm-missed"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.missed.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+resource "google_pubsub_topic" "anomaly" {
+  name                       = "farm-anomaly"
   message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.anomaly.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+
+resource "google_pubsub_topic" "try" {
+  name                       = "farm-try"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.try.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
+}
+
+resource "google_pubsub_topic" "failure" {
+  name                       = "farm-failure"
+  message_retention_duration = "604800s" # 7 days
+  schema_settings {
+    schema   = google_pubsub_schema.failure.id
+    encoding = "JSON" # must match sinks.pubsub.encoding
+  }
 }
 
 
 resource "google_pubsub_subscription" "airflow" {
   name                       = "farm-airflow-bigquery"
-  topic                      = google_pubsub_topic.farm.name
+  topic                      = google_pubsub_topic.airflow.name
   message_retention_duration = "604800s" # 7 days
   expiration_policy {
     ttl = "" # never expires
@@ -55,13 +314,12 @@ resource "google_pubsub_subscription" "airflow" {
     write_metadata      = true
     drop_unknown_fields = true
   }
-  filter = "attributes.type = \"airflow\""
 }
 
 
 resource "google_pubsub_subscription" "argo" {
   name                       = "farm-argo-bigquery"
-  topic                      = google_pubsub_topic.farm.name
+  topic                      = google_pubsub_topic.argo.name
   message_retention_duration = "604800s" # 7 days
   expiration_policy {
     ttl = "" #never expires
@@ -72,6 +330,148 @@ resource "google_pubsub_subscription" "argo" {
     write_metadata      = true
     drop_unknown_fields = true
   }
-  filter = "attributes.type = \"argo\""
 }
 
+
+resource "google_pubsub_subscription" "tekton" {
+  name                       = "farm-tekton-bigquery"
+  topic                      = google_pubsub_topic.tekton.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.tekton.project}.${google_bigquery_table.tekton.dataset_id}.${google_bigquery_table.tekton.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "job" {
+  name                       = "farm-job-bigquery"
+  topic                      = google_pubsub_topic.job.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.job.project}.${google_bigquery_table.job.dataset_id}.${google_bigquery_table.job.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "prefect" {
+  name                       = "farm-prefect-bigquery"
+  topic                      = google_pubsub_topic.prefect.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.prefect.project}.${google_bigquery_table.prefect.dataset_id}.${google_bigquery_table.prefect.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "dagster" {
+  name                       = "farm-dagster-bigquery"
+  topic                      = google_pubsub_topic.dagster.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.dagster.project}.${google_bigquery_table.dagster.dataset_id}.${google_bigquery_table.dagster.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "temporal" {
+  name                       = "farm-temporal-bigquery"
+  topic                      = google_pubsub_topic.temporal.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.temporal.project}.${google_bigquery_table.temporal.dataset_id}.${google_bigquery_table.temporal.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "slo" {
+  name                       = "farm-slo-bigquery"
+  topic                      = google_pubsub_topic.slo.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.slo.project}.${google_bigquery_table.slo.dataset_id}.${google_bigquery_table.slo.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "missed" {
+  name                       = "farm-missed-bigquery"
+  topic                      = google_pubsub_topic.missed.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.missed.project}.${google_bigquery_table.missed.dataset_id}.${google_bigquery_table.missed.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+resource "google_pubsub_subscription" "anomaly" {
+  name                       = "farm-anomaly-bigquery"
+  topic                      = google_pubsub_topic.anomaly.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.anomaly.project}.${google_bigquery_table.anomaly.dataset_id}.${google_bigquery_table.anomaly.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+
+resource "google_pubsub_subscription" "try" {
+  name                       = "farm-try-bigquery"
+  topic                      = google_pubsub_topic.try.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.try.project}.${google_bigquery_table.try.dataset_id}.${google_bigquery_table.try.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
+
+resource "google_pubsub_subscription" "failure" {
+  name                       = "farm-failure-bigquery"
+  topic                      = google_pubsub_topic.failure.name
+  message_retention_duration = "604800s" # 7 days
+  expiration_policy {
+    ttl = "" # never expires
+  }
+  bigquery_config {
+    table               = "${google_bigquery_table.failure.project}.${google_bigquery_table.failure.dataset_id}.${google_bigquery_table.failure.table_id}"
+    use_table_schema    = true
+    write_metadata      = true
+    drop_unknown_fields = true
+  }
+}
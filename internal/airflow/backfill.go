@@ -0,0 +1,104 @@
+package airflow
+
+import (
+	"context"
+	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/backfill"
+	"github.com/estecker/farm/internal/config"
+	"log/slog"
+	"strconv"
+)
+
+// DAGs and DAG runs fetched per API call
+const backfillPageSize = 100
+
+// Backfill publishes every DAG run that started between opts.Since and opts.Until
+// Progress is checkpointed per DAG after every page so an interrupted backfill resumes where it stopped
+func Backfill(ctx context.Context, cfg *config.Config, opts backfill.Options) error {
+	cli, err := newClient(ctx, cfg.Sources.Airflow.Host)
+	if err != nil {
+		return err
+	}
+	for offset := int32(0); ; offset += backfillPageSize {
+		if err := opts.Wait(ctx); err != nil {
+			return err
+		}
+		dags, _, err := cli.DAGApi.GetDags(ctx).Limit(backfillPageSize).Offset(offset).OrderBy("dag_id").Execute()
+		if err != nil {
+			return err
+		}
+		for _, dag := range dags.GetDags() {
+			if !cfg.Sources.Airflow.Filter.Match(dag.GetDagId()) {
+				continue
+			}
+			if err := backfillDag(ctx, cfg, cli, dag.GetDagId(), opts); err != nil {
+				return err
+			}
+		}
+		if len(dags.GetDags()) < backfillPageSize {
+			return nil
+		}
+	}
+}
+
+// backfillDag pages through the runs of a single DAG, oldest first
+func backfillDag(ctx context.Context, cfg *config.Config, cli *airflow.APIClient, dagID string, opts backfill.Options) error {
+	key := "backfill/airflow/" + cfg.Sources.Airflow.Host + "/" + dagID
+	cp := opts.Load(key)
+	if cp.Done {
+		return nil
+	}
+	offset, _ := strconv.Atoi(cp.Continue)
+	for {
+		if err := opts.Wait(ctx); err != nil {
+			return err
+		}
+		runs, _, err := cli.DAGRunApi.GetDagRuns(ctx, dagID).
+			Limit(backfillPageSize).
+			Offset(int32(offset)).
+			OrderBy("start_date").
+			StartDateGte(opts.Since).
+			StartDateLte(opts.Until).
+			Execute()
+		if err != nil {
+			return err
+		}
+		for _, run := range runs.GetDagRuns() {
+			traced := opts.Trace && completed(run.GetState())
+			var d details
+			if traced {
+				if err := opts.Wait(ctx); err != nil {
+					return err
+				}
+				if d, err = gather(ctx, cli, cfg, run); err != nil {
+					return err
+				}
+			}
+			msgID, err := publish(ctx, cfg, opts.Emitter, run, d)
+			if err != nil {
+				return err
+			}
+			slog.Debug("backfill.publish",
+				"type", "airflow",
+				"state", run.GetState(),
+				"dagId", run.GetDagId(),
+				"DagRunId", run.GetDagRunId(),
+				"msgID", msgID)
+			if traced {
+				publishTries(ctx, cfg, opts.Emitter, d)
+				trace(cli, run, d, cfg.Sources.Airflow.Tenant, nil, nil)
+				publishFailures(ctx, cfg, opts.Emitter, d)
+			}
+		}
+		offset += len(runs.GetDagRuns())
+		cp.Continue = strconv.Itoa(offset)
+		cp.Done = len(runs.GetDagRuns()) < backfillPageSize
+		if err := opts.Save(key, cp); err != nil {
+			return err
+		}
+		slog.Info("Backfill: airflow page done", "dagId", dagID, "runs", len(runs.GetDagRuns()), "offset", offset)
+		if cp.Done {
+			return nil
+		}
+	}
+}
@@ -2,19 +2,22 @@ package airflow
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/apache/airflow-client-go/airflow"
-	"github.com/estecker/farm/internal/pubsub"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
 	"github.com/jellydator/ttlcache/v3"
 	"golang.org/x/oauth2/google"
 	"log/slog"
-	"os"
-	"regexp"
+	"strconv"
 	"time"
 )
 
 // Get the Dags that I'm interested in
-func getDags(ctx context.Context, cli *airflow.APIClient) (airflow.DAGCollection, error) {
+func getDags(ctx context.Context, cli *airflow.APIClient, filter config.Filter) (airflow.DAGCollection, error) {
 	//tags := []string{"farm"} // Whitelist of DAG tags to monitor based on tags
 	dags, r, err := cli.DAGApi.GetDags(ctx).OnlyActive(true).Execute()
 	if err != nil {
@@ -22,9 +25,8 @@ func getDags(ctx context.Context, cli *airflow.APIClient) (airflow.DAGCollection
 	}
 	//Now we need to filter out the dags we don't want to monitor
 	var d []airflow.DAG
-	var excludedDags = regexp.MustCompile(`airflow_monitoring`)
 	for _, dag := range dags.GetDags() {
-		if !excludedDags.MatchString(dag.GetDagId()) {
+		if filter.Match(dag.GetDagId()) {
 			d = append(d, dag)
 		}
 	}
@@ -34,85 +36,188 @@ func getDags(ctx context.Context, cli *airflow.APIClient) (airflow.DAGCollection
 }
 
 // Get the DAG runs for the DAGs I'm interested in
-func getDagRuns(ctx context.Context, cli *airflow.APIClient, dag airflow.DAG) (airflow.DAGRunCollection, error) {
-	tenMinAgo := time.Now().Add(-10 * time.Minute)
-	dagRuns, r, err := cli.DAGRunApi.GetDagRuns(ctx, dag.GetDagId()).Limit(10).StartDateGte(tenMinAgo).EndDateGte(tenMinAgo).Execute() //list DAG runs
+func getDagRuns(ctx context.Context, cli *airflow.APIClient, dag airflow.DAG, lookback time.Duration) (airflow.DAGRunCollection, error) {
+	since := time.Now().Add(-lookback)
+	dagRuns, r, err := cli.DAGRunApi.GetDagRuns(ctx, dag.GetDagId()).Limit(10).StartDateGte(since).EndDateGte(since).Execute() //list DAG runs
 	if err != nil {
 		slog.Error("Error when calling `DAGRunApi.GetDagRuns`", "error", err, "response", r)
 	}
 	return dagRuns, err
 }
 
-// Create the event to be sent to pubsub
-func main(ctx context.Context, cli *airflow.APIClient, projectID, saEmail string, run airflow.DAGRun, cache *ttlcache.Cache[string, airflow.DagState], topicProjectID string) {
+// Create the event to be sent to pubsub and publish it, used by both main and Backfill
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, run airflow.DAGRun, d details) (string, error) {
+	e := &Event{
+		DagId:                  run.GetDagId(),
+		DagRunId:               run.GetDagRunId(),
+		LogicalDate:            run.GetLogicalDate().UnixMicro(), //I could not get strings to work
+		StartDate:              run.GetStartDate().UnixMicro(),
+		EndDate:                run.GetEndDate().UnixMicro(),
+		DataIntervalStart:      run.GetDataIntervalStart().UnixMicro(),
+		DataIntervalEnd:        run.GetDataIntervalEnd().UnixMicro(),
+		LastSchedulingDecision: run.GetLastSchedulingDecision().UnixMicro(),
+		RunType:                run.GetRunType(),
+		State:                  string(run.GetState()),
+		ExternalTrigger:        run.GetExternalTrigger(),
+		Note:                   run.GetNote(),
+		CriticalPath:           d.path.Proto(),
+		Delays:                 d.delays,
+	}
+	// dag_run_id is only unique within a DAG
+	env := event.New("airflow", e.DagId+"/"+e.DagRunId, e.State, cfg.Sources.Airflow.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "airflow",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.airflow.dagrun.state_changed",
+		Source:     "https://" + cfg.Sources.Airflow.Host,
+		Subject:    e.DagId + "/" + e.DagRunId,
+	})
+}
+
+// Publish the DAG run if its state changed since last time, returns the API and publish errors
+// A run is only cached once published, so it is tried again on the next poll
+func main(ctx context.Context, cfg *config.Config, cli *airflow.APIClient, em *source.Emitter, run airflow.DAGRun, cache *ttlcache.Cache[string, airflow.DagState]) error {
 	rID := run.GetDagRunId()
 	rState := run.GetState()
-	if !cache.Has(rID) || cache.Get(rID).Value() != rState {
-		e := event{
-			DagId:                  run.GetDagId(),
-			DagRunId:               run.GetDagRunId(),
-			LogicalDate:            run.GetLogicalDate().UnixMicro(), //I could not get strings to work
-			StartDate:              run.GetStartDate().UnixMicro(),
-			EndDate:                run.GetEndDate().UnixMicro(),
-			DataIntervalStart:      run.GetDataIntervalStart().UnixMicro(),
-			DataIntervalEnd:        run.GetDataIntervalEnd().UnixMicro(),
-			LastSchedulingDecision: run.GetLastSchedulingDecision().UnixMicro(),
-			RunType:                run.GetRunType(),
-			State:                  string(rState),
-			ExternalTrigger:        run.GetExternalTrigger(),
-			Note:                   run.GetNote(),
+	if cache.Has(rID) && cache.Get(rID).Value() == rState {
+		return nil
+	}
+	var d details
+	if completed(rState) {
+		var err error
+		if d, err = gather(ctx, cli, cfg, run); err != nil {
+			return err
 		}
-		msg, err := json.Marshal(e)
-		if err != nil {
-			slog.Error("Error marshalling Airflow event", "error", err)
+	}
+	msgID, err := publish(ctx, cfg, em, run, d)
+	if err != nil {
+		em.Logger.Error("Error publishing to pubsub", "error", err, "msgID", msgID)
+		return err
+	}
+	cache.Set(rID, run.GetState(), 0)
+	em.Logger.Debug("pubsub.publish",
+		"type", "airflow",
+		"state", run.GetState(),
+		"dagId", run.GetDagId(),
+		"DagRunId", run.GetDagRunId(),
+		"msgID", msgID)
+	if completed(rState) {
+		publishTries(ctx, cfg, em, d)
+		r := slo.Run{
+			Source:   "airflow",
+			Workflow: run.GetDagId(),
+			Tenant:   cfg.Sources.Airflow.Tenant,
+			ID:       run.GetDagId() + "/" + rID,
+			URL:      "https://" + cli.GetConfig().Host + "/dags/" + run.GetDagId(),
+			Start:    run.GetStartDate(),
+			End:      run.GetEndDate(),
+			Success:  rState == airflow.DAGSTATE_SUCCESS,
+		}
+		check := em.Durations(cfg, r)
+		trace(cli, run, d, cfg.Sources.Airflow.Tenant, em.Completed(ctx, cfg, r), check)
+		check.Publish(ctx)
+		publishFailures(ctx, cfg, em, d)
+	}
+	return nil
+}
+
+// completed reports if the DAG run will not change state anymore
+func completed(state airflow.DagState) bool {
+	return state == airflow.DAGSTATE_SUCCESS || state == airflow.DAGSTATE_FAILED
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Airflow DAG run events, sources.airflow in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "airflow"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Airflow.Enabled
+}
+
+// Run is the main loop for collecting Airflow events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	cache := ttlcache.New[string, airflow.DagState](ttlcache.WithTTL[string, airflow.DagState](time.Hour))
+	cli, err := newClient(ctx, config.Get().Sources.Airflow.Host)
+	if err != nil {
+		return err
+	}
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, cli, em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Airflow.Interval) {
+			return nil
 		}
-		attributes := map[string]string{
-			"project_id":  projectID,
-			"sa_email":    saEmail,
-			"type":        "airflow",
-			"tenant":      os.Getenv("tenant"),
-			"environment": os.Getenv("DD_ENV"),
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every DAG run in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	if cfg.Sources.Airflow.Host == "" {
+		return errors.New("sources.airflow.host not set")
+	}
+	cli, err := newClient(ctx, cfg.Sources.Airflow.Host)
+	if err != nil {
+		return err
+	}
+	return cycle(ctx, cfg, cli, em, ttlcache.New[string, airflow.DagState]())
+}
+
+// cycle is one poll of the Airflow API, returns the API errors
+func cycle(ctx context.Context, cfg *config.Config, cli *airflow.APIClient, em *source.Emitter, cache *ttlcache.Cache[string, airflow.DagState]) error {
+	dags, err := getDags(ctx, cli, cfg.Sources.Airflow.Filter)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, dag := range dags.GetDags() { //doing it this way so not running into API rate limits
+		runs, err := getDagRuns(ctx, cli, dag, cfg.Sources.Airflow.Lookback)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		msgID, err := pubsub.Publish(msg, topicProjectID, "farm", attributes)
-		if err == nil {
-			cache.Set(rID, run.GetState(), 0)
-			slog.Debug("pubsub.publish",
-				"type", "airflow",
-				"state", run.GetState(),
-				"dagId", run.GetDagId(),
-				"DagRunId", run.GetDagRunId(),
-				"msgID", msgID)
-		} else {
-			slog.Error("Error publishing to pubsub", "error", err, "msgID", msgID)
+		for _, dagRun := range runs.GetDagRuns() {
+			if err := main(ctx, cfg, cli, em, dagRun, cache); err != nil {
+				errs = append(errs, err)
+			}
 		}
-		if rState == airflow.DAGSTATE_SUCCESS || rState == airflow.DAGSTATE_FAILED {
-			trace(ctx, cli, run)
+	}
+	if cfg.Sources.Airflow.Missed.Enabled {
+		if err := checkDags(ctx, cfg, cli, em, dags.GetDags()); err != nil {
+			em.Logger.Error("Airflow: Error checking DAG schedules", "error", err)
+			errs = append(errs, err)
 		}
 	}
+	return errors.Join(errs...)
 }
 
-// Main loop for collecting Airflow events, runs forever
-func Exec(ctx context.Context, projectID string, saEmail string, host string, topicProjectID string) {
-	cache := ttlcache.New[string, airflow.DagState](ttlcache.WithTTL[string, airflow.DagState](time.Hour))
+// newClient creates an Airflow API client authenticated with the default Google credentials
+func newClient(ctx context.Context, host string) (*airflow.APIClient, error) {
 	conf := airflow.NewConfiguration()
 	conf.Host = host
 	conf.Scheme = "https"
 	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
 	if err != nil {
-		slog.Error("Error creating Google client", "error", err)
-		os.Exit(1)
+		return nil, err
 	}
 	conf.HTTPClient = client
-	cli := airflow.NewAPIClient(conf)
-	for {
-		dags, _ := getDags(ctx, cli)
-		for _, dag := range dags.GetDags() { //doing it this way so not running into API rate limits
-			runs, _ := getDagRuns(ctx, cli, dag)
-			for _, dagRun := range runs.GetDagRuns() {
-				main(ctx, cli, projectID, saEmail, dagRun, cache, topicProjectID)
-			}
-		}
-		time.Sleep(311 * time.Second)
-		cache.DeleteExpired()
-	}
+	return airflow.NewAPIClient(conf), nil
 }
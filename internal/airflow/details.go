@@ -0,0 +1,143 @@
+package airflow
+
+import (
+	"context"
+	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/critical"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/phase"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// details of a completed DAG run, fetched once for its event and its trace
+type details struct {
+	tasks    []airflow.TaskInstance
+	upstream map[string][]string               //Upstream task IDs by task ID, nil when the tasks endpoint failed
+	tries    map[string][]airflow.TaskInstance //By instance ID, every try of the retried tasks
+	path     critical.Path
+	delays   *farmv1.RunDelays
+	failures []*farmv1.StepFailure //Of the failed tasks, with failure_logs.enabled
+}
+
+// stepFailure of a failed task instance by instance ID, nil without failure_logs.enabled
+func (d details) stepFailure(id string) *farmv1.StepFailure {
+	if i := slices.IndexFunc(d.failures, func(f *farmv1.StepFailure) bool { return f.StepId == id }); i >= 0 {
+		return d.failures[i]
+	}
+	return nil
+}
+
+// gather the details of a completed DAG run, fails when its task instances could not be listed
+func gather(ctx context.Context, cli *airflow.APIClient, cfg *config.Config, run airflow.DAGRun) (details, error) {
+	tasks, err := taskInstances(ctx, cli, run)
+	if err != nil {
+		return details{}, err
+	}
+	d := details{tasks: tasks, upstream: dependencies(ctx, cli, run)}
+	d.tries = taskTries(ctx, cli, run, d.tasks)
+	d.failures = stepFailures(ctx, cfg, cli, run, d.tasks)
+	if d.upstream != nil {
+		d.path = criticalPath(run, d.tasks, d.upstream)
+	}
+	var steps []phase.Step
+	for _, task := range d.tasks {
+		steps = append(steps, d.phases(run, task))
+	}
+	var due time.Time
+	switch run.GetRunType() {
+	case "scheduled":
+		due = run.GetDataIntervalEnd()
+	case "manual", "dataset_triggered":
+		due = run.GetLogicalDate()
+	}
+	d.delays = phase.Delays(due, run.GetStartDate(), steps)
+	d.delays.Retrying = retrying(d.tries).Seconds()
+	return d, nil
+}
+
+// taskInstances of a DAG run
+func taskInstances(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) ([]airflow.TaskInstance, error) {
+	tis, r, err := cli.TaskInstanceApi.GetTaskInstances(ctx, run.GetDagId(), run.GetDagRunId()).Execute()
+	if err != nil {
+		slog.Error("Error when calling `TaskInstanceApi.GetTaskInstances`", "error", err, "response", r)
+		return nil, err
+	}
+	return tis.GetTaskInstances(), nil
+}
+
+// dependencies of the tasks of a DAG, the tasks endpoint only has the downstream task IDs
+func dependencies(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) map[string][]string {
+	dagTasks, r, err := cli.DAGApi.GetTasks(ctx, run.GetDagId()).Execute()
+	if err != nil {
+		slog.Error("Error when calling `DAGApi.GetTasks`", "error", err, "response", r)
+		return nil
+	}
+	upstream := map[string][]string{}
+	for _, t := range dagTasks.GetTasks() {
+		for _, d := range t.GetDownstreamTaskIds() {
+			upstream[d] = append(upstream[d], t.GetTaskId())
+		}
+	}
+	return upstream
+}
+
+// instanceID is the task ID, with the map index of a mapped task
+func instanceID(task airflow.TaskInstance) string {
+	if task.GetMapIndex() < 0 {
+		return task.GetTaskId()
+	}
+	return task.GetTaskId() + "[" + strconv.Itoa(int(task.GetMapIndex())) + "]"
+}
+
+// parseTime of the API, zero when it is not set
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// criticalPath of a completed DAG run over its task instances
+// Every instance of a mapped task waited for every instance upstream
+func criticalPath(run airflow.DAGRun, tasks []airflow.TaskInstance, upstream map[string][]string) critical.Path {
+	instances := map[string][]string{}
+	for _, task := range tasks {
+		instances[task.GetTaskId()] = append(instances[task.GetTaskId()], instanceID(task))
+	}
+	var steps []critical.Step
+	for _, task := range tasks {
+		// Skipped and upstream_failed tasks never started, they pass on their upstream
+		step := critical.Step{ID: instanceID(task), Name: task.GetTaskId(), Start: parseTime(task.GetStartDate()), End: parseTime(task.GetEndDate())}
+		for _, u := range upstream[task.GetTaskId()] {
+			step.Upstream = append(step.Upstream, instances[u]...)
+		}
+		steps = append(steps, step)
+	}
+	return critical.Compute(steps, run.GetStartDate(), run.GetEndDate())
+}
+
+// phases of the latest try of a task instance, ready when the last of its upstream tasks ended or else when the DAG run started
+// A retried task is ready again when its previous try ended
+func (d details) phases(run airflow.DAGRun, task airflow.TaskInstance) phase.Step {
+	s := phase.Step{
+		Ready:    run.GetStartDate(),
+		Queued:   parseTime(task.GetQueuedWhen()),
+		Started:  parseTime(task.GetStartDate()),
+		Finished: parseTime(task.GetEndDate()),
+	}
+	for _, try := range d.tries[instanceID(task)] {
+		if end := parseTime(try.GetEndDate()); try.GetTryNumber() < task.GetTryNumber() && end.After(s.Ready) {
+			s.Ready = end
+		}
+	}
+	for _, u := range d.upstream[task.GetTaskId()] {
+		for _, t := range d.tasks {
+			if end := parseTime(t.GetEndDate()); t.GetTaskId() == u && end.After(s.Ready) {
+				s.Ready = end
+			}
+		}
+	}
+	return s
+}
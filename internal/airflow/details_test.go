@@ -0,0 +1,69 @@
+package airflow
+
+import (
+	"encoding/json"
+	"github.com/apache/airflow-client-go/airflow"
+	"testing"
+	"time"
+)
+
+// fromJSON unmarshals an Airflow API object
+func fromJSON[T any](t *testing.T, s string) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestPhases(t *testing.T) {
+	run := fromJSON[airflow.DAGRun](t, `{"dag_id": "etl", "dag_run_id": "scheduled__2026-10-19", "start_date": "2026-10-19T06:00:00Z"}`)
+	extract := fromJSON[airflow.TaskInstance](t, `{"task_id": "extract", "map_index": -1, "try_number": 1, "start_date": "2026-10-19T06:00:10Z", "end_date": "2026-10-19T06:05:00Z"}`)
+	validate := fromJSON[airflow.TaskInstance](t, `{"task_id": "validate", "map_index": -1, "try_number": 1, "start_date": "2026-10-19T06:00:10Z", "end_date": "2026-10-19T06:07:00Z"}`)
+	// Retried, its first try failed at 06:09
+	load := fromJSON[airflow.TaskInstance](t, `{"task_id": "load", "map_index": -1, "try_number": 2, "queued_when": "2026-10-19T06:10:00Z", "start_date": "2026-10-19T06:10:30Z", "end_date": "2026-10-19T06:12:00Z"}`)
+	firstLoad := fromJSON[airflow.TaskInstance](t, `{"task_id": "load", "map_index": -1, "try_number": 1, "start_date": "2026-10-19T06:07:30Z", "end_date": "2026-10-19T06:09:00Z"}`)
+	report := fromJSON[airflow.TaskInstance](t, `{"task_id": "report", "map_index": -1, "try_number": 1, "start_date": "2026-10-19T06:07:20Z", "end_date": "2026-10-19T06:08:00Z"}`)
+	// Never ran, its times are unknown
+	notify := fromJSON[airflow.TaskInstance](t, `{"task_id": "notify", "map_index": -1, "try_number": 0, "state": "upstream_failed"}`)
+	d := details{
+		tasks:    []airflow.TaskInstance{extract, validate, load, report, notify},
+		upstream: map[string][]string{"load": {"extract", "validate"}, "report": {"validate"}, "notify": {"load", "gone"}},
+		tries:    map[string][]airflow.TaskInstance{"load": {firstLoad, load}},
+	}
+	at := func(clock string) time.Time {
+		t, _ := time.Parse(time.RFC3339, "2026-10-19T"+clock+"Z")
+		return t
+	}
+	tests := []struct {
+		task                             airflow.TaskInstance
+		ready, queued, started, finished time.Time
+	}{
+		// No upstream, ready when the DAG run started
+		{extract, at("06:00:00"), time.Time{}, at("06:00:10"), at("06:05:00")},
+		// Ready when its upstream task ended
+		{report, at("06:07:00"), time.Time{}, at("06:07:20"), at("06:08:00")},
+		// Ready when its previous try ended, after the last of its upstream tasks
+		{load, at("06:09:00"), at("06:10:00"), at("06:10:30"), at("06:12:00")},
+		{notify, at("06:12:00"), time.Time{}, time.Time{}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.task.GetTaskId(), func(t *testing.T) {
+			s := d.phases(run, tt.task)
+			if !s.Ready.Equal(tt.ready) || !s.Queued.Equal(tt.queued) || !s.Started.Equal(tt.started) || !s.Finished.Equal(tt.finished) {
+				t.Errorf("phases() = %+v, want ready %v, queued %v, started %v, finished %v", s, tt.ready, tt.queued, tt.started, tt.finished)
+			}
+		})
+	}
+
+	// Without the tries and upstream tasks, e.g. when their endpoints failed, every task is ready when the run started
+	if s := (details{tasks: d.tasks}).phases(run, load); !s.Ready.Equal(at("06:00:00")) {
+		t.Errorf("phases() without dependencies ready at %v", s.Ready)
+	}
+	// An upstream task that ended before the previous try does not move the ready time back
+	d.tasks[1] = fromJSON[airflow.TaskInstance](t, `{"task_id": "validate", "map_index": -1, "try_number": 1, "end_date": "2026-10-19T06:01:00Z"}`)
+	if s := d.phases(run, load); !s.Ready.Equal(at("06:09:00")) {
+		t.Errorf("phases() ready at %v, want when the previous try ended", s.Ready)
+	}
+}
@@ -0,0 +1,83 @@
+package airflow
+
+import (
+	"context"
+	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/failure"
+	"github.com/estecker/farm/internal/source"
+	"log/slog"
+	"net/url"
+	"strconv"
+)
+
+// Most failed tasks of a DAG run to get the log of
+const maxFailureLogs = 20
+
+// stepFailures of the failed tasks of a DAG run with the end of the log of their last try, nil unless failure_logs.enabled
+func stepFailures(ctx context.Context, cfg *config.Config, cli *airflow.APIClient, run airflow.DAGRun, tasks []airflow.TaskInstance) []*farmv1.StepFailure {
+	if !cfg.FailureLogs.Enabled {
+		return nil
+	}
+	var failures []*farmv1.StepFailure
+	for _, task := range tasks {
+		if task.GetState() != airflow.TASKSTATE_FAILED {
+			continue
+		}
+		if len(failures) == maxFailureLogs {
+			slog.Warn("Airflow: Too many failed tasks, skipping the logs of the others", "dagId", run.GetDagId(), "max", maxFailureLogs)
+			break
+		}
+		f := &farmv1.StepFailure{
+			Source:    "airflow",
+			Workflow:  run.GetDagId(),
+			RunId:     run.GetDagRunId(),
+			Url:       "https://" + cfg.Sources.Airflow.Host + "/dags/" + url.PathEscape(run.GetDagId()) + "/grid?dag_run_id=" + url.QueryEscape(run.GetDagRunId()) + "&task_id=" + url.QueryEscape(task.GetTaskId()),
+			Step:      task.GetTaskId(),
+			StepId:    instanceID(task),
+			TryNumber: task.GetTryNumber(),
+			State:     string(task.GetState()),
+		}
+		// otherwise will send the zero value date, which is not null
+		if st := parseTime(task.GetStartDate()); !st.IsZero() {
+			f.StartedAt = st.UnixMicro()
+		}
+		if et := parseTime(task.GetEndDate()); !et.IsZero() {
+			f.FinishedAt = et.UnixMicro()
+		}
+		log, cut, err := taskLog(ctx, cli, task, cfg.FailureLogs.TailLines+1) //One more, the excerpt drops the first line of a cut log
+		if err != nil {
+			slog.Warn("Airflow: Error getting the log", "error", err, "dagId", run.GetDagId(), "taskId", task.GetTaskId())
+		} else {
+			f.Log, f.Truncated = failure.Excerpt(cfg.FailureLogs, log, cut)
+			f.LogSource = failure.Airflow
+		}
+		failures = append(failures, f)
+	}
+	return failures
+}
+
+// taskLog is the end of the log of the latest try of a task instance, and if the lines before were dropped
+// The endpoint serves the whole log, as text to skip the JSON escaping
+func taskLog(ctx context.Context, cli *airflow.APIClient, task airflow.TaskInstance, lines int) (string, bool, error) {
+	q := url.Values{"full_content": {"true"}}
+	if task.GetMapIndex() >= 0 {
+		q.Set("map_index", strconv.Itoa(int(task.GetMapIndex())))
+	}
+	body, err := apiRequest(ctx, cli, instancePath(task)+"/logs/"+strconv.Itoa(int(task.GetTryNumber()))+"?"+q.Encode(), "text/plain")
+	if err != nil {
+		return "", false, err
+	}
+	defer body.Close()
+	return failure.Tail(body, lines)
+}
+
+// publishFailures publishes the failed tasks of a completed DAG run with their log
+func publishFailures(ctx context.Context, cfg *config.Config, em *source.Emitter, d details) {
+	for _, f := range d.failures {
+		if err := failure.Publish(ctx, cfg, em, f, cfg.Sources.Airflow.Tenant, "https://"+cfg.Sources.Airflow.Host); err != nil {
+			em.Logger.Error("Airflow: Error publishing the failure", "error", err, "dagId", f.Workflow, "taskId", f.Step)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package airflow
+
+import (
+	"context"
+	"errors"
+	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/missed"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/robfig/cron/v3"
+	"strings"
+	"time"
+)
+
+// Timezones of the DAGs by host and DAG ID, the DAG list does not have them and they rarely change
+var dagTimezones = ttlcache.New[string, string](ttlcache.WithTTL[string, string](time.Hour))
+
+// missedRun is the next run of the DAG if the scheduler should have created it by until, nil otherwise
+// next_dagrun_create_after stops moving when the DAG is paused or the scheduler is stuck
+// The cron expression is in the timezone of the DAG, empty for UTC
+func missedRun(host string, dag airflow.DAG, timezone string, until time.Time) *farmv1.MissedRun {
+	expected := dag.GetNextDagrunCreateAfter()
+	if expected.IsZero() || expected.After(until) {
+		return nil //Not scheduled, or not late yet
+	}
+	m := &farmv1.MissedRun{
+		Source:       "airflow",
+		Workflow:     dag.GetDagId(),
+		Schedule:     dag.GetTimetableDescription(),
+		Url:          "https://" + host + "/dags/" + dag.GetDagId(),
+		ExpectedTime: expected.UnixMicro(),
+		Missed:       1,
+		Paused:       dag.GetIsPaused(),
+		Timezone:     timezone,
+	}
+	if c := dag.GetScheduleInterval().CronExpression; c != nil {
+		m.Schedule = c.GetValue()
+		spec := c.GetValue()
+		if timezone != "" {
+			spec = "CRON_TZ=" + timezone + " " + spec //Like the schedule string of a CronWorkflow
+		}
+		if schedule, err := cron.ParseStandard(spec); err == nil {
+			if latest, n := missed.Since(schedule, expected.Add(-time.Second), until); n > 0 {
+				m.Missed = int32(n)
+				if !m.Paused {
+					m.ExpectedTime = latest.UnixMicro() //Paused is published once until it resumes
+				}
+			}
+		}
+	}
+	return m
+}
+
+// dagTimezone is the timezone of a DAG from its details, cached
+// Airflow 2 before 2.7 returns the pendulum repr, e.g. Timezone('Europe/Amsterdam')
+func dagTimezone(ctx context.Context, cli *airflow.APIClient, host string, dagID string) (string, error) {
+	key := host + "/" + dagID
+	if item := dagTimezones.Get(key); item != nil {
+		return item.Value(), nil
+	}
+	detail, _, err := cli.DAGApi.GetDagDetails(ctx, dagID).Execute()
+	if err != nil {
+		return "", err
+	}
+	tz := strings.TrimSuffix(strings.TrimPrefix(detail.GetTimezone(), "Timezone('"), "')")
+	if _, err := time.LoadLocation(tz); err != nil {
+		return "", err
+	}
+	dagTimezones.Set(key, tz, 0)
+	return tz, nil
+}
+
+// checkDags publishes the runs of the scheduled DAGs that were not created within the grace period
+func checkDags(ctx context.Context, cfg *config.Config, cli *airflow.APIClient, em *source.Emitter, dags []airflow.DAG) error {
+	until := time.Now().Add(-cfg.Sources.Airflow.Missed.Grace)
+	var errs []error
+	for _, dag := range dags {
+		if dag.GetNextDagrunCreateAfter().IsZero() {
+			continue //Not scheduled
+		}
+		var tz string
+		// Only the late DAGs need the timezone to count the missed runs of their cron expression
+		if dag.GetScheduleInterval().CronExpression != nil && !dag.GetNextDagrunCreateAfter().After(until) {
+			var err error
+			if tz, err = dagTimezone(ctx, cli, cfg.Sources.Airflow.Host, dag.GetDagId()); err != nil {
+				em.Logger.Error("Airflow: Error getting the DAG timezone, counting missed runs in UTC", "error", err, "dagId", dag.GetDagId())
+			}
+		}
+		m := missedRun(cfg.Sources.Airflow.Host, dag, tz, until)
+		if err := missed.Check(ctx, cfg, em, dag.GetDagId(), m, cfg.Sources.Airflow.Tenant, "https://"+cfg.Sources.Airflow.Host); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
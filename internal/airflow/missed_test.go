@@ -0,0 +1,94 @@
+package airflow
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/apache/airflow-client-go/airflow"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nightly runs at 06:00, the scheduler stopped creating runs after the one of 2026-10-18
+func nightlyDag(t *testing.T) airflow.DAG {
+	t.Helper()
+	var dag airflow.DAG
+	err := json.Unmarshal([]byte(`{
+		"dag_id": "nightly",
+		"is_paused": false,
+		"next_dagrun_create_after": "2026-10-18T10:00:00Z",
+		"schedule_interval": {"__type": "CronExpression", "value": "0 6 * * *"},
+		"timetable_description": "At 06:00"
+	}`), &dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dag
+}
+
+func TestMissedRun(t *testing.T) {
+	dag := nightlyDag(t)
+	until := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		timezone string
+		missed   int32
+		expected time.Time
+	}{
+		// 06:00 UTC on the 19th is the only fire time after 10:00 UTC on the 18th
+		{"", 1, time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)},
+		// 06:00 in New York is 10:00 UTC, the runs of the 18th and the 19th are missing
+		{"America/New_York", 2, time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			m := missedRun("airflow.example.com", dag, tt.timezone, until)
+			if m == nil {
+				t.Fatal("missedRun() = nil, want a missed run")
+			}
+			if m.Missed != tt.missed || m.ExpectedTime != tt.expected.UnixMicro() || m.Timezone != tt.timezone || m.Schedule != "0 6 * * *" {
+				t.Errorf("missedRun() = %v, want %d missed, the latest at %v", m, tt.missed, tt.expected)
+			}
+		})
+	}
+	if m := missedRun("airflow.example.com", dag, "", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)); m != nil {
+		t.Errorf("missedRun() before the next run = %v, want nil", m)
+	}
+}
+
+func TestDagTimezone(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/dags/nightly/details":
+			_, _ = w.Write([]byte(`{"dag_id":"nightly","timezone":"Timezone('America/New_York')"}`))
+		case "/api/v1/dags/hourly/details":
+			_, _ = w.Write([]byte(`{"dag_id":"hourly","timezone":"Europe/Amsterdam"}`))
+		default:
+			_, _ = w.Write([]byte(`{"dag_id":"broken","timezone":"Mars/Olympus_Mons"}`))
+		}
+	}))
+	defer srv.Close()
+	conf := airflow.NewConfiguration()
+	conf.Host = strings.TrimPrefix(srv.URL, "http://")
+	conf.Scheme = "http"
+	cli := airflow.NewAPIClient(conf)
+	dagTimezones.DeleteAll()
+
+	for dagID, want := range map[string]string{"nightly": "America/New_York", "hourly": "Europe/Amsterdam"} {
+		for range 2 {
+			if tz, err := dagTimezone(context.Background(), cli, conf.Host, dagID); err != nil || tz != want {
+				t.Errorf("dagTimezone(%s) = %q, %v, want %s", dagID, tz, err, want)
+			}
+		}
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want one per DAG", requests)
+	}
+	if _, err := dagTimezone(context.Background(), cli, conf.Host, "broken"); err == nil {
+		t.Error("dagTimezone() of an unknown timezone error = nil")
+	}
+}
@@ -1,13 +1,13 @@
 package airflow
 
 import (
-	"context"
 	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/anomaly"
+	"github.com/estecker/farm/internal/failure"
+	"github.com/estecker/farm/internal/phase"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"log/slog"
-	"os"
-	"time"
 )
 
 // statusToCode maps the status of a DAGRun to an HTTP status code
@@ -23,7 +23,10 @@ func statusToCode(dr airflow.DAGRun) int {
 	}
 }
 
-func trace(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) {
+// Create a DataDog trace for an Airflow DAG run
+// The task spans start when the task was ready, or at its first try, and get the critical_path, slack and log tags and a span per phase and per try from d
+// check flags the anomalous durations, nil to skip
+func trace(cli *airflow.APIClient, run airflow.DAGRun, d details, tenant string, tags map[string]string, check *anomaly.Check) {
 	slog.Debug("trace",
 		"type", "airflow:",
 		"state", run.GetState(),
@@ -34,8 +37,11 @@ func trace(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) {
 		tracer.ResourceName(run.GetDagId()))
 	rootSpan.SetTag(ext.HTTPMethod, "AIRFLOW")
 	rootSpan.SetTag(ext.HTTPCode, statusToCode(run))
-	rootSpan.SetTag("tenant", os.Getenv("tenant"))
+	rootSpan.SetTag("tenant", tenant)
 	rootSpan.SetTag("url", "https://"+cli.GetConfig().Host+"/dags/"+run.GetDagId())
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
 
 	dagRunSpan := tracer.StartSpan(run.GetDagRunId(),
 		tracer.ServiceName(run.GetDagId()),
@@ -55,11 +61,25 @@ func trace(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) {
 	dagRunSpan.SetTag("external_trigger", run.GetExternalTrigger())
 	dagRunSpan.SetTag("conf", run.GetConf())
 	dagRunSpan.SetTag("note", run.GetNote())
+	for k, v := range phase.Tags(d.delays) {
+		dagRunSpan.SetTag(k, v)
+	}
+	for k, v := range check.Run() {
+		dagRunSpan.SetTag(k, v)
+	}
 	//	dagRunSpan.SetTag("owners", "TODO")
-	taskInstances, _, _ := cli.TaskInstanceApi.GetTaskInstances(ctx, run.GetDagId(), run.GetDagRunId()).Execute()
-	for _, task := range taskInstances.GetTaskInstances() {
-		st, _ := time.Parse(time.RFC3339, task.GetStartDate())
-		et, _ := time.Parse(time.RFC3339, task.GetEndDate())
+	for _, task := range d.tasks {
+		phases := d.phases(run, task)
+		st, et := phases.Start(), phases.Finished
+		if phases.Started.IsZero() {
+			st = phases.Started //Never ran, e.g. skipped
+		}
+		tries := d.tries[instanceID(task)]
+		if len(tries) > 0 {
+			if first := parseTime(tries[0].GetStartDate()); !first.IsZero() && first.Before(st) {
+				st = first
+			}
+		}
 		taskSpan := tracer.StartSpan(
 			task.GetTaskId(),
 			tracer.ChildOf(dagRunSpan.Context()),
@@ -90,6 +110,19 @@ func trace(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun) {
 		taskSpan.SetTag("trigger_job", task.GetTriggererJob())
 		taskSpan.SetTag("note", task.GetNote())
 		taskSpan.SetOperationName("dagTask")
+		for k, v := range d.path.Tags(instanceID(task)) {
+			taskSpan.SetTag(k, v)
+		}
+		phases.Trace(taskSpan.Context(), task.GetTaskId())
+		traceTries(tries, taskSpan.Context())
+		for k, v := range failure.Tags(d.stepFailure(instanceID(task))) {
+			taskSpan.SetTag(k, v)
+		}
+		if task.GetState() == airflow.TASKSTATE_SUCCESS {
+			for k, v := range check.Step(task.GetTaskId(), phases.Started, et) {
+				taskSpan.SetTag(k, v)
+			}
+		}
 		taskSpanFO := []tracer.FinishOption{tracer.FinishTime(et), tracer.WithError(nil)}
 		taskSpan.Finish(taskSpanFO...)
 	}
@@ -0,0 +1,177 @@
+package airflow
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apache/airflow-client-go/airflow"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// taskTries of the retried task instances by instance ID, oldest first
+// The tries endpoint is not in the client and needs Airflow 2.10, older ones only have the latest try
+func taskTries(ctx context.Context, cli *airflow.APIClient, run airflow.DAGRun, tasks []airflow.TaskInstance) map[string][]airflow.TaskInstance {
+	tries := map[string][]airflow.TaskInstance{}
+	for _, task := range tasks {
+		if task.GetTryNumber() <= 1 {
+			continue
+		}
+		path := instancePath(task)
+		if task.GetMapIndex() >= 0 {
+			path += "/" + strconv.Itoa(int(task.GetMapIndex()))
+		}
+		var c airflow.TaskInstanceCollection
+		if err := apiGet(ctx, cli, path+"/tries", &c); err != nil {
+			slog.Error("Airflow: Error getting the tries", "error", err, "dagId", run.GetDagId(), "taskId", task.GetTaskId())
+			return tries //Most likely an Airflow without the endpoint, the other tasks would fail too
+		}
+		t := c.GetTaskInstances()
+		slices.SortFunc(t, func(a, b airflow.TaskInstance) int { return cmp.Compare(a.GetTryNumber(), b.GetTryNumber()) })
+		tries[instanceID(task)] = t
+	}
+	return tries
+}
+
+// instancePath is the API path of a task instance, without the map index
+func instancePath(task airflow.TaskInstance) string {
+	return "/dags/" + url.PathEscape(task.GetDagId()) + "/dagRuns/" + url.PathEscape(task.GetDagRunId()) + "/taskInstances/" + url.PathEscape(task.GetTaskId())
+}
+
+// apiGet decodes the JSON response of an Airflow API path into v, for the endpoints the client does not have
+func apiGet(ctx context.Context, cli *airflow.APIClient, path string, v any) error {
+	body, err := apiRequest(ctx, cli, path, "application/json")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// apiRequest GETs an Airflow API path with its query, the caller closes the body
+func apiRequest(ctx context.Context, cli *airflow.APIClient, path, accept string) (io.ReadCloser, error) {
+	conf := cli.GetConfig()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, conf.Scheme+"://"+conf.Host+"/api/v1"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	client := conf.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// retrying is the running time of the tries before the last one
+func retrying(tries map[string][]airflow.TaskInstance) time.Duration {
+	var d time.Duration
+	for _, t := range tries {
+		for _, try := range t[:max(len(t)-1, 0)] {
+			if start, end := parseTime(try.GetStartDate()), parseTime(try.GetEndDate()); !start.IsZero() && end.After(start) {
+				d += end.Sub(start)
+			}
+		}
+	}
+	return d
+}
+
+// traceTries adds a span per try of a retried task under the span of the task
+func traceTries(tries []airflow.TaskInstance, parent ddtrace.SpanContext) {
+	for _, try := range tries {
+		st, et := parseTime(try.GetStartDate()), parseTime(try.GetEndDate())
+		if st.IsZero() {
+			continue
+		}
+		span := tracer.StartSpan("try",
+			tracer.ResourceName(try.GetTaskId()),
+			tracer.ChildOf(parent),
+			tracer.StartTime(st))
+		span.SetTag("try_number", try.GetTryNumber())
+		span.SetTag("state", try.GetState())
+		span.SetTag("duration", try.GetDuration())
+		span.SetTag("hostname", try.GetHostname())
+		span.Finish(tracer.FinishTime(et), tracer.WithError(nil))
+	}
+}
+
+// publishTries publishes every try of the retried tasks of a completed DAG run
+func publishTries(ctx context.Context, cfg *config.Config, em *source.Emitter, d details) {
+	for _, tries := range d.tries {
+		for i, try := range tries {
+			t := &farmv1.TaskTry{
+				DagId:     try.GetDagId(),
+				DagRunId:  try.GetDagRunId(),
+				TaskId:    try.GetTaskId(),
+				MapIndex:  try.GetMapIndex(),
+				TryNumber: try.GetTryNumber(),
+				MaxTries:  try.GetMaxTries(),
+				State:     string(try.GetState()),
+				Duration:  float64(try.GetDuration()),
+				Hostname:  try.GetHostname(),
+				Operator:  try.GetOperator(),
+				Last:      i == len(tries)-1,
+			}
+			// otherwise will send the zero value date, which is not null
+			if q := parseTime(try.GetQueuedWhen()); !q.IsZero() {
+				t.QueuedWhen = q.UnixMicro()
+			}
+			if st := parseTime(try.GetStartDate()); !st.IsZero() {
+				t.StartDate = st.UnixMicro()
+			}
+			if et := parseTime(try.GetEndDate()); !et.IsZero() {
+				t.EndDate = et.UnixMicro()
+			}
+			key := t.DagId + "/" + t.DagRunId + "/" + t.TaskId + "/" + strconv.Itoa(int(t.MapIndex)) + "/" + strconv.Itoa(int(t.TryNumber))
+			env := event.New("try", key, t.State, cfg.Sources.Airflow.Tenant, cfg.Environment, t)
+			attributes := map[string]string{
+				"project_id":     em.ProjectID,
+				"sa_email":       em.SAEmail,
+				"type":           "try",
+				"tenant":         env.Tenant,
+				"environment":    env.Environment,
+				"event_id":       env.EventID,
+				"schema_version": strconv.Itoa(env.SchemaVersion),
+			}
+			msgID, err := em.Publish(ctx, sink.Message{
+				Event:      env,
+				Attributes: attributes,
+				Type:       "io.farm.airflow.taskinstance.try_finished",
+				Source:     "https://" + cfg.Sources.Airflow.Host,
+				Subject:    t.DagId + "/" + t.DagRunId + "/" + t.TaskId,
+			})
+			if err != nil {
+				em.Logger.Error("Error publishing to pubsub", "error", err, "msgID", msgID)
+				continue
+			}
+			em.Logger.Debug("pubsub.publish",
+				"type", "try",
+				"state", t.State,
+				"dagId", t.DagId,
+				"taskId", t.TaskId,
+				"tryNumber", t.TryNumber,
+				"msgID", msgID)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package airflow
+
+import (
+	"context"
+	"github.com/apache/airflow-client-go/airflow"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// triesServer serves the tries of the task instances by API path, the other paths are not found
+func triesServer(t *testing.T, tries map[string]string) (*airflow.APIClient, *[]string) {
+	t.Helper()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		body, ok := tries[strings.TrimPrefix(r.URL.Path, "/api/v1")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	conf := airflow.NewConfiguration()
+	conf.Host = strings.TrimPrefix(srv.URL, "http://")
+	conf.Scheme = "http"
+	return airflow.NewAPIClient(conf), &requests
+}
+
+func TestTaskTries(t *testing.T) {
+	run := fromJSON[airflow.DAGRun](t, `{"dag_id": "etl", "dag_run_id": "scheduled__2026-10-19T06:00:00+00:00"}`)
+	extract := fromJSON[airflow.TaskInstance](t, `{"dag_id": "etl", "dag_run_id": "scheduled__2026-10-19T06:00:00+00:00", "task_id": "extract", "map_index": -1, "try_number": 1}`)
+	load := fromJSON[airflow.TaskInstance](t, `{"dag_id": "etl", "dag_run_id": "scheduled__2026-10-19T06:00:00+00:00", "task_id": "load", "map_index": -1, "try_number": 3}`)
+	shard := fromJSON[airflow.TaskInstance](t, `{"dag_id": "etl", "dag_run_id": "scheduled__2026-10-19T06:00:00+00:00", "task_id": "shard", "map_index": 2, "try_number": 2}`)
+	tasks := []airflow.TaskInstance{extract, load, shard}
+	path := "/dags/etl/dagRuns/scheduled__2026-10-19T06:00:00+00:00/taskInstances/"
+	cli, requests := triesServer(t, map[string]string{
+		path + "load/tries": `{"task_instances": [
+			{"task_id": "load", "map_index": -1, "try_number": 3},
+			{"task_id": "load", "map_index": -1, "try_number": 1},
+			{"task_id": "load", "map_index": -1, "try_number": 2}
+		], "total_entries": 3}`,
+		path + "shard/2/tries": `{"task_instances": [
+			{"task_id": "shard", "map_index": 2, "try_number": 2},
+			{"task_id": "shard", "map_index": 2, "try_number": 1}
+		], "total_entries": 2}`,
+	})
+
+	tries := taskTries(context.Background(), cli, run, tasks)
+	// The tasks tried once are not requested
+	if len(*requests) != 2 {
+		t.Errorf("requests = %v, want the tries of load and shard", *requests)
+	}
+	numbers := func(id string) []int32 {
+		var n []int32
+		for _, try := range tries[id] {
+			n = append(n, try.GetTryNumber())
+		}
+		return n
+	}
+	if len(tries) != 2 {
+		t.Errorf("taskTries() has %d tasks, want 2", len(tries))
+	}
+	if n := numbers("load"); len(n) != 3 || n[0] != 1 || n[1] != 2 || n[2] != 3 {
+		t.Errorf("tries of load = %v, want 1, 2 and 3", n)
+	}
+	if n := numbers("shard[2]"); len(n) != 2 || n[0] != 1 || n[1] != 2 {
+		t.Errorf("tries of shard[2] = %v, want 1 and 2", n)
+	}
+
+	// Airflow before 2.10, the first missing endpoint stops the lookups
+	cli, requests = triesServer(t, nil)
+	if tries := taskTries(context.Background(), cli, run, tasks); len(tries) != 0 {
+		t.Errorf("taskTries() without the endpoint = %v, want none", tries)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("requests without the endpoint = %v, want 1", *requests)
+	}
+}
+
+func TestRetrying(t *testing.T) {
+	try := func(number int, start, end string) airflow.TaskInstance {
+		ti := airflow.TaskInstance{}
+		ti.SetTryNumber(int32(number))
+		if start != "" {
+			ti.SetStartDate("2026-10-19T" + start + "Z")
+		}
+		if end != "" {
+			ti.SetEndDate("2026-10-19T" + end + "Z")
+		}
+		return ti
+	}
+	tries := map[string][]airflow.TaskInstance{
+		// The last try of 10 minutes is the running time of the task, not a retry
+		"load": {try(1, "06:00:00", "06:01:00"), try(2, "06:02:00", "06:04:00"), try(3, "06:05:00", "06:15:00")},
+		// A try that never started, e.g. failed while queued, or with clock skew has no running time
+		"shard[2]": {try(1, "", "06:01:00"), try(2, "06:02:00", "06:01:30"), try(3, "06:03:00", "06:03:30"), try(4, "06:04:00", "")},
+		// Tried once, e.g. when the endpoint had a single try
+		"extract": {try(1, "06:00:00", "06:30:00")},
+		"empty":   nil,
+	}
+	if got, want := retrying(tries), 3*time.Minute+30*time.Second; got != want {
+		t.Errorf("retrying() = %v, want %v", got, want)
+	}
+	if got := retrying(nil); got != 0 {
+		t.Errorf("retrying(nil) = %v, want 0", got)
+	}
+}
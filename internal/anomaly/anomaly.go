@@ -0,0 +1,257 @@
+package anomaly
+
+import (
+	"cmp"
+	"context"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/state"
+	"github.com/estecker/farm/internal/stats"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Run IDs remembered per workflow so a run traced twice is only counted once
+const maxRunIDs = 100
+
+// sample is a successful duration
+type sample struct {
+	End     int64   `json:"end"`     //micros
+	Seconds float64 `json:"seconds"` //Duration
+}
+
+// history of a workflow in the state store, under anomaly/<source>/<workflow>
+type history struct {
+	Runs  []string            `json:"runs"`  //Latest run IDs
+	Steps map[string][]sample `json:"steps"` //By step, the run itself is ""
+}
+
+// Detector flags the runs and steps that took much longer than their previous successful runs
+// Anomalies are published to the sink like the runs, with the Pub/Sub attribute type=anomaly
+type Detector struct {
+	Sink      sink.Sink
+	ProjectID string
+	SAEmail   string
+	State     *state.Store //Keeps the durations of the windows
+	Logger    *slog.Logger
+	Metrics   statsd.ClientInterface
+	mu        sync.Mutex
+}
+
+// Check of the durations of one completed run, its methods do nothing on a nil Check
+type Check struct {
+	d       *Detector
+	cfg     *config.Config
+	run     slo.Run
+	key     string
+	h       history
+	anomaly *farmv1.DurationAnomaly
+}
+
+// Start the check of a completed run, nil if detection is disabled or the run was checked before
+func (d *Detector) Start(cfg *config.Config, run slo.Run) *Check {
+	if d == nil || !cfg.Anomaly.Enabled {
+		return nil
+	}
+	c := &Check{
+		d:       d,
+		cfg:     cfg,
+		run:     run,
+		key:     "anomaly/" + run.Source + "/" + run.Workflow,
+		h:       history{Steps: map[string][]sample{}},
+		anomaly: &farmv1.DurationAnomaly{Source: run.Source, Workflow: run.Workflow, RunId: run.ID, Url: run.URL},
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.State.Get(c.key, &c.h); err != nil {
+		d.Logger.Error("Anomaly: Error reading state", "error", err, "workflow", run.Workflow)
+	}
+	if c.h.Steps == nil {
+		c.h.Steps = map[string][]sample{}
+	}
+	if slices.Contains(c.h.Runs, run.ID) {
+		return nil
+	}
+	return c
+}
+
+// Run checks the duration of the run, returns the tags for its span
+func (c *Check) Run() map[string]string {
+	if c == nil || !c.run.Success {
+		return nil
+	}
+	a, tags := c.observe("", c.run.Start, c.run.End)
+	c.anomaly.Run = a
+	return tags
+}
+
+// Step checks the duration of a successful step, returns the tags for its span
+func (c *Check) Step(name string, start, end time.Time) map[string]string {
+	if c == nil || name == "" {
+		return nil
+	}
+	a, tags := c.observe(name, start, end)
+	if a != nil {
+		c.anomaly.Steps = append(c.anomaly.Steps, a)
+	}
+	return tags
+}
+
+// observe compares a duration to the previous ones of the same step, then adds it to them
+func (c *Check) observe(step string, start, end time.Time) (*farmv1.AnomalousDuration, map[string]string) {
+	if start.IsZero() || end.Before(start) {
+		return nil, nil
+	}
+	a := evaluate(c.cfg.Anomaly, c.h.Steps[step], end, end.Sub(start))
+	c.h.Steps[step] = append(c.h.Steps[step], sample{End: end.UnixMicro(), Seconds: end.Sub(start).Seconds()})
+	if a == nil {
+		return nil, nil
+	}
+	a.Step = step
+	median := 0.0
+	for _, w := range a.Windows {
+		if w.Score == a.Score {
+			median = w.Median
+		}
+	}
+	return a, map[string]string{
+		"anomaly":        "duration",
+		"anomaly.score":  strconv.FormatFloat(a.Score, 'f', 1, 64),
+		"anomaly.median": strconv.FormatFloat(median, 'f', 1, 64),
+	}
+}
+
+// evaluate a duration against the samples of each window, nil if it is not anomalous
+func evaluate(cfg config.Anomaly, samples []sample, at time.Time, d time.Duration) *farmv1.AnomalousDuration {
+	if d < cfg.MinDuration {
+		return nil
+	}
+	a := &farmv1.AnomalousDuration{Duration: d.Seconds()}
+	anomalous := false
+	for _, window := range cfg.Windows {
+		var values []float64
+		for _, s := range samples {
+			if s.End > at.Add(-window).UnixMicro() {
+				values = append(values, s.Seconds)
+			}
+		}
+		if len(values) < cfg.MinSamples {
+			continue
+		}
+		median := stats.Median(values)
+		mad := stats.MAD(values, median)
+		// Identical durations have no spread, 5% of the median keeps a few seconds more from being anomalous
+		score := stats.Score(d.Seconds(), median, max(mad, median*0.05, 1))
+		a.Windows = append(a.Windows, &farmv1.DurationStats{
+			Window:  int64(window.Seconds()),
+			Samples: int32(len(values)),
+			Median:  median,
+			Mad:     mad,
+			P90:     stats.Percentile(values, 90),
+			P95:     stats.Percentile(values, 95),
+			P99:     stats.Percentile(values, 99),
+			Score:   score,
+		})
+		a.Score = max(a.Score, score)
+		anomalous = anomalous || score > cfg.Threshold
+	}
+	if !anomalous {
+		return nil
+	}
+	return a
+}
+
+// Publish publishes the anomalies of the run, if any, then saves its durations
+// The run is only remembered once published, so a failed publish leaves it to be checked again
+func (c *Check) Publish(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c.anomaly.Run != nil || len(c.anomaly.Steps) > 0 {
+		if err := c.publish(ctx); err != nil {
+			d.Logger.Error("Anomaly: Error publishing", "error", err, "workflow", c.run.Workflow, "runId", c.run.ID)
+			return
+		}
+	}
+	// Another check of the same workflow may have saved in between, merge into the latest state
+	var latest history
+	if _, err := d.State.Get(c.key, &latest); err != nil {
+		d.Logger.Error("Anomaly: Error reading state", "error", err, "workflow", c.run.Workflow)
+	}
+	if latest.Steps == nil {
+		latest.Steps = map[string][]sample{}
+	}
+	since := time.Now().Add(-slices.Max(c.cfg.Anomaly.Windows)).UnixMicro()
+	for step, samples := range c.h.Steps {
+		merged := latest.Steps[step]
+		for _, s := range samples {
+			if !slices.Contains(merged, s) {
+				merged = append(merged, s)
+			}
+		}
+		merged = slices.DeleteFunc(merged, func(s sample) bool { return s.End <= since })
+		slices.SortFunc(merged, func(a, b sample) int { return cmp.Compare(a.End, b.End) })
+		if len(merged) > c.cfg.Anomaly.MaxSamples {
+			merged = merged[len(merged)-c.cfg.Anomaly.MaxSamples:]
+		}
+		latest.Steps[step] = merged
+	}
+	latest.Runs = append(latest.Runs, c.run.ID)
+	if len(latest.Runs) > maxRunIDs {
+		latest.Runs = latest.Runs[len(latest.Runs)-maxRunIDs:]
+	}
+	if err := d.State.Put(c.key, latest); err != nil {
+		d.Logger.Error("Anomaly: Error writing state", "error", err, "workflow", c.run.Workflow)
+	}
+}
+
+// publish sends the anomaly event and counts it
+func (c *Check) publish(ctx context.Context) error {
+	d := c.d
+	tenant := c.run.Tenant
+	if tenant == "" {
+		tenant = c.cfg.Tenant
+	}
+	env := event.New("anomaly", c.run.Source+"/"+c.run.ID, "duration", tenant, c.cfg.Environment, c.anomaly)
+	attributes := map[string]string{
+		"project_id":     d.ProjectID,
+		"sa_email":       d.SAEmail,
+		"type":           "anomaly",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	msgID, err := d.Sink.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.anomaly.duration",
+		Source:     "anomaly/" + c.run.Source,
+		Subject:    c.run.Workflow + "/" + c.run.ID,
+	})
+	if err != nil {
+		return err
+	}
+	tags := []string{"source:" + c.run.Source, "workflow:" + c.run.Workflow}
+	if c.anomaly.Run != nil {
+		_ = d.Metrics.Incr("anomalies", append(tags, "kind:run"), 1)
+	}
+	_ = d.Metrics.Count("anomalies", int64(len(c.anomaly.Steps)), append(tags, "kind:step"), 1)
+	d.Logger.Info("Anomaly: Unusual duration",
+		"workflow", c.run.Workflow,
+		"runId", c.run.ID,
+		"run", c.anomaly.Run != nil,
+		"steps", len(c.anomaly.Steps),
+		"msgID", msgID)
+	return nil
+}
@@ -0,0 +1,204 @@
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/state"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{Anomaly: config.Anomaly{
+		Enabled:     true,
+		Windows:     []time.Duration{24 * time.Hour, 7 * 24 * time.Hour},
+		MinSamples:  3,
+		MaxSamples:  5,
+		Threshold:   3.5,
+		MinDuration: time.Minute,
+	}}
+}
+
+func TestEvaluate(t *testing.T) {
+	cfg := testConfig().Anomaly
+	now := time.Now()
+	// Ten minutes a day for a week, an hour and a half yesterday
+	var week []sample
+	for day := 7; day > 1; day-- {
+		week = append(week, sample{End: now.Add(-time.Duration(day) * 24 * time.Hour).UnixMicro(), Seconds: 600})
+	}
+	tests := []struct {
+		name    string
+		samples []sample
+		d       time.Duration
+		windows int //Of the anomaly, 0 for none
+	}{
+		{"usual", week, 11 * time.Minute, 0},
+		{"slow", week, 40 * time.Minute, 1},
+		{"too short to tell", week, 50 * time.Second, 0},
+		{"too few samples", week[:2], 40 * time.Minute, 0},
+		{"both windows", append(week, sample{End: now.Add(-time.Hour).UnixMicro(), Seconds: 600}, sample{End: now.Add(-2 * time.Hour).UnixMicro(), Seconds: 610}, sample{End: now.Add(-3 * time.Hour).UnixMicro(), Seconds: 590}), 40 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := evaluate(cfg, tt.samples, now, tt.d)
+			if tt.windows == 0 {
+				if a != nil {
+					t.Errorf("evaluate() = %v, want nil", a)
+				}
+				return
+			}
+			if a == nil {
+				t.Fatal("evaluate() = nil, want an anomaly")
+			}
+			if len(a.Windows) != tt.windows || a.Score <= cfg.Threshold || a.Duration != tt.d.Seconds() {
+				t.Errorf("evaluate() = %v", a)
+			}
+		})
+	}
+}
+
+func testDetector(t *testing.T, out io.Writer) *Detector {
+	store, err := state.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Detector{
+		Sink:    &sink.Writer{W: out},
+		State:   store,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: &statsd.NoOpClient{},
+	}
+}
+
+func run(id string, end time.Time, minutes int) slo.Run {
+	return slo.Run{Source: "argo", Workflow: "nightly", ID: id, Start: end.Add(-time.Duration(minutes) * time.Minute), End: end, Success: true}
+}
+
+func TestPublishMergesState(t *testing.T) {
+	cfg := testConfig()
+	var out bytes.Buffer
+	d := testDetector(t, &out)
+	now := time.Now()
+	old := now.Add(-8 * 24 * time.Hour).UnixMicro() //Out of every window
+	if err := d.State.Put("anomaly/argo/nightly", history{
+		Runs: []string{"r0"},
+		Steps: map[string][]sample{
+			"":        {{End: old, Seconds: 600}, {End: now.Add(-4 * time.Hour).UnixMicro(), Seconds: 600}},
+			"extract": {{End: now.Add(-4 * time.Hour).UnixMicro(), Seconds: 120}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two runs checked at the same time, each from the state before the other saved
+	a := d.Start(cfg, run("r1", now.Add(-2*time.Hour), 10))
+	b := d.Start(cfg, run("r2", now.Add(-time.Hour), 11))
+	if a == nil || b == nil {
+		t.Fatal("Start() = nil for a new run")
+	}
+	a.Run()
+	a.Step("extract", now.Add(-150*time.Minute), now.Add(-148*time.Minute))
+	b.Run()
+	b.Step("load", now.Add(-80*time.Minute), now.Add(-75*time.Minute))
+	a.Publish(context.Background())
+	b.Publish(context.Background())
+
+	var h history
+	if _, err := d.State.Get("anomaly/argo/nightly", &h); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(h.Runs, ","); got != "r0,r1,r2" {
+		t.Errorf("runs = %s, want r0,r1,r2", got)
+	}
+	// The sample out of the windows is dropped, those of both runs are kept once
+	for step, want := range map[string]int{"": 3, "extract": 2, "load": 1} {
+		if len(h.Steps[step]) != want {
+			t.Errorf("samples of %q = %v, want %d", step, h.Steps[step], want)
+		}
+	}
+	for step, samples := range h.Steps {
+		for i := 1; i < len(samples); i++ {
+			if samples[i].End < samples[i-1].End {
+				t.Errorf("samples of %q are not in order: %v", step, samples)
+			}
+		}
+	}
+	if d.Start(cfg, run("r1", now.Add(-2*time.Hour), 10)) != nil {
+		t.Error("Start() of a run checked before is not nil")
+	}
+	if out.Len() != 0 {
+		t.Errorf("published %s, want nothing with too few samples", out.String())
+	}
+
+	// Only the latest max_samples are kept
+	for i := 3; i < 10; i++ {
+		c := d.Start(cfg, run("r"+string(rune('0'+i)), now.Add(-time.Duration(60-i)*time.Minute), 10))
+		c.Run()
+		c.Publish(context.Background())
+	}
+	if _, err := d.State.Get("anomaly/argo/nightly", &h); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Steps[""]); n != cfg.Anomaly.MaxSamples {
+		t.Errorf("samples = %d, want %d", n, cfg.Anomaly.MaxSamples)
+	}
+	if last := h.Steps[""][len(h.Steps[""])-1]; last.End != now.Add(-51*time.Minute).UnixMicro() {
+		t.Errorf("latest sample = %v, want the one of r9", last)
+	}
+
+	// A run much slower than the others is published
+	c := d.Start(cfg, run("slow", now, 60))
+	tags := c.Run()
+	c.Publish(context.Background())
+	if tags["anomaly"] != "duration" || !strings.Contains(out.String(), `"run_id":"slow"`) {
+		t.Errorf("tags = %v, published %s", tags, out.String())
+	}
+}
+
+// failing is a sink that never takes an event
+type failing struct{}
+
+func (failing) Publish(context.Context, sink.Message) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestPublishFailureKeepsRunUnchecked(t *testing.T) {
+	cfg := testConfig()
+	d := testDetector(t, io.Discard)
+	d.Sink = failing{}
+	now := time.Now()
+	var samples []sample
+	for i := 1; i <= 5; i++ {
+		samples = append(samples, sample{End: now.Add(-time.Duration(i) * time.Hour).UnixMicro(), Seconds: 600})
+	}
+	if err := d.State.Put("anomaly/argo/nightly", history{Runs: []string{"r0"}, Steps: map[string][]sample{"": samples}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := d.Start(cfg, run("slow", now, 60))
+	if tags := c.Run(); tags["anomaly"] != "duration" {
+		t.Fatalf("tags = %v, want an anomaly", tags)
+	}
+	c.Publish(context.Background())
+
+	// Neither the run nor its duration are saved, it is checked again against the same samples
+	var h history
+	if _, err := d.State.Get("anomaly/argo/nightly", &h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Runs) != 1 || len(h.Steps[""]) != 5 {
+		t.Errorf("state = %v, want it unchanged", h)
+	}
+	if d.Start(cfg, run("slow", now, 60)) == nil {
+		t.Error("Start() of a run whose anomaly was not published = nil")
+	}
+}
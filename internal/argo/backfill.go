@@ -0,0 +1,98 @@
+package argo
+
+import (
+	"context"
+	"github.com/argoproj/argo-workflows/v3/cmd/argo/commands/client"
+	workflowarchivepkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflowarchive"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/backfill"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/objectstore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log/slog"
+	"time"
+)
+
+// Archived workflows fetched per API call
+const backfillPageSize = 100
+
+// Backfill publishes every archived workflow that started between opts.Since and opts.Until
+// Progress is checkpointed after every page so an interrupted backfill resumes where it stopped
+func Backfill(ctx context.Context, cfg *config.Config, opts backfill.Options) error {
+	ctx, apiClient := client.NewAPIClient(ctx)
+	archiveClient, err := apiClient.NewArchivedWorkflowServiceClient()
+	if err != nil {
+		return err
+	}
+	nameSpace := cfg.Sources.Argo.Namespace
+	key := "backfill/argo/" + nameSpace
+	cp := opts.Load(key)
+	if cp.Done {
+		slog.Info("Backfill: argo already done", "namespace", nameSpace, "since", opts.Since, "until", opts.Until)
+		return nil
+	}
+	logs := &objectstore.Tailer{}
+	defer logs.Close()
+	kubeCli := newKubeClient() //Only for the URL of the workflows, their pods are long gone
+	for {
+		if err := opts.Wait(ctx); err != nil {
+			return err
+		}
+		wfList, err := archiveClient.ListArchivedWorkflows(ctx, &workflowarchivepkg.ListArchivedWorkflowsRequest{
+			Namespace: nameSpace,
+			ListOptions: &metav1.ListOptions{
+				Limit:         backfillPageSize,
+				Continue:      cp.Continue,
+				FieldSelector: "spec.startedAt>" + opts.Since.Format(time.RFC3339) + ",spec.startedAt<" + opts.Until.Format(time.RFC3339),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, wf := range wfList.Items {
+			kf := kubeflowInfo(ctx, cfg.Sources.Argo.Kubeflow, wf)
+			if !cfg.Sources.Argo.Filter.Match(workflowName(wf, kf)) {
+				continue
+			}
+			var full *wfv1.Workflow
+			d := details{url: wfUrl(ctx, kubeCli, wf)}
+			if opts.Trace && wf.Status.Phase.Completed() {
+				// The list does not include the nodes, so get the whole workflow
+				if err := opts.Wait(ctx); err != nil {
+					return err
+				}
+				full, err = archiveClient.GetArchivedWorkflow(ctx, &workflowarchivepkg.GetArchivedWorkflowRequest{
+					Uid:       string(wf.UID),
+					Namespace: wf.Namespace,
+					Name:      wf.Name,
+				})
+				if err != nil {
+					return err
+				}
+				d = gather(ctx, nil, logs, cfg, *full, kf, d.url) //The pods are long gone, so are most nodes
+			}
+			msgID, err := publish(ctx, cfg, opts.Emitter, wf, kf, d)
+			if err != nil {
+				return err
+			}
+			slog.Debug("backfill.publish",
+				"type", "argo",
+				"phase", wf.Status.Phase,
+				"name", wf.ObjectMeta.Name,
+				"msgID", msgID)
+			if full != nil {
+				trace(*full, kf, d, cfg.Sources.Argo.Tenant, nil, nil)
+				publishFailures(ctx, cfg, opts.Emitter, *full, d)
+			}
+		}
+		cp.Continue = wfList.Continue
+		cp.Done = wfList.Continue == ""
+		if err := opts.Save(key, cp); err != nil {
+			return err
+		}
+		slog.Info("Backfill: argo page done", "namespace", nameSpace, "workflows", len(wfList.Items), "continue", cp.Continue)
+		if cp.Done {
+			return nil
+		}
+	}
+}
@@ -2,20 +2,25 @@ package argo
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/argoproj/argo-workflows/v3/cmd/argo/commands/client"
+	cronworkflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/cronworkflow"
 	workflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflow"
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
-	"github.com/argoproj/pkg/errors"
-	argotime "github.com/argoproj/pkg/time"
-	"github.com/estecker/farm/internal/pubsub"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/failure"
+	"github.com/estecker/farm/internal/objectstore"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
 	"github.com/jellydator/ttlcache/v3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"log/slog"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -31,7 +36,7 @@ var (
 
 // Get workflows for both use cases, completed and not completed but recently changed
 // Most logic from https://github.com/argoproj/argo-workflows/blob/6a39edf366319a40d37ccf406fe27dcee3d15705/cmd/argo/commands/list.go#L127
-func listWorkflows(ctx context.Context, serviceClient workflowpkg.WorkflowServiceClient, nameSpace string) (wfv1.Workflows, error) {
+func listWorkflows(ctx context.Context, serviceClient workflowpkg.WorkflowServiceClient, nameSpace string, lookback time.Duration) (wfv1.Workflows, error) {
 	listOpts := &metav1.ListOptions{
 		Limit: 0,
 	}
@@ -51,9 +56,7 @@ func listWorkflows(ctx context.Context, serviceClient workflowpkg.WorkflowServic
 		}
 		listOpts.Continue = wfList.Continue
 	}
-	t, er := argotime.ParseSince("10m")
-	errors.CheckError(er)
-	workflows = workflows.Filter(activeInWindow(*t))
+	workflows = workflows.Filter(activeInWindow(time.Now().Add(-lookback)))
 	return workflows, nil
 }
 
@@ -71,95 +74,211 @@ func normalizeName(wf wfv1.Workflow) string {
 }
 
 // Generate the URL for the workflow so we can click on a link and see the workflow in DD
-func wfUrl(wf wfv1.Workflow) string {
+// Empty without a Kubernetes client or the argo-server ingress, looked up once per workflow and kept in its details
+func wfUrl(ctx context.Context, cli kubernetes.Interface, wf wfv1.Workflow) string {
 	//"https://nz-argo-staging.cirrus.ai/workflows/network-staging/rm-cron-tagging-log-net-od-1704511800"
-	config, err := rest.InClusterConfig()
-	if err != nil {
+	if cli == nil {
 		return "" //running farm locally?
 	}
-	clientset, _ := kubernetes.NewForConfig(config)
-	ingress, err := clientset.NetworkingV1().Ingresses("argo").List(context.TODO(), metav1.ListOptions{FieldSelector: "metadata.name=argo-server"})
+	ingress, err := cli.NetworkingV1().Ingresses("argo").List(ctx, metav1.ListOptions{FieldSelector: "metadata.name=argo-server"})
 	if err != nil {
-		return err.Error()
+		slog.Warn("Argo: Error getting the argo-server ingress", "error", err, "name", wf.Name)
+		return ""
+	}
+	if len(ingress.Items) == 0 {
+		return ""
+	}
+	hostname := ingress.Items[0].ObjectMeta.Annotations["external-dns.alpha.kubernetes.io/hostname"]
+	if hostname == "" {
+		return ""
+	}
+	return "https://" + hostname + "/workflows/" + wf.ObjectMeta.Namespace + "/" + wf.Name
+}
+
+// Build the event for a workflow and publish it, used by both collect and Backfill
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, wf wfv1.Workflow, kf *farmv1.KubeflowRun, d details) (string, error) {
+	e := &Event{
+		Name:              wf.Name,
+		NormalizedName:    workflowName(wf, kf),
+		Namespace:         wf.ObjectMeta.Namespace,
+		Kind:              wf.GetObjectKind().GroupVersionKind().Kind,
+		Url:               d.url,
+		Phase:             string(wf.Status.Phase),
+		WorkflowTemplate:  wf.ObjectMeta.Labels["workflows.argoproj.io/workflow-template"],
+		Labels:            wf.ObjectMeta.Labels,
+		Annotations:       wf.ObjectMeta.Annotations,
+		CreationTimestamp: wf.ObjectMeta.CreationTimestamp.UnixMicro(),
+		Kubeflow:          kf,
+		CriticalPath:      d.path.Proto(),
+		Delays:            d.delays,
+		Usage:             d.usage,
+		Nodes:             d.nodes,
+		FailureReason:     d.reason,
 	}
-	return "https://" + ingress.Items[0].ObjectMeta.Annotations["external-dns.alpha.kubernetes.io/hostname"] + "/workflows/" + wf.ObjectMeta.Namespace + "/" + wf.Name
+	for _, p := range wf.Spec.Arguments.Parameters {
+		param := &farmv1.Parameter{Name: p.Name}
+		if p.Value != nil {
+			param.Value = p.Value.String()
+		}
+		e.Parameters = append(e.Parameters, param)
+	}
+	// otherwise will send the zero value date, which is not null
+	if !wf.Status.StartedAt.IsZero() {
+		e.StartedAt = wf.Status.StartedAt.UnixMicro()
+	}
+	if !wf.Status.FinishedAt.IsZero() {
+		e.FinishedAt = wf.Status.FinishedAt.UnixMicro()
+	}
+	env := event.New("argo", string(wf.UID), e.Phase, cfg.Sources.Argo.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "argo",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.argo.workflow.phase_changed",
+		Source:     ceSource(cfg.Sources.Argo.Cluster, wf.ObjectMeta.Namespace),
+		Subject:    wf.Name,
+	})
 }
 
-// Main loop for collecting Argo events
-func collect(projectID string, saEmail string, workflows wfv1.Workflows, cache *ttlcache.Cache[types.UID, wfv1.WorkflowPhase], topicProjectID string) {
+// publishFailures publishes the failed steps of a completed workflow with their log
+func publishFailures(ctx context.Context, cfg *config.Config, em *source.Emitter, wf wfv1.Workflow, d details) {
+	for _, f := range d.failures {
+		if err := failure.Publish(ctx, cfg, em, f, cfg.Sources.Argo.Tenant, ceSource(cfg.Sources.Argo.Cluster, wf.Namespace)); err != nil {
+			em.Logger.Error("Argo: Error publishing the failure", "error", err, "name", wf.Name, "node", f.StepId)
+		}
+	}
+}
+
+// ceSource is the CloudEvents source of a workflow, argo/<cluster>/<namespace>
+func ceSource(cluster string, nameSpace string) string {
+	if cluster == "" {
+		return "argo/" + nameSpace
+	}
+	return "argo/" + cluster + "/" + nameSpace
+}
+
+// Main loop for collecting Argo events, returns the publish errors
+// A workflow is only cached once published, so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, em *source.Emitter, kubeCli kubernetes.Interface, logs *objectstore.Tailer, workflows wfv1.Workflows, cache *ttlcache.Cache[types.UID, wfv1.WorkflowPhase]) error {
+	var errs []error
 	for _, wf := range workflows {
-		_ = wf
 		UID := wf.GetUID()
 		if !cache.Has(UID) || cache.Get(UID).Value() != wf.Status.Phase {
-			e := Event{
-				Name:              wf.Name,
-				NormalizedName:    normalizeName(wf),
-				NameSpace:         wf.ObjectMeta.Namespace,
-				Kind:              wf.GetObjectKind().GroupVersionKind().Kind,
-				URL:               wfUrl(wf),
-				Phase:             string(wf.Status.Phase),
-				WorkflowTemplate:  wf.ObjectMeta.Labels["workflows.argoproj.io/workflow-template"],
-				CreationTimestamp: wf.ObjectMeta.CreationTimestamp.UnixMicro(),
+			kf := kubeflowInfo(ctx, cfg.Sources.Argo.Kubeflow, wf)
+			if !cfg.Sources.Argo.Filter.Match(workflowName(wf, kf)) {
+				continue
 			}
-			// if there are parameters, will send them as json in json
-			// prevents sending the string "null" when there are no parameters
-			if wf.ObjectMeta.Annotations != nil {
-				annotations, _ := json.Marshal(wf.ObjectMeta.Annotations)
-				e.Annotations = string(annotations) //json in json
-			}
-			if wf.ObjectMeta.Labels != nil {
-				labels, _ := json.Marshal(wf.ObjectMeta.Labels)
-				e.Labels = string(labels) //json in json
-			}
-			if wf.Spec.Arguments.Parameters != nil {
-				params, _ := json.Marshal(wf.Spec.Arguments.Parameters) //Going to be json in json pubsub message
-				e.Parameters = string(params)                           //json in json
-			}
-			// otherwise will send the zero value date, which is not null
-			if !wf.Status.StartedAt.IsZero() {
-				e.StartedAt = wf.Status.StartedAt.UnixMicro()
-			}
-			if !wf.Status.FinishedAt.IsZero() {
-				e.FinishedAt = wf.Status.FinishedAt.UnixMicro()
+			d := details{url: wfUrl(ctx, kubeCli, wf)}
+			if wf.Status.Phase.Completed() {
+				d = gather(ctx, kubeCli, logs, cfg, wf, kf, d.url)
 			}
-			msg, err := json.Marshal(e)
+			msgID, err := publish(ctx, cfg, em, wf, kf, d)
 			if err != nil {
-				slog.Error("Error marshalling Argo event.", "error", err)
-			}
-			attributes := map[string]string{
-				"project_id":  projectID,
-				"sa_email":    saEmail,
-				"type":        "argo",
-				"tenant":      os.Getenv("tenant"),
-				"environment": os.Getenv("DD_ENV"),
-			}
-			msgID, err := pubsub.Publish(msg, topicProjectID, "farm", attributes)
-			if err == nil {
-				cache.Set(wf.UID, wf.Status.Phase, 0)
-				slog.Debug("pubsub.publish",
-					"type", "argo",
-					"phase", wf.Status.Phase,
-					"name", wf.ObjectMeta.Name,
-					"msgID", msgID)
-			} else {
-				slog.Error("Argo: pubsub Error publishing to pubsub", "error", err, "msgID", msgID)
+				em.Logger.Error("Argo: pubsub Error publishing to pubsub", "error", err, "msgID", msgID)
+				errs = append(errs, err)
+				continue
 			}
+			cache.Set(wf.UID, wf.Status.Phase, 0)
+			em.Logger.Debug("pubsub.publish",
+				"type", "argo",
+				"phase", wf.Status.Phase,
+				"name", wf.ObjectMeta.Name,
+				"msgID", msgID)
 			if wf.Status.Phase.Completed() {
-				trace(wf)
+				run := slo.Run{
+					Source:   "argo",
+					Workflow: workflowName(wf, kf),
+					Tenant:   cfg.Sources.Argo.Tenant,
+					ID:       string(wf.UID),
+					URL:      d.url,
+					Start:    wf.Status.StartedAt.Time,
+					End:      wf.Status.FinishedAt.Time,
+					Success:  wf.Status.Phase == wfv1.WorkflowSucceeded,
+				}
+				if cfg.Sources.Argo.Cost.Enabled && d.usage != nil {
+					em.Distribution("cost", d.usage.Cost, "tenant:"+run.Tenant, "namespace:"+wf.Namespace, "workflow:"+run.Workflow)
+				}
+				check := em.Durations(cfg, run)
+				trace(wf, kf, d, cfg.Sources.Argo.Tenant, em.Completed(ctx, cfg, run), check)
+				check.Publish(ctx)
+				publishFailures(ctx, cfg, em, wf, d)
 			}
 		}
 	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Argo workflow events, sources.argo in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "argo"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Argo.Enabled
 }
 
-// Main loop for collecting Argo events, runs forever
-func Exec(ctx context.Context, projectID string, saEmail string, nameSpace string, topicProjectID string) {
+// Run is the main loop for collecting Argo events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
 	cache := ttlcache.New[types.UID, wfv1.WorkflowPhase](ttlcache.WithTTL[types.UID, wfv1.WorkflowPhase](time.Hour))
 	ctx, apiClient := client.NewAPIClient(ctx)
 	serviceClient := apiClient.NewWorkflowServiceClient()
+	cronClient, err := apiClient.NewCronWorkflowServiceClient()
+	if err != nil {
+		return err
+	}
+	kubeCli := newKubeClient()
 	for {
-		createdSinceWf, _ := listWorkflows(ctx, serviceClient, nameSpace) //Something changed recently, might be completed too
-		collect(projectID, saEmail, createdSinceWf, cache, topicProjectID)
-		time.Sleep(191 * time.Second)
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, serviceClient, cronClient, kubeCli, em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Argo.Interval) {
+			return nil
+		}
 		cache.DeleteExpired()
 	}
 }
+
+// Once runs a single collection cycle, every workflow in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	cache := ttlcache.New[types.UID, wfv1.WorkflowPhase]()
+	ctx, apiClient := client.NewAPIClient(ctx)
+	cronClient, err := apiClient.NewCronWorkflowServiceClient()
+	if err != nil {
+		return err
+	}
+	return cycle(ctx, cfg, apiClient.NewWorkflowServiceClient(), cronClient, newKubeClient(), em, cache)
+}
+
+// cycle is one poll of the Argo API, returns the API and publish errors
+func cycle(ctx context.Context, cfg *config.Config, serviceClient workflowpkg.WorkflowServiceClient, cronClient cronworkflowpkg.CronWorkflowServiceClient, kubeCli kubernetes.Interface, em *source.Emitter, cache *ttlcache.Cache[types.UID, wfv1.WorkflowPhase]) error {
+	createdSinceWf, err := listWorkflows(ctx, serviceClient, cfg.Sources.Argo.Namespace, cfg.Sources.Argo.Lookback) //Something changed recently, might be completed too
+	if err != nil {
+		em.Logger.Error("Argo: Error listing workflows", "error", err)
+		return err
+	}
+	logs := &objectstore.Tailer{}
+	defer logs.Close()
+	errs := []error{collect(ctx, cfg, em, kubeCli, logs, createdSinceWf, cache)}
+	if cfg.Sources.Argo.Missed.Enabled {
+		if err := checkCronWorkflows(ctx, cfg, serviceClient, cronClient, em); err != nil {
+			em.Logger.Error("Argo: Error checking CronWorkflows", "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package argo
+
+import (
+	"context"
+	"errors"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	typednetworkingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+	"testing"
+)
+
+type fakeNetworking struct {
+	typednetworkingv1.NetworkingV1Interface
+	f *fakeClient
+}
+
+type fakeIngresses struct {
+	typednetworkingv1.IngressInterface
+	f         *fakeClient
+	namespace string
+}
+
+func (f *fakeClient) NetworkingV1() typednetworkingv1.NetworkingV1Interface {
+	return fakeNetworking{f: f}
+}
+
+func (n fakeNetworking) Ingresses(namespace string) typednetworkingv1.IngressInterface {
+	return fakeIngresses{f: n.f, namespace: namespace}
+}
+
+func (i fakeIngresses) List(ctx context.Context, opts metav1.ListOptions) (*networkingv1.IngressList, error) {
+	if i.f.ingressesErr != nil {
+		return nil, i.f.ingressesErr
+	}
+	selector, err := fields.ParseSelector(opts.FieldSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &networkingv1.IngressList{}
+	for _, ing := range i.f.ingresses {
+		if ing.Namespace == i.namespace && selector.Matches(fields.Set{"metadata.name": ing.Name}) {
+			list.Items = append(list.Items, ing)
+		}
+	}
+	return list, nil
+}
+
+func TestWfUrl(t *testing.T) {
+	wf := wfv1.Workflow{ObjectMeta: metav1.ObjectMeta{Name: "etl-1", Namespace: "etl"}}
+	argoServer := func(namespace, name, hostname string) networkingv1.Ingress {
+		ing := networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		if hostname != "" {
+			ing.Annotations = map[string]string{"external-dns.alpha.kubernetes.io/hostname": hostname}
+		}
+		return ing
+	}
+	tests := []struct {
+		name string
+		cli  *fakeClient
+		want string
+	}{
+		{"ingress", &fakeClient{ingresses: []networkingv1.Ingress{
+			argoServer("argo", "grafana", "grafana.example.com"),
+			argoServer("argo", "argo-server", "argo.example.com"),
+		}}, "https://argo.example.com/workflows/etl/etl-1"},
+		{"no ingress", &fakeClient{ingresses: []networkingv1.Ingress{argoServer("monitoring", "argo-server", "argo.example.com")}}, ""},
+		{"no hostname", &fakeClient{ingresses: []networkingv1.Ingress{argoServer("argo", "argo-server", "")}}, ""},
+		{"error", &fakeClient{ingressesErr: errors.New("forbidden")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wfUrl(context.Background(), tt.cli, wf); got != tt.want {
+				t.Errorf("wfUrl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := wfUrl(context.Background(), nil, wf); got != "" {
+		t.Errorf("wfUrl() without a client = %q, want none", got)
+	}
+}
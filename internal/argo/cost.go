@@ -0,0 +1,51 @@
+package argo
+
+import (
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	corev1 "k8s.io/api/core/v1"
+	"strconv"
+)
+
+// The GPUs Argo accounts in resourcesDuration
+const gpuResource corev1.ResourceName = "nvidia.com/gpu"
+
+// usage of the resources accounted by Argo, with its cost at the prices p
+func usage(rd wfv1.ResourcesDuration, p config.Prices) *farmv1.ResourceUsage {
+	if rd.IsZero() {
+		return nil
+	}
+	u := &farmv1.ResourceUsage{ResourcesDuration: map[string]int64{}}
+	for name, d := range rd {
+		u.ResourcesDuration[string(name)] = int64(d)
+		// Argo counts the seconds of a unit of each resource, e.g. 100Mi of memory
+		seconds := float64(d) * wfv1.ResourceQuantityDenominator(name).AsApproximateFloat64()
+		switch name {
+		case corev1.ResourceCPU:
+			u.CpuSeconds = seconds
+		case corev1.ResourceMemory:
+			u.MemorySeconds = seconds / (1 << 30)
+		case gpuResource:
+			u.GpuSeconds = seconds
+		}
+	}
+	u.Cost = u.CpuSeconds*p.CPU + u.MemorySeconds*p.Memory + u.GpuSeconds*p.GPU
+	return u
+}
+
+// usageTags for the span of a workflow or a node, nil without usage
+func usageTags(u *farmv1.ResourceUsage) map[string]string {
+	if u == nil {
+		return nil
+	}
+	tags := map[string]string{
+		"cpu_seconds":    strconv.FormatFloat(u.CpuSeconds, 'f', 1, 64),
+		"memory_seconds": strconv.FormatFloat(u.MemorySeconds, 'f', 1, 64),
+		"gpu_seconds":    strconv.FormatFloat(u.GpuSeconds, 'f', 1, 64),
+	}
+	if u.Cost > 0 {
+		tags["cost"] = strconv.FormatFloat(u.Cost, 'f', 6, 64)
+	}
+	return tags
+}
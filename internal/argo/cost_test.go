@@ -0,0 +1,48 @@
+package argo
+
+import (
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	"math"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	// An hour of a CPU, of 10Gi of memory in 100Mi units and a minute of a GPU
+	rd := wfv1.ResourcesDuration{
+		corev1.ResourceCPU:    3600,
+		corev1.ResourceMemory: 3600 * 1024 / 10,
+		gpuResource:           60,
+	}
+	u := usage(rd, config.Prices{CPU: 0.00001, Memory: 0.000001, GPU: 0.001})
+	tests := []struct {
+		name      string
+		got, want float64
+	}{
+		{"cpu", u.CpuSeconds, 3600},
+		{"memory", u.MemorySeconds, 36000}, //GiB-seconds
+		{"gpu", u.GpuSeconds, 60},
+		{"cost", u.Cost, 0.036 + 0.036 + 0.06},
+	}
+	for _, tt := range tests {
+		if math.Abs(tt.got-tt.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	// The raw durations are kept in the units of Argo
+	if u.ResourcesDuration["memory"] != 368640 || u.ResourcesDuration["cpu"] != 3600 {
+		t.Errorf("resources duration = %v", u.ResourcesDuration)
+	}
+	if tags := usageTags(u); tags["memory_seconds"] != "36000.0" || tags["cost"] != "0.132000" {
+		t.Errorf("usageTags() = %v", tags)
+	}
+
+	if usage(wfv1.ResourcesDuration{}, config.Prices{}) != nil || usageTags(nil) != nil {
+		t.Error("usage of no resources is not nil")
+	}
+	// Without prices the usage is kept at no cost
+	if u := usage(wfv1.ResourcesDuration{corev1.ResourceMemory: 1024}, config.Prices{}); u.MemorySeconds != 100 || u.Cost != 0 || usageTags(u)["cost"] != "" {
+		t.Errorf("usage() = %v", u)
+	}
+}
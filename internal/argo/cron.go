@@ -0,0 +1,100 @@
+package argo
+
+import (
+	"context"
+	"errors"
+	cronworkflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/cronworkflow"
+	workflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflow"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/missed"
+	"github.com/estecker/farm/internal/source"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// missedRun is the latest run of the CronWorkflow that should have started by until, nil if none is missing
+// Without a timezone the schedule is in the local time of FARM, like the workflow controller
+// activeSince is when the earliest active run was created, zero if none is known
+func missedRun(cwf wfv1.CronWorkflow, activeSince time.Time, until time.Time) (*farmv1.MissedRun, error) {
+	schedule, err := cron.ParseStandard(cwf.Spec.GetScheduleString())
+	if err != nil {
+		return nil, err
+	}
+	// Forbid skips the runs while one is active, only those due before it started are missed
+	if cwf.Spec.ConcurrencyPolicy == wfv1.ForbidConcurrent && !activeSince.IsZero() && activeSince.Before(until) {
+		until = activeSince
+	}
+	last := cwf.CreationTimestamp.Time
+	m := &farmv1.MissedRun{
+		Source:    "argo",
+		Workflow:  cwf.Name,
+		Namespace: cwf.Namespace,
+		Schedule:  cwf.Spec.Schedule,
+		Timezone:  cwf.Spec.Timezone,
+		Paused:    cwf.Spec.Suspend,
+	}
+	if t := cwf.Status.LastScheduledTime; t != nil {
+		last = t.Time
+		m.LastScheduledTime = t.UnixMicro()
+	}
+	expected, n := missed.Since(schedule, last, until)
+	if n == 0 {
+		return nil, nil
+	}
+	m.ExpectedTime, m.Missed = expected.UnixMicro(), int32(n)
+	if m.Paused {
+		m.ExpectedTime = schedule.Next(last).UnixMicro() //Published once until it resumes
+	}
+	return m, nil
+}
+
+// activeSince is when the earliest active run of the CronWorkflow was created, zero if none is known
+// An active run that can not be read, e.g. deleted before the status was updated, does not hold back the schedule
+func activeSince(ctx context.Context, serviceClient workflowpkg.WorkflowServiceClient, cwf wfv1.CronWorkflow, em *source.Emitter) time.Time {
+	var since time.Time
+	for _, ref := range cwf.Status.Active {
+		wf, err := serviceClient.GetWorkflow(ctx, &workflowpkg.WorkflowGetRequest{
+			Name:      ref.Name,
+			Namespace: ref.Namespace,
+			Fields:    "metadata.name,metadata.creationTimestamp",
+		})
+		if err != nil {
+			em.Logger.Warn("Argo: Error getting active workflow", "error", err, "name", ref.Name, "cronWorkflow", cwf.Name)
+			continue
+		}
+		if since.IsZero() || wf.CreationTimestamp.Time.Before(since) {
+			since = wf.CreationTimestamp.Time
+		}
+	}
+	return since
+}
+
+// checkCronWorkflows publishes the runs of the CronWorkflows that did not start within the grace period
+func checkCronWorkflows(ctx context.Context, cfg *config.Config, serviceClient workflowpkg.WorkflowServiceClient, cronClient cronworkflowpkg.CronWorkflowServiceClient, em *source.Emitter) error {
+	list, err := cronClient.ListCronWorkflows(ctx, &cronworkflowpkg.ListCronWorkflowsRequest{Namespace: cfg.Sources.Argo.Namespace})
+	if err != nil {
+		return err
+	}
+	until := time.Now().Add(-cfg.Sources.Argo.Missed.Grace)
+	var errs []error
+	for _, cwf := range list.Items {
+		if !cfg.Sources.Argo.Filter.Match(cwf.Name) {
+			continue
+		}
+		var since time.Time
+		if cwf.Spec.ConcurrencyPolicy == wfv1.ForbidConcurrent {
+			since = activeSince(ctx, serviceClient, cwf, em)
+		}
+		m, err := missedRun(cwf, since, until)
+		if err != nil {
+			em.Logger.Error("Argo: Invalid CronWorkflow schedule", "error", err, "name", cwf.Name, "schedule", cwf.Spec.Schedule)
+			continue
+		}
+		if err := missed.Check(ctx, cfg, em, cwf.Name, m, cfg.Sources.Argo.Tenant, ceSource(cfg.Sources.Argo.Cluster, cwf.Namespace)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
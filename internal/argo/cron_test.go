@@ -0,0 +1,122 @@
+package argo
+
+import (
+	"context"
+	"errors"
+	workflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflow"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/source"
+	"google.golang.org/grpc"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// hourly CronWorkflow last scheduled at 06:00 UTC
+func hourly(policy wfv1.ConcurrencyPolicy, active ...string) wfv1.CronWorkflow {
+	cwf := wfv1.CronWorkflow{
+		ObjectMeta: metav1.ObjectMeta{Name: "hourly", Namespace: "etl", CreationTimestamp: metav1.NewTime(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))},
+		Spec:       wfv1.CronWorkflowSpec{Schedule: "0 * * * *", Timezone: "UTC", ConcurrencyPolicy: policy},
+		Status:     wfv1.CronWorkflowStatus{LastScheduledTime: &metav1.Time{Time: time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)}},
+	}
+	for _, name := range active {
+		cwf.Status.Active = append(cwf.Status.Active, corev1.ObjectReference{Name: name, Namespace: "etl"})
+	}
+	return cwf
+}
+
+func TestCronMissedRun(t *testing.T) {
+	until := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+	clock := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.UTC)
+	}
+	suspended := hourly(wfv1.AllowConcurrent)
+	suspended.Spec.Suspend = true
+	tests := []struct {
+		name        string
+		cwf         wfv1.CronWorkflow
+		activeSince time.Time
+		missed      int32
+		expected    time.Time //Zero for no missed run
+	}{
+		{"on schedule", hourly(wfv1.AllowConcurrent), clock(6, 0), 3, clock(9, 0)},
+		{"no active run", hourly(wfv1.ForbidConcurrent), time.Time{}, 3, clock(9, 0)},
+		// The run of 06:00 is still running, the later ones were skipped on purpose
+		{"forbid, running since the last schedule", hourly(wfv1.ForbidConcurrent, "hourly-1"), clock(6, 0), 0, time.Time{}},
+		// Submitted by hand at 08:10, the runs of 07:00 and 08:00 were missed before it
+		{"forbid, running since later", hourly(wfv1.ForbidConcurrent, "hourly-manual"), clock(8, 10), 2, clock(8, 0)},
+		{"forbid, started after until", hourly(wfv1.ForbidConcurrent, "hourly-2"), clock(9, 45), 3, clock(9, 0)},
+		{"replace", hourly(wfv1.ReplaceConcurrent, "hourly-1"), clock(6, 0), 3, clock(9, 0)},
+		// Published once at the first missed run until it resumes
+		{"suspended", suspended, time.Time{}, 3, clock(7, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := missedRun(tt.cwf, tt.activeSince, until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expected.IsZero() {
+				if m != nil {
+					t.Errorf("missedRun() = %v, want nil", m)
+				}
+				return
+			}
+			if m == nil {
+				t.Fatal("missedRun() = nil, want a missed run")
+			}
+			if m.Missed != tt.missed || m.ExpectedTime != tt.expected.UnixMicro() || m.Paused != tt.cwf.Spec.Suspend {
+				t.Errorf("missedRun() = %v, want %d missed, expected at %v", m, tt.missed, tt.expected)
+			}
+		})
+	}
+
+	invalid := hourly(wfv1.AllowConcurrent)
+	invalid.Spec.Schedule = "every hour"
+	if _, err := missedRun(invalid, time.Time{}, until); err == nil {
+		t.Error("missedRun() of an invalid schedule error = nil")
+	}
+}
+
+// fakeWorkflows gets workflows by name, the other methods are not implemented
+type fakeWorkflows struct {
+	workflowpkg.WorkflowServiceClient
+	created map[string]time.Time
+}
+
+func (f *fakeWorkflows) GetWorkflow(ctx context.Context, req *workflowpkg.WorkflowGetRequest, opts ...grpc.CallOption) (*wfv1.Workflow, error) {
+	created, ok := f.created[req.Name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &wfv1.Workflow{ObjectMeta: metav1.ObjectMeta{Name: req.Name, Namespace: req.Namespace, CreationTimestamp: metav1.NewTime(created)}}, nil
+}
+
+func TestActiveSince(t *testing.T) {
+	f := &fakeWorkflows{created: map[string]time.Time{
+		"hourly-1": time.Date(2026, 10, 19, 6, 0, 1, 0, time.UTC),
+		"hourly-2": time.Date(2026, 10, 19, 8, 10, 0, 0, time.UTC),
+	}}
+	em := (&source.Emitter{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}).For("argo")
+	tests := []struct {
+		name   string
+		active []string
+		want   time.Time
+	}{
+		{"none", nil, time.Time{}},
+		{"earliest", []string{"hourly-2", "hourly-1"}, f.created["hourly-1"]},
+		// Deleted before the status of the CronWorkflow was updated
+		{"gone", []string{"hourly-0"}, time.Time{}},
+		{"gone and running", []string{"hourly-0", "hourly-2"}, f.created["hourly-2"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activeSince(context.Background(), f, hourly(wfv1.ForbidConcurrent, tt.active...), em); !got.Equal(tt.want) {
+				t.Errorf("activeSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package argo
+
+import (
+	"cmp"
+	"context"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/workflow/util"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Most pods of a failed workflow to get the events of, a failed fan out can have thousands
+const maxEventPods = 50
+
+// failed reports if a pod node of a failed workflow may be why it failed, it failed or never finished
+func failed(node wfv1.NodeStatus) bool {
+	return node.Type == wfv1.NodeTypePod && (node.FailedOrError() || !node.Fulfilled())
+}
+
+// podName of a node, the one Argo generates when the pod is gone
+func podName(wf wfv1.Workflow, node wfv1.NodeStatus, pod *corev1.Pod) string {
+	if pod != nil {
+		return pod.Name
+	}
+	return util.GeneratePodName(wf.Name, node.Name, util.GetTemplateFromNode(node), node.ID, util.GetWorkflowPodNameVersion(&wf))
+}
+
+// podEvents adds the Warning events of the pods of the steps that did not succeed to the nodes of a failed workflow
+// Events expire after an hour by default, so they are only looked up while collecting
+func podEvents(ctx context.Context, cli kubernetes.Interface, wf wfv1.Workflow, d details) {
+	if cli == nil {
+		return
+	}
+	looked := 0
+	for _, n := range d.nodes {
+		node := wf.Status.Nodes[n.Id]
+		if !failed(node) {
+			continue
+		}
+		if looked++; looked > maxEventPods {
+			slog.Warn("Argo: Too many failed steps, skipping the events of the others", "name", wf.Name, "max", maxEventPods)
+			return
+		}
+		selector := fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": podName(wf, node, d.pod(n.Id)),
+			"type":                corev1.EventTypeWarning,
+		}
+		events, err := cli.CoreV1().Events(wf.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector.AsSelector().String()})
+		if err != nil {
+			slog.Error("Argo: Error listing events", "error", err, "name", wf.Name, "node", n.Id)
+			return
+		}
+		for _, e := range events.Items {
+			n.Events = append(n.Events, kubernetesEvent(e))
+		}
+		slices.SortFunc(n.Events, func(a, b *farmv1.KubernetesEvent) int { return cmp.Compare(a.FirstTimestamp, b.FirstTimestamp) })
+	}
+}
+
+// kubernetesEvent of core/v1 Event, also when it was recorded with the events.k8s.io/v1 API and only has a series
+func kubernetesEvent(e corev1.Event) *farmv1.KubernetesEvent {
+	first := e.FirstTimestamp.Time
+	if first.IsZero() {
+		first = cmp.Or(e.EventTime.Time, e.CreationTimestamp.Time)
+	}
+	last, count := e.LastTimestamp.Time, e.Count
+	if e.Series != nil {
+		last, count = e.Series.LastObservedTime.Time, e.Series.Count
+	}
+	return &farmv1.KubernetesEvent{
+		Type:           e.Type,
+		Reason:         e.Reason,
+		Message:        e.Message,
+		Count:          max(count, 1),
+		FirstTimestamp: first.UnixMicro(),
+		LastTimestamp:  max(last.UnixMicro(), first.UnixMicro()),
+		Component:      cmp.Or(e.Source.Component, e.ReportingController),
+	}
+}
+
+// failureReason of a failed workflow, the most repeated event of its failed steps
+// Without events it is why a step failed, the cluster killing its pod or its message, e.g. a pod forbidden by a quota, else the workflow message
+func failureReason(wf wfv1.Workflow, nodes []*farmv1.ArgoNode) string {
+	var step string
+	var top *farmv1.KubernetesEvent
+	for _, n := range nodes {
+		for _, e := range n.Events {
+			if top == nil || cmp.Or(cmp.Compare(e.Count, top.Count), cmp.Compare(e.LastTimestamp, top.LastTimestamp)) > 0 {
+				step, top = n.Name, e
+			}
+		}
+	}
+	if top != nil {
+		return step + ": " + top.Reason + ": " + top.Message
+	}
+	for _, n := range nodes {
+		if n.InfrastructureFailure != "" {
+			return n.Name + ": " + n.InfrastructureFailure
+		}
+	}
+	for _, n := range nodes {
+		if failed(wf.Status.Nodes[n.Id]) && n.Message != "" {
+			return n.Name + ": " + n.Message
+		}
+	}
+	return wf.Status.Message
+}
+
+// traceEvents adds a span per event under the span of the step, from when it was first seen to when it was last seen
+func traceEvents(events []*farmv1.KubernetesEvent, parent ddtrace.SpanContext) {
+	for _, e := range events {
+		span := tracer.StartSpan("k8s_event",
+			tracer.ResourceName(e.Reason),
+			tracer.ChildOf(parent),
+			tracer.StartTime(time.UnixMicro(e.FirstTimestamp)))
+		span.SetTag("type", e.Type)
+		span.SetTag("reason", e.Reason)
+		span.SetTag("message", e.Message)
+		span.SetTag("count", e.Count)
+		span.SetTag("component", e.Component)
+		span.Finish(tracer.FinishTime(time.UnixMicro(e.LastTimestamp)), tracer.WithError(nil))
+	}
+}
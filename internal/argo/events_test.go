@@ -0,0 +1,232 @@
+package argo
+
+import (
+	"context"
+	"errors"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/event/farmv1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type fakeEvents struct {
+	typedcorev1.EventInterface
+	f         *fakeClient
+	namespace string
+}
+
+func (c fakeCore) Events(namespace string) typedcorev1.EventInterface {
+	return fakeEvents{f: c.f, namespace: namespace}
+}
+
+func (e fakeEvents) List(ctx context.Context, opts metav1.ListOptions) (*corev1.EventList, error) {
+	e.f.selectors = append(e.f.selectors, opts.FieldSelector)
+	if e.f.eventsErr != nil {
+		return nil, e.f.eventsErr
+	}
+	selector, err := fields.ParseSelector(opts.FieldSelector)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := selector.RequiresExactMatch("involvedObject.name")
+	list := &corev1.EventList{}
+	for _, ev := range e.f.events[name] {
+		if ev.Namespace == e.namespace {
+			list.Items = append(list.Items, ev)
+		}
+	}
+	return list, nil
+}
+
+var t0 = time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+// at is a Kubernetes time seconds after t0
+func at(seconds int) metav1.Time {
+	return metav1.NewTime(t0.Add(time.Duration(seconds) * time.Second))
+}
+
+func TestKubernetesEvent(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       corev1.Event
+		count       int32
+		first, last metav1.Time
+		component   string
+	}{
+		{"core", corev1.Event{
+			FirstTimestamp: at(10),
+			LastTimestamp:  at(70),
+			Count:          3,
+			Source:         corev1.EventSource{Component: "kubelet"},
+		}, 3, at(10), at(70), "kubelet"},
+		// Recorded with the events.k8s.io/v1 API
+		{"series", corev1.Event{
+			EventTime:           metav1.NewMicroTime(at(10).Time),
+			LastTimestamp:       at(20),
+			Count:               2,
+			Series:              &corev1.EventSeries{Count: 5, LastObservedTime: metav1.NewMicroTime(at(90).Time)},
+			ReportingController: "default-scheduler",
+		}, 5, at(10), at(90), "default-scheduler"},
+		{"single", corev1.Event{EventTime: metav1.NewMicroTime(at(10).Time), ReportingController: "karpenter"}, 1, at(10), at(10), "karpenter"},
+		{"only created", corev1.Event{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: at(30)}}, 1, at(30), at(30), ""},
+		// Clock skew between the components
+		{"last before first", corev1.Event{FirstTimestamp: at(10), LastTimestamp: at(5), Count: 2}, 2, at(10), at(10), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.Type, tt.event.Reason, tt.event.Message = corev1.EventTypeWarning, "FailedScheduling", "0/3 nodes are available"
+			e := kubernetesEvent(tt.event)
+			if e.Type != corev1.EventTypeWarning || e.Reason != "FailedScheduling" || e.Message != "0/3 nodes are available" {
+				t.Errorf("kubernetesEvent() = %v", e)
+			}
+			if e.Count != tt.count || e.FirstTimestamp != tt.first.UnixMicro() || e.LastTimestamp != tt.last.UnixMicro() || e.Component != tt.component {
+				t.Errorf("kubernetesEvent() = %v, want %d times from %v to %v by %q", e, tt.count, tt.first, tt.last, tt.component)
+			}
+		})
+	}
+}
+
+// failedWorkflow has a failed extract step, a load step that succeeded and a train step that failed
+func failedWorkflow() wfv1.Workflow {
+	return wfv1.Workflow{
+		ObjectMeta: metav1.ObjectMeta{Name: "etl-1", Namespace: "etl"},
+		Status: wfv1.WorkflowStatus{
+			Phase:   wfv1.WorkflowFailed,
+			Message: "child 'etl-1-3' failed",
+			Nodes: wfv1.Nodes{
+				"etl-1-1": {ID: "etl-1-1", Name: "etl-1.extract", TemplateName: "extract", Type: wfv1.NodeTypePod, Phase: wfv1.NodeFailed},
+				"etl-1-2": {ID: "etl-1-2", Name: "etl-1.load", TemplateName: "load", Type: wfv1.NodeTypePod, Phase: wfv1.NodeSucceeded},
+				"etl-1-3": {ID: "etl-1-3", Name: "etl-1.train", TemplateName: "train", Type: wfv1.NodeTypePod, Phase: wfv1.NodeError},
+			},
+		},
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	wf := failedWorkflow()
+	event := func(reason string, count int32, last int) *farmv1.KubernetesEvent {
+		return &farmv1.KubernetesEvent{Reason: reason, Message: reason + " message", Count: count, LastTimestamp: at(last).UnixMicro()}
+	}
+	tests := []struct {
+		name  string
+		nodes []*farmv1.ArgoNode
+		want  string
+	}{
+		{"most repeated event", []*farmv1.ArgoNode{
+			{Id: "etl-1-1", Name: "extract", Events: []*farmv1.KubernetesEvent{event("BackOff", 2, 60), event("FailedMount", 4, 30)}},
+			{Id: "etl-1-3", Name: "train", InfrastructureFailure: "OOMKilled", Events: []*farmv1.KubernetesEvent{event("FailedScheduling", 3, 90)}},
+		}, "extract: FailedMount: FailedMount message"},
+		{"last seen event", []*farmv1.ArgoNode{
+			{Id: "etl-1-1", Name: "extract", Events: []*farmv1.KubernetesEvent{event("BackOff", 3, 60)}},
+			{Id: "etl-1-3", Name: "train", Events: []*farmv1.KubernetesEvent{event("FailedScheduling", 3, 90)}},
+		}, "train: FailedScheduling: FailedScheduling message"},
+		{"infrastructure failure", []*farmv1.ArgoNode{
+			{Id: "etl-1-1", Name: "extract", Message: "Error (exit code 1)"},
+			{Id: "etl-1-3", Name: "train", Message: "OOMKilled (exit code 137)", InfrastructureFailure: "OOMKilled"},
+		}, "train: OOMKilled"},
+		// The message of the step that succeeded is not why the workflow failed
+		{"failed step message", []*farmv1.ArgoNode{
+			{Id: "etl-1-2", Name: "load", Message: "retried"},
+			{Id: "etl-1-3", Name: "train", Message: "pods \"etl-1-train\" is forbidden: exceeded quota"},
+		}, "train: pods \"etl-1-train\" is forbidden: exceeded quota"},
+		{"workflow message", []*farmv1.ArgoNode{{Id: "etl-1-2", Name: "load", Message: "retried"}, {Id: "etl-1-3", Name: "train"}}, "child 'etl-1-3' failed"},
+		{"no nodes", nil, "child 'etl-1-3' failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(wf, tt.nodes); got != tt.want {
+				t.Errorf("failureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodEvents(t *testing.T) {
+	wf := failedWorkflow()
+	// The pod of train is gone, its events are looked up by the name Argo gave it
+	trainPod := podName(wf, wf.Status.Nodes["etl-1-3"], nil)
+	warning := func(pod string, reason string, first int) corev1.Event {
+		return corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: pod + "." + reason, Namespace: "etl"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: pod, Namespace: "etl"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         reason,
+			FirstTimestamp: at(first),
+			LastTimestamp:  at(first),
+			Count:          1,
+		}
+	}
+	f := &fakeClient{events: map[string][]corev1.Event{
+		"etl-1-extract-1": {warning("etl-1-extract-1", "BackOff", 60), warning("etl-1-extract-1", "FailedMount", 10)},
+		"etl-1-load-2":    {warning("etl-1-load-2", "Unhealthy", 30)},
+		trainPod:          {warning(trainPod, "FailedScheduling", 0)},
+	}}
+	nodes := func() details {
+		return details{
+			pods:  map[string]corev1.Pod{"etl-1-1": {ObjectMeta: metav1.ObjectMeta{Name: "etl-1-extract-1"}}, "etl-1-2": {ObjectMeta: metav1.ObjectMeta{Name: "etl-1-load-2"}}},
+			nodes: []*farmv1.ArgoNode{{Id: "etl-1-1", Name: "extract"}, {Id: "etl-1-2", Name: "load"}, {Id: "etl-1-3", Name: "train"}},
+		}
+	}
+
+	d := nodes()
+	podEvents(context.Background(), f, wf, d)
+	reasons := func(n *farmv1.ArgoNode) []string {
+		var r []string
+		for _, e := range n.Events {
+			r = append(r, e.Reason)
+		}
+		return r
+	}
+	// In the order they were first seen, the step that succeeded is skipped
+	if got := reasons(d.nodes[0]); len(got) != 2 || got[0] != "FailedMount" || got[1] != "BackOff" {
+		t.Errorf("extract events = %v, want FailedMount and BackOff", got)
+	}
+	if got := reasons(d.nodes[1]); len(got) != 0 {
+		t.Errorf("load events = %v, want none", got)
+	}
+	if got := reasons(d.nodes[2]); len(got) != 1 || got[0] != "FailedScheduling" {
+		t.Errorf("train events = %v, want FailedScheduling", got)
+	}
+	if len(f.selectors) != 2 {
+		t.Fatalf("%d event lists, want 2", len(f.selectors))
+	}
+	for i, pod := range []string{"etl-1-extract-1", trainPod} {
+		selector, err := fields.ParseSelector(f.selectors[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": pod, "type": corev1.EventTypeWarning}
+		if !selector.Matches(want) || len(selector.Requirements()) != len(want) {
+			t.Errorf("field selector = %q, want %v", f.selectors[i], want)
+		}
+	}
+
+	// Stops at the first error
+	f.selectors, f.eventsErr = nil, errors.New("forbidden")
+	d = nodes()
+	podEvents(context.Background(), f, wf, d)
+	if len(f.selectors) != 1 || d.nodes[0].Events != nil || d.nodes[2].Events != nil {
+		t.Errorf("podEvents() on error listed %d times, events %v and %v", len(f.selectors), d.nodes[0].Events, d.nodes[2].Events)
+	}
+
+	// Only the first failed steps of a large fan out
+	f.selectors, f.eventsErr = nil, nil
+	fanOut := wfv1.Workflow{ObjectMeta: wf.ObjectMeta, Status: wfv1.WorkflowStatus{Nodes: wfv1.Nodes{}}}
+	d = details{}
+	for i := range maxEventPods + 10 {
+		id := "etl-1-" + strconv.Itoa(i)
+		fanOut.Status.Nodes[id] = wfv1.NodeStatus{ID: id, Name: "etl-1.shard(" + strconv.Itoa(i) + ")", TemplateName: "shard", Type: wfv1.NodeTypePod, Phase: wfv1.NodeFailed}
+		d.nodes = append(d.nodes, &farmv1.ArgoNode{Id: id, Name: "shard"})
+	}
+	podEvents(context.Background(), f, fanOut, d)
+	if len(f.selectors) != maxEventPods {
+		t.Errorf("%d event lists, want %d", len(f.selectors), maxEventPods)
+	}
+
+	podEvents(context.Background(), nil, wf, nodes())
+}
@@ -0,0 +1,205 @@
+package argo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/jellydator/ttlcache/v3"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Labels and annotations Kubeflow Pipelines puts on the workflows it submits
+const (
+	kfpRunID        = "pipeline/runid"
+	kfpRecurringRun = "scheduledworkflows.kubeflow.org/scheduledWorkflowName"
+	kfpPrefix       = "pipelines.kubeflow.org/"
+	kfpRunName      = kfpPrefix + "run_name"
+	kfpPipelineSpec = kfpPrefix + "pipeline_spec"  //KFP v1, JSON with the pipeline name
+	kfpComponent    = kfpPrefix + "component_spec" //KFP v1, on the templates, JSON with the component name
+	kfpSDKVersion   = kfpPrefix + "kfp_sdk_version"
+)
+
+// isKubeflow reports if Kubeflow Pipelines created the workflow
+func isKubeflow(wf wfv1.Workflow) bool {
+	if _, ok := wf.Labels[kfpRunID]; ok {
+		return true
+	}
+	for k := range wf.Labels {
+		if strings.HasPrefix(k, kfpPrefix) {
+			return true
+		}
+	}
+	for k := range wf.Annotations {
+		if strings.HasPrefix(k, kfpPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// specName is the name field of a JSON spec annotation
+func specName(annotation string) string {
+	var spec struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal([]byte(annotation), &spec)
+	return spec.Name
+}
+
+// kubeflowInfo is the Kubeflow Pipelines run of a workflow, nil for the other workflows
+// The names only known to the KFP API are looked up when sources.argo.kubeflow.url is set
+func kubeflowInfo(ctx context.Context, cfg config.Kubeflow, wf wfv1.Workflow) *farmv1.KubeflowRun {
+	if !isKubeflow(wf) {
+		return nil
+	}
+	kf := &farmv1.KubeflowRun{
+		Pipeline:     specName(wf.Annotations[kfpPipelineSpec]),
+		RunId:        wf.Labels[kfpRunID],
+		RunName:      wf.Annotations[kfpRunName],
+		RecurringRun: wf.Labels[kfpRecurringRun],
+		SdkVersion:   wf.Annotations[kfpSDKVersion],
+	}
+	for _, node := range wf.Status.Nodes {
+		if c := componentName(wf, node); c != "" && !slices.Contains(kf.Components, c) {
+			kf.Components = append(kf.Components, c)
+		}
+	}
+	slices.Sort(kf.Components)
+	if cfg.URL != "" && kf.RunId != "" {
+		if err := kubeflowLookup(ctx, cfg, kf); err != nil {
+			slog.Error("Argo: Error getting the Kubeflow run", "error", err, "runId", kf.RunId)
+		}
+	}
+	return kf
+}
+
+// componentName is the Kubeflow Pipelines component a node runs, empty for the DAG and system nodes
+func componentName(wf wfv1.Workflow, node wfv1.NodeStatus) string {
+	if node.Type != wfv1.NodeTypePod && !strings.HasSuffix(node.DisplayName, "-driver") {
+		return ""
+	}
+	if t := wf.GetTemplateByName(node.TemplateName); t != nil {
+		if n := specName(t.Metadata.Annotations[kfpComponent]); n != "" {
+			return n
+		}
+	}
+	// KFP v2 drivers get the task spec as a parameter
+	if node.Inputs != nil {
+		if p := node.Inputs.GetParameterByName("task"); p != nil && p.Value != nil {
+			var task struct {
+				TaskInfo struct {
+					Name string `json:"name"`
+				} `json:"taskInfo"`
+			}
+			if json.Unmarshal([]byte(p.Value.String()), &task) == nil && task.TaskInfo.Name != "" {
+				return task.TaskInfo.Name
+			}
+		}
+	}
+	if name, ok := strings.CutSuffix(node.DisplayName, "-driver"); ok && name != "root" {
+		return name
+	}
+	return ""
+}
+
+// workflowName is the pipeline name of Kubeflow Pipelines workflows, else the normalized name
+func workflowName(wf wfv1.Workflow, kf *farmv1.KubeflowRun) string {
+	if kf != nil && kf.Pipeline != "" {
+		return kf.Pipeline
+	}
+	return normalizeName(wf)
+}
+
+// Display names of runs, experiments and pipelines by ID, they rarely change
+var kubeflowNames = ttlcache.New[string, string](ttlcache.WithTTL[string, string](time.Hour))
+
+// Runs by ID, the filter needs the pipeline name so excluded workflows are looked up too, once an hour instead of every poll
+var kubeflowRuns = ttlcache.New[string, kubeflowRun](ttlcache.WithTTL[string, kubeflowRun](time.Hour))
+
+// kubeflowRun is a run of the KFP v2beta1 API
+type kubeflowRun struct {
+	DisplayName              string `json:"display_name"`
+	ExperimentID             string `json:"experiment_id"`
+	PipelineVersionReference struct {
+		PipelineID string `json:"pipeline_id"`
+	} `json:"pipeline_version_reference"`
+}
+
+// kubeflowLookup fills the run, experiment and pipeline names from the KFP v2beta1 API
+func kubeflowLookup(ctx context.Context, cfg config.Kubeflow, kf *farmv1.KubeflowRun) error {
+	path := "/apis/v2beta1/runs/" + kf.RunId
+	var run kubeflowRun
+	if item := kubeflowRuns.Get(cfg.URL + path); item != nil {
+		run = item.Value()
+	} else {
+		if err := kubeflowGet(ctx, cfg, path, &run); err != nil {
+			return err
+		}
+		kubeflowRuns.Set(cfg.URL+path, run, 0)
+	}
+	if run.DisplayName != "" {
+		kf.RunName = run.DisplayName
+	}
+	var err error
+	if id := run.ExperimentID; id != "" {
+		kf.Experiment, err = kubeflowName(ctx, cfg, "/apis/v2beta1/experiments/"+id)
+		if err != nil {
+			return err
+		}
+	}
+	if id := run.PipelineVersionReference.PipelineID; id != "" {
+		pipeline, err := kubeflowName(ctx, cfg, "/apis/v2beta1/pipelines/"+id)
+		if err != nil {
+			return err
+		}
+		if pipeline != "" {
+			kf.Pipeline = pipeline
+		}
+	}
+	return nil
+}
+
+// kubeflowName is the display name of an experiment or pipeline, cached
+func kubeflowName(ctx context.Context, cfg config.Kubeflow, path string) (string, error) {
+	key := cfg.URL + path
+	if item := kubeflowNames.Get(key); item != nil {
+		return item.Value(), nil
+	}
+	var v struct {
+		DisplayName string `json:"display_name"`
+	}
+	if err := kubeflowGet(ctx, cfg, path, &v); err != nil {
+		return "", err
+	}
+	kubeflowNames.Set(key, v.DisplayName, 0)
+	return v.DisplayName, nil
+}
+
+var kubeflowClient = &http.Client{Timeout: 30 * time.Second}
+
+// kubeflowGet decodes the JSON response of the KFP API into v
+func kubeflowGet(ctx context.Context, cfg config.Kubeflow, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	resp, err := kubeflowClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,121 @@
+package argo
+
+import (
+	"context"
+	"encoding/json"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// kfpV2Workflow is a workflow submitted by Kubeflow Pipelines v2, with drivers and executors
+func kfpV2Workflow(t *testing.T) wfv1.Workflow {
+	t.Helper()
+	b, err := os.ReadFile("testdata/kfp_v2_workflow.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wf wfv1.Workflow
+	if err := json.Unmarshal(b, &wf); err != nil {
+		t.Fatal(err)
+	}
+	return wf
+}
+
+func TestComponentName(t *testing.T) {
+	wf := kfpV2Workflow(t)
+	tests := map[string]string{
+		"daily-training-x7k2p":      "",            //The workflow DAG
+		"daily-training-x7k2p-1001": "",            //Driver of the root DAG
+		"daily-training-x7k2p-1002": "",            //The root DAG
+		"daily-training-x7k2p-1003": "preprocess",  //Driver with the task spec
+		"daily-training-x7k2p-1004": "",            //Executor
+		"daily-training-x7k2p-1005": "train-model", //The task name wins over the display name
+		"daily-training-x7k2p-1007": "evaluate",    //Driver without the task spec
+	}
+	for id, want := range tests {
+		t.Run(wf.Status.Nodes[id].DisplayName, func(t *testing.T) {
+			if got := componentName(wf, wf.Status.Nodes[id]); got != want {
+				t.Errorf("componentName() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// fakeKubeflow is the KFP v2beta1 API, counting the requests by path
+type fakeKubeflow struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (f *fakeKubeflow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.URL.Path]++
+	f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/apis/v2beta1/runs/"):
+		_, _ = w.Write([]byte(`{"display_name":"daily-training manual","experiment_id":"e1","pipeline_version_reference":{"pipeline_id":"p1","pipeline_version_id":"v1"}}`))
+	case r.URL.Path == "/apis/v2beta1/experiments/e1":
+		_, _ = w.Write([]byte(`{"display_name":"forecasting"}`))
+	case r.URL.Path == "/apis/v2beta1/pipelines/p1":
+		_, _ = w.Write([]byte(`{"display_name":"demand-forecast"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestKubeflowInfo(t *testing.T) {
+	wf := kfpV2Workflow(t)
+	kf := kubeflowInfo(context.Background(), config.Kubeflow{}, wf)
+	if kf == nil {
+		t.Fatal("kubeflowInfo() = nil for a KFP workflow")
+	}
+	if kf.RunId != "0b8f0d1e-2c3a-4b5c-8d6e-7f8a9b0c1d2e" || kf.RunName != "daily-training 2026-10-19" || kf.RecurringRun != "daily-training-schedule" || kf.SdkVersion != "2.7.0" {
+		t.Errorf("kubeflowInfo() = %+v", kf)
+	}
+	if got := strings.Join(kf.Components, ","); got != "evaluate,preprocess,train-model" {
+		t.Errorf("components = %s", got)
+	}
+	// KFP v2 has no pipeline spec annotation, without the API the workflow keeps its normalized name
+	if name := workflowName(wf, kf); name != "daily-training" {
+		t.Errorf("workflowName() = %s, want daily-training", name)
+	}
+
+	f := &fakeKubeflow{requests: map[string]int{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	kubeflowRuns.DeleteAll()
+	kubeflowNames.DeleteAll()
+	cfg := config.Kubeflow{URL: srv.URL + "/", Token: "token"}
+	for range 2 {
+		kf = kubeflowInfo(context.Background(), cfg, wf)
+		if kf.RunName != "daily-training manual" || kf.Experiment != "forecasting" || kf.Pipeline != "demand-forecast" {
+			t.Errorf("kubeflowInfo() = %+v", kf)
+		}
+	}
+	if name := workflowName(wf, kf); name != "demand-forecast" {
+		t.Errorf("workflowName() = %s, want demand-forecast", name)
+	}
+	// Every poll sees the workflow, excluded or not, the API is asked once
+	for path, n := range f.requests {
+		if n != 1 {
+			t.Errorf("GET %s %d times, want once", path, n)
+		}
+	}
+	if len(f.requests) != 3 {
+		t.Errorf("requests = %v", f.requests)
+	}
+
+	if kubeflowInfo(context.Background(), cfg, wfv1.Workflow{}) != nil {
+		t.Error("kubeflowInfo() of a plain workflow is not nil")
+	}
+}
@@ -0,0 +1,99 @@
+package argo
+
+import (
+	"context"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/failure"
+	"github.com/estecker/farm/internal/objectstore"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"strings"
+)
+
+// Most failed steps of a workflow to get the log of
+const maxFailureLogs = 20
+
+// The artifact with the log of the main container, when Argo archives the logs
+const mainLogs = "main-logs"
+
+// stepFailures of the failed steps of a workflow with the end of their log, nil unless failure_logs.enabled
+func stepFailures(ctx context.Context, cfg *config.Config, cli kubernetes.Interface, logs *objectstore.Tailer, wf wfv1.Workflow, kf *farmv1.KubeflowRun, d details) []*farmv1.StepFailure {
+	if !cfg.FailureLogs.Enabled {
+		return nil
+	}
+	var failures []*farmv1.StepFailure
+	for _, n := range d.nodes {
+		node := wf.Status.Nodes[n.Id]
+		if !node.FailedOrError() {
+			continue
+		}
+		if len(failures) == maxFailureLogs {
+			slog.Warn("Argo: Too many failed steps, skipping the logs of the others", "name", wf.Name, "max", maxFailureLogs)
+			break
+		}
+		f := &farmv1.StepFailure{
+			Source:     "argo",
+			Workflow:   workflowName(wf, kf),
+			RunId:      string(wf.UID),
+			Url:        d.url,
+			Step:       n.Name,
+			StepId:     n.Id,
+			State:      n.Phase,
+			StartedAt:  n.StartedAt,
+			FinishedAt: n.FinishedAt,
+			Message:    n.Message,
+		}
+		log, logSource, cut, err := nodeLog(ctx, cfg.FailureLogs, cli, logs, wf.Namespace, node, d.pod(n.Id))
+		if err != nil {
+			slog.Warn("Argo: Error getting the log", "error", err, "name", wf.Name, "node", n.Id)
+		}
+		if logSource != "" {
+			f.Log, f.Truncated = failure.Excerpt(cfg.FailureLogs, log, cut)
+			f.LogSource = logSource
+		}
+		failures = append(failures, f)
+	}
+	return failures
+}
+
+// nodeLog is the end of the log of the main container of a node, where it came from and if its start was cut, empty when there is none
+// The pod has it until the pod GC deletes it, the main-logs artifact after that when the workflow archives its logs
+func nodeLog(ctx context.Context, cfg config.FailureLogs, cli kubernetes.Interface, logs *objectstore.Tailer, namespace string, node wfv1.NodeStatus, pod *corev1.Pod) (string, string, bool, error) {
+	var podErr error
+	if cli != nil && pod != nil {
+		lines := int64(cfg.TailLines + 1) //One more, the excerpt drops the first line of a cut log
+		b, err := cli.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: mainContainer, TailLines: &lines}).DoRaw(ctx)
+		if err == nil {
+			return string(b), failure.Pod, int64(strings.Count(string(b), "\n")) >= lines, nil
+		}
+		podErr = err
+	}
+	if node.Outputs == nil {
+		return "", "", false, podErr
+	}
+	for _, a := range node.Outputs.Artifacts {
+		if a.Name != mainLogs {
+			continue
+		}
+		var u string
+		switch {
+		case a.GCS != nil && a.GCS.Bucket != "":
+			u = "gs://" + a.GCS.Bucket + "/" + a.GCS.Key
+		case a.S3 != nil && a.S3.Bucket != "":
+			u = "s3://" + a.S3.Bucket + "/" + a.S3.Key
+		default:
+			return "", "", false, podErr //Another repository, or the default one without its bucket in the status
+		}
+		// More than max_bytes so the redaction sees whole secrets, the excerpt drops the first line, likely cut
+		n := 4 * int64(cfg.MaxBytes)
+		b, err := logs.Tail(ctx, u, n)
+		if err != nil {
+			return "", "", false, err
+		}
+		return string(b), failure.Artifact, int64(len(b)) >= n, nil
+	}
+	return "", "", false, podErr
+}
@@ -0,0 +1,237 @@
+package argo
+
+import (
+	"cmp"
+	"context"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/jellydator/ttlcache/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// argoNodes are the pod nodes of a workflow with their pod, host and usage, in the order they started
+// The workflow usage is the one of Argo, its cost the sum of the nodes as they can run in different node pools
+func argoNodes(ctx context.Context, cli kubernetes.Interface, cost config.Cost, wf wfv1.Workflow, kf *farmv1.KubeflowRun, pods map[string]corev1.Pod) ([]*farmv1.ArgoNode, *farmv1.ResourceUsage) {
+	var nodes []*farmv1.ArgoNode
+	var total float64
+	for id, node := range wf.Status.Nodes {
+		if node.Type != wfv1.NodeTypePod {
+			continue
+		}
+		n := &farmv1.ArgoNode{
+			Id:       id,
+			Name:     stepName(wf, node, kf),
+			Phase:    string(node.Phase),
+			HostNode: node.HostNodeName,
+			Message:  node.Message,
+		}
+		// otherwise will send the zero value date, which is not null
+		if !node.StartedAt.IsZero() {
+			n.StartedAt = node.StartedAt.UnixMicro()
+		}
+		if !node.FinishedAt.IsZero() {
+			n.FinishedAt = node.FinishedAt.UnixMicro()
+		}
+		if node.Outputs != nil && node.Outputs.ExitCode != nil {
+			n.ExitCode = *node.Outputs.ExitCode
+		}
+		var pod *corev1.Pod
+		if p, ok := pods[id]; ok {
+			pod = &p
+			n.Pod = argoPod(p)
+			if n.HostNode == "" {
+				n.HostNode = p.Spec.NodeName
+			}
+		}
+		if node.FailedOrError() {
+			n.InfrastructureFailure = infrastructureFailure(node, pod)
+		}
+		h := lookupHost(ctx, cli, cost.NodePoolLabel, n.HostNode)
+		n.NodePool, n.InstanceType = h.pool, h.instanceType
+		n.Usage = usage(node.ResourcesDuration, cost.Prices(n.NodePool))
+		if n.Usage != nil {
+			total += n.Usage.Cost
+		}
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b *farmv1.ArgoNode) int {
+		return cmp.Or(cmp.Compare(a.StartedAt, b.StartedAt), cmp.Compare(a.Id, b.Id))
+	})
+	u := usage(wf.Status.ResourcesDuration, config.Prices{})
+	if u != nil {
+		u.Cost = total
+	}
+	return nodes, u
+}
+
+// argoPod has the containers of a pod with their resources and last termination
+func argoPod(pod corev1.Pod) *farmv1.ArgoPod {
+	p := &farmv1.ArgoPod{Name: pod.Name, Reason: pod.Status.Reason, Message: pod.Status.Message}
+	statuses := map[string]corev1.ContainerStatus{}
+	for _, cs := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+		statuses[cs.Name] = cs
+	}
+	add := func(c corev1.Container, init bool) {
+		ac := &farmv1.ArgoContainer{
+			Name:     c.Name,
+			Image:    c.Image,
+			Init:     init,
+			Requests: quantities(c.Resources.Requests),
+			Limits:   quantities(c.Resources.Limits),
+		}
+		if cs, ok := statuses[c.Name]; ok {
+			ac.Restarts = cs.RestartCount
+			if t := terminated(cs); t != nil {
+				ac.ExitCode = t.ExitCode
+				ac.Reason = t.Reason
+			}
+		}
+		p.Containers = append(p.Containers, ac)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		add(c, true)
+	}
+	for _, c := range pod.Spec.Containers {
+		add(c, false)
+	}
+	return p
+}
+
+// terminated is the last termination of a container, nil if it never terminated
+func terminated(cs corev1.ContainerStatus) *corev1.ContainerStateTerminated {
+	if cs.State.Terminated != nil {
+		return cs.State.Terminated
+	}
+	return cs.LastTerminationState.Terminated
+}
+
+// quantities of a resource list by resource name, e.g. cpu: 500m
+func quantities(rl corev1.ResourceList) map[string]string {
+	if len(rl) == 0 {
+		return nil
+	}
+	m := map[string]string{}
+	for name, q := range rl {
+		m[string(name)] = q.String()
+	}
+	return m
+}
+
+// infrastructureFailure is why the cluster killed the pod of a failed node, empty when it failed on its own
+// Without the pod only the node message is left, where Argo copies the reason
+func infrastructureFailure(node wfv1.NodeStatus, pod *corev1.Pod) string {
+	if pod == nil {
+		message := strings.ToLower(node.Message)
+		for _, reason := range []string{"OOMKilled", "Evicted", "Preempted"} {
+			if strings.Contains(message, strings.ToLower(reason)) {
+				return reason
+			}
+		}
+		if strings.Contains(message, "node shutdown") {
+			return "Shutdown"
+		}
+		return ""
+	}
+	// e.g. PreemptionByScheduler, DeletionByTaintManager, EvictionByEvictionAPI or TerminationByKubelet
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.DisruptionTarget && c.Status == corev1.ConditionTrue {
+			return c.Reason
+		}
+	}
+	// Only the kubelet sets the reason of a pod, e.g. Evicted, Shutdown or OutOfmemory
+	if pod.Status.Reason != "" {
+		return pod.Status.Reason
+	}
+	for _, cs := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+		if t := terminated(cs); t != nil && t.Reason == "OOMKilled" {
+			return t.Reason
+		}
+	}
+	return ""
+}
+
+// podTags for the span of a pod node
+// The requests and limits are the ones of the main container, the restarts are summed over the containers
+func podTags(n *farmv1.ArgoNode) map[string]string {
+	tags := map[string]string{}
+	if n.HostNode != "" {
+		tags["host_node"] = n.HostNode
+	}
+	if n.NodePool != "" {
+		tags["node_pool"] = n.NodePool
+	}
+	if n.InstanceType != "" {
+		tags["instance_type"] = n.InstanceType
+	}
+	if n.ExitCode != "" {
+		tags["exit_code"] = n.ExitCode
+	}
+	if n.InfrastructureFailure != "" {
+		tags["infrastructure_failure"] = n.InfrastructureFailure
+	}
+	if n.Pod == nil {
+		return tags
+	}
+	tags["pod"] = n.Pod.Name
+	if n.Pod.Reason != "" {
+		tags["pod.reason"] = n.Pod.Reason
+	}
+	var restarts int32
+	for _, c := range n.Pod.Containers {
+		restarts += c.Restarts
+		if c.Name != mainContainer {
+			continue
+		}
+		tags["image"] = c.Image
+		for name, q := range c.Requests {
+			tags["requests."+name] = q
+		}
+		for name, q := range c.Limits {
+			tags["limits."+name] = q
+		}
+		if c.Reason != "" {
+			tags["container.reason"] = c.Reason
+		}
+	}
+	tags["restarts"] = strconv.Itoa(int(restarts))
+	return tags
+}
+
+// host is the Kubernetes node of a pod
+type host struct {
+	pool         string
+	instanceType string
+}
+
+// Kubernetes nodes by pool label and name, the labels of a node do not change and nodes come and go
+var hosts = ttlcache.New[string, host](ttlcache.WithTTL[string, host](time.Hour))
+
+// lookupHost of a pod, the zero host when unknown and the default prices apply
+func lookupHost(ctx context.Context, cli kubernetes.Interface, poolLabel, name string) host {
+	if cli == nil || name == "" {
+		return host{}
+	}
+	key := poolLabel + "/" + name
+	if item := hosts.Get(key); item != nil {
+		return item.Value()
+	}
+	var h host
+	node, err := cli.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		h = host{pool: node.Labels[poolLabel], instanceType: node.Labels[corev1.LabelInstanceTypeStable]}
+	case !apierrors.IsNotFound(err): //Not found when it was scaled down since
+		slog.Warn("Argo: Error getting the node", "error", err, "node", name)
+	}
+	hosts.Set(key, h, 0) //Errors too, a missing RBAC warns once an hour per node
+	return h
+}
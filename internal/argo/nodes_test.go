@@ -0,0 +1,258 @@
+package argo
+
+import (
+	"context"
+	"errors"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/event/farmv1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"maps"
+	"testing"
+)
+
+// fakeClient gets Kubernetes nodes by name, a missing node is not found, lists the events of a pod and the ingresses
+// The other methods of kubernetes.Interface are not implemented
+type fakeClient struct {
+	kubernetes.Interface
+	nodes        map[string]corev1.Node
+	nodesErr     error
+	gets         int
+	events       map[string][]corev1.Event //By pod name
+	eventsErr    error
+	selectors    []string
+	ingresses    []networkingv1.Ingress
+	ingressesErr error
+}
+
+type fakeCore struct {
+	typedcorev1.CoreV1Interface
+	f *fakeClient
+}
+
+type fakeNodes struct {
+	typedcorev1.NodeInterface
+	f *fakeClient
+}
+
+func (f *fakeClient) CoreV1() typedcorev1.CoreV1Interface {
+	return fakeCore{f: f}
+}
+
+func (c fakeCore) Nodes() typedcorev1.NodeInterface {
+	return fakeNodes{f: c.f}
+}
+
+func (n fakeNodes) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Node, error) {
+	n.f.gets++
+	if n.f.nodesErr != nil {
+		return nil, n.f.nodesErr
+	}
+	node, ok := n.f.nodes[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(corev1.Resource("nodes"), name)
+	}
+	return &node, nil
+}
+
+// oomKilled is a container status that was OOM killed
+func oomKilled(name string) corev1.ContainerStatus {
+	return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}}}
+}
+
+func TestInfrastructureFailure(t *testing.T) {
+	disrupted := corev1.PodCondition{Type: corev1.DisruptionTarget, Status: corev1.ConditionTrue, Reason: "PreemptionByScheduler"}
+	tests := []struct {
+		name    string
+		message string
+		pod     *corev1.Pod
+		want    string
+	}{
+		{"disruption target", "", &corev1.Pod{Status: corev1.PodStatus{
+			Conditions:        []corev1.PodCondition{disrupted},
+			Reason:            "Evicted",
+			ContainerStatuses: []corev1.ContainerStatus{oomKilled("main")},
+		}}, "PreemptionByScheduler"},
+		{"disruption target not true", "", &corev1.Pod{Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.DisruptionTarget, Status: corev1.ConditionFalse, Reason: "PreemptionByScheduler"}},
+		}}, ""},
+		{"pod reason", "", &corev1.Pod{Status: corev1.PodStatus{
+			Reason:            "Evicted",
+			ContainerStatuses: []corev1.ContainerStatus{oomKilled("main")},
+		}}, "Evicted"},
+		{"OOM killed init container", "", &corev1.Pod{Status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{oomKilled("init")}}}, "OOMKilled"},
+		// Restarted after it was OOM killed
+		{"OOM killed last termination", "", &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:                 "main",
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}},
+		}}}}, "OOMKilled"},
+		{"failed on its own", "Error (exit code 1)", &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "main",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+		}}}}, ""},
+		// The pod is gone, the reason is the one in the message
+		{"message OOM killed", "OOMKilled (exit code 137)", nil, "OOMKilled"},
+		{"message evicted", "Pod was evicted: The node was low on resource: memory", nil, "Evicted"},
+		{"message preempted", "Pod was preempted", nil, "Preempted"},
+		{"message node shutdown", "Pod was terminated in response to imminent node shutdown.", nil, "Shutdown"},
+		{"message error", "Error (exit code 1)", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := wfv1.NodeStatus{Type: wfv1.NodeTypePod, Phase: wfv1.NodeFailed, Message: tt.message}
+			if got := infrastructureFailure(node, tt.pod); got != tt.want {
+				t.Errorf("infrastructureFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgoPod(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "etl-load-123"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "argoexec:v3.5"}},
+			Containers: []corev1.Container{
+				{Name: "wait", Image: "argoexec:v3.5"},
+				{Name: "main", Image: "etl:1.2", Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourceMemory: resource.MustParse("1Gi")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+				}},
+			},
+		},
+		Status: corev1.PodStatus{
+			Reason:                "Evicted",
+			Message:               "The node was low on resource: memory",
+			InitContainerStatuses: []corev1.ContainerStatus{{Name: "init", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}}},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "wait"}, //Still running
+				{Name: "main", RestartCount: 2, LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}}},
+			},
+		},
+	}
+	p := argoPod(pod)
+	if p.Name != "etl-load-123" || p.Reason != "Evicted" || p.Message != "The node was low on resource: memory" {
+		t.Errorf("argoPod() = %v", p)
+	}
+	if len(p.Containers) != 3 {
+		t.Fatalf("argoPod() has %d containers, want 3", len(p.Containers))
+	}
+	initc, wait, main := p.Containers[0], p.Containers[1], p.Containers[2]
+	if initc.Name != "init" || !initc.Init || initc.Reason != "Completed" || initc.Requests != nil {
+		t.Errorf("init container = %v", initc)
+	}
+	if wait.Name != "wait" || wait.Init || wait.Reason != "" || wait.ExitCode != 0 {
+		t.Errorf("wait container = %v", wait)
+	}
+	if main.Image != "etl:1.2" || main.Restarts != 2 || main.ExitCode != 137 || main.Reason != "OOMKilled" {
+		t.Errorf("main container = %v", main)
+	}
+	if want := map[string]string{"cpu": "500m", "memory": "1Gi"}; !maps.Equal(main.Requests, want) {
+		t.Errorf("main requests = %v, want %v", main.Requests, want)
+	}
+	if want := map[string]string{"memory": "2Gi"}; !maps.Equal(main.Limits, want) {
+		t.Errorf("main limits = %v, want %v", main.Limits, want)
+	}
+}
+
+func TestPodTags(t *testing.T) {
+	tests := []struct {
+		name string
+		node *farmv1.ArgoNode
+		want map[string]string
+	}{
+		{"no pod", &farmv1.ArgoNode{HostNode: "ip-10-0-0-1", ExitCode: "1"}, map[string]string{"host_node": "ip-10-0-0-1", "exit_code": "1"}},
+		{"pod", &farmv1.ArgoNode{
+			HostNode:              "ip-10-0-0-1",
+			NodePool:              "batch",
+			InstanceType:          "m5.xlarge",
+			InfrastructureFailure: "Evicted",
+			Pod: &farmv1.ArgoPod{Name: "etl-load-123", Reason: "Evicted", Containers: []*farmv1.ArgoContainer{
+				{Name: "init", Init: true, Image: "argoexec:v3.5", Restarts: 1, Requests: map[string]string{"cpu": "10m"}},
+				{Name: "main", Image: "etl:1.2", Restarts: 2, Reason: "OOMKilled", Requests: map[string]string{"cpu": "500m"}, Limits: map[string]string{"memory": "2Gi"}},
+			}},
+		}, map[string]string{
+			"host_node":              "ip-10-0-0-1",
+			"node_pool":              "batch",
+			"instance_type":          "m5.xlarge",
+			"infrastructure_failure": "Evicted",
+			"pod":                    "etl-load-123",
+			"pod.reason":             "Evicted",
+			"image":                  "etl:1.2",
+			"requests.cpu":           "500m",
+			"limits.memory":          "2Gi",
+			"container.reason":       "OOMKilled",
+			"restarts":               "3",
+		}},
+		{"pod without main container", &farmv1.ArgoNode{Pod: &farmv1.ArgoPod{Name: "etl-load-123"}}, map[string]string{"pod": "etl-load-123", "restarts": "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podTags(tt.node); !maps.Equal(got, tt.want) {
+				t.Errorf("podTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupHost(t *testing.T) {
+	const poolLabel = "karpenter.sh/nodepool"
+	f := &fakeClient{nodes: map[string]corev1.Node{
+		"ip-10-0-0-1": {ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-1", Labels: map[string]string{poolLabel: "batch", corev1.LabelInstanceTypeStable: "m5.xlarge"}}},
+		"ip-10-0-0-2": {ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-2"}},
+	}}
+	hosts.DeleteAll()
+	t.Cleanup(hosts.DeleteAll)
+	tests := []struct {
+		name string
+		want host
+	}{
+		{"ip-10-0-0-1", host{pool: "batch", instanceType: "m5.xlarge"}},
+		{"ip-10-0-0-2", host{}}, //Not labeled
+		{"ip-10-0-0-3", host{}}, //Scaled down since
+		{"", host{}},
+	}
+	for _, tt := range tests {
+		if got := lookupHost(context.Background(), f, poolLabel, tt.name); got != tt.want {
+			t.Errorf("lookupHost(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if f.gets != 3 {
+		t.Errorf("%d nodes got, want 3", f.gets)
+	}
+
+	// Cached, also when the node was not found
+	f.nodes["ip-10-0-0-3"] = f.nodes["ip-10-0-0-1"]
+	for _, tt := range tests {
+		if got := lookupHost(context.Background(), f, poolLabel, tt.name); got != tt.want {
+			t.Errorf("lookupHost(%q) cached = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if f.gets != 3 {
+		t.Errorf("%d nodes got once cached, want 3", f.gets)
+	}
+	// By pool label
+	if got := lookupHost(context.Background(), f, "pool", "ip-10-0-0-1"); got != (host{instanceType: "m5.xlarge"}) {
+		t.Errorf("lookupHost() by another pool label = %v", got)
+	}
+
+	// Errors are cached too, not to warn on every poll
+	hosts.DeleteAll()
+	f.gets, f.nodesErr = 0, errors.New("forbidden")
+	for range 2 {
+		if got := lookupHost(context.Background(), f, poolLabel, "ip-10-0-0-1"); got != (host{}) {
+			t.Errorf("lookupHost() on error = %v, want the zero host", got)
+		}
+	}
+	if f.gets != 1 {
+		t.Errorf("%d nodes got on error, want 1", f.gets)
+	}
+	if got := lookupHost(context.Background(), nil, poolLabel, "ip-10-0-0-1"); got != (host{}) {
+		t.Errorf("lookupHost() without a client = %v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package argo
+
+import (
+	"context"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/critical"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/kube"
+	"github.com/estecker/farm/internal/objectstore"
+	"github.com/estecker/farm/internal/phase"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Labels and annotations Argo puts on the pods of a workflow
+const (
+	podWorkflow     = "workflows.argoproj.io/workflow"
+	podNodeID       = "workflows.argoproj.io/node-id"
+	cronScheduledAt = "workflows.argoproj.io/scheduled-time" //On the workflows of a CronWorkflow
+)
+
+// The container running the template, the others are the Argo executor and sidecars
+const mainContainer = "main"
+
+// details of a completed workflow, gathered once for its event and its trace
+type details struct {
+	pods     map[string]corev1.Pod //By node ID, only the pods not deleted yet
+	path     critical.Path
+	delays   *farmv1.RunDelays
+	nodes    []*farmv1.ArgoNode
+	usage    *farmv1.ResourceUsage
+	reason   string //Of a failed workflow
+	failures []*farmv1.StepFailure
+	url      string //Of the workflow in the Argo UI, empty when unknown
+}
+
+// pod of a node, nil if it was deleted
+func (d details) pod(nodeID string) *corev1.Pod {
+	if pod, ok := d.pods[nodeID]; ok {
+		return &pod
+	}
+	return nil
+}
+
+// node of the event by node ID, nil for the nodes that are not pods
+func (d details) node(id string) *farmv1.ArgoNode {
+	if i := slices.IndexFunc(d.nodes, func(n *farmv1.ArgoNode) bool { return n.Id == id }); i >= 0 {
+		return d.nodes[i]
+	}
+	return nil
+}
+
+// stepFailure of a failed node, nil without failure_logs.enabled
+func (d details) stepFailure(nodeID string) *farmv1.StepFailure {
+	if i := slices.IndexFunc(d.failures, func(f *farmv1.StepFailure) bool { return f.StepId == nodeID }); i >= 0 {
+		return d.failures[i]
+	}
+	return nil
+}
+
+// gather the details of a completed workflow, cli is nil when the pods, nodes and events are not looked up
+// logs reads the archived logs of the failed steps, url is the one of the workflow from wfUrl
+func gather(ctx context.Context, cli kubernetes.Interface, logs *objectstore.Tailer, cfg *config.Config, wf wfv1.Workflow, kf *farmv1.KubeflowRun, url string) details {
+	d := details{pods: listPods(ctx, cli, wf), path: criticalPath(wf, kf), url: url}
+	d.nodes, d.usage = argoNodes(ctx, cli, cfg.Sources.Argo.Cost, wf, kf, d.pods)
+	if wf.Status.Phase == wfv1.WorkflowFailed || wf.Status.Phase == wfv1.WorkflowError {
+		podEvents(ctx, cli, wf, d)
+		d.reason = failureReason(wf, d.nodes)
+		d.failures = stepFailures(ctx, cfg, cli, logs, wf, kf, d)
+	}
+	var steps []phase.Step
+	for id, node := range wf.Status.Nodes {
+		if node.Type == wfv1.NodeTypePod {
+			steps = append(steps, nodePhases(node, d.pod(id)))
+		}
+	}
+	due := wf.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, wf.Annotations[cronScheduledAt]); err == nil {
+		due = t
+	}
+	d.delays = phase.Delays(due, wf.Status.StartedAt.Time, steps)
+	return d
+}
+
+// newKubeClient for the pods of the workflows, nil when there is no cluster to talk to
+func newKubeClient() kubernetes.Interface {
+	restConfig, err := kube.Config()
+	if err == nil {
+		var cli *kubernetes.Clientset
+		if cli, err = kubernetes.NewForConfig(restConfig); err == nil {
+			return cli
+		}
+	}
+	slog.Warn("Argo: No Kubernetes client, the steps are traced without their pods", "error", err)
+	return nil
+}
+
+// listPods of a workflow by node ID, pods deleted by the pod GC are missing
+func listPods(ctx context.Context, cli kubernetes.Interface, wf wfv1.Workflow) map[string]corev1.Pod {
+	if cli == nil {
+		return nil
+	}
+	pods, err := cli.CoreV1().Pods(wf.Namespace).List(ctx, metav1.ListOptions{LabelSelector: podWorkflow + "=" + wf.Name})
+	if err != nil {
+		slog.Error("Argo: Error listing pods", "error", err, "name", wf.Name)
+		return nil
+	}
+	byNode := map[string]corev1.Pod{}
+	for _, pod := range pods.Items {
+		if id := pod.Annotations[podNodeID]; id != "" {
+			byNode[id] = pod
+		}
+	}
+	return byNode
+}
+
+// nodePhases of a pod node, the node is ready when its pod is created
+// Scheduled until the pod is bound to a node, queued until the main container starts
+func nodePhases(node wfv1.NodeStatus, pod *corev1.Pod) phase.Step {
+	s := phase.Step{Ready: node.StartedAt.Time, Finished: node.FinishedAt.Time}
+	if pod == nil {
+		s.Started = s.Ready //Unknown without the pod, the pending time counts as running
+		return s
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionTrue {
+			s.Queued = c.LastTransitionTime.Time
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != mainContainer {
+			continue
+		}
+		// The first run of the container, a restarted one only has its latest start
+		if t := cs.LastTerminationState.Terminated; t != nil {
+			s.Started = t.StartedAt.Time
+		} else if t := cs.State.Terminated; t != nil {
+			s.Started = t.StartedAt.Time
+		} else if r := cs.State.Running; r != nil {
+			s.Started = r.StartedAt.Time
+		}
+	}
+	return s
+}
@@ -2,10 +2,14 @@ package argo
 
 import (
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/estecker/farm/internal/anomaly"
+	"github.com/estecker/farm/internal/critical"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/failure"
+	"github.com/estecker/farm/internal/phase"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"log/slog"
-	"os"
 )
 
 // statusToCode maps the status of a Workflow to an HTTP status code
@@ -20,18 +24,23 @@ func statusToCode(wf wfv1.Workflow) int {
 }
 
 // Create a DataDog trace for an Argo workflow
-func trace(wf wfv1.Workflow) {
+// Kubeflow Pipelines workflows are named after their pipeline and the node spans after their component
+// The pod spans get the critical_path, slack, usage, pod and log tags and a span per phase and Kubernetes Event from d, check flags the anomalous durations, nil to skip
+func trace(wf wfv1.Workflow, kf *farmv1.KubeflowRun, d details, tenant string, tags map[string]string, check *anomaly.Check) {
 	slog.Debug("trace",
 		"phase", wf.Status.Phase,
 		"name", wf.ObjectMeta.Name)
-	name := normalizeName(wf)
+	name := workflowName(wf, kf)
 	rootSpan := tracer.StartSpan("argo_workflow",
 		tracer.StartTime(wf.ObjectMeta.CreationTimestamp.Time),
 		tracer.ResourceName(name))
 	rootSpan.SetTag(ext.HTTPCode, statusToCode(wf))
 	rootSpan.SetTag(ext.HTTPMethod, "ARGO")
-	rootSpan.SetTag("tenant", os.Getenv("tenant"))
-	rootSpan.SetTag("url", wfUrl(wf))
+	rootSpan.SetTag("tenant", tenant)
+	rootSpan.SetTag("url", d.url)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
 
 	wfSpan := tracer.StartSpan(name,
 		tracer.ServiceName(name),
@@ -45,6 +54,25 @@ func trace(wf wfv1.Workflow) {
 	wfSpan.SetTag("phase", wf.Status.Phase)
 	wfSpan.SetTag("name", wf.ObjectMeta.Name)
 	wfSpan.SetTag("workflow", wf.ObjectMeta.UID)
+	if kf != nil {
+		wfSpan.SetTag("kubeflow.pipeline", kf.Pipeline)
+		wfSpan.SetTag("kubeflow.run_id", kf.RunId)
+		wfSpan.SetTag("kubeflow.run_name", kf.RunName)
+		wfSpan.SetTag("kubeflow.experiment", kf.Experiment)
+		wfSpan.SetTag("kubeflow.recurring_run", kf.RecurringRun)
+	}
+	for k, v := range phase.Tags(d.delays) {
+		wfSpan.SetTag(k, v)
+	}
+	for k, v := range usageTags(d.usage) {
+		wfSpan.SetTag(k, v)
+	}
+	if d.reason != "" {
+		wfSpan.SetTag("failure_reason", d.reason)
+	}
+	for k, v := range check.Run() {
+		wfSpan.SetTag(k, v)
+	}
 
 	for _, node := range wf.Status.Nodes {
 		nodeSpan := tracer.StartSpan(
@@ -61,6 +89,33 @@ func trace(wf wfv1.Workflow) {
 		nodeSpan.SetTag("started", node.StartedAt.Time)
 		nodeSpan.SetTag("finished", node.FinishedAt.Time)
 		nodeSpan.SetOperationName(string(node.Type))
+		if c := componentName(wf, node); kf != nil && c != "" {
+			nodeSpan.SetTag(ext.ResourceName, c)
+			nodeSpan.SetTag("kubeflow.component", c)
+		}
+		for k, v := range d.path.Tags(node.ID) {
+			nodeSpan.SetTag(k, v)
+		}
+		if node.Type == wfv1.NodeTypePod {
+			nodePhases(node, d.pod(node.ID)).Trace(nodeSpan.Context(), stepName(wf, node, kf))
+		}
+		if n := d.node(node.ID); n != nil {
+			for k, v := range podTags(n) {
+				nodeSpan.SetTag(k, v)
+			}
+			for k, v := range usageTags(n.Usage) {
+				nodeSpan.SetTag(k, v)
+			}
+			traceEvents(n.Events, nodeSpan.Context())
+			for k, v := range failure.Tags(d.stepFailure(node.ID)) {
+				nodeSpan.SetTag(k, v)
+			}
+		}
+		if node.Type == wfv1.NodeTypePod && node.Phase == wfv1.NodeSucceeded {
+			for k, v := range check.Step(stepName(wf, node, kf), node.StartedAt.Time, node.FinishedAt.Time) {
+				nodeSpan.SetTag(k, v)
+			}
+		}
 		fo := []tracer.FinishOption{tracer.FinishTime(node.FinishedAt.Time), tracer.WithError(nil)}
 		nodeSpan.Finish(fo...)
 	}
@@ -68,3 +123,34 @@ func trace(wf wfv1.Workflow) {
 	wfSpan.Finish(finishOptions...)
 	rootSpan.Finish(finishOptions...)
 }
+
+// stepName identifies a pod across the runs of a workflow, pod names change every run
+func stepName(wf wfv1.Workflow, node wfv1.NodeStatus, kf *farmv1.KubeflowRun) string {
+	if c := componentName(wf, node); kf != nil && c != "" {
+		return c
+	}
+	if node.TemplateName != "" {
+		return node.TemplateName
+	}
+	return node.DisplayName
+}
+
+// criticalPath of a completed workflow over its pods
+// Argo links the outbound nodes of a task to the tasks depending on it with Children, the DAG, steps and retry nodes in between pass the dependencies on
+func criticalPath(wf wfv1.Workflow, kf *farmv1.KubeflowRun) critical.Path {
+	parents := map[string][]string{}
+	for id, node := range wf.Status.Nodes {
+		for _, child := range node.Children {
+			parents[child] = append(parents[child], id)
+		}
+	}
+	var steps []critical.Step
+	for id, node := range wf.Status.Nodes {
+		step := critical.Step{ID: id, Name: stepName(wf, node, kf), Upstream: parents[id]}
+		if node.Type == wfv1.NodeTypePod {
+			step.Start, step.End = node.StartedAt.Time, node.FinishedAt.Time
+		}
+		steps = append(steps, step)
+	}
+	return critical.Compute(steps, wf.Status.StartedAt.Time, wf.Status.FinishedAt.Time)
+}
@@ -0,0 +1,56 @@
+package backfill
+
+import (
+	"context"
+	"github.com/estecker/farm/internal/source"
+	"github.com/estecker/farm/internal/state"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"time"
+)
+
+// Options shared by the Backfill of every source
+type Options struct {
+	Since   time.Time
+	Until   time.Time
+	Trace   bool          //Also send a trace for every completed run
+	Limiter *rate.Limiter //Every API call waits on this
+	Store   *state.Store  //Checkpoints so an interrupted backfill can resume
+	Emitter *source.Emitter
+}
+
+// Checkpoint is how far a backfill got for one key
+type Checkpoint struct {
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Continue string    `json:"continue,omitempty"` //Opaque page token of the next page to fetch
+	Done     bool      `json:"done,omitempty"`
+}
+
+// Load returns the checkpoint for key, a checkpoint of a different time range starts over
+func (o Options) Load(key string) Checkpoint {
+	c := Checkpoint{Since: o.Since, Until: o.Until}
+	var saved Checkpoint
+	ok, err := o.Store.Get(key, &saved)
+	if err != nil {
+		slog.Error("Backfill: ignoring unreadable checkpoint", "key", key, "error", err)
+		return c
+	}
+	if ok && saved.Since.Equal(o.Since) && saved.Until.Equal(o.Until) {
+		return saved
+	}
+	return c
+}
+
+// Save persists the checkpoint for key
+func (o Options) Save(key string, c Checkpoint) error {
+	return o.Store.Put(key, c)
+}
+
+// Wait blocks until the rate limiter allows another API call
+func (o Options) Wait(ctx context.Context) error {
+	if o.Limiter == nil {
+		return nil
+	}
+	return o.Limiter.Wait(ctx)
+}
@@ -0,0 +1,297 @@
+package bigquery
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/schema"
+	"github.com/estecker/farm/internal/sink"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sink writes events straight to BigQuery tables with the Storage Write API, no Pub/Sub needed
+// Every source gets a committed stream and rows are appended at explicit offsets, so a retried append is written once
+type Sink struct {
+	ProjectID string
+	Dataset   string
+	Tables    map[string]string //Table per source, defaults to <source>_events
+	Location  string            //Of tables created by the sink, empty for the location of the dataset
+
+	mu           sync.Mutex
+	apiOptions   []option.ClientOption //Of the BigQuery API client, to point it at a fake
+	writeOptions []option.ClientOption //Of the Storage Write API client, to point it at a fake
+	client       *bigquery.Client
+	writer       *managedwriter.Client
+	streams      map[string]*stream
+}
+
+// stream of rows to the table of one source
+type stream struct {
+	mu     sync.Mutex
+	ms     *managedwriter.ManagedStream
+	fields []schema.BigQueryField
+	row    protoreflect.MessageDescriptor
+	offset int64 //Of the next row
+}
+
+func (s *Sink) Publish(ctx context.Context, msg sink.Message) (string, error) {
+	st, err := s.stream(ctx, msg.Event.Source)
+	if err != nil {
+		return "", err
+	}
+	row, err := st.encode(msg.Event)
+	if err != nil {
+		return "", err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	res, err := st.ms.AppendRows(ctx, [][]byte{row}, managedwriter.WithOffset(st.offset))
+	if err == nil {
+		_, err = res.GetResult(ctx)
+	}
+	// The row at this offset is already written, e.g. the response of an earlier attempt was lost
+	if status.Code(err) == codes.AlreadyExists {
+		err = nil
+	}
+	if err != nil {
+		// Whether the row was written is unknown, start over on a new stream, consumers dedupe on event_id
+		s.drop(msg.Event.Source, st)
+		return "", err
+	}
+	st.offset++
+	return msg.Event.EventID, nil
+}
+
+// Table is where the events of the source are written to
+func (s *Sink) Table(source string) string {
+	if t, ok := s.Tables[source]; ok {
+		return t
+	}
+	return source + "_events"
+}
+
+// stream returns the stream of the source, creating the clients, table and stream on first use
+func (s *Sink) stream(ctx context.Context, source string) (*stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.streams[source]; ok {
+		return st, nil
+	}
+	md, ok := schema.Events[source]
+	if !ok {
+		return nil, fmt.Errorf("no BigQuery schema for source %q", source)
+	}
+	if s.client == nil {
+		// The clients outlive the publish, so they get their own context
+		client, err := bigquery.NewClient(context.Background(), s.ProjectID, s.apiOptions...)
+		if err != nil {
+			return nil, err
+		}
+		writer, err := managedwriter.NewClient(context.Background(), s.ProjectID, s.writeOptions...)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		s.client, s.writer, s.streams = client, writer, map[string]*stream{}
+	}
+	fields := schema.BigQuery(md)
+	table := s.Table(source)
+	if err := s.createTable(ctx, table, fields); err != nil {
+		return nil, err
+	}
+	row, descriptor, err := rowDescriptor(fields)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := s.writer.NewManagedStream(context.Background(),
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(s.client.Project(), s.Dataset, table)),
+		managedwriter.WithType(managedwriter.CommittedStream),
+		managedwriter.WithSchemaDescriptor(descriptor))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("BigQuery: opened stream", "table", s.Dataset+"."+table, "stream", ms.StreamName())
+	st := &stream{ms: ms, fields: fields, row: row}
+	s.streams[source] = st
+	return st, nil
+}
+
+// drop closes a failed stream so the next publish opens a new one
+func (s *Sink) drop(source string, st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[source] == st {
+		delete(s.streams, source)
+	}
+	if err := st.ms.Close(); err != nil {
+		slog.Error("BigQuery: failed to close stream", "stream", st.ms.StreamName(), "error", err)
+	}
+}
+
+// createTable creates the table partitioned by day of event_time unless it exists
+// An existing table gets the columns added to the event since it was created, an append with columns the table lacks fails
+func (s *Sink) createTable(ctx context.Context, table string, fields []schema.BigQueryField) error {
+	bqSchema, err := bigQuerySchema(fields)
+	if err != nil {
+		return err
+	}
+	t := s.client.Dataset(s.Dataset).Table(table)
+	md, err := t.Metadata(ctx)
+	if err == nil {
+		return s.addColumns(ctx, t, md, bqSchema)
+	}
+	if !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	err = t.Create(ctx, &bigquery.TableMetadata{
+		Schema:           bqSchema,
+		Location:         s.Location,
+		TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Field: "event_time"},
+		Clustering:       &bigquery.Clustering{Fields: []string{"tenant", "environment"}},
+	})
+	// Another FARM created it first
+	if isStatus(err, http.StatusConflict) {
+		return nil
+	}
+	if err == nil {
+		slog.Info("BigQuery: created table", "table", s.Dataset+"."+table)
+	}
+	return err
+}
+
+// addColumns of the event the existing table lacks, the etag fails the update if another FARM changed the table meanwhile
+func (s *Sink) addColumns(ctx context.Context, t *bigquery.Table, md *bigquery.TableMetadata, want bigquery.Schema) error {
+	merged, added, err := mergeSchema(md.Schema, want, "")
+	if err != nil {
+		return fmt.Errorf("table %s.%s: %w, drop the table or write to another one with sinks.bigquery.tables", s.Dataset, t.TableID, err)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if _, err := t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: merged}, md.ETag); err != nil {
+		return fmt.Errorf("table %s.%s: adding columns %s: %w", s.Dataset, t.TableID, strings.Join(added, ", "), err)
+	}
+	slog.Info("BigQuery: added columns", "table", s.Dataset+"."+t.TableID, "columns", added)
+	return nil
+}
+
+// mergeSchema appends the columns of want missing from have, nested ones too, and returns their names
+// Columns are only ever added to the events, a column of another type can not be fixed by an update
+func mergeSchema(have, want bigquery.Schema, prefix string) (bigquery.Schema, []string, error) {
+	merged := make(bigquery.Schema, 0, len(have))
+	byName := map[string]*bigquery.FieldSchema{}
+	for _, f := range have {
+		c := *f
+		merged = append(merged, &c)
+		byName[strings.ToLower(f.Name)] = &c //Column names are case insensitive
+	}
+	var added []string
+	for _, w := range want {
+		h, ok := byName[strings.ToLower(w.Name)]
+		if !ok {
+			c := *w
+			c.Required = false //Only nullable or repeated columns can be added
+			merged = append(merged, &c)
+			added = append(added, prefix+w.Name)
+			continue
+		}
+		if h.Type != w.Type || h.Repeated != w.Repeated {
+			return nil, nil, fmt.Errorf("column %s%s is %s in the table and %s in the event", prefix, w.Name, mode(h), mode(w))
+		}
+		if w.Type == bigquery.RecordFieldType {
+			nested, a, err := mergeSchema(h.Schema, w.Schema, prefix+w.Name+".")
+			if err != nil {
+				return nil, nil, err
+			}
+			h.Schema = nested
+			added = append(added, a...)
+		}
+	}
+	return merged, added, nil
+}
+
+// mode of a column for errors, e.g. REPEATED RECORD
+func mode(f *bigquery.FieldSchema) string {
+	if f.Repeated {
+		return "REPEATED " + string(f.Type)
+	}
+	return string(f.Type)
+}
+
+// bigQuerySchema of the generated fields
+func bigQuerySchema(fields []schema.BigQueryField) (bigquery.Schema, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return bigquery.SchemaFromJSON(b)
+}
+
+func isStatus(err error, code int) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// rowDescriptor is the proto of a table row, JSON columns are written as strings
+func rowDescriptor(fields []schema.BigQueryField) (protoreflect.MessageDescriptor, *descriptorpb.DescriptorProto, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The storage adapter has no JSON type, it takes the JSON text in a string
+	bqSchema, err := bigquery.SchemaFromJSON([]byte(strings.ReplaceAll(string(b), `"type":"JSON"`, `"type":"STRING"`)))
+	if err != nil {
+		return nil, nil, err
+	}
+	storageSchema, err := adapt.BQSchemaToStorageTableSchema(bqSchema)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := adapt.StorageSchemaToProto2Descriptor(storageSchema, "row")
+	if err != nil {
+		return nil, nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, nil, fmt.Errorf("row descriptor is a %T", d)
+	}
+	dp, err := adapt.NormalizeDescriptor(md)
+	if err != nil {
+		return nil, nil, err
+	}
+	return md, dp, nil
+}
+
+// encode the event as a serialized row
+func (st *stream) encode(e event.Envelope) ([]byte, error) {
+	row, err := schema.Row(st.fields, e)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(st.row)
+	if err := protojson.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
@@ -0,0 +1,273 @@
+package bigquery
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"context"
+	"encoding/json"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/schema"
+	"github.com/estecker/farm/internal/sink"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTables is the tables endpoint of the BigQuery API
+type fakeTables struct {
+	mu      sync.Mutex
+	tables  map[string]*bq.Table //By table ID
+	patches int
+}
+
+func (f *fakeTables) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// e.g. /projects/p/datasets/d/tables/argo_events
+	parts := strings.Split(strings.Trim(r.URL.Path[strings.Index(r.URL.Path, "projects/"):], "/"), "/")
+	var t bq.Table
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&t)
+	}
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 5:
+		t.Etag = "1"
+		f.tables[t.TableReference.TableId] = &t
+		_ = json.NewEncoder(w).Encode(t)
+	case r.Method == http.MethodGet && len(parts) == 6 && f.tables[parts[5]] != nil:
+		_ = json.NewEncoder(w).Encode(f.tables[parts[5]])
+	case r.Method == http.MethodPatch && len(parts) == 6 && f.tables[parts[5]] != nil:
+		if r.Header.Get("If-Match") != f.tables[parts[5]].Etag {
+			http.Error(w, `{"error":{"code":412,"message":"precondition failed"}}`, http.StatusPreconditionFailed)
+			return
+		}
+		f.patches++
+		f.tables[parts[5]].Schema = t.Schema
+		f.tables[parts[5]].Etag += "1"
+		_ = json.NewEncoder(w).Encode(f.tables[parts[5]])
+	default:
+		http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+	}
+}
+
+// fakeWrite is the Storage Write API with a single committed stream
+type fakeWrite struct {
+	storagepb.UnimplementedBigQueryWriteServer
+	mu   sync.Mutex
+	rows []*dynamicpb.Message
+}
+
+func (f *fakeWrite) CreateWriteStream(ctx context.Context, req *storagepb.CreateWriteStreamRequest) (*storagepb.WriteStream, error) {
+	return &storagepb.WriteStream{Name: req.Parent + "/streams/s1", Type: storagepb.WriteStream_COMMITTED, Location: "us"}, nil
+}
+
+func (f *fakeWrite) GetWriteStream(ctx context.Context, req *storagepb.GetWriteStreamRequest) (*storagepb.WriteStream, error) {
+	return &storagepb.WriteStream{Name: req.Name, Type: storagepb.WriteStream_COMMITTED, Location: "us"}, nil
+}
+
+func (f *fakeWrite) AppendRows(srv storagepb.BigQueryWrite_AppendRowsServer) error {
+	var row *dynamicpb.Message
+	for {
+		req, err := srv.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := req.GetProtoRows()
+		if d := data.GetWriterSchema().GetProtoDescriptor(); d != nil {
+			file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{Name: proto.String("row.proto"), MessageType: []*descriptorpb.DescriptorProto{d}}, nil)
+			if err != nil {
+				return err
+			}
+			row = dynamicpb.NewMessage(file.Messages().Get(0))
+		}
+		f.mu.Lock()
+		offset := req.GetOffset().GetValue()
+		resp := &storagepb.AppendRowsResponse{}
+		if offset < int64(len(f.rows)) {
+			resp.Response = &storagepb.AppendRowsResponse_Error{Error: status.New(codes.AlreadyExists, "already exists").Proto()}
+		} else {
+			for _, b := range data.GetRows().GetSerializedRows() {
+				m := row.New().Interface().(*dynamicpb.Message)
+				if err := proto.Unmarshal(b, m); err != nil {
+					f.mu.Unlock()
+					return err
+				}
+				f.rows = append(f.rows, m)
+			}
+			resp.Response = &storagepb.AppendRowsResponse_AppendResult_{AppendResult: &storagepb.AppendRowsResponse_AppendResult{Offset: wrapperspb.Int64(offset)}}
+		}
+		f.mu.Unlock()
+		if err := srv.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// fakeSink is a Sink writing to fakes of both APIs
+func fakeSink(t *testing.T, tables *fakeTables, write *fakeWrite) *Sink {
+	api := httptest.NewServer(tables)
+	t.Cleanup(api.Close)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	storagepb.RegisterBigQueryWriteServer(srv, write)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	s := &Sink{
+		ProjectID:  "p",
+		Dataset:    "d",
+		apiOptions: []option.ClientOption{option.WithEndpoint(api.URL), option.WithoutAuthentication()},
+		writeOptions: []option.ClientOption{
+			option.WithEndpoint(lis.Addr().String()),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		},
+	}
+	t.Cleanup(func() {
+		if s.writer != nil {
+			_ = s.writer.Close()
+		}
+	})
+	return s
+}
+
+func argoMessage(name string) sink.Message {
+	return sink.Message{Event: event.New("argo", name, "Succeeded", "t", "stg", &farmv1.ArgoWorkflow{Name: name, Phase: "Succeeded"})}
+}
+
+func TestPublishCreatesTableAndAppendsOnce(t *testing.T) {
+	tables, write := &fakeTables{tables: map[string]*bq.Table{}}, &fakeWrite{}
+	s := fakeSink(t, tables, write)
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := s.Publish(ctx, argoMessage(name)); err != nil {
+			t.Fatalf("Publish(%s) error = %v", name, err)
+		}
+	}
+	created := tables.tables["argo_events"]
+	if created == nil {
+		t.Fatal("table argo_events not created")
+	}
+	if created.TimePartitioning.Field != "event_time" {
+		t.Errorf("partitioned by %q, want event_time", created.TimePartitioning.Field)
+	}
+
+	// The row of the next offset was written but its response lost, the append is acknowledged without a second row
+	write.mu.Lock()
+	write.rows = append(write.rows, write.rows[1])
+	write.mu.Unlock()
+	if _, err := s.Publish(ctx, argoMessage("c")); err != nil {
+		t.Fatalf("Publish(c) error = %v", err)
+	}
+	if _, err := s.Publish(ctx, argoMessage("d")); err != nil {
+		t.Fatalf("Publish(d) error = %v", err)
+	}
+
+	var names []string
+	for _, row := range write.rows {
+		payload := row.Get(row.Descriptor().Fields().ByName("payload")).Message()
+		names = append(names, payload.Get(payload.Descriptor().Fields().ByName("name")).String())
+	}
+	if got, want := strings.Join(names, ","), "a,b,b,d"; got != want {
+		t.Errorf("rows = %s, want %s", got, want)
+	}
+}
+
+func TestPublishAddsMissingColumns(t *testing.T) {
+	fields := schema.BigQuery(schema.Events["argo"])
+	// An older table, without the environment column and the last column of the payload
+	old := slices.DeleteFunc(slices.Clone(fields), func(f schema.BigQueryField) bool { return f.Name == "environment" })
+	for i, f := range old {
+		if f.Name == "payload" {
+			old[i].Fields = f.Fields[:len(f.Fields)-1]
+		}
+	}
+	var oldFields []*bq.TableFieldSchema
+	if err := json.Unmarshal(mustJSON(t, old), &oldFields); err != nil {
+		t.Fatal(err)
+	}
+	tables := &fakeTables{tables: map[string]*bq.Table{"argo_events": {Etag: "1", Schema: &bq.TableSchema{Fields: oldFields}}}}
+	s := fakeSink(t, tables, &fakeWrite{})
+
+	if _, err := s.Publish(context.Background(), argoMessage("a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if tables.patches != 1 {
+		t.Fatalf("patches = %d, want 1", tables.patches)
+	}
+	got := tables.tables["argo_events"].Schema.Fields
+	if len(got) != len(fields) {
+		t.Errorf("columns = %d, want %d", len(got), len(fields))
+	}
+	payload := fields[len(fields)-1]
+	for _, f := range got {
+		if f.Name == payload.Name && len(f.Fields) != len(payload.Fields) {
+			t.Errorf("payload columns = %d, want %d", len(f.Fields), len(payload.Fields))
+		}
+	}
+}
+
+func TestMergeSchema(t *testing.T) {
+	have := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "run", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{{Name: "name", Type: bigquery.StringFieldType}}},
+	}
+	want := bigquery.Schema{
+		{Name: "ID", Type: bigquery.StringFieldType},
+		{Name: "run", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "name", Type: bigquery.StringFieldType},
+			{Name: "cost", Type: bigquery.FloatFieldType, Required: true},
+		}},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+	}
+	merged, added, err := mergeSchema(have, want, "")
+	if err != nil {
+		t.Fatalf("mergeSchema() error = %v", err)
+	}
+	if got := strings.Join(added, ","); got != "run.cost,tags" {
+		t.Errorf("added = %s, want run.cost,tags", got)
+	}
+	if len(merged) != 3 || len(merged[1].Schema) != 2 || merged[1].Schema[1].Required {
+		t.Errorf("merged = %s", mustJSON(t, merged))
+	}
+	if len(have[1].Schema) != 1 {
+		t.Error("mergeSchema() changed the schema of the table")
+	}
+
+	want[0].Type = bigquery.IntegerFieldType
+	if _, _, err := mergeSchema(have, want, ""); err == nil || !strings.Contains(err.Error(), "column ID is STRING in the table and INTEGER in the event") {
+		t.Errorf("mergeSchema() error = %v, want a type change error", err)
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,675 @@
+package config
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The FARM configuration file, see deployments/config.schema.json for the JSON Schema
+type Config struct {
+	Tenant      string      `mapstructure:"tenant"`      //Default tenant for every source
+	Environment string      `mapstructure:"environment"` //Usually the same as DD_ENV
+	Sources     Sources     `mapstructure:"sources"`
+	Sinks       Sinks       `mapstructure:"sinks"`
+	Tracing     Tracing     `mapstructure:"tracing"`
+	Metrics     Metrics     `mapstructure:"metrics"`
+	State       State       `mapstructure:"state"`
+	SLOs        []SLO       `mapstructure:"slos"`
+	Anomaly     Anomaly     `mapstructure:"anomaly"`
+	FailureLogs FailureLogs `mapstructure:"failure_logs"`
+}
+
+// Sources are the workflow orchestration systems to collect from
+type Sources struct {
+	Argo     Argo     `mapstructure:"argo"`
+	Airflow  Airflow  `mapstructure:"airflow"`
+	Tekton   Tekton   `mapstructure:"tekton"`
+	Job      Job      `mapstructure:"job"`
+	Prefect  Prefect  `mapstructure:"prefect"`
+	Dagster  Dagster  `mapstructure:"dagster"`
+	Temporal Temporal `mapstructure:"temporal"`
+}
+
+// Argo source configuration
+type Argo struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Cluster   string        `mapstructure:"cluster"` //Used in the CloudEvents source
+	Namespace string        `mapstructure:"namespace"`
+	Tenant    string        `mapstructure:"tenant"`   //Overrides the top level tenant
+	Interval  time.Duration `mapstructure:"interval"` //Time between polls of the Argo API
+	Lookback  time.Duration `mapstructure:"lookback"` //How far back to look for changed workflows
+	Filter    Filter        `mapstructure:"filter"`   //Applied to the normalized workflow name
+	Kubeflow  Kubeflow      `mapstructure:"kubeflow"`
+	Missed    MissedRuns    `mapstructure:"missed_runs"` //Of the CronWorkflows
+	Cost      Cost          `mapstructure:"cost"`
+}
+
+// Cost model of the Argo workflows, prices of the resources Argo accounts in resourcesDuration
+type Cost struct {
+	Enabled       bool              `mapstructure:"enabled"`
+	NodePoolLabel string            `mapstructure:"node_pool_label"` //Label of the Kubernetes nodes naming their pool
+	Default       Prices            `mapstructure:"default"`         //Of the pods on a node without prices
+	NodePools     map[string]Prices `mapstructure:"node_pools"`      //By pool, viper lowercases the names
+}
+
+// Prices per second of the resources
+type Prices struct {
+	CPU    float64 `mapstructure:"cpu"`    //Per CPU-second
+	Memory float64 `mapstructure:"memory"` //Per GiB-second
+	GPU    float64 `mapstructure:"gpu"`    //Per nvidia.com/gpu-second
+}
+
+// Prices of a node pool, the default ones if it has none
+func (c Cost) Prices(pool string) Prices {
+	if p, ok := c.NodePools[strings.ToLower(pool)]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// MissedRuns detection, for the scheduled workflows that stop running
+type MissedRuns struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Grace   time.Duration `mapstructure:"grace"` //How late a run can start before it is missed
+}
+
+// Kubeflow Pipelines API, to name the runs and experiments of the workflows it submits
+type Kubeflow struct {
+	URL   string `mapstructure:"url"`   //e.g. http://ml-pipeline.kubeflow:8888, empty to only read the workflow annotations
+	Token string `mapstructure:"token"` //Bearer token for multi-user Kubeflow
+}
+
+// Airflow source configuration
+type Airflow struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Host     string        `mapstructure:"host"`
+	Tenant   string        `mapstructure:"tenant"`   //Overrides the top level tenant
+	Interval time.Duration `mapstructure:"interval"` //Time between polls of the Airflow API
+	Lookback time.Duration `mapstructure:"lookback"` //How far back to look for changed DAG runs
+	Filter   Filter        `mapstructure:"filter"`   //Applied to the dag_id
+	Missed   MissedRuns    `mapstructure:"missed_runs"`
+}
+
+// Tekton source configuration
+type Tekton struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Cluster      string        `mapstructure:"cluster"` //Used in the CloudEvents source
+	Namespace    string        `mapstructure:"namespace"`
+	Tenant       string        `mapstructure:"tenant"`        //Overrides the top level tenant
+	Interval     time.Duration `mapstructure:"interval"`      //Time between polls of the Kubernetes API
+	Lookback     time.Duration `mapstructure:"lookback"`      //How far back to look for changed PipelineRuns
+	Filter       Filter        `mapstructure:"filter"`        //Applied to the normalized PipelineRun name
+	DashboardURL string        `mapstructure:"dashboard_url"` //Tekton Dashboard to link PipelineRuns to
+}
+
+// Job source configuration, Kubernetes batch/v1 Jobs and the CronJobs that create them
+type Job struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Cluster   string        `mapstructure:"cluster"` //Used in the CloudEvents source
+	Namespace string        `mapstructure:"namespace"`
+	Tenant    string        `mapstructure:"tenant"`   //Overrides the top level tenant
+	Interval  time.Duration `mapstructure:"interval"` //Time between polls of the Kubernetes API
+	Lookback  time.Duration `mapstructure:"lookback"` //How far back to look for changed Jobs
+	Filter    Filter        `mapstructure:"filter"`   //Applied to the CronJob name or the generateName
+}
+
+// Prefect source configuration, Prefect Cloud or a self hosted Prefect server
+type Prefect struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	URL      string        `mapstructure:"url"`      //API URL, for Prefect Cloud including the account and workspace
+	APIKey   string        `mapstructure:"api_key"`  //Empty for a server without auth
+	UIURL    string        `mapstructure:"ui_url"`   //Prefect UI to link flow runs to
+	Tenant   string        `mapstructure:"tenant"`   //Overrides the top level tenant
+	Interval time.Duration `mapstructure:"interval"` //Time between polls of the Prefect API
+	Lookback time.Duration `mapstructure:"lookback"` //How far back to look for changed flow runs
+	Filter   Filter        `mapstructure:"filter"`   //Applied to the flow name
+}
+
+// Dagster source configuration, Dagster+ or a self hosted dagster-webserver
+type Dagster struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	URL      string        `mapstructure:"url"`       //Webserver URL, the GraphQL API is at <url>/graphql
+	APIToken string        `mapstructure:"api_token"` //Dagster+ user token, empty for a server without auth
+	Tenant   string        `mapstructure:"tenant"`    //Overrides the top level tenant
+	Interval time.Duration `mapstructure:"interval"`  //Time between polls of the Dagster API
+	Lookback time.Duration `mapstructure:"lookback"`  //How far back to look for changed runs
+	Filter   Filter        `mapstructure:"filter"`    //Applied to the job name
+}
+
+// Temporal source configuration, Temporal Cloud or a self hosted Temporal frontend
+type Temporal struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	HostPort  string        `mapstructure:"host_port"` //Frontend gRPC endpoint, e.g. <namespace>.<account>.tmprl.cloud:7233
+	Namespace string        `mapstructure:"namespace"`
+	TLS       bool          `mapstructure:"tls"`
+	APIKey    string        `mapstructure:"api_key"`  //Temporal Cloud API key, needs tls
+	UIURL     string        `mapstructure:"ui_url"`   //Temporal UI to link workflow executions to
+	Tenant    string        `mapstructure:"tenant"`   //Overrides the top level tenant
+	Interval  time.Duration `mapstructure:"interval"` //Time between polls of the visibility API
+	Lookback  time.Duration `mapstructure:"lookback"` //How far back to look for closed workflow executions
+	Filter    Filter        `mapstructure:"filter"`   //Applied to the workflow type
+}
+
+// Sinks are where events are published to
+type Sinks struct {
+	PubSub        PubSub        `mapstructure:"pubsub"`
+	HTTP          HTTP          `mapstructure:"http"`
+	BigQuery      BigQuery      `mapstructure:"bigquery"`
+	ObjectStorage ObjectStorage `mapstructure:"object_storage"`
+}
+
+// PubSub sink configuration
+type PubSub struct {
+	Enabled     bool              `mapstructure:"enabled"`
+	ProjectID   string            `mapstructure:"project_id"` //Defaults to the GCE project
+	Topic       string            `mapstructure:"topic"`
+	Topics      map[string]string `mapstructure:"topics"`      //Topic per source, overrides topic
+	CloudEvents string            `mapstructure:"cloudevents"` //Empty for plain JSON, structured or binary
+	Encoding    string            `mapstructure:"encoding"`    //json or binary protobuf, must match the topic schema
+}
+
+// HTTP sink configuration, POSTs every event to the URL
+type HTTP struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	URL         string        `mapstructure:"url"`
+	CloudEvents string        `mapstructure:"cloudevents"` //Empty for plain JSON, structured or binary
+	Encoding    string        `mapstructure:"encoding"`    //json or binary protobuf
+	Timeout     time.Duration `mapstructure:"timeout"`
+}
+
+// BigQuery sink configuration, writes straight to tables with the Storage Write API
+type BigQuery struct {
+	Enabled   bool              `mapstructure:"enabled"`
+	ProjectID string            `mapstructure:"project_id"` //Defaults to the GCE project
+	Dataset   string            `mapstructure:"dataset"`
+	Tables    map[string]string `mapstructure:"tables"`   //Table per source, defaults to <source>_events
+	Location  string            `mapstructure:"location"` //Of created tables, defaults to the location of the dataset
+}
+
+// ObjectStorage sink configuration, writes files partitioned by source, tenant and date
+type ObjectStorage struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	URL           string        `mapstructure:"url"`            //gs://bucket/prefix, s3://bucket/prefix or a local directory
+	Format        string        `mapstructure:"format"`         //parquet or ndjson
+	FlushSize     int           `mapstructure:"flush_size"`     //Events per file
+	FlushInterval time.Duration `mapstructure:"flush_interval"` //Longest an event is buffered
+}
+
+// Tracing backends that receive a trace per completed run
+type Tracing struct {
+	Datadog Datadog `mapstructure:"datadog"`
+}
+
+// Datadog APM tracing configuration
+type Datadog struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// Metrics about FARM itself, events published and collection cycles per source
+type Metrics struct {
+	DogStatsD DogStatsD `mapstructure:"dogstatsd"`
+}
+
+// DogStatsD client configuration
+type DogStatsD struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	Address   string `mapstructure:"address"`   //Empty uses DD_AGENT_HOST or DD_DOGSTATSD_URL
+	Namespace string `mapstructure:"namespace"` //Prefix of the metric names
+}
+
+// State the sources keep across restarts
+type State struct {
+	Path string `mapstructure:"path"` //JSON file, empty keeps the state in memory
+}
+
+// SLO of the runs of one workflow, evaluated by internal/slo
+// Every objective that is set is checked on its own
+type SLO struct {
+	Name        string        `mapstructure:"name"`
+	Source      string        `mapstructure:"source"`   //argo, airflow, ...
+	Workflow    string        `mapstructure:"workflow"` //Normalized workflow name, DAG ID, pipeline or job name like the filters
+	Tenant      string        `mapstructure:"tenant"`   //Only the runs of this tenant, empty for any
+	Deadline    string        `mapstructure:"deadline"` //15:04, a run must succeed by then every day
+	Timezone    string        `mapstructure:"timezone"` //Of the deadline, default UTC
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+	Percentile  float64       `mapstructure:"percentile"`   //Of the durations in the window compared to max_duration, default 95
+	SuccessRate float64       `mapstructure:"success_rate"` //0.99 for 99% of the runs in the window
+	Window      time.Duration `mapstructure:"window"`       //Of the duration and success rate, default 7 days
+}
+
+// Location of the deadline
+func (s SLO) Location() *time.Location {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC //load already checked it
+	}
+	return loc
+}
+
+// validate fills the defaults and checks the objectives
+func (s *SLO) validate() error {
+	if s.Name == "" || s.Source == "" || s.Workflow == "" {
+		return fmt.Errorf("slos need a name, source and workflow")
+	}
+	if s.Deadline == "" && s.MaxDuration == 0 && s.SuccessRate == 0 {
+		return fmt.Errorf("slo %s has no deadline, max_duration or success_rate", s.Name)
+	}
+	if s.Deadline != "" {
+		if _, err := time.Parse("15:04", s.Deadline); err != nil {
+			return fmt.Errorf("slo %s deadline must be 15:04, not %q", s.Name, s.Deadline)
+		}
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("slo %s: %w", s.Name, err)
+	}
+	if s.Percentile == 0 {
+		s.Percentile = 95
+	}
+	if s.Window == 0 {
+		s.Window = 7 * 24 * time.Hour
+	}
+	if s.MaxDuration < 0 || s.Percentile < 0 || s.Percentile > 100 || s.SuccessRate < 0 || s.SuccessRate > 1 || s.Window < 0 {
+		return fmt.Errorf("slo %s: max_duration and window must be positive, percentile within 0-100 and success_rate within 0-1", s.Name)
+	}
+	return nil
+}
+
+// Anomaly detection of the run and step durations of Argo and Airflow, by normalized workflow name or DAG ID
+type Anomaly struct {
+	Enabled     bool            `mapstructure:"enabled"`
+	Windows     []time.Duration `mapstructure:"windows"`      //Statistics of each window, a duration anomalous in any of them is flagged
+	MinSamples  int             `mapstructure:"min_samples"`  //Of a window before it is used
+	MaxSamples  int             `mapstructure:"max_samples"`  //Kept per run or step, the oldest are dropped
+	Threshold   float64         `mapstructure:"threshold"`    //Modified z-score above which a duration is anomalous
+	MinDuration time.Duration   `mapstructure:"min_duration"` //Shorter steps are never anomalous, their jitter is noise
+}
+
+// FailureLogs are the log excerpts of the failed Argo steps and Airflow tasks, on their span and in a failure event
+type FailureLogs struct {
+	Enabled   bool     `mapstructure:"enabled"`
+	TailLines int      `mapstructure:"tail_lines"` //Fetched from the end of the log
+	MaxBytes  int      `mapstructure:"max_bytes"`  //Of the excerpt, its end is kept
+	Redact    []string `mapstructure:"redact"`     //Regular expressions of the secrets to redact, on top of the built in ones
+
+	redact []*regexp.Regexp
+}
+
+// Redactions are the compiled redact expressions
+func (l FailureLogs) Redactions() []*regexp.Regexp {
+	return l.redact
+}
+
+// compile the redact expressions once per load
+func (l *FailureLogs) compile() error {
+	l.redact = nil
+	for _, s := range l.Redact {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("failure_logs redact %q: %w", s, err)
+		}
+		l.redact = append(l.redact, re)
+	}
+	return nil
+}
+
+// Filter is a list of regular expressions to include or exclude by name
+// An empty include list includes everything, exclude wins over include
+type Filter struct {
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Match reports if the name passes the filter
+func (f Filter) Match(name string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile the regular expressions once per load instead of once per match
+func (f *Filter) compile() error {
+	f.include, f.exclude = nil, nil
+	for _, s := range f.Include {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("filter include %q: %w", s, err)
+		}
+		f.include = append(f.include, re)
+	}
+	for _, s := range f.Exclude {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("filter exclude %q: %w", s, err)
+		}
+		f.exclude = append(f.exclude, re)
+	}
+	return nil
+}
+
+var current atomic.Pointer[Config]
+
+// Get returns the current configuration, it changes when the config file is reloaded
+func Get() *Config {
+	if c := current.Load(); c != nil {
+		return c
+	}
+	return &Config{}
+}
+
+// Set replaces the current configuration
+func Set(c *Config) {
+	current.Store(c)
+}
+
+// Older deployments only set these environment variables
+var legacyEnv = map[string][]string{
+	"tenant":                  {"FARM_TENANT", "tenant"},
+	"environment":             {"FARM_ENVIRONMENT", "DD_ENV"},
+	"sources.argo.enabled":    {"FARM_SOURCES_ARGO_ENABLED", "FARM_ARGO"},
+	"sources.argo.namespace":  {"FARM_SOURCES_ARGO_NAMESPACE", "FARM_ARGO_NAMESPACE"},
+	"sources.airflow.enabled": {"FARM_SOURCES_AIRFLOW_ENABLED", "FARM_AIRFLOW"},
+	"sources.airflow.host":    {"FARM_SOURCES_AIRFLOW_HOST", "FARM_AIRFLOW_HOST"},
+	"sinks.pubsub.project_id": {"FARM_SINKS_PUBSUB_PROJECT_ID", "FARM_TOPIC_PROJECT_ID"},
+}
+
+// setDefaults registers every key so environment variables can override keys missing from the file
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("tenant", "")
+	v.SetDefault("environment", "")
+	v.SetDefault("sources.argo.enabled", false)
+	v.SetDefault("sources.argo.cluster", "")
+	v.SetDefault("sources.argo.namespace", "")
+	v.SetDefault("sources.argo.tenant", "")
+	v.SetDefault("sources.argo.interval", 191*time.Second)
+	v.SetDefault("sources.argo.lookback", 10*time.Minute)
+	v.SetDefault("sources.argo.filter.include", []string{})
+	v.SetDefault("sources.argo.filter.exclude", []string{})
+	v.SetDefault("sources.argo.kubeflow.url", "")
+	v.SetDefault("sources.argo.kubeflow.token", "")
+	v.SetDefault("sources.argo.missed_runs.enabled", false)
+	v.SetDefault("sources.argo.missed_runs.grace", 10*time.Minute)
+	v.SetDefault("sources.argo.cost.enabled", false)
+	v.SetDefault("sources.argo.cost.node_pool_label", "cloud.google.com/gke-nodepool")
+	v.SetDefault("sources.argo.cost.default.cpu", 0)
+	v.SetDefault("sources.argo.cost.default.memory", 0)
+	v.SetDefault("sources.argo.cost.default.gpu", 0)
+	v.SetDefault("sources.airflow.enabled", false)
+	v.SetDefault("sources.airflow.host", "")
+	v.SetDefault("sources.airflow.tenant", "")
+	v.SetDefault("sources.airflow.interval", 311*time.Second)
+	v.SetDefault("sources.airflow.lookback", 10*time.Minute)
+	v.SetDefault("sources.airflow.filter.include", []string{})
+	v.SetDefault("sources.airflow.filter.exclude", []string{"airflow_monitoring"})
+	v.SetDefault("sources.airflow.missed_runs.enabled", false)
+	v.SetDefault("sources.airflow.missed_runs.grace", 10*time.Minute)
+	v.SetDefault("sources.tekton.enabled", false)
+	v.SetDefault("sources.tekton.cluster", "")
+	v.SetDefault("sources.tekton.namespace", "")
+	v.SetDefault("sources.tekton.tenant", "")
+	v.SetDefault("sources.tekton.interval", 193*time.Second)
+	v.SetDefault("sources.tekton.lookback", 10*time.Minute)
+	v.SetDefault("sources.tekton.filter.include", []string{})
+	v.SetDefault("sources.tekton.filter.exclude", []string{})
+	v.SetDefault("sources.tekton.dashboard_url", "")
+	v.SetDefault("sources.job.enabled", false)
+	v.SetDefault("sources.job.cluster", "")
+	v.SetDefault("sources.job.namespace", "")
+	v.SetDefault("sources.job.tenant", "")
+	v.SetDefault("sources.job.interval", 197*time.Second)
+	v.SetDefault("sources.job.lookback", 10*time.Minute)
+	v.SetDefault("sources.job.filter.include", []string{})
+	v.SetDefault("sources.job.filter.exclude", []string{})
+	v.SetDefault("sources.prefect.enabled", false)
+	v.SetDefault("sources.prefect.url", "")
+	v.SetDefault("sources.prefect.api_key", "")
+	v.SetDefault("sources.prefect.ui_url", "")
+	v.SetDefault("sources.prefect.tenant", "")
+	v.SetDefault("sources.prefect.interval", 199*time.Second)
+	v.SetDefault("sources.prefect.lookback", 10*time.Minute)
+	v.SetDefault("sources.prefect.filter.include", []string{})
+	v.SetDefault("sources.prefect.filter.exclude", []string{})
+	v.SetDefault("sources.dagster.enabled", false)
+	v.SetDefault("sources.dagster.url", "")
+	v.SetDefault("sources.dagster.api_token", "")
+	v.SetDefault("sources.dagster.tenant", "")
+	v.SetDefault("sources.dagster.interval", 211*time.Second)
+	v.SetDefault("sources.dagster.lookback", 10*time.Minute)
+	v.SetDefault("sources.dagster.filter.include", []string{})
+	v.SetDefault("sources.dagster.filter.exclude", []string{})
+	v.SetDefault("sources.temporal.enabled", false)
+	v.SetDefault("sources.temporal.host_port", "localhost:7233")
+	v.SetDefault("sources.temporal.namespace", "default")
+	v.SetDefault("sources.temporal.tls", false)
+	v.SetDefault("sources.temporal.api_key", "")
+	v.SetDefault("sources.temporal.ui_url", "")
+	v.SetDefault("sources.temporal.tenant", "")
+	v.SetDefault("sources.temporal.interval", 223*time.Second)
+	v.SetDefault("sources.temporal.lookback", 10*time.Minute)
+	v.SetDefault("sources.temporal.filter.include", []string{})
+	v.SetDefault("sources.temporal.filter.exclude", []string{})
+	v.SetDefault("sinks.pubsub.enabled", true)
+	v.SetDefault("sinks.pubsub.project_id", "")
+	v.SetDefault("sinks.pubsub.topic", "farm")
+	v.SetDefault("sinks.pubsub.topics", map[string]string{})
+	v.SetDefault("sinks.pubsub.cloudevents", "")
+	v.SetDefault("sinks.pubsub.encoding", "json")
+	v.SetDefault("sinks.http.enabled", false)
+	v.SetDefault("sinks.http.url", "")
+	v.SetDefault("sinks.http.cloudevents", "structured")
+	v.SetDefault("sinks.http.encoding", "json")
+	v.SetDefault("sinks.http.timeout", 10*time.Second)
+	v.SetDefault("sinks.bigquery.enabled", false)
+	v.SetDefault("sinks.bigquery.project_id", "")
+	v.SetDefault("sinks.bigquery.dataset", "farm")
+	v.SetDefault("sinks.bigquery.tables", map[string]string{})
+	v.SetDefault("sinks.bigquery.location", "")
+	v.SetDefault("sinks.object_storage.enabled", false)
+	v.SetDefault("sinks.object_storage.url", "")
+	v.SetDefault("sinks.object_storage.format", "parquet")
+	v.SetDefault("sinks.object_storage.flush_size", 1000)
+	v.SetDefault("sinks.object_storage.flush_interval", 5*time.Minute)
+	v.SetDefault("tracing.datadog.enabled", true)
+	v.SetDefault("metrics.dogstatsd.enabled", false)
+	v.SetDefault("metrics.dogstatsd.address", "")
+	v.SetDefault("metrics.dogstatsd.namespace", "farm.")
+	v.SetDefault("state.path", "")
+	v.SetDefault("anomaly.enabled", false)
+	v.SetDefault("anomaly.windows", []time.Duration{24 * time.Hour, 7 * 24 * time.Hour})
+	v.SetDefault("anomaly.min_samples", 10)
+	v.SetDefault("anomaly.max_samples", 500)
+	v.SetDefault("anomaly.threshold", 3.5)
+	v.SetDefault("anomaly.min_duration", 10*time.Second)
+	v.SetDefault("failure_logs.enabled", false)
+	v.SetDefault("failure_logs.tail_lines", 100)
+	v.SetDefault("failure_logs.max_bytes", 4096)
+	v.SetDefault("failure_logs.redact", []string{})
+}
+
+// Init reads the config file, if any, and environment variables into viper
+// FARM_SOURCES_ARGO_NAMESPACE overrides sources.argo.namespace and so on
+// The config file is watched and reloaded when it changes
+func Init(v *viper.Viper, file string) error {
+	setDefaults(v)
+	v.SetEnvPrefix("farm")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv() // read in environment variables that match
+	for key, envs := range legacyEnv {
+		_ = v.BindEnv(append([]string{key}, envs...)...)
+	}
+	if file != "" {
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	c, err := load(v)
+	if err != nil {
+		return err
+	}
+	Set(c)
+	if file != "" {
+		v.OnConfigChange(func(e fsnotify.Event) {
+			c, err := load(v)
+			if err != nil {
+				slog.Error("Config reload failed, keeping previous config", "file", e.Name, "error", err)
+				return
+			}
+			Set(c)
+			slog.Info("Config reloaded", "file", e.Name)
+		})
+		v.WatchConfig()
+	}
+	return nil
+}
+
+// load unmarshals and validates the config from viper
+func load(v *viper.Viper) (*Config, error) {
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.Sources.Argo.Tenant == "" {
+		c.Sources.Argo.Tenant = c.Tenant
+	}
+	if c.Sources.Airflow.Tenant == "" {
+		c.Sources.Airflow.Tenant = c.Tenant
+	}
+	if c.Sources.Tekton.Tenant == "" {
+		c.Sources.Tekton.Tenant = c.Tenant
+	}
+	if c.Sources.Job.Tenant == "" {
+		c.Sources.Job.Tenant = c.Tenant
+	}
+	if c.Sources.Prefect.Tenant == "" {
+		c.Sources.Prefect.Tenant = c.Tenant
+	}
+	if c.Sources.Dagster.Tenant == "" {
+		c.Sources.Dagster.Tenant = c.Tenant
+	}
+	if c.Sources.Temporal.Tenant == "" {
+		c.Sources.Temporal.Tenant = c.Tenant
+	}
+	if err := c.Sources.Argo.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.argo: %w", err)
+	}
+	if err := c.Sources.Airflow.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.airflow: %w", err)
+	}
+	if err := c.Sources.Tekton.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.tekton: %w", err)
+	}
+	if err := c.Sources.Job.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.job: %w", err)
+	}
+	if err := c.Sources.Prefect.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.prefect: %w", err)
+	}
+	if err := c.Sources.Dagster.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.dagster: %w", err)
+	}
+	if err := c.Sources.Temporal.Filter.compile(); err != nil {
+		return nil, fmt.Errorf("sources.temporal: %w", err)
+	}
+	if err := c.FailureLogs.compile(); err != nil {
+		return nil, err
+	}
+	if l := c.FailureLogs; l.Enabled && (l.TailLines <= 0 || l.MaxBytes <= 0) {
+		return nil, fmt.Errorf("failure_logs tail_lines and max_bytes must be positive")
+	}
+	names := map[string]bool{}
+	for i := range c.SLOs {
+		if err := c.SLOs[i].validate(); err != nil {
+			return nil, err
+		}
+		if names[c.SLOs[i].Name] {
+			return nil, fmt.Errorf("slo %s defined twice", c.SLOs[i].Name)
+		}
+		names[c.SLOs[i].Name] = true
+	}
+	if c.Sources.Airflow.Enabled && c.Sources.Airflow.Host == "" {
+		return nil, fmt.Errorf("sources.airflow.host not set")
+	}
+	if c.Sources.Prefect.Enabled && c.Sources.Prefect.URL == "" {
+		return nil, fmt.Errorf("sources.prefect.url not set")
+	}
+	if c.Sources.Dagster.Enabled && c.Sources.Dagster.URL == "" {
+		return nil, fmt.Errorf("sources.dagster.url not set")
+	}
+	if t := c.Sources.Temporal; t.Enabled && (t.HostPort == "" || t.Namespace == "") {
+		return nil, fmt.Errorf("sources.temporal host_port and namespace must be set")
+	}
+	if t := c.Sources.Temporal; t.APIKey != "" && !t.TLS {
+		return nil, fmt.Errorf("sources.temporal.api_key needs sources.temporal.tls")
+	}
+	if c.Sinks.HTTP.Enabled && c.Sinks.HTTP.URL == "" {
+		return nil, fmt.Errorf("sinks.http.url not set")
+	}
+	if c.Sinks.BigQuery.Enabled && c.Sinks.BigQuery.Dataset == "" {
+		return nil, fmt.Errorf("sinks.bigquery.dataset not set")
+	}
+	if o := c.Sinks.ObjectStorage; o.Enabled {
+		if o.URL == "" {
+			return nil, fmt.Errorf("sinks.object_storage.url not set")
+		}
+		if o.Format != "parquet" && o.Format != "ndjson" {
+			return nil, fmt.Errorf("sinks.object_storage.format must be parquet or ndjson, not %q", o.Format)
+		}
+		if o.FlushSize <= 0 || o.FlushInterval <= 0 {
+			return nil, fmt.Errorf("sinks.object_storage flush_size and flush_interval must be positive")
+		}
+	}
+	for _, mode := range []string{c.Sinks.PubSub.CloudEvents, c.Sinks.HTTP.CloudEvents} {
+		if mode != "" && mode != "structured" && mode != "binary" {
+			return nil, fmt.Errorf("cloudevents must be structured or binary, not %q", mode)
+		}
+	}
+	for _, s := range [][2]string{{c.Sinks.PubSub.CloudEvents, c.Sinks.PubSub.Encoding}, {c.Sinks.HTTP.CloudEvents, c.Sinks.HTTP.Encoding}} {
+		if s[1] != "json" && s[1] != "binary" {
+			return nil, fmt.Errorf("encoding must be json or binary, not %q", s[1])
+		}
+		if s[0] == "structured" && s[1] == "binary" {
+			return nil, fmt.Errorf("structured cloudevents need the json encoding")
+		}
+	}
+	if a := c.Anomaly; a.Enabled && (len(a.Windows) == 0 || slices.Min(a.Windows) <= 0 || a.MinSamples < 2 || a.MaxSamples < a.MinSamples || a.Threshold <= 0) {
+		return nil, fmt.Errorf("anomaly needs positive windows, min_samples of at least 2, max_samples of at least min_samples and a positive threshold")
+	}
+	prices := map[string]Prices{"default": c.Sources.Argo.Cost.Default}
+	for pool, p := range c.Sources.Argo.Cost.NodePools {
+		prices["node_pools."+pool] = p
+	}
+	for name, p := range prices {
+		if p.CPU < 0 || p.Memory < 0 || p.GPU < 0 {
+			return nil, fmt.Errorf("sources.argo.cost.%s prices must not be negative", name)
+		}
+	}
+	if c.Sources.Argo.Missed.Grace < 0 || c.Sources.Airflow.Missed.Grace < 0 {
+		return nil, fmt.Errorf("missed_runs.grace must not be negative")
+	}
+	if c.Sources.Argo.Interval <= 0 || c.Sources.Airflow.Interval <= 0 || c.Sources.Tekton.Interval <= 0 || c.Sources.Job.Interval <= 0 ||
+		c.Sources.Prefect.Interval <= 0 || c.Sources.Dagster.Interval <= 0 || c.Sources.Temporal.Interval <= 0 {
+		return nil, fmt.Errorf("source interval must be positive")
+	}
+	return &c, nil
+}
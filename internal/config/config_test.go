@@ -0,0 +1,188 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadYAML loads a config file with the defaults for the keys it does not set
+func loadYAML(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	v := viper.New()
+	setDefaults(v)
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	return load(v)
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := loadYAML(t, `
+tenant: data
+sources:
+  argo:
+    enabled: true
+  temporal:
+    tenant: ml
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Sources.Argo.Interval != 191*time.Second || c.Sources.Argo.Lookback != 10*time.Minute || c.Sources.Argo.Cost.NodePoolLabel != "cloud.google.com/gke-nodepool" {
+		t.Errorf("sources.argo = %+v", c.Sources.Argo)
+	}
+	// The sources without a tenant get the top level one
+	if c.Sources.Argo.Tenant != "data" || c.Sources.Airflow.Tenant != "data" || c.Sources.Temporal.Tenant != "ml" {
+		t.Errorf("tenants = %q, %q and %q, want data, data and ml", c.Sources.Argo.Tenant, c.Sources.Airflow.Tenant, c.Sources.Temporal.Tenant)
+	}
+	if c.Sources.Airflow.Filter.Match("airflow_monitoring") || !c.Sources.Airflow.Filter.Match("etl") {
+		t.Error("sources.airflow.filter does not exclude airflow_monitoring only")
+	}
+	if tc := c.Sources.Temporal; tc.HostPort != "localhost:7233" || tc.Namespace != "default" {
+		t.Errorf("sources.temporal = %+v", tc)
+	}
+	if p := c.Sinks.PubSub; !p.Enabled || p.Topic != "farm" || p.Encoding != "json" {
+		t.Errorf("sinks.pubsub = %+v", p)
+	}
+	if a := c.Anomaly; a.Enabled || !slices.Equal(a.Windows, []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}) || a.MinSamples != 10 || a.Threshold != 3.5 {
+		t.Errorf("anomaly = %+v", a)
+	}
+	if l := c.FailureLogs; l.TailLines != 100 || l.MaxBytes != 4096 {
+		t.Errorf("failure_logs = %+v", l)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	previous := Get()
+	t.Cleanup(func() { Set(previous) })
+	tests := []struct {
+		name      string
+		env       map[string]string
+		namespace string
+		projectID string
+		tenant    string
+	}{
+		{"keys", map[string]string{"FARM_SOURCES_ARGO_NAMESPACE": "argo", "FARM_SINKS_PUBSUB_PROJECT_ID": "farm-prod", "FARM_TENANT": "data"}, "argo", "farm-prod", "data"},
+		// Older deployments
+		{"legacy", map[string]string{"FARM_ARGO_NAMESPACE": "workflows", "FARM_TOPIC_PROJECT_ID": "farm-legacy", "tenant": "ml"}, "workflows", "farm-legacy", "ml"},
+		{"keys win over legacy", map[string]string{"FARM_SOURCES_ARGO_NAMESPACE": "argo", "FARM_ARGO_NAMESPACE": "workflows", "FARM_TENANT": "data", "tenant": "ml"}, "argo", "", "data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if err := Init(viper.New(), ""); err != nil {
+				t.Fatal(err)
+			}
+			c := Get()
+			if c.Sources.Argo.Namespace != tt.namespace || c.Sinks.PubSub.ProjectID != tt.projectID || c.Tenant != tt.tenant {
+				t.Errorf("namespace, project ID and tenant = %q, %q and %q, want %q, %q and %q",
+					c.Sources.Argo.Namespace, c.Sinks.PubSub.ProjectID, c.Tenant, tt.namespace, tt.projectID, tt.tenant)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"filter", "sources: {tekton: {filter: {exclude: ['(']}}}", "sources.tekton: filter exclude"},
+		{"redact", "failure_logs: {redact: ['[']}", "failure_logs redact"},
+		{"failure logs", "failure_logs: {enabled: true, max_bytes: 0}", "failure_logs tail_lines and max_bytes"},
+		{"airflow host", "sources: {airflow: {enabled: true}}", "sources.airflow.host not set"},
+		{"temporal api key", "sources: {temporal: {api_key: secret}}", "needs sources.temporal.tls"},
+		{"object storage format", "sinks: {object_storage: {enabled: true, url: 'gs://farm', format: csv}}", "parquet or ndjson"},
+		{"cloudevents", "sinks: {http: {enabled: true, url: 'http://farm', cloudevents: batch}}", "structured or binary"},
+		{"structured binary", "sinks: {pubsub: {cloudevents: structured, encoding: binary}}", "need the json encoding"},
+		{"anomaly", "anomaly: {enabled: true, min_samples: 1}", "anomaly needs"},
+		{"prices", "sources: {argo: {cost: {node_pools: {gpu: {gpu: -1}}}}}", "sources.argo.cost.node_pools.gpu prices"},
+		{"grace", "sources: {airflow: {missed_runs: {grace: -1m}}}", "missed_runs.grace"},
+		{"interval", "sources: {job: {interval: 0s}}", "source interval must be positive"},
+		{"slo without objective", "slos: [{name: nightly, source: argo, workflow: etl}]", "slo nightly has no deadline"},
+		{"slo deadline", "slos: [{name: nightly, source: argo, workflow: etl, deadline: '7am'}]", "deadline must be 15:04"},
+		{"slo timezone", "slos: [{name: nightly, source: argo, workflow: etl, deadline: '07:00', timezone: Mars/Olympus_Mons}]", "slo nightly"},
+		{"slo success rate", "slos: [{name: nightly, source: argo, workflow: etl, success_rate: 99}]", "success_rate within 0-1"},
+		{"slo defined twice", "slos: [{name: nightly, source: argo, workflow: etl, deadline: '07:00'}, {name: nightly, source: airflow, workflow: etl, deadline: '08:00'}]", "defined twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, tt.yaml)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("load() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSLOs(t *testing.T) {
+	c, err := loadYAML(t, `
+slos:
+  - name: nightly-etl
+    source: argo
+    workflow: etl
+    deadline: "07:30"
+    timezone: Europe/Amsterdam
+    max_duration: 2h
+  - name: hourly-report
+    source: airflow
+    workflow: report
+    success_rate: 0.99
+    percentile: 90
+    window: 24h
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.SLOs) != 2 {
+		t.Fatalf("%d slos, want 2", len(c.SLOs))
+	}
+	etl, report := c.SLOs[0], c.SLOs[1]
+	if etl.Name != "nightly-etl" || etl.Source != "argo" || etl.Workflow != "etl" || etl.Deadline != "07:30" || etl.MaxDuration != 2*time.Hour {
+		t.Errorf("slos[0] = %+v", etl)
+	}
+	// The defaults of the unset objectives
+	if etl.Percentile != 95 || etl.Window != 7*24*time.Hour || etl.Location().String() != "Europe/Amsterdam" {
+		t.Errorf("slos[0] percentile, window and location = %v, %v and %v", etl.Percentile, etl.Window, etl.Location())
+	}
+	if report.SuccessRate != 0.99 || report.Percentile != 90 || report.Window != 24*time.Hour || report.Location() != time.UTC {
+		t.Errorf("slos[1] = %+v", report)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		matches []string
+		misses  []string
+	}{
+		{"empty", Filter{}, []string{"etl", ""}, nil},
+		{"include", Filter{Include: []string{"^etl-", "report$"}}, []string{"etl-nightly", "daily-report"}, []string{"nightly-etl"}},
+		{"exclude wins", Filter{Include: []string{"^etl-"}, Exclude: []string{"-test$"}}, []string{"etl-nightly"}, []string{"etl-nightly-test", "report"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.compile(); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.matches {
+				if !tt.filter.Match(name) {
+					t.Errorf("Match(%q) = false", name)
+				}
+			}
+			for _, name := range tt.misses {
+				if tt.filter.Match(name) {
+					t.Errorf("Match(%q) = true", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package critical
+
+import (
+	"cmp"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Step of a run, whatever the source
+// Steps without a start or end, e.g. skipped or only grouping other steps, are never on the path but pass on their Upstream
+type Step struct {
+	ID       string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Upstream []string //IDs of the steps it waited for
+}
+
+func (s Step) timed() bool {
+	return !s.Start.IsZero() && !s.End.IsZero()
+}
+
+// Path is the critical path of a completed run, the zero Path has no steps
+type Path struct {
+	Steps    []Step                   //In the order they ran
+	Slack    map[string]time.Duration //By step ID, how much later it could have ended without delaying the run
+	Start    time.Time
+	End      time.Time
+	critical map[string]bool
+}
+
+// Compute the critical path of a run that ran from start to end
+// Walks back from the step that ended last through the upstream step that ended last, the one it actually waited for
+func Compute(steps []Step, start, end time.Time) Path {
+	byID := map[string]Step{}
+	for _, s := range steps {
+		byID[s.ID] = s
+	}
+	var resolve func(id string, seen map[string]bool) []string
+	resolve = func(id string, seen map[string]bool) []string {
+		var ids []string
+		for _, u := range byID[id].Upstream {
+			s, ok := byID[u]
+			if !ok || seen[u] {
+				continue
+			}
+			seen[u] = true
+			if s.timed() {
+				ids = append(ids, u)
+			} else {
+				ids = append(ids, resolve(u, seen)...)
+			}
+		}
+		return ids
+	}
+	var timed []Step
+	upstream := map[string][]string{}
+	downstream := map[string][]string{}
+	for _, s := range steps {
+		if !s.timed() {
+			continue
+		}
+		timed = append(timed, s)
+		upstream[s.ID] = resolve(s.ID, map[string]bool{s.ID: true})
+		for _, u := range upstream[s.ID] {
+			downstream[u] = append(downstream[u], s.ID)
+		}
+	}
+	if len(timed) == 0 {
+		return Path{}
+	}
+	later := func(a, b Step) int {
+		return cmp.Or(a.End.Compare(b.End), cmp.Compare(a.ID, b.ID))
+	}
+	last := slices.MaxFunc(timed, later)
+	if end.Before(last.End) {
+		end = last.End
+	}
+	if start.IsZero() || start.After(end) {
+		start = slices.MinFunc(timed, func(a, b Step) int { return a.Start.Compare(b.Start) }).Start
+	}
+
+	p := Path{Slack: map[string]time.Duration{}, Start: start, End: end, critical: map[string]bool{}}
+	for id := last.ID; id != "" && !p.critical[id]; {
+		p.critical[id] = true
+		p.Steps = append(p.Steps, byID[id])
+		next := ""
+		for _, u := range upstream[id] {
+			if next == "" || later(byID[u], byID[next]) > 0 {
+				next = u
+			}
+		}
+		id = next
+	}
+	slices.Reverse(p.Steps)
+
+	// The latest a step could have ended is when every step after it must start to end in time
+	latest := map[string]time.Time{}
+	var latestEnd func(id string) time.Time
+	latestEnd = func(id string) time.Time {
+		if t, ok := latest[id]; ok {
+			return t
+		}
+		latest[id] = end //In case the dependencies have a cycle
+		t := end
+		for _, d := range downstream[id] {
+			s := byID[d]
+			if l := latestEnd(d).Add(-s.End.Sub(s.Start)); l.Before(t) {
+				t = l
+			}
+		}
+		latest[id] = t
+		return t
+	}
+	for _, s := range timed {
+		p.Slack[s.ID] = max(latestEnd(s.ID).Sub(s.End), 0)
+	}
+	return p
+}
+
+// Critical reports if the step is on the path
+func (p Path) Critical(id string) bool {
+	return p.critical[id]
+}
+
+// Tags for the span of a step, nil if the step was not part of the computation
+func (p Path) Tags(id string) map[string]string {
+	slack, ok := p.Slack[id]
+	if !ok {
+		return nil
+	}
+	return map[string]string{
+		"critical_path": strconv.FormatBool(p.Critical(id)),
+		"slack":         strconv.FormatFloat(slack.Seconds(), 'f', 1, 64),
+	}
+}
+
+// Proto of the path for the run event, nil for the zero Path
+func (p Path) Proto() *farmv1.CriticalPath {
+	if len(p.Steps) == 0 {
+		return nil
+	}
+	cp := &farmv1.CriticalPath{}
+	var busy, slack time.Duration
+	for _, s := range p.Steps {
+		cp.Steps = append(cp.Steps, &farmv1.CriticalStep{
+			Id:       s.ID,
+			Name:     s.Name,
+			Start:    s.Start.UnixMicro(),
+			End:      s.End.UnixMicro(),
+			Duration: s.End.Sub(s.Start).Seconds(),
+		})
+		busy += s.End.Sub(s.Start)
+	}
+	for id, d := range p.Slack {
+		if !p.Critical(id) {
+			slack += d
+		}
+	}
+	cp.Duration = busy.Seconds()
+	cp.Idle = max(p.End.Sub(p.Start)-busy, 0).Seconds()
+	cp.TotalSlack = slack.Seconds()
+	return cp
+}
@@ -0,0 +1,97 @@
+package critical
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+// at is seconds after t0
+func at(seconds int) time.Time {
+	return t0.Add(time.Duration(seconds) * time.Second)
+}
+
+func TestCompute(t *testing.T) {
+	// extract fans out to transform and validate, join only groups them, load waits for join
+	steps := []Step{
+		{ID: "load", Name: "Load", Start: at(35), End: at(50), Upstream: []string{"join"}},
+		{ID: "join", Name: "Join", Upstream: []string{"transform", "validate", "gone"}},
+		{ID: "validate", Name: "Validate", Start: at(10), End: at(20), Upstream: []string{"extract"}},
+		{ID: "transform", Name: "Transform", Start: at(10), End: at(30), Upstream: []string{"extract"}},
+		{ID: "extract", Name: "Extract", Start: at(0), End: at(10)},
+	}
+	p := Compute(steps, at(0), at(55))
+
+	var path []string
+	for _, s := range p.Steps {
+		path = append(path, s.ID)
+	}
+	if got, want := path, []string{"extract", "transform", "load"}; !slices.Equal(got, want) {
+		t.Fatalf("path = %v, want %v", got, want)
+	}
+	tests := []struct {
+		id       string
+		critical bool
+		slack    time.Duration
+	}{
+		{"extract", true, 10 * time.Second},
+		{"transform", true, 10 * time.Second},
+		{"validate", false, 20 * time.Second},
+		{"load", true, 5 * time.Second}, //The run ended after it
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if p.Critical(tt.id) != tt.critical {
+				t.Errorf("Critical() = %v, want %v", p.Critical(tt.id), tt.critical)
+			}
+			if p.Slack[tt.id] != tt.slack {
+				t.Errorf("slack = %v, want %v", p.Slack[tt.id], tt.slack)
+			}
+		})
+	}
+	if p.Critical("join") || p.Tags("join") != nil {
+		t.Errorf("the untimed join is on the path or has tags %v", p.Tags("join"))
+	}
+	if tags := p.Tags("validate"); tags["critical_path"] != "false" || tags["slack"] != "20.0" {
+		t.Errorf("Tags(validate) = %v", tags)
+	}
+
+	cp := p.Proto()
+	if len(cp.Steps) != 3 || cp.Duration != 45 || cp.Idle != 10 || cp.TotalSlack != 20 {
+		t.Errorf("Proto() = %v", cp)
+	}
+}
+
+func TestComputeWithoutRunTimes(t *testing.T) {
+	// A step ending after the run, and no run start, stretch the run to the steps
+	steps := []Step{
+		{ID: "a", Start: at(5), End: at(10)},
+		{ID: "b", Start: at(10), End: at(70), Upstream: []string{"a"}},
+	}
+	p := Compute(steps, time.Time{}, at(60))
+	if !p.Start.Equal(at(5)) || !p.End.Equal(at(70)) {
+		t.Errorf("run = %v to %v, want the first start and the last end", p.Start, p.End)
+	}
+	if p.Slack["b"] != 0 || p.Slack["a"] != 0 {
+		t.Errorf("slack = %v, want none", p.Slack)
+	}
+}
+
+func TestComputeCycle(t *testing.T) {
+	steps := []Step{
+		{ID: "a", Start: at(0), End: at(10), Upstream: []string{"b"}},
+		{ID: "b", Start: at(10), End: at(20), Upstream: []string{"a"}},
+	}
+	if p := Compute(steps, at(0), at(20)); len(p.Steps) != 2 {
+		t.Errorf("path = %v, want both steps once", p.Steps)
+	}
+}
+
+func TestComputeNoSteps(t *testing.T) {
+	p := Compute([]Step{{ID: "skipped", Upstream: []string{"also-skipped"}}}, at(0), at(10))
+	if len(p.Steps) != 0 || p.Proto() != nil || p.Tags("skipped") != nil {
+		t.Errorf("Compute() = %+v, want the zero Path", p)
+	}
+}
@@ -0,0 +1,192 @@
+package dagster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client of the Dagster GraphQL API, only the queries FARM needs
+// https://docs.dagster.io/concepts/webserver/graphql
+type Client struct {
+	URL        string //Webserver URL, e.g. https://<org>.dagster.cloud/<deployment>
+	APIToken   string //Empty for a self hosted webserver without auth
+	HTTPClient *http.Client
+}
+
+type tag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type run struct {
+	RunID            string   `json:"runId"`
+	JobName          string   `json:"jobName"`
+	Status           string   `json:"status"`
+	CreationTime     *float64 `json:"creationTime"` //Seconds since the epoch
+	StartTime        *float64 `json:"startTime"`
+	EndTime          *float64 `json:"endTime"`
+	UpdateTime       *float64 `json:"updateTime"`
+	Tags             []tag    `json:"tags"`
+	RepositoryOrigin *struct {
+		RepositoryName         string `json:"repositoryName"`
+		RepositoryLocationName string `json:"repositoryLocationName"`
+	} `json:"repositoryOrigin"`
+}
+
+type attempt struct {
+	StartTime *float64 `json:"startTime"`
+	EndTime   *float64 `json:"endTime"`
+}
+
+type stepStats struct {
+	StepKey   string    `json:"stepKey"`
+	Status    string    `json:"status"`
+	StartTime *float64  `json:"startTime"`
+	EndTime   *float64  `json:"endTime"`
+	Attempts  []attempt `json:"attempts"`
+}
+
+// Runs fetched per API call, tests page through small fixtures
+var pageSize = 100
+
+const runsQuery = `query FarmRuns($filter: RunsFilter, $cursor: String, $limit: Int) {
+  runsOrError(filter: $filter, cursor: $cursor, limit: $limit) {
+    __typename
+    ... on Runs {
+      results {
+        runId
+        jobName
+        status
+        creationTime
+        startTime
+        endTime
+        updateTime
+        tags { key value }
+        repositoryOrigin { repositoryName repositoryLocationName }
+      }
+    }
+    ... on PythonError { message }
+    ... on InvalidPipelineRunsFilterError { message }
+  }
+}`
+
+const stepStatsQuery = `query FarmStepStats($runId: ID!) {
+  runOrError(runId: $runId) {
+    __typename
+    ... on Run {
+      stepStats {
+        stepKey
+        status
+        startTime
+        endTime
+        attempts { startTime endTime }
+      }
+    }
+    ... on RunNotFoundError { message }
+    ... on PythonError { message }
+  }
+}`
+
+// query sends a GraphQL query and decodes its data into v
+func (c *Client) query(ctx context.Context, query string, variables map[string]any, v any) error {
+	b, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+"/graphql", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIToken != "" {
+		req.Header.Set("Dagster-Cloud-Api-Token", c.APIToken)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST /graphql: %s: %s", resp.Status, msg)
+	}
+	var r struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if len(r.Errors) > 0 {
+		return errors.New(r.Errors[0].Message)
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// runs updated after since
+func (c *Client) runs(ctx context.Context, since time.Time) ([]run, error) {
+	var runs []run
+	variables := map[string]any{
+		"filter": map[string]any{"updatedAfter": float64(since.UnixMilli()) / 1000},
+		"limit":  pageSize,
+	}
+	for {
+		var data struct {
+			RunsOrError struct {
+				Typename string `json:"__typename"`
+				Message  string `json:"message"`
+				Results  []run  `json:"results"`
+			} `json:"runsOrError"`
+		}
+		if err := c.query(ctx, runsQuery, variables, &data); err != nil {
+			return nil, err
+		}
+		if r := data.RunsOrError; r.Typename != "Runs" {
+			return nil, fmt.Errorf("runsOrError: %s: %s", r.Typename, r.Message)
+		}
+		page := data.RunsOrError.Results
+		runs = append(runs, page...)
+		if len(page) < pageSize {
+			return runs, nil
+		}
+		variables["cursor"] = page[len(page)-1].RunID
+	}
+}
+
+// stepStats of a run, one per op that was executed
+func (c *Client) stepStats(ctx context.Context, runID string) ([]stepStats, error) {
+	var data struct {
+		RunOrError struct {
+			Typename  string      `json:"__typename"`
+			Message   string      `json:"message"`
+			StepStats []stepStats `json:"stepStats"`
+		} `json:"runOrError"`
+	}
+	if err := c.query(ctx, stepStatsQuery, map[string]any{"runId": runID}, &data); err != nil {
+		return nil, err
+	}
+	if r := data.RunOrError; r.Typename != "Run" {
+		return nil, fmt.Errorf("runOrError: %s: %s", r.Typename, r.Message)
+	}
+	return data.RunOrError.StepStats, nil
+}
+
+// toTime converts Dagster float seconds, nil stays nil
+func toTime(s *float64) *time.Time {
+	if s == nil {
+		return nil
+	}
+	sec, frac := math.Modf(*s)
+	t := time.Unix(int64(sec), int64(frac*1e9))
+	return &t
+}
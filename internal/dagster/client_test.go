@@ -0,0 +1,188 @@
+package dagster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// graphQLRequest is the body of a query
+type graphQLRequest struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables"`
+}
+
+// fakeAPI serves the recorded responses in testdata, the runs after the cursor of the request
+type fakeAPI struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests []graphQLRequest
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/graphql" || r.Header.Get("Dagster-Cloud-Api-Token") != "token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req graphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("decoding the query: %v", err)
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	name := "step_stats.json"
+	if strings.HasPrefix(req.Query, "query FarmRuns") {
+		name = "runs_page1.json"
+		if req.Variables["cursor"] == "8a9b0c1d-2e3f-4a5b-9c6d-7e8f9a0b1c2d" {
+			name = "runs_page2.json"
+		}
+	}
+	_, _ = w.Write(fixture(f.t, name))
+}
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newFake(t *testing.T) (*fakeAPI, *Client) {
+	f := &fakeAPI{t: t}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &Client{URL: srv.URL + "/", APIToken: "token", HTTPClient: srv.Client()}
+}
+
+func TestRuns(t *testing.T) {
+	defer func(n int) { pageSize = n }(pageSize)
+	pageSize = 2
+	f, cli := newFake(t)
+	since := time.Date(2026, 10, 19, 8, 55, 0, 500e6, time.UTC)
+
+	runs, err := cli.runs(context.Background(), since)
+	if err != nil {
+		t.Fatalf("runs() error = %v", err)
+	}
+	var ids []string
+	for _, r := range runs {
+		ids = append(ids, r.RunID)
+	}
+	if got, want := strings.Join(ids, ","), "4f1c2a7e-9b3d-4e5f-8a6b-7c8d9e0f1a2b,8a9b0c1d-2e3f-4a5b-9c6d-7e8f9a0b1c2d,c3d4e5f6-a7b8-4c9d-8e0f-1a2b3c4d5e6f"; got != want {
+		t.Errorf("runs() = %s, want %s", got, want)
+	}
+	if len(f.requests) != 2 {
+		t.Fatalf("requests = %d, want 2 pages", len(f.requests))
+	}
+	// The cursor is the last run of the previous page
+	if c, ok := f.requests[0].Variables["cursor"]; ok {
+		t.Errorf("first page cursor = %v, want none", c)
+	}
+	if c := f.requests[1].Variables["cursor"]; c != "8a9b0c1d-2e3f-4a5b-9c6d-7e8f9a0b1c2d" {
+		t.Errorf("second page cursor = %v", c)
+	}
+	for _, req := range f.requests {
+		if after := req.Variables["filter"].(map[string]any)["updatedAfter"]; after != float64(since.UnixMilli())/1000 {
+			t.Errorf("updatedAfter = %v", after)
+		}
+		if req.Variables["limit"] != float64(2) {
+			t.Errorf("limit = %v", req.Variables["limit"])
+		}
+	}
+
+	if r := runs[0]; !completed(r) || toTime(r.EndTime).Sub(*toTime(r.StartTime)) != 248750*time.Millisecond {
+		t.Errorf("runs[0] = %+v", r)
+	}
+	if r := runs[1]; completed(r) || r.EndTime != nil || commonState(r.Status) != "running" {
+		t.Errorf("runs[1] = %+v", r)
+	}
+}
+
+func TestRunsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"runsOrError":{"__typename":"PythonError","message":"boom"}}}`))
+	}))
+	defer srv.Close()
+	cli := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+	if _, err := cli.runs(context.Background(), time.Now()); err == nil || err.Error() != "runsOrError: PythonError: boom" {
+		t.Errorf("runs() error = %v", err)
+	}
+}
+
+// failing is a sink that never takes an event
+type failing struct{}
+
+func (failing) Publish(context.Context, sink.Message) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestCycle(t *testing.T) {
+	defer func(n int) { pageSize = n }(pageSize)
+	pageSize = 2
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	_, cli := newFake(t)
+	var out bytes.Buffer
+	em := (&source.Emitter{Sink: &sink.Writer{W: &out}}).For("dagster")
+	cfg := &config.Config{Sources: config.Sources{Dagster: config.Dagster{URL: "https://acme.dagster.cloud/prod", Lookback: time.Hour}}}
+
+	if err := cycle(context.Background(), cfg, cli, em, ttlcache.New[string, string]()); err != nil {
+		t.Fatalf("cycle() error = %v", err)
+	}
+	type published struct {
+		Data struct {
+			Payload *Event `json:"payload"`
+		} `json:"data"`
+	}
+	var events []*Event
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e published
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e.Data.Payload)
+	}
+	if len(events) != 3 {
+		t.Fatalf("published %d events, want 3", len(events))
+	}
+	if e := events[0]; e.State != "success" || e.Location != "orders" || e.Tags["team"] != "data" || e.Url != "https://acme.dagster.cloud/prod/runs/"+e.RunId {
+		t.Errorf("events[0] = %+v", e)
+	}
+	if e := events[2]; e.State != "failed" || e.Status != "FAILURE" {
+		t.Errorf("events[2] = %+v", e)
+	}
+
+	// The step stats of both completed runs are traced, with a span per attempt of the retried step
+	counts := map[string]int{}
+	for _, s := range mt.FinishedSpans() {
+		counts[s.OperationName()+" "+s.Tag(ext.ResourceName).(string)]++
+	}
+	for name, want := range map[string]int{"dagster.run daily_orders": 2, "step extract_orders": 2, "step load_orders": 2, "attempt load_orders": 4} {
+		if counts[name] != want {
+			t.Errorf("spans %s = %d, want %d in %v", name, counts[name], want, counts)
+		}
+	}
+
+	// Nothing is cached while the sink fails, the errors are returned
+	cache := ttlcache.New[string, string]()
+	if err := cycle(context.Background(), cfg, cli, (&source.Emitter{Sink: failing{}}).For("dagster"), cache); err == nil || cache.Len() != 0 {
+		t.Errorf("cycle() with a failing sink error = %v, cached %v", err, cache.Keys())
+	}
+}
@@ -0,0 +1,190 @@
+package dagster
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commonState maps a Dagster run status to the Airflow DAG run states, queued, running, success or failed
+func commonState(status string) string {
+	switch status {
+	case "SUCCESS":
+		return "success"
+	case "FAILURE", "CANCELED":
+		return "failed"
+	case "STARTED", "CANCELING":
+		return "running"
+	}
+	return "queued" //QUEUED, NOT_STARTED, STARTING, MANAGED
+}
+
+// completed reports if the run will not change status anymore
+func completed(r run) bool {
+	return r.Status == "SUCCESS" || r.Status == "FAILURE" || r.Status == "CANCELED"
+}
+
+// Link to the run in the Dagster UI
+func runUrl(host string, r run) string {
+	return strings.TrimSuffix(host, "/") + "/runs/" + r.RunID
+}
+
+func micros(s *float64) int64 {
+	if t := toTime(s); t != nil {
+		return t.UnixMicro()
+	}
+	return 0 //otherwise will send the zero value date, which is not null
+}
+
+// timeOf is the zero time for a missing timestamp
+func timeOf(s *float64) time.Time {
+	if t := toTime(s); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+// Build the event for a run and publish it
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, r run) (string, error) {
+	e := &Event{
+		RunId:        r.RunID,
+		JobName:      r.JobName,
+		Url:          runUrl(cfg.Sources.Dagster.URL, r),
+		State:        commonState(r.Status),
+		Status:       r.Status,
+		Tags:         map[string]string{},
+		CreationTime: micros(r.CreationTime),
+		StartTime:    micros(r.StartTime),
+		EndTime:      micros(r.EndTime),
+	}
+	if o := r.RepositoryOrigin; o != nil {
+		e.Repository, e.Location = o.RepositoryName, o.RepositoryLocationName
+	}
+	for _, t := range r.Tags {
+		e.Tags[t.Key] = t.Value
+	}
+	env := event.New("dagster", r.RunID, r.Status, cfg.Sources.Dagster.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "dagster",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.dagster.run.status_changed",
+		Source:     cfg.Sources.Dagster.URL,
+		Subject:    r.JobName + "/" + r.RunID,
+	})
+}
+
+// Publish the runs whose status changed and trace the completed ones, returns the publish errors and those of the step stats
+// A run is only cached once published, so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, cli *Client, em *source.Emitter, runs []run, cache *ttlcache.Cache[string, string]) error {
+	var errs []error
+	for _, r := range runs {
+		if !cfg.Sources.Dagster.Filter.Match(r.JobName) {
+			continue
+		}
+		if cache.Has(r.RunID) && cache.Get(r.RunID).Value() == r.Status {
+			continue
+		}
+		msgID, err := publish(ctx, cfg, em, r)
+		if err != nil {
+			em.Logger.Error("Dagster: Error publishing", "error", err, "runId", r.RunID)
+			errs = append(errs, err)
+			continue
+		}
+		cache.Set(r.RunID, r.Status, 0)
+		em.Logger.Debug("pubsub.publish",
+			"type", "dagster",
+			"status", r.Status,
+			"job", r.JobName,
+			"runId", r.RunID,
+			"msgID", msgID)
+		if completed(r) {
+			steps, err := cli.stepStats(ctx, r.RunID)
+			if err != nil {
+				em.Logger.Error("Dagster: Error getting step stats", "error", err, "runId", r.RunID)
+				errs = append(errs, err)
+			}
+			trace(r, steps, cfg.Sources.Dagster.Tenant, runUrl(cfg.Sources.Dagster.URL, r), em.Completed(ctx, cfg, slo.Run{
+				Source:   "dagster",
+				Workflow: r.JobName,
+				Tenant:   cfg.Sources.Dagster.Tenant,
+				ID:       r.RunID,
+				URL:      runUrl(cfg.Sources.Dagster.URL, r),
+				Start:    timeOf(r.StartTime),
+				End:      timeOf(r.EndTime),
+				Success:  r.Status == "SUCCESS",
+			}))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewClient of the API in the config
+func NewClient(cfg config.Dagster) *Client {
+	return &Client{URL: cfg.URL, APIToken: cfg.APIToken, HTTPClient: &http.Client{Timeout: time.Minute}}
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Dagster run events, sources.dagster in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "dagster"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Dagster.Enabled
+}
+
+// Run is the main loop for collecting Dagster events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	cache := ttlcache.New[string, string](ttlcache.WithTTL[string, string](time.Hour))
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, NewClient(cfg.Sources.Dagster), em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Dagster.Interval) {
+			return nil
+		}
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every run in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	if cfg.Sources.Dagster.URL == "" {
+		return errors.New("sources.dagster.url not set")
+	}
+	return cycle(ctx, cfg, NewClient(cfg.Sources.Dagster), em, ttlcache.New[string, string]())
+}
+
+// cycle is one poll of the Dagster API, returns the API and publish errors
+func cycle(ctx context.Context, cfg *config.Config, cli *Client, em *source.Emitter, cache *ttlcache.Cache[string, string]) error {
+	runs, err := cli.runs(ctx, time.Now().Add(-cfg.Sources.Dagster.Lookback))
+	if err != nil {
+		em.Logger.Error("Dagster: Error listing runs", "error", err)
+		return err
+	}
+	return collect(ctx, cfg, cli, em, runs, cache)
+}
@@ -0,0 +1,99 @@
+package dagster
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"log/slog"
+	"time"
+)
+
+// statusToCode maps the status of a run to an HTTP status code
+// Makes the DataDog UI look nice
+func statusToCode(status string) int {
+	switch commonState(status) {
+	case "success":
+		return 200
+	case "running", "queued":
+		return 102
+	default:
+		return 500
+	}
+}
+
+func orNow(s *float64) time.Time {
+	if t := toTime(s); t != nil {
+		return *t
+	}
+	return time.Now()
+}
+
+// Create a DataDog trace for a run with a span per step, and per attempt of the retried steps
+func trace(r run, steps []stepStats, tenant string, url string, tags map[string]string) {
+	slog.Debug("trace",
+		"type", "dagster",
+		"status", r.Status,
+		"job", r.JobName,
+		"runId", r.RunID)
+	start := orNow(r.StartTime)
+	rootSpan := tracer.StartSpan("dagster.run",
+		tracer.StartTime(start),
+		tracer.ResourceName(r.JobName))
+	rootSpan.SetTag(ext.HTTPMethod, "DAGSTER")
+	rootSpan.SetTag(ext.HTTPCode, statusToCode(r.Status))
+	rootSpan.SetTag("tenant", tenant)
+	rootSpan.SetTag("url", url)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
+
+	runSpan := tracer.StartSpan(r.RunID,
+		tracer.ServiceName(r.JobName),
+		tracer.StartTime(start),
+		tracer.SpanType("dagster_run"),
+		tracer.ChildOf(rootSpan.Context()))
+	runSpan.SetTag("run_id", r.RunID)
+	runSpan.SetTag("job_name", r.JobName)
+	runSpan.SetTag("status", r.Status)
+	if o := r.RepositoryOrigin; o != nil {
+		runSpan.SetTag("repository", o.RepositoryName)
+		runSpan.SetTag("location", o.RepositoryLocationName)
+	}
+	for _, t := range r.Tags {
+		runSpan.SetTag("tags."+t.Key, t.Value)
+	}
+	for _, step := range steps {
+		traceStep(step, runSpan.Context())
+	}
+	finishOptions := []tracer.FinishOption{tracer.FinishTime(orNow(r.EndTime)), tracer.WithError(nil)}
+	runSpan.Finish(finishOptions...)
+	rootSpan.Finish(finishOptions...)
+}
+
+// traceStep adds the span of an op, with a child span per attempt when it was retried
+func traceStep(step stepStats, parent ddtrace.SpanContext) {
+	if step.StartTime == nil {
+		return //never ran, e.g. upstream failed
+	}
+	span := tracer.StartSpan(step.StepKey,
+		tracer.ChildOf(parent),
+		tracer.StartTime(orNow(step.StartTime)),
+		tracer.ResourceName(step.StepKey))
+	span.SetTag("status", step.Status)
+	span.SetTag("attempts", len(step.Attempts))
+	span.SetOperationName("step")
+	if len(step.Attempts) > 1 {
+		for i, a := range step.Attempts {
+			if a.StartTime == nil {
+				continue
+			}
+			attemptSpan := tracer.StartSpan("attempt",
+				tracer.ChildOf(span.Context()),
+				tracer.StartTime(orNow(a.StartTime)),
+				tracer.ResourceName(step.StepKey))
+			attemptSpan.SetTag("attempt", i+1)
+			attemptSpan.Finish(tracer.FinishTime(orNow(a.EndTime)), tracer.WithError(nil))
+		}
+	}
+	span.Finish(tracer.FinishTime(orNow(step.EndTime)), tracer.WithError(nil))
+}
@@ -0,0 +1,97 @@
+package event
+
+//go:generate sh -c "cd ../.. && buf generate"
+
+import (
+	"fmt"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"time"
+)
+
+// SchemaVersion of the Envelope and its payloads, bump it on any incompatible change
+// Version 1 was the bare payload without an envelope
+// Version 3 sends labels and annotations as objects and parameters as a list instead of json in json
+const SchemaVersion = 3
+
+// Namespace of the deterministic event IDs
+var idNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/estecker/farm"))
+
+// Envelope wraps every event published by FARM, whatever the sink
+type Envelope struct {
+	SchemaVersion int    `json:"schema_version"`
+	EventID       string `json:"event_id"`   //Same source, run and state always get the same ID
+	EventTime     int64  `json:"event_time"` //When FARM emitted the event, micros like the payload timestamps
+	Source        string `json:"source"`     //argo, airflow
+	Tenant        string `json:"tenant,omitempty"`
+	Environment   string `json:"environment,omitempty"`
+	Payload       any    `json:"payload"` //A message from proto/farm/v1/events.proto
+}
+
+// New wraps the payload of a run in an envelope
+func New(source, runID, state, tenant, environment string, payload any) Envelope {
+	return Envelope{
+		SchemaVersion: SchemaVersion,
+		EventID:       ID(source, runID, state),
+		EventTime:     time.Now().UnixMicro(),
+		Source:        source,
+		Tenant:        tenant,
+		Environment:   environment,
+		Payload:       payload,
+	}
+}
+
+// ID is a UUID derived from the source, run and state so consumers can dedupe re-publishes
+func ID(source, runID, state string) string {
+	return uuid.NewSHA1(idNamespace, []byte(source+"/"+runID+"/"+state)).String()
+}
+
+// Envelope messages of proto/farm/v1/events.proto by the full name of their payload message
+// They all have the fields of the Envelope, a new payload only needs its envelope message here
+var messages = map[protoreflect.FullName]protoreflect.MessageType{}
+
+func init() {
+	for _, m := range []proto.Message{
+		&farmv1.ArgoEvent{},
+		&farmv1.AirflowEvent{},
+		&farmv1.TektonEvent{},
+		&farmv1.JobEvent{},
+		&farmv1.PrefectEvent{},
+		&farmv1.DagsterEvent{},
+		&farmv1.TemporalEvent{},
+		&farmv1.SloEvent{},
+		&farmv1.MissedEvent{},
+		&farmv1.AnomalyEvent{},
+		&farmv1.TryEvent{},
+		&farmv1.FailureEvent{},
+	} {
+		payload := m.ProtoReflect().Descriptor().Fields().ByName("payload").Message()
+		messages[payload.FullName()] = m.ProtoReflect().Type()
+	}
+}
+
+// Proto returns the envelope as the protobuf message of its source, used for binary encoding
+func (e Envelope) Proto() (proto.Message, error) {
+	p, ok := e.Payload.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("no protobuf message for payload %T", e.Payload)
+	}
+	mt, ok := messages[p.ProtoReflect().Descriptor().FullName()]
+	if !ok {
+		return nil, fmt.Errorf("no protobuf message for payload %T", e.Payload)
+	}
+	m := mt.New()
+	fields := m.Descriptor().Fields()
+	m.Set(fields.ByName("schema_version"), protoreflect.ValueOfInt32(int32(e.SchemaVersion)))
+	m.Set(fields.ByName("event_id"), protoreflect.ValueOfString(e.EventID))
+	m.Set(fields.ByName("event_time"), protoreflect.ValueOfInt64(e.EventTime))
+	m.Set(fields.ByName("source"), protoreflect.ValueOfString(e.Source))
+	m.Set(fields.ByName("tenant"), protoreflect.ValueOfString(e.Tenant))
+	m.Set(fields.ByName("environment"), protoreflect.ValueOfString(e.Environment))
+	if p.ProtoReflect().IsValid() { //A nil payload is left unset
+		m.Set(fields.ByName("payload"), protoreflect.ValueOfMessage(p.ProtoReflect()))
+	}
+	return m.Interface(), nil
+}
@@ -0,0 +1,100 @@
+package event
+
+import (
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestProto(t *testing.T) {
+	tests := []struct {
+		payload proto.Message
+		message string
+	}{
+		{&farmv1.ArgoWorkflow{Name: "etl-1"}, "farm.v1.ArgoEvent"},
+		{&farmv1.AirflowDagRun{DagId: "etl"}, "farm.v1.AirflowEvent"},
+		{&farmv1.TektonPipelineRun{}, "farm.v1.TektonEvent"},
+		{&farmv1.KubernetesJob{}, "farm.v1.JobEvent"},
+		{&farmv1.PrefectFlowRun{}, "farm.v1.PrefectEvent"},
+		{&farmv1.DagsterRun{}, "farm.v1.DagsterEvent"},
+		{&farmv1.TemporalWorkflowExecution{}, "farm.v1.TemporalEvent"},
+		{&farmv1.SloBreach{}, "farm.v1.SloEvent"},
+		{&farmv1.MissedRun{}, "farm.v1.MissedEvent"},
+		{&farmv1.DurationAnomaly{}, "farm.v1.AnomalyEvent"},
+		{&farmv1.TaskTry{}, "farm.v1.TryEvent"},
+		{&farmv1.StepFailure{}, "farm.v1.FailureEvent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			e := New("argo", "uid-1", "Succeeded", "data", "prd", tt.payload)
+			m, err := e.Proto()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := m.ProtoReflect()
+			if got := string(r.Descriptor().FullName()); got != tt.message {
+				t.Fatalf("Proto() = %s, want %s", got, tt.message)
+			}
+			fields := r.Descriptor().Fields()
+			if r.Get(fields.ByName("schema_version")).Int() != SchemaVersion || r.Get(fields.ByName("event_id")).String() != e.EventID ||
+				r.Get(fields.ByName("event_time")).Int() != e.EventTime || r.Get(fields.ByName("source")).String() != "argo" ||
+				r.Get(fields.ByName("tenant")).String() != "data" || r.Get(fields.ByName("environment")).String() != "prd" {
+				t.Errorf("Proto() = %v, want the fields of %+v", m, e)
+			}
+			if p := r.Get(fields.ByName("payload")).Message().Interface(); p != tt.payload {
+				t.Errorf("Proto() payload = %v, want %v", p, tt.payload)
+			}
+		})
+	}
+
+	want := &farmv1.ArgoEvent{SchemaVersion: SchemaVersion, EventId: "id", EventTime: 1, Source: "argo", Tenant: "data", Payload: &farmv1.ArgoWorkflow{Name: "etl-1"}}
+	m, err := Envelope{SchemaVersion: SchemaVersion, EventID: "id", EventTime: 1, Source: "argo", Tenant: "data", Payload: &farmv1.ArgoWorkflow{Name: "etl-1"}}.Proto()
+	if err != nil || !proto.Equal(m, want) {
+		t.Errorf("Proto() = %v, %v, want %v", m, err, want)
+	}
+	if m, err := (Envelope{Payload: (*farmv1.ArgoWorkflow)(nil)}).Proto(); err != nil || m.(*farmv1.ArgoEvent).Payload != nil {
+		t.Errorf("Proto() of a nil payload = %v, %v", m, err)
+	}
+	// Not a payload of an envelope message
+	for _, payload := range []any{&farmv1.ArgoNode{}, map[string]string{"name": "etl-1"}, nil} {
+		if _, err := (Envelope{Payload: payload}).Proto(); err == nil {
+			t.Errorf("Proto() of %T error = nil", payload)
+		}
+	}
+}
+
+// Every envelope message of the events file wraps a payload
+func TestMessages(t *testing.T) {
+	all := farmv1.File_farm_v1_events_proto.Messages()
+	envelopes := 0
+	for i := range all.Len() {
+		md := all.Get(i)
+		payload := md.Fields().ByName("payload")
+		if payload == nil || md.Fields().ByName("event_id") == nil {
+			continue
+		}
+		envelopes++
+		if mt, ok := messages[payload.Message().FullName()]; !ok || mt.Descriptor().FullName() != md.FullName() {
+			t.Errorf("%s is not the envelope message of %s", md.FullName(), payload.Message().FullName())
+		}
+	}
+	if envelopes != len(messages) {
+		t.Errorf("%d envelope messages, %d payloads", envelopes, len(messages))
+	}
+}
+
+func TestID(t *testing.T) {
+	id := New("argo", "uid-1", "Running", "data", "prd", nil).EventID
+	if again := New("argo", "uid-1", "Running", "ml", "stg", &farmv1.ArgoWorkflow{}).EventID; again != id {
+		t.Errorf("re-published ID = %s, want %s", again, id)
+	}
+	if u, err := uuid.Parse(id); err != nil || u.Version() != 5 {
+		t.Errorf("ID %s is not a name based UUID: %v", id, err)
+	}
+	for _, other := range [][3]string{{"argo", "uid-1", "Succeeded"}, {"argo", "uid-2", "Running"}, {"tekton", "uid-1", "Running"}} {
+		if ID(other[0], other[1], other[2]) == id {
+			t.Errorf("ID(%v) = ID(argo, uid-1, Running)", other)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package failure
+
+import (
+	"bufio"
+	"context"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Where the log of a failed step came from
+const (
+	Pod      = "pod"      //The Kubernetes API, while the pod is not deleted
+	Artifact = "artifact" //The main-logs artifact Argo archives
+	Airflow  = "airflow"  //The task log endpoint of the try
+)
+
+const redacted = "[REDACTED]"
+
+// The ends of a PEM private key, a window of a log may start after its BEGIN line or end before its END line
+var (
+	keyBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	keyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+)
+
+// Secrets redacted from every log before failure_logs.redact
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(-----END [A-Z ]*PRIVATE KEY-----|$)`), redacted},
+	{regexp.MustCompile(`(?i)\b((?:bearer|basic)\s+)[A-Za-z0-9._~+/=-]{8,}`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)([a-z0-9_.-]*(?:password|passwd|secret|token|api_?key|access_?key|credentials?)["']?\s*[:=]\s*["']?)[^\s"',;&]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), redacted},
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redacted}, //JWT
+	{regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{30,}|github_pat_[A-Za-z0-9_]{30,}|xox[abpsr]-[A-Za-z0-9-]{10,})`), redacted},
+}
+
+// Redact the secrets of a log, the built in ones and the ones of failure_logs.redact
+func Redact(cfg config.FailureLogs, log string) string {
+	// The rest of a key whose BEGIN line was cut off, from the start of the log
+	if end := keyEnd.FindStringIndex(log); end != nil {
+		if begin := keyBegin.FindStringIndex(log); begin == nil || begin[0] > end[0] {
+			log = redacted + log[end[1]:]
+		}
+	}
+	for _, r := range redactions {
+		log = r.re.ReplaceAllString(log, r.repl)
+	}
+	for _, re := range cfg.Redactions() {
+		log = re.ReplaceAllString(log, redacted)
+	}
+	return log
+}
+
+// Excerpt is the end of a log, redacted and cut to at most tail_lines lines and max_bytes bytes
+// cut is set when the log is a window of a longer one, its first line may be part of a line or of a secret and is dropped
+// The redaction runs next, so a cut never leaves half a secret behind
+func Excerpt(cfg config.FailureLogs, log string, cut bool) (string, bool) {
+	truncated := false
+	if cut {
+		_, log, _ = strings.Cut(log, "\n") //Nothing is left of a window in the middle of a single line
+		truncated = true
+	}
+	log = strings.TrimRight(Redact(cfg, log), "\n")
+	if lines := strings.Split(log, "\n"); len(lines) > cfg.TailLines {
+		log = strings.Join(lines[len(lines)-cfg.TailLines:], "\n")
+		truncated = true
+	}
+	if len(log) > cfg.MaxBytes {
+		log = log[len(log)-cfg.MaxBytes:]
+		if i := strings.IndexByte(log, '\n'); i >= 0 && i < len(log)-1 {
+			log = log[i+1:] //Whole lines, unless it is a single long one
+		}
+		for len(log) > 0 && !utf8.RuneStart(log[0]) {
+			log = log[1:]
+		}
+		truncated = true
+	}
+	return log, truncated
+}
+
+// Tail reads the last n lines of r, for the logs only served whole
+// Reports if the lines before were dropped, a cut window for Excerpt
+func Tail(r io.Reader, n int) (string, bool, error) {
+	ring := make([]string, n) //The last n lines, the oldest at i%n
+	i := 0
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			ring[i%n] = line
+			i++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if i <= n {
+		return strings.Join(ring[:i], ""), false, nil
+	}
+	return strings.Join(ring[i%n:], "") + strings.Join(ring[:i%n], ""), true, nil
+}
+
+// Tags for the span of the failed step
+func Tags(f *farmv1.StepFailure) map[string]string {
+	if f == nil || f.LogSource == "" {
+		return nil
+	}
+	return map[string]string{
+		"log":           f.Log,
+		"log.source":    f.LogSource,
+		"log.truncated": strconv.FormatBool(f.Truncated),
+	}
+}
+
+// Publish the failure event of a step, ceSource is the CloudEvents source of its run
+func Publish(ctx context.Context, cfg *config.Config, em *source.Emitter, f *farmv1.StepFailure, tenant, ceSource string) error {
+	key := f.Source + "/" + f.Workflow + "/" + f.RunId + "/" + f.StepId + "/" + strconv.Itoa(int(f.TryNumber))
+	env := event.New("failure", key, f.State, tenant, cfg.Environment, f)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "failure",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	msgID, err := em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.step.failed",
+		Source:     ceSource,
+		Subject:    f.Workflow + "/" + f.Step,
+	})
+	if err != nil {
+		return err
+	}
+	em.Logger.Debug("pubsub.publish",
+		"type", "failure",
+		"workflow", f.Workflow,
+		"step", f.Step,
+		"logSource", f.LogSource,
+		"msgID", msgID)
+	return nil
+}
@@ -0,0 +1,280 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/kube"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// List the Jobs created or finished within the lookback, and those still running
+func listJobs(ctx context.Context, cli kubernetes.Interface, nameSpace string, lookback time.Duration) ([]batchv1.Job, error) {
+	since := time.Now().Add(-lookback)
+	var jobs []batchv1.Job
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		list, err := cli.BatchV1().Jobs(nameSpace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range list.Items {
+			if finished := finishedAt(j); j.CreationTimestamp.After(since) || finished == nil || finished.After(since) {
+				jobs = append(jobs, j)
+			}
+		}
+		if list.Continue == "" {
+			return jobs, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// List the pods of a Job, completed pods may already be deleted
+func listPods(ctx context.Context, cli kubernetes.Interface, j batchv1.Job) ([]corev1.Pod, error) {
+	pods, err := cli.CoreV1().Pods(j.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + j.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// cronJob is the name of the CronJob that created the Job
+func cronJob(j batchv1.Job) string {
+	for _, o := range j.OwnerReferences {
+		if o.Kind == "CronJob" {
+			return o.Name
+		}
+	}
+	return ""
+}
+
+// The "name" is not always the same, so we need to normalize it
+func normalizeName(j batchv1.Job) string {
+	if n := cronJob(j); n != "" {
+		return n
+	} else if n := j.GenerateName; n != "" {
+		before, _ := strings.CutSuffix(n, "-")
+		return before
+	}
+	return j.Name
+}
+
+// condition returns the condition of the type if it is true
+func condition(j batchv1.Job, t batchv1.JobConditionType) *batchv1.JobCondition {
+	for i, c := range j.Status.Conditions {
+		if c.Type == t && c.Status == corev1.ConditionTrue {
+			return &j.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// phase is Pending, Running, Complete or Failed
+func phase(j batchv1.Job) string {
+	if condition(j, batchv1.JobComplete) != nil {
+		return "Complete"
+	} else if condition(j, batchv1.JobFailed) != nil {
+		return "Failed"
+	} else if j.Status.StartTime != nil {
+		return "Running"
+	}
+	return "Pending"
+}
+
+// completed reports if the Job finished, whatever the outcome
+func completed(j batchv1.Job) bool {
+	p := phase(j)
+	return p == "Complete" || p == "Failed"
+}
+
+// finishedAt is the completion time, or when the Job failed
+func finishedAt(j batchv1.Job) *metav1.Time {
+	if j.Status.CompletionTime != nil {
+		return j.Status.CompletionTime
+	}
+	if c := condition(j, batchv1.JobFailed); c != nil {
+		return &c.LastTransitionTime
+	}
+	return nil
+}
+
+// Build the event for a Job and publish it
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, j batchv1.Job) (string, error) {
+	e := &Event{
+		Name:              j.Name,
+		NormalizedName:    normalizeName(j),
+		Namespace:         j.Namespace,
+		CronJob:           cronJob(j),
+		Phase:             phase(j),
+		Labels:            j.Labels,
+		Annotations:       j.Annotations,
+		CreationTimestamp: j.CreationTimestamp.UnixMicro(),
+		Active:            j.Status.Active,
+		Succeeded:         j.Status.Succeeded,
+		Failed:            j.Status.Failed,
+	}
+	if c := condition(j, batchv1.JobFailed); c != nil {
+		e.Reason = c.Reason
+	}
+	// otherwise will send the zero value date, which is not null
+	if j.Status.StartTime != nil {
+		e.StartedAt = j.Status.StartTime.UnixMicro()
+	}
+	if t := finishedAt(j); t != nil {
+		e.FinishedAt = t.UnixMicro()
+	}
+	env := event.New("job", string(j.UID), e.Phase, cfg.Sources.Job.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "job",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.kubernetes.job.phase_changed",
+		Source:     ceSource(cfg.Sources.Job.Cluster, j.Namespace),
+		Subject:    j.Name,
+	})
+}
+
+// ceSource is the CloudEvents source of a Job, job/<cluster>/<namespace>
+func ceSource(cluster string, nameSpace string) string {
+	if cluster == "" {
+		return "job/" + nameSpace
+	}
+	return "job/" + cluster + "/" + nameSpace
+}
+
+// Publish the Jobs whose phase changed and trace the completed ones, returns the publish and pod errors
+// A Job is only cached once published, so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, cli kubernetes.Interface, em *source.Emitter, jobs []batchv1.Job, cache *ttlcache.Cache[types.UID, string]) error {
+	var errs []error
+	for _, j := range jobs {
+		if !cfg.Sources.Job.Filter.Match(normalizeName(j)) {
+			continue
+		}
+		p := phase(j)
+		if cache.Has(j.UID) && cache.Get(j.UID).Value() == p {
+			continue
+		}
+		msgID, err := publish(ctx, cfg, em, j)
+		if err != nil {
+			em.Logger.Error("Job: Error publishing", "error", err, "name", j.Name)
+			errs = append(errs, err)
+			continue
+		}
+		cache.Set(j.UID, p, 0)
+		em.Logger.Debug("pubsub.publish",
+			"type", "job",
+			"phase", p,
+			"name", j.Name,
+			"msgID", msgID)
+		if completed(j) {
+			pods, err := listPods(ctx, cli, j)
+			if err != nil {
+				em.Logger.Error("Job: Error listing pods", "error", err, "name", j.Name)
+				errs = append(errs, err)
+			}
+			trace(j, pods, cfg.Sources.Job.Tenant, em.Completed(ctx, cfg, slo.Run{
+				Source:   "job",
+				Workflow: normalizeName(j),
+				Tenant:   cfg.Sources.Job.Tenant,
+				ID:       string(j.UID),
+				Start:    timeOf(j.Status.StartTime),
+				End:      timeOf(finishedAt(j)),
+				Success:  phase(j) == "Complete",
+			}))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newClient is the in-cluster client or the one of the local kubeconfig
+func newClient() (kubernetes.Interface, error) {
+	restConfig, err := kube.Config()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// timeOf is the zero time for a nil time
+func timeOf(t *metav1.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Kubernetes Job events, sources.job in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "job"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Job.Enabled
+}
+
+// Run is the main loop for collecting Job events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	cache := ttlcache.New[types.UID, string](ttlcache.WithTTL[types.UID, string](time.Hour))
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, cli, em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Job.Interval) {
+			return nil
+		}
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every Job in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	return cycle(ctx, cfg, cli, em, ttlcache.New[types.UID, string]())
+}
+
+// cycle is one poll of the Kubernetes API, returns the API and publish errors
+func cycle(ctx context.Context, cfg *config.Config, cli kubernetes.Interface, em *source.Emitter, cache *ttlcache.Cache[types.UID, string]) error {
+	jobs, err := listJobs(ctx, cli, cfg.Sources.Job.Namespace, cfg.Sources.Job.Lookback)
+	if err != nil {
+		em.Logger.Error("Job: Error listing Jobs", "error", err)
+		return err
+	}
+	return collect(ctx, cfg, cli, em, jobs, cache)
+}
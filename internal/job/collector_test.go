@@ -0,0 +1,313 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	typedbatchv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ago is a Kubernetes time before now
+func ago(d time.Duration) *metav1.Time {
+	t := metav1.NewTime(time.Now().Add(-d).Truncate(time.Second))
+	return &t
+}
+
+// fakeClient lists Jobs a page of one Job per request, and the pods of a Job
+// The other methods of kubernetes.Interface are not implemented
+type fakeClient struct {
+	kubernetes.Interface
+	jobs    []batchv1.Job
+	pods    []corev1.Pod
+	podsErr error
+	lists   int
+}
+
+type fakeBatch struct {
+	typedbatchv1.BatchV1Interface
+	f *fakeClient
+}
+
+type fakeJobs struct {
+	typedbatchv1.JobInterface
+	f         *fakeClient
+	namespace string
+}
+
+type fakeCore struct {
+	typedcorev1.CoreV1Interface
+	f *fakeClient
+}
+
+type fakePods struct {
+	typedcorev1.PodInterface
+	f         *fakeClient
+	namespace string
+}
+
+func (f *fakeClient) BatchV1() typedbatchv1.BatchV1Interface {
+	return fakeBatch{f: f}
+}
+
+func (f *fakeClient) CoreV1() typedcorev1.CoreV1Interface {
+	return fakeCore{f: f}
+}
+
+func (b fakeBatch) Jobs(namespace string) typedbatchv1.JobInterface {
+	return fakeJobs{f: b.f, namespace: namespace}
+}
+
+func (c fakeCore) Pods(namespace string) typedcorev1.PodInterface {
+	return fakePods{f: c.f, namespace: namespace}
+}
+
+func (j fakeJobs) List(_ context.Context, opts metav1.ListOptions) (*batchv1.JobList, error) {
+	j.f.lists++
+	var matching []batchv1.Job
+	for _, job := range j.f.jobs {
+		if j.namespace == "" || job.Namespace == j.namespace {
+			matching = append(matching, job)
+		}
+	}
+	list := &batchv1.JobList{}
+	i, _ := strconv.Atoi(opts.Continue)
+	if i < len(matching) {
+		list.Items = matching[i : i+1]
+	}
+	if i+1 < len(matching) {
+		list.Continue = strconv.Itoa(i + 1)
+	}
+	return list, nil
+}
+
+func (p fakePods) List(_ context.Context, opts metav1.ListOptions) (*corev1.PodList, error) {
+	if p.f.podsErr != nil {
+		return nil, p.f.podsErr
+	}
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &corev1.PodList{}
+	for _, pod := range p.f.pods {
+		if pod.Namespace == p.namespace && selector.Matches(labels.Set(pod.Labels)) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+	return list, nil
+}
+
+func TestPhase(t *testing.T) {
+	failedAt := ago(time.Minute)
+	tests := []struct {
+		name     string
+		status   batchv1.JobStatus
+		phase    string
+		finished *metav1.Time
+	}{
+		{"pending", batchv1.JobStatus{}, "Pending", nil},
+		{"running", batchv1.JobStatus{StartTime: ago(time.Hour), Active: 1}, "Running", nil},
+		{"complete", batchv1.JobStatus{StartTime: ago(time.Hour), CompletionTime: ago(time.Minute), Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue},
+		}}, "Complete", ago(time.Minute)},
+		// A failed Job has no completion time, it finished when it failed
+		{"failed", batchv1.JobStatus{StartTime: ago(time.Hour), Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", LastTransitionTime: *failedAt},
+		}}, "Failed", failedAt},
+		{"condition not true", batchv1.JobStatus{StartTime: ago(time.Hour), Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobFailed, Status: corev1.ConditionFalse},
+		}}, "Running", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := batchv1.Job{Status: tt.status}
+			if p := phase(j); p != tt.phase || completed(j) != (tt.finished != nil) {
+				t.Errorf("phase() = %s, completed() = %v, want %s", p, completed(j), tt.phase)
+			}
+			if got := finishedAt(j); (got == nil) != (tt.finished == nil) || (got != nil && !got.Equal(tt.finished)) {
+				t.Errorf("finishedAt() = %v, want %v", got, tt.finished)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		meta metav1.ObjectMeta
+		want string
+		cron string
+	}{
+		{"cron job", metav1.ObjectMeta{Name: "backup-29345678", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "Deployment", Name: "other"}, {Kind: "CronJob", Name: "backup"},
+		}}, "backup", "backup"},
+		{"generate name", metav1.ObjectMeta{Name: "migrate-x7k2p", GenerateName: "migrate-"}, "migrate", ""},
+		{"name", metav1.ObjectMeta{Name: "seed", OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "other"}}}, "seed", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := batchv1.Job{ObjectMeta: tt.meta}
+			if normalizeName(j) != tt.want || cronJob(j) != tt.cron {
+				t.Errorf("normalizeName() = %s, cronJob() = %s, want %s, %s", normalizeName(j), cronJob(j), tt.want, tt.cron)
+			}
+		})
+	}
+}
+
+// testJobs of the namespace batch, and one of another namespace
+func testJobs() []batchv1.Job {
+	job := func(name string, created *metav1.Time, status batchv1.JobStatus) batchv1.Job {
+		return batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "batch", UID: types.UID(name), CreationTimestamp: *created},
+			Status:     status,
+		}
+	}
+	complete := []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	failed := []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: *ago(5 * time.Minute)}}
+	other := job("other", ago(time.Minute), batchv1.JobStatus{})
+	other.Namespace = "web"
+	return []batchv1.Job{
+		job("recent", ago(time.Minute), batchv1.JobStatus{StartTime: ago(time.Minute), Active: 1}),
+		job("finished-long-ago", ago(48*time.Hour), batchv1.JobStatus{StartTime: ago(48 * time.Hour), CompletionTime: ago(47 * time.Hour), Conditions: complete}),
+		job("running-long", ago(48*time.Hour), batchv1.JobStatus{StartTime: ago(48 * time.Hour), Active: 1}),
+		job("completed-recently", ago(3*time.Hour), batchv1.JobStatus{StartTime: ago(3 * time.Hour), CompletionTime: ago(5 * time.Minute), Conditions: complete, Succeeded: 1}),
+		job("failed-recently", ago(3*time.Hour), batchv1.JobStatus{StartTime: ago(3 * time.Hour), Conditions: failed, Failed: 2}),
+		other,
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	cli := &fakeClient{jobs: testJobs()}
+	jobs, err := listJobs(context.Background(), cli, "batch", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs {
+		names = append(names, j.Name)
+	}
+	// A Job running since before the lookback is kept until it finishes
+	if want := []string{"recent", "running-long", "completed-recently", "failed-recently"}; !slices.Equal(names, want) {
+		t.Errorf("listJobs() = %v, want %v", names, want)
+	}
+	if cli.lists != 5 {
+		t.Errorf("lists = %d, want a page per Job of the namespace", cli.lists)
+	}
+}
+
+// containerRun is a terminated container run, seconds after start
+func containerRun(start time.Time, from, to int, exitCode int32) *corev1.ContainerStateTerminated {
+	return &corev1.ContainerStateTerminated{
+		StartedAt:  metav1.NewTime(start.Add(time.Duration(from) * time.Second)),
+		FinishedAt: metav1.NewTime(start.Add(time.Duration(to) * time.Second)),
+		ExitCode:   exitCode,
+	}
+}
+
+func TestTracePod(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	start := time.Now().Add(-time.Hour)
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "backup-29345678-abcde"},
+		Status: corev1.PodStatus{StartTime: &metav1.Time{Time: start}, ContainerStatuses: []corev1.ContainerStatus{
+			// Restarted twice, the first run is gone
+			{Name: "dump", RestartCount: 2, LastTerminationState: corev1.ContainerState{Terminated: containerRun(start, 10, 20, 1)}, State: corev1.ContainerState{Terminated: containerRun(start, 30, 90, 0)}},
+			{Name: "upload", State: corev1.ContainerState{Terminated: containerRun(start, 0, 60, 0)}},
+			{Name: "sidecar", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		}},
+	}
+	tracePod(pod, "backup", nil)
+	tracePod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "never-started"}}, "backup", nil)
+
+	spans := mt.FinishedSpans()
+	var restarts []string
+	for _, s := range spans {
+		switch s.OperationName() {
+		case "container":
+			restarts = append(restarts, s.Tag(ext.ResourceName).(string)+":"+strconv.Itoa(int(s.Tag("restart").(int32))))
+		case "pod":
+			if s.Tag(ext.ResourceName) != pod.Name || !s.FinishTime().Equal(start.Add(90*time.Second)) {
+				t.Errorf("pod span %v to %v, want until the last container exit", s.Tag(ext.ResourceName), s.FinishTime())
+			}
+		}
+	}
+	slices.Sort(restarts)
+	if want := []string{"dump:1", "dump:2", "upload:0"}; !slices.Equal(restarts, want) {
+		t.Errorf("container spans = %v, want %v", restarts, want)
+	}
+	if len(spans) != 4 {
+		t.Errorf("spans = %d, want a pod and 3 container runs", len(spans))
+	}
+}
+
+// failing is a sink that never takes an event
+type failing struct{}
+
+func (failing) Publish(context.Context, sink.Message) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestCycle(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "completed-recently-abcde", Namespace: "batch", Labels: map[string]string{"job-name": "completed-recently"}},
+		Status: corev1.PodStatus{StartTime: ago(3 * time.Hour)}}
+	cli := &fakeClient{jobs: testJobs(), pods: []corev1.Pod{pod}}
+	cfg := &config.Config{Sources: config.Sources{Job: config.Job{Namespace: "batch", Lookback: time.Hour}}}
+	cache := ttlcache.New[types.UID, string]()
+
+	// Nothing is cached while the sink fails
+	if err := cycle(context.Background(), cfg, cli, (&source.Emitter{Sink: failing{}}).For("job"), cache); err == nil {
+		t.Error("cycle() with a failing sink error = nil")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("cached %v without publishing", cache.Keys())
+	}
+
+	var out bytes.Buffer
+	em := (&source.Emitter{Sink: &sink.Writer{W: &out}}).For("job")
+	if err := cycle(context.Background(), cfg, cli, em, cache); err != nil {
+		t.Fatalf("cycle() error = %v", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 4 {
+		t.Errorf("published %d events, want 4", n)
+	}
+	counts := map[string]int{}
+	for _, s := range mt.FinishedSpans() {
+		counts[s.OperationName()]++
+	}
+	if counts["kubernetes_job"] != 2 || counts["pod"] != 1 {
+		t.Errorf("spans = %v, want the 2 completed Jobs and a pod", counts)
+	}
+
+	// A running Job that completes is published and traced, the pod error is returned
+	cli.jobs[0].Status.CompletionTime = ago(0)
+	cli.jobs[0].Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	cli.podsErr = errors.New("forbidden")
+	out.Reset()
+	if err := cycle(context.Background(), cfg, cli, em, cache); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("cycle() error = %v, want the pod error", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 1 || !strings.Contains(out.String(), `"phase":"Complete"`) {
+		t.Errorf("published %s, want the completed Job", out.String())
+	}
+}
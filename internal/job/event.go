@@ -0,0 +1,6 @@
+package job
+
+import "github.com/estecker/farm/internal/event/farmv1"
+
+// A Kubernetes Job event to publish, defined in proto/farm/v1/events.proto
+type Event = farmv1.KubernetesJob
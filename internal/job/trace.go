@@ -0,0 +1,113 @@
+package job
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"log/slog"
+	"time"
+)
+
+// statusToCode maps the phase of a Job to an HTTP status code
+// Makes the DataDog UI look nice
+func statusToCode(phase string) int {
+	switch phase {
+	case "Complete":
+		return 200
+	default:
+		return 500
+	}
+}
+
+// Create a DataDog trace for a Job, with a span per pod and per container attempt
+func trace(j batchv1.Job, pods []corev1.Pod, tenant string, tags map[string]string) {
+	p := phase(j)
+	slog.Debug("trace",
+		"phase", p,
+		"name", j.Name)
+	name := normalizeName(j)
+	started, finished := j.CreationTimestamp.Time, time.Now()
+	if j.Status.StartTime != nil {
+		started = j.Status.StartTime.Time
+	}
+	if t := finishedAt(j); t != nil {
+		finished = t.Time
+	}
+	rootSpan := tracer.StartSpan("kubernetes_job",
+		tracer.StartTime(j.CreationTimestamp.Time),
+		tracer.ResourceName(name))
+	rootSpan.SetTag(ext.HTTPCode, statusToCode(p))
+	rootSpan.SetTag(ext.HTTPMethod, "JOB")
+	rootSpan.SetTag("tenant", tenant)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
+
+	jobSpan := tracer.StartSpan(name,
+		tracer.ServiceName(name),
+		tracer.StartTime(started),
+		tracer.SpanType("kubernetes_job"),
+		tracer.ChildOf(rootSpan.Context()))
+	jobSpan.SetTag("component", "job")
+	jobSpan.SetTag("namespace", j.Namespace)
+	jobSpan.SetTag("cron_job", cronJob(j))
+	jobSpan.SetTag("phase", p)
+	jobSpan.SetTag("name", j.Name)
+	jobSpan.SetTag("job", j.UID)
+	jobSpan.SetTag("succeeded", j.Status.Succeeded)
+	jobSpan.SetTag("failed", j.Status.Failed)
+
+	for _, pod := range pods {
+		tracePod(pod, name, jobSpan.Context())
+	}
+	finishOptions := []tracer.FinishOption{tracer.FinishTime(finished), tracer.WithError(nil)}
+	jobSpan.Finish(finishOptions...)
+	rootSpan.Finish(finishOptions...)
+}
+
+// tracePod adds the span of a pod, from its start to its last container exit
+func tracePod(pod corev1.Pod, component string, parent ddtrace.SpanContext) {
+	if pod.Status.StartTime == nil {
+		return
+	}
+	finished := pod.Status.StartTime.Time
+	for _, cs := range pod.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil && t.FinishedAt.After(finished) {
+			finished = t.FinishedAt.Time
+		}
+	}
+	podSpan := tracer.StartSpan("pod",
+		tracer.ResourceName(pod.Name),
+		tracer.ChildOf(parent),
+		tracer.StartTime(pod.Status.StartTime.Time))
+	podSpan.SetTag("span.kind", "consumer")
+	podSpan.SetTag("component", component)
+	podSpan.SetTag("phase", pod.Status.Phase)
+	podSpan.SetTag("node", pod.Spec.NodeName)
+	podSpan.SetTag("reason", pod.Status.Reason)
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		// Only the attempt before the last restart is kept by Kubernetes
+		if t := cs.LastTerminationState.Terminated; t != nil {
+			traceContainer(cs.Name, t, cs.RestartCount-1, podSpan.Context())
+		}
+		if t := cs.State.Terminated; t != nil {
+			traceContainer(cs.Name, t, cs.RestartCount, podSpan.Context())
+		}
+	}
+	podSpan.Finish(tracer.FinishTime(finished), tracer.WithError(nil))
+}
+
+// traceContainer adds the span of one run of a container
+func traceContainer(name string, t *corev1.ContainerStateTerminated, restart int32, parent ddtrace.SpanContext) {
+	span := tracer.StartSpan("container",
+		tracer.ResourceName(name),
+		tracer.ChildOf(parent),
+		tracer.StartTime(t.StartedAt.Time))
+	span.SetTag("restart", restart)
+	span.SetTag("exit_code", t.ExitCode)
+	span.SetTag("reason", t.Reason)
+	span.Finish(tracer.FinishTime(t.FinishedAt.Time), tracer.WithError(nil))
+}
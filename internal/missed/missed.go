@@ -0,0 +1,77 @@
+package missed
+
+import (
+	"context"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/robfig/cron/v3"
+	"strconv"
+	"time"
+)
+
+// Most fire times counted between two runs, an every minute schedule missing for a day stops there
+const maxMissed = 10000
+
+// Since returns the latest fire time of the schedule after last and at or before until, and how many there are
+// Zero if the schedule did not fire in between
+func Since(schedule cron.Schedule, last, until time.Time) (time.Time, int) {
+	var latest time.Time
+	n := 0
+	for t := schedule.Next(last); !t.IsZero() && !t.After(until) && n < maxMissed; t = schedule.Next(t) {
+		latest = t
+		n++
+	}
+	return latest, n
+}
+
+// Check sends the overdue gauge of a scheduled workflow and publishes m if it has a missed run not published before
+// A nil m means the workflow is on schedule
+func Check(ctx context.Context, cfg *config.Config, em *source.Emitter, workflow string, m *farmv1.MissedRun, tenant, ceSource string) error {
+	if m == nil {
+		em.Gauge("schedule.overdue", 0, "workflow:"+workflow)
+		return nil
+	}
+	em.Gauge("schedule.overdue", time.Since(time.UnixMicro(m.ExpectedTime)).Seconds(), "workflow:"+workflow)
+	// The expected time of the last published missed run, it survives a restart with state.path
+	key := "missed/" + m.Source + "/" + m.Namespace + "/" + workflow
+	var published int64
+	if _, err := em.State.Get(key, &published); err != nil {
+		return err
+	}
+	if published >= m.ExpectedTime {
+		return nil
+	}
+	runID := m.Namespace + "/" + workflow + "/" + strconv.FormatInt(m.ExpectedTime, 10)
+	env := event.New("missed", m.Source+"/"+runID, "missed", tenant, cfg.Environment, m)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "missed",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	msgID, err := em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.schedule.run_missed",
+		Source:     ceSource,
+		Subject:    workflow,
+	})
+	if err != nil {
+		return err
+	}
+	em.Incr("schedule.missed", "workflow:"+workflow)
+	em.Logger.Info("Missed scheduled run",
+		"workflow", workflow,
+		"namespace", m.Namespace,
+		"expected", time.UnixMicro(m.ExpectedTime),
+		"missed", m.Missed,
+		"paused", m.Paused,
+		"msgID", msgID)
+	return em.State.Put(key, m.ExpectedTime)
+}
@@ -0,0 +1,185 @@
+package objectstore
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bucket is where the files are written to
+type Bucket interface {
+	// Put writes the object, key is a slash separated path
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// Open returns the bucket of the URL, gs://bucket/prefix, s3://bucket/prefix or a local directory
+func Open(ctx context.Context, rawURL string) (Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "gs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return GCS{Client: client, Bucket: u.Host, Prefix: prefix}, nil
+	case "s3":
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return S3{Client: s3.NewFromConfig(cfg), Bucket: u.Host, Prefix: prefix}, nil
+	case "file":
+		return Dir{Path: u.Path}, nil
+	case "":
+		return Dir{Path: rawURL}, nil
+	}
+	return nil, fmt.Errorf("unknown object storage %q, want gs://, s3:// or a directory", rawURL)
+}
+
+// GCS is a Google Cloud Storage bucket
+type GCS struct {
+	Client *storage.Client
+	Bucket string
+	Prefix string
+}
+
+func (b GCS) Put(ctx context.Context, key string, data []byte) error {
+	w := b.Client.Bucket(b.Bucket).Object(path.Join(b.Prefix, key)).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// S3 is an AWS S3 bucket, credentials and region come from the usual AWS environment
+type S3 struct {
+	Client *s3.Client
+	Bucket string
+	Prefix string
+}
+
+func (b S3) Put(ctx context.Context, key string, data []byte) error {
+	k := path.Join(b.Prefix, key)
+	_, err := b.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &b.Bucket,
+		Key:    &k,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Dir is a local directory, works without any cloud service
+type Dir struct {
+	Path string
+}
+
+func (b Dir) Put(ctx context.Context, key string, data []byte) error {
+	name := filepath.Join(b.Path, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	// Readers never see a partial file
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Tailer reads the end of objects with one client per scheme, created on first use
+// One is shared by the reads of a poll, Close it after
+type Tailer struct {
+	mu  sync.Mutex
+	gcs *storage.Client
+	s3  *s3.Client
+}
+
+// Tail reads the last n bytes of an object, gs://bucket/key or s3://bucket/key, all of it when it is smaller
+func (t *Tailer) Tail(ctx context.Context, rawURL string, n int64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "gs":
+		client, err := t.gcsClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r, err := client.Bucket(u.Host).Object(key).NewRangeReader(ctx, -n, -1)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "s3":
+		client, err := t.s3Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rng := "bytes=-" + strconv.FormatInt(n, 10)
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &u.Host, Key: &key, Range: &rng})
+		if err != nil {
+			return nil, err
+		}
+		defer out.Body.Close()
+		return io.ReadAll(out.Body)
+	}
+	return nil, fmt.Errorf("unknown object storage %q, want gs:// or s3://", rawURL)
+}
+
+func (t *Tailer) gcsClient(ctx context.Context) (*storage.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gcs == nil {
+		// The client outlives the read, so it gets its own context
+		client, err := storage.NewClient(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, err
+		}
+		t.gcs = client
+	}
+	return t.gcs, nil
+}
+
+func (t *Tailer) s3Client(ctx context.Context) (*s3.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.s3 == nil {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		t.s3 = s3.NewFromConfig(cfg)
+	}
+	return t.s3, nil
+}
+
+// Close the clients, the Tailer can be used again after
+func (t *Tailer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	if t.gcs != nil {
+		err = t.gcs.Close()
+	}
+	t.gcs, t.s3 = nil, nil
+	return err
+}
@@ -0,0 +1,252 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/schema"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/google/uuid"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// File formats
+const (
+	FormatParquet = "parquet"
+	FormatNDJSON  = "ndjson" //One envelope per line, the json encoding of the other sinks
+)
+
+// Sink buffers events and writes them as files partitioned like source=argo/tenant=eddie/date=2026-10-19/
+// A partition is flushed when it has FlushSize events, every FlushInterval and on Close
+type Sink struct {
+	Bucket        Bucket
+	Format        string
+	FlushSize     int
+	FlushInterval time.Duration
+
+	mu      sync.Mutex
+	buffers map[string]*buffer //By partition
+	start   sync.Once
+	closing sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// buffer of the events of one partition
+type buffer struct {
+	source string
+	events []event.Envelope
+}
+
+// Hive's name of the partition of a missing value
+const defaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// errBuffered wraps the error of a write whose events stay buffered for the next flush
+var errBuffered = errors.New("events kept buffered")
+
+func (s *Sink) Publish(ctx context.Context, msg sink.Message) (string, error) {
+	s.start.Do(s.run)
+	e := msg.Event
+	tenant := e.Tenant
+	if tenant == "" {
+		tenant = defaultPartition
+	}
+	partition := fmt.Sprintf("source=%s/tenant=%s/date=%s", e.Source, tenant, time.UnixMicro(e.EventTime).UTC().Format(time.DateOnly))
+	s.mu.Lock()
+	b, ok := s.buffers[partition]
+	if !ok {
+		b = &buffer{source: e.Source}
+		s.buffers[partition] = b
+	}
+	b.events = append(b.events, e)
+	full := len(b.events) >= s.FlushSize
+	s.mu.Unlock()
+	if full {
+		// The event is taken once buffered, a failed write is tried again by the next flush
+		// Returning the error would have the caller publish the event a second time
+		if err := s.flush(ctx, partition); errors.Is(err, errBuffered) {
+			slog.Error("Object storage: write failed, will retry", "error", err)
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return e.EventID, nil
+}
+
+// Close writes every buffered event, closing it again only flushes
+func (s *Sink) Close() error {
+	s.start.Do(s.run)
+	s.closing.Do(func() {
+		close(s.stop)
+		<-s.stopped
+	})
+	return s.Flush(context.Background())
+}
+
+// Flush writes every buffered event
+func (s *Sink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	var partitions []string
+	for p := range s.buffers {
+		partitions = append(partitions, p)
+	}
+	s.mu.Unlock()
+	var errs []error
+	for _, p := range partitions {
+		if err := s.flush(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("flushing %d partitions failed, first: %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// run flushes every FlushInterval until Close
+func (s *Sink) run() {
+	s.mu.Lock()
+	s.buffers = map[string]*buffer{}
+	s.mu.Unlock()
+	s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(s.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Flush(context.Background()); err != nil {
+					slog.Error("Object storage: flush failed, will retry", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// flush writes the events of the partition to a new file, they stay buffered if the write fails
+// Events that can not be encoded never will be, they are dropped so the partition does not grow forever
+func (s *Sink) flush(ctx context.Context, partition string) error {
+	s.mu.Lock()
+	b, ok := s.buffers[partition]
+	delete(s.buffers, partition)
+	s.mu.Unlock()
+	if !ok || len(b.events) == 0 {
+		return nil
+	}
+	data, err := s.encode(b)
+	if err != nil {
+		slog.Error("Object storage: dropping events that can not be encoded", "partition", partition, "events", len(b.events), "error", err)
+		return fmt.Errorf("%s: %w", partition, err)
+	}
+	key := fmt.Sprintf("%s/%s-%s.%s", partition, time.Now().UTC().Format("20060102T150405Z"), uuid.NewString(), s.Format)
+	if err := s.Bucket.Put(ctx, key, data); err != nil {
+		// Put them back in front of anything published meanwhile
+		s.mu.Lock()
+		if newer, ok := s.buffers[partition]; ok {
+			b.events = append(b.events, newer.events...)
+		}
+		s.buffers[partition] = b
+		s.mu.Unlock()
+		return fmt.Errorf("%s: %w, %w", partition, err, errBuffered)
+	}
+	slog.Info("Object storage: wrote file", "key", key, "events", len(b.events))
+	return nil
+}
+
+func (s *Sink) encode(b *buffer) ([]byte, error) {
+	if s.Format == FormatNDJSON {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, e := range b.events {
+			if err := enc.Encode(e); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	md, ok := schema.Events[b.source]
+	if !ok {
+		return nil, fmt.Errorf("no schema for source %q", b.source)
+	}
+	return encodeParquet(schema.BigQuery(md), b.events)
+}
+
+// encodeParquet writes the events as a Snappy compressed Parquet file with the columns of the BigQuery schema
+func encodeParquet(fields []schema.BigQueryField, events []event.Envelope) ([]byte, error) {
+	rows := make([]map[string]any, 0, len(events))
+	for _, e := range events {
+		row, err := schema.Row(fields, e)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	sc := arrow.NewSchema(arrowFields(fields), nil)
+	rec, _, err := array.RecordFromJSON(memory.DefaultAllocator, sc, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+	var buf bytes.Buffer
+	w, err := pqarrow.NewFileWriter(sc, &buf,
+		parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy)),
+		pqarrow.DefaultWriterProps())
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Write(rec); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// arrowFields maps the BigQuery columns to Arrow, JSON columns are strings of JSON text
+func arrowFields(fields []schema.BigQueryField) []arrow.Field {
+	var out []arrow.Field
+	for _, f := range fields {
+		var t arrow.DataType
+		switch f.Type {
+		case "STRING", "JSON":
+			t = arrow.BinaryTypes.String
+		case "BOOLEAN":
+			t = arrow.FixedWidthTypes.Boolean
+		case "FLOAT":
+			t = arrow.PrimitiveTypes.Float64
+		case "BYTES":
+			t = arrow.BinaryTypes.Binary
+		case "TIMESTAMP":
+			t = &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}
+		case "RECORD":
+			t = arrow.StructOf(arrowFields(f.Fields)...)
+		default:
+			t = arrow.PrimitiveTypes.Int64
+		}
+		if f.Mode == "REPEATED" {
+			t = arrow.ListOf(t)
+		}
+		out = append(out, arrow.Field{Name: f.Name, Type: t, Nullable: true})
+	}
+	return out
+}
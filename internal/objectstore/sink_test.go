@@ -0,0 +1,117 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBucket keeps the files it was given, failing while down is set
+type fakeBucket struct {
+	mu    sync.Mutex
+	down  bool
+	files map[string][]byte
+}
+
+func (b *fakeBucket) Put(ctx context.Context, key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("unavailable")
+	}
+	b.files[key] = data
+	return nil
+}
+
+func message(source, run string) sink.Message {
+	return sink.Message{Event: event.New(source, run, "Succeeded", "eddie", "stg", &farmv1.ArgoWorkflow{Name: run})}
+}
+
+func TestFlushKeepsEventsUntilPut(t *testing.T) {
+	b := &fakeBucket{down: true, files: map[string][]byte{}}
+	s := &Sink{Bucket: b, Format: FormatNDJSON, FlushSize: 2, FlushInterval: time.Hour}
+	ctx := context.Background()
+	if _, err := s.Publish(ctx, message("argo", "a")); err != nil {
+		t.Fatalf("Publish(a) error = %v", err)
+	}
+	// b is taken and kept buffered, an error would have it published again
+	if _, err := s.Publish(ctx, message("argo", "b")); err != nil {
+		t.Fatalf("Publish(b) error = %v, want it buffered", err)
+	}
+	if err := s.Flush(ctx); !errors.Is(err, errBuffered) {
+		t.Fatalf("Flush() error = %v, want the events kept", err)
+	}
+	b.down = false
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	if len(b.files) != 1 {
+		t.Fatalf("files = %d, want 1", len(b.files))
+	}
+	for key, data := range b.files {
+		if !strings.HasPrefix(key, "source=argo/tenant=eddie/date=") || !strings.HasSuffix(key, ".ndjson") {
+			t.Errorf("key = %s", key)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 2 {
+			t.Errorf("%s has %d events, want 2", key, lines)
+		}
+	}
+}
+
+func TestFlushDropsEventsThatCanNotBeEncoded(t *testing.T) {
+	b := &fakeBucket{files: map[string][]byte{}}
+	s := &Sink{Bucket: b, Format: FormatParquet, FlushSize: 10, FlushInterval: time.Hour}
+	ctx := context.Background()
+	if _, err := s.Publish(ctx, message("unknown", "a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("Flush() error = nil, want an encode error")
+	}
+	if len(s.buffers) != 0 {
+		t.Errorf("buffers = %d, want the batch dropped", len(s.buffers))
+	}
+	if _, err := s.Publish(ctx, message("argo", "b")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(b.files) != 1 {
+		t.Errorf("files = %d, want the Parquet file of the argo event", len(b.files))
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := Open(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sink{Bucket: bucket, Format: FormatParquet, FlushSize: 1, FlushInterval: time.Hour}
+	if _, err := s.Publish(context.Background(), message("argo", "a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "source=argo", "tenant=eddie", "date=*", "*.parquet"))
+	if len(files) != 1 {
+		t.Fatalf("files = %v, want one Parquet file", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.HasPrefix(string(data), "PAR1") {
+		t.Errorf("%s is not a Parquet file", files[0])
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package phase
+
+import (
+	"github.com/estecker/farm/internal/event/farmv1"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"strconv"
+	"time"
+)
+
+// Phases of a step, named after the Airflow task instance states
+const (
+	Scheduled = "scheduled" //Ready to run, waiting for the scheduler to queue it or for a node
+	Queued    = "queued"    //Waiting for a worker or pool slot, or for the images and init containers
+	Running   = "running"
+)
+
+// Step is when a step was ready to run, queued, started and finished, zero when unknown
+type Step struct {
+	Ready    time.Time
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// between is the duration from a to b, zero if either is unknown
+func between(a, b time.Time) time.Duration {
+	if a.IsZero() || b.IsZero() || b.Before(a) {
+		return 0
+	}
+	return b.Sub(a)
+}
+
+// Start is the start of the first known phase
+func (s Step) Start() time.Time {
+	for _, t := range []time.Time{s.Ready, s.Queued, s.Started} {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return s.Finished
+}
+
+// Durations of the phases, by name
+func (s Step) Durations() map[string]time.Duration {
+	return map[string]time.Duration{
+		Scheduled: between(s.Ready, s.Queued),
+		Queued:    between(s.Queued, s.Started),
+		Running:   between(s.Started, s.Finished),
+	}
+}
+
+// Trace adds a child span to parent for every phase with both bounds known
+func (s Step) Trace(parent ddtrace.SpanContext, resource string) {
+	for _, p := range []struct {
+		name       string
+		start, end time.Time
+	}{
+		{Scheduled, s.Ready, s.Queued},
+		{Queued, s.Queued, s.Started},
+		{Running, s.Started, s.Finished},
+	} {
+		if between(p.start, p.end) == 0 {
+			continue
+		}
+		span := tracer.StartSpan("phase",
+			tracer.ResourceName(resource),
+			tracer.ChildOf(parent),
+			tracer.StartTime(p.start))
+		span.SetTag("phase", p.name)
+		span.Finish(tracer.FinishTime(p.end), tracer.WithError(nil))
+	}
+}
+
+// Delays of a run from its steps, due is when it should have started, zero if it was not scheduled
+func Delays(due, started time.Time, steps []Step) *farmv1.RunDelays {
+	d := &farmv1.RunDelays{ScheduleDelay: between(due, started).Seconds()}
+	for _, s := range steps {
+		durations := s.Durations()
+		d.Scheduled += durations[Scheduled].Seconds()
+		d.Queued += durations[Queued].Seconds()
+		d.Running += durations[Running].Seconds()
+	}
+	return d
+}
+
+// Tags for the span of the run
+func Tags(d *farmv1.RunDelays) map[string]string {
+	if d == nil {
+		return nil
+	}
+	return map[string]string{
+		"schedule_delay": strconv.FormatFloat(d.ScheduleDelay, 'f', 1, 64),
+		"scheduled_time": strconv.FormatFloat(d.Scheduled, 'f', 1, 64),
+		"queue_time":     strconv.FormatFloat(d.Queued, 'f', 1, 64),
+		"running_time":   strconv.FormatFloat(d.Running, 'f', 1, 64),
+	}
+}
@@ -0,0 +1,93 @@
+package phase
+
+import (
+	"github.com/estecker/farm/internal/event/farmv1"
+	"maps"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+// at is seconds after t0
+func at(seconds int) time.Time {
+	return t0.Add(time.Duration(seconds) * time.Second)
+}
+
+func TestDurations(t *testing.T) {
+	tests := []struct {
+		name                       string
+		step                       Step
+		start                      time.Time
+		scheduled, queued, running time.Duration
+	}{
+		{"every phase", Step{Ready: at(0), Queued: at(5), Started: at(15), Finished: at(75)}, at(0), 5 * time.Second, 10 * time.Second, time.Minute},
+		{"never queued", Step{Ready: at(0), Started: at(15), Finished: at(75)}, at(0), 0, 0, time.Minute},
+		{"unknown ready", Step{Queued: at(5), Started: at(15), Finished: at(75)}, at(5), 0, 10 * time.Second, time.Minute},
+		{"still running", Step{Ready: at(0), Queued: at(5), Started: at(15)}, at(0), 5 * time.Second, 10 * time.Second, 0},
+		// Clock skew between the scheduler and the workers, a phase ending before it starts has no duration
+		{"queued before ready", Step{Ready: at(10), Queued: at(5), Started: at(15), Finished: at(20)}, at(10), 0, 10 * time.Second, 5 * time.Second},
+		{"finished before started", Step{Ready: at(0), Queued: at(5), Started: at(15), Finished: at(14)}, at(0), 5 * time.Second, 10 * time.Second, 0},
+		{"only finished", Step{Finished: at(75)}, at(75), 0, 0, 0},
+		{"nothing", Step{}, time.Time{}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := map[string]time.Duration{Scheduled: tt.scheduled, Queued: tt.queued, Running: tt.running}
+			if got := tt.step.Durations(); !maps.Equal(got, want) {
+				t.Errorf("Durations() = %v, want %v", got, want)
+			}
+			if got := tt.step.Start(); !got.Equal(tt.start) {
+				t.Errorf("Start() = %v, want %v", got, tt.start)
+			}
+		})
+	}
+}
+
+func TestDelays(t *testing.T) {
+	steps := []Step{
+		{Ready: at(0), Queued: at(5), Started: at(15), Finished: at(75)},
+		{Ready: at(75), Queued: at(80), Started: at(100), Finished: at(130)},
+		{Ready: at(75)}, //Skipped
+	}
+	tests := []struct {
+		name          string
+		due, started  time.Time
+		scheduleDelay float64
+	}{
+		{"late", at(-30), at(0), 30},
+		{"not scheduled", time.Time{}, at(0), 0},
+		{"started before due", at(10), at(0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Delays(tt.due, tt.started, steps)
+			if d.ScheduleDelay != tt.scheduleDelay || d.Scheduled != 10 || d.Queued != 30 || d.Running != 90 {
+				t.Errorf("Delays() = %v", d)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		delays *farmv1.RunDelays
+		want   map[string]string
+	}{
+		{"nil", nil, nil},
+		{"delays", &farmv1.RunDelays{ScheduleDelay: 30, Scheduled: 10.25, Queued: 30, Running: 90}, map[string]string{
+			"schedule_delay": "30.0",
+			"scheduled_time": "10.2",
+			"queue_time":     "30.0",
+			"running_time":   "90.0",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Tags(tt.delays); !maps.Equal(got, tt.want) {
+				t.Errorf("Tags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
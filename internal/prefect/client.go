@@ -0,0 +1,148 @@
+package prefect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client of the Prefect REST API, only the endpoints FARM reads
+// https://docs.prefect.io/latest/api-ref/rest-api/
+type Client struct {
+	URL        string //e.g. https://api.prefect.cloud/api/accounts/<account>/workspaces/<workspace>
+	APIKey     string //Empty for a self hosted server without auth
+	HTTPClient *http.Client
+}
+
+type state struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type flowRun struct {
+	ID                string         `json:"id"`
+	Name              string         `json:"name"`
+	FlowID            string         `json:"flow_id"`
+	DeploymentID      string         `json:"deployment_id"`
+	State             *state         `json:"state"`
+	Tags              []string       `json:"tags"`
+	Parameters        map[string]any `json:"parameters"`
+	ExpectedStartTime *time.Time     `json:"expected_start_time"`
+	StartTime         *time.Time     `json:"start_time"`
+	EndTime           *time.Time     `json:"end_time"`
+	TotalRunTime      float64        `json:"total_run_time"`
+	RunCount          int32          `json:"run_count"`
+}
+
+type flow struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type taskRun struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	TaskKey      string     `json:"task_key"`
+	DynamicKey   string     `json:"dynamic_key"`
+	State        *state     `json:"state"`
+	StartTime    *time.Time `json:"start_time"`
+	EndTime      *time.Time `json:"end_time"`
+	TotalRunTime float64    `json:"total_run_time"`
+	RunCount     int32      `json:"run_count"`
+}
+
+// Flow runs and task runs fetched per API call, tests page through small fixtures
+var pageSize = 200
+
+// post sends the body as JSON and decodes the response into v
+func (c *Client) post(ctx context.Context, path string, body any, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST %s: %s: %s", path, resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// flowRuns that started or ended after since
+func (c *Client) flowRuns(ctx context.Context, since time.Time) ([]flowRun, error) {
+	var runs []flowRun
+	for offset := 0; ; offset += pageSize {
+		var page []flowRun
+		err := c.post(ctx, "/flow_runs/filter", map[string]any{
+			"flow_runs": map[string]any{
+				"operator":   "or_",
+				"start_time": map[string]any{"after_": since},
+				"end_time":   map[string]any{"after_": since},
+			},
+			"sort":   "START_TIME_DESC",
+			"limit":  pageSize,
+			"offset": offset,
+		}, &page)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, page...)
+		if len(page) < pageSize {
+			return runs, nil
+		}
+	}
+}
+
+// flowNames by flow ID
+func (c *Client) flowNames(ctx context.Context, ids []string) (map[string]string, error) {
+	names := map[string]string{}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	var flows []flow
+	err := c.post(ctx, "/flows/filter", map[string]any{
+		"flows": map[string]any{"id": map[string]any{"any_": ids}},
+	}, &flows)
+	for _, f := range flows {
+		names[f.ID] = f.Name
+	}
+	return names, err
+}
+
+// taskRuns of a flow run
+func (c *Client) taskRuns(ctx context.Context, flowRunID string) ([]taskRun, error) {
+	var runs []taskRun
+	for offset := 0; ; offset += pageSize {
+		var page []taskRun
+		err := c.post(ctx, "/task_runs/filter", map[string]any{
+			"flow_runs": map[string]any{"id": map[string]any{"any_": []string{flowRunID}}},
+			"sort":      "EXPECTED_START_TIME_ASC",
+			"limit":     pageSize,
+			"offset":    offset,
+		}, &page)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, page...)
+		if len(page) < pageSize {
+			return runs, nil
+		}
+	}
+}
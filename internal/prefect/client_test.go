@@ -0,0 +1,190 @@
+package prefect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI serves the recorded responses in testdata, paged by the limit and offset of the request
+type fakeAPI struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests map[string][]map[string]any //Bodies by path
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Errorf("%s: %v", r.URL.Path, err)
+	}
+	f.mu.Lock()
+	f.requests[r.URL.Path] = append(f.requests[r.URL.Path], body)
+	f.mu.Unlock()
+	name, ok := map[string]string{
+		"/api/flow_runs/filter": "flow_runs.json",
+		"/api/flows/filter":     "flows.json",
+		"/api/task_runs/filter": "task_runs.json",
+	}[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(fixture(f.t, name), &items); err != nil {
+		f.t.Fatal(err)
+	}
+	if limit, ok := body["limit"].(float64); ok {
+		offset := min(int(body["offset"].(float64)), len(items))
+		items = items[offset:min(offset+int(limit), len(items))]
+	}
+	_ = json.NewEncoder(w).Encode(items)
+}
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newFake(t *testing.T) (*fakeAPI, *Client) {
+	f := &fakeAPI{t: t, requests: map[string][]map[string]any{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &Client{URL: srv.URL + "/api/", HTTPClient: srv.Client()}
+}
+
+func TestFlowRuns(t *testing.T) {
+	defer func(n int) { pageSize = n }(pageSize)
+	pageSize = 1
+	f, cli := newFake(t)
+	since := time.Date(2026, 10, 19, 8, 55, 0, 0, time.UTC)
+
+	runs, err := cli.flowRuns(context.Background(), since)
+	if err != nil {
+		t.Fatalf("flowRuns() error = %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("flowRuns() = %d runs, want 2", len(runs))
+	}
+	requests := f.requests["/api/flow_runs/filter"]
+	if len(requests) != 3 {
+		t.Errorf("requests = %d, want 3 pages of 1", len(requests))
+	}
+	for i, body := range requests {
+		if body["offset"] != float64(i) {
+			t.Errorf("request %d offset = %v", i, body["offset"])
+		}
+		// A run that started before since and ended after it changed in the window too
+		filter := body["flow_runs"].(map[string]any)
+		if filter["operator"] != "or_" {
+			t.Errorf("operator = %v, want or_", filter["operator"])
+		}
+		for _, field := range []string{"start_time", "end_time"} {
+			if got := filter[field].(map[string]any)["after_"]; got != "2026-10-19T08:55:00Z" {
+				t.Errorf("%s.after_ = %v", field, got)
+			}
+		}
+	}
+
+	done, running := runs[0], runs[1]
+	if done.State.Type != "COMPLETED" || !completed(done.State) || done.EndTime == nil || done.TotalRunTime != 248.683 {
+		t.Errorf("runs[0] = %+v", done)
+	}
+	if done.Parameters["date"] != "2026-10-18" || len(done.Tags) != 2 {
+		t.Errorf("runs[0] parameters = %v, tags = %v", done.Parameters, done.Tags)
+	}
+	if completed(running.State) || running.EndTime != nil || commonState(running.State) != "running" {
+		t.Errorf("runs[1] = %+v", running)
+	}
+}
+
+// failing is a sink that never takes an event
+type failing struct{}
+
+func (failing) Publish(context.Context, sink.Message) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestCycle(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	f, cli := newFake(t)
+	var out bytes.Buffer
+	em := (&source.Emitter{Sink: &sink.Writer{W: &out}}).For("prefect")
+	cfg := &config.Config{Sources: config.Sources{Prefect: config.Prefect{URL: cli.URL, UIURL: "https://app.prefect.cloud/", Lookback: time.Hour}}}
+
+	if err := cycle(context.Background(), cfg, cli, em, ttlcache.New[string, string]()); err != nil {
+		t.Fatalf("cycle() error = %v", err)
+	}
+	type published struct {
+		Data struct {
+			Payload *Event `json:"payload"`
+		} `json:"data"`
+	}
+	var events []*published
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		e := &published{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("published %d events, want 2", len(events))
+	}
+	if p := events[0].Data.Payload; p.FlowName != "nightly-etl" || p.State != "success" || p.Tags["team"] != "data" || p.Url != "https://app.prefect.cloud/flow-runs/flow-run/"+p.Id {
+		t.Errorf("events[0] = %+v", p)
+	}
+	if p := events[1].Data.Payload; p.FlowName != "adhoc-export" || p.State != "running" || p.EndTime != 0 {
+		t.Errorf("events[1] = %+v", p)
+	}
+
+	// Only the completed flow run is traced, with its task runs
+	tasks := f.requests["/api/task_runs/filter"]
+	if len(tasks) != 1 {
+		t.Fatalf("task run requests = %d, want 1", len(tasks))
+	}
+	if ids := tasks[0]["flow_runs"].(map[string]any)["id"].(map[string]any)["any_"].([]any); len(ids) != 1 || ids[0] != "0c6c8a52-3f0d-4a5e-9d37-2b1f4e6a9c11" {
+		t.Errorf("task runs of %v", ids)
+	}
+	names := map[string]bool{}
+	for _, s := range mt.FinishedSpans() {
+		names[s.OperationName()+" "+s.Tag(ext.ResourceName).(string)] = true
+		// The state and expected start are plain values, not Go structs and pointers
+		if s.Tag("flow_run_id") != nil && (s.Tag("state") != "COMPLETED" || s.Tag("state_name") != "Completed" || s.Tag("expected_start_time") != "2026-10-19T09:00:00Z") {
+			t.Errorf("flow run span tags = %v", s.Tags())
+		}
+		if s.OperationName() == "flowTask" && s.Tag("state") != "COMPLETED" {
+			t.Errorf("task span tags = %v", s.Tags())
+		}
+	}
+	for _, name := range []string{"prefect.flowrun nightly-etl", "flowTask extract-0", "flowTask load-0"} {
+		if !names[name] {
+			t.Errorf("no span %s in %v", name, names)
+		}
+	}
+
+	// Nothing is cached while the sink fails, the errors are returned
+	cache := ttlcache.New[string, string]()
+	if err := cycle(context.Background(), cfg, cli, (&source.Emitter{Sink: failing{}}).For("prefect"), cache); err == nil || cache.Len() != 0 {
+		t.Errorf("cycle() with a failing sink error = %v, cached %v", err, cache.Keys())
+	}
+}
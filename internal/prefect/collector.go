@@ -0,0 +1,226 @@
+package prefect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commonState maps a Prefect state type to the Airflow DAG run states, queued, running, success or failed
+func commonState(s *state) string {
+	if s == nil {
+		return "queued"
+	}
+	switch s.Type {
+	case "COMPLETED":
+		return "success"
+	case "FAILED", "CRASHED", "CANCELLED":
+		return "failed"
+	case "RUNNING", "CANCELLING", "PAUSED":
+		return "running"
+	}
+	return "queued" //SCHEDULED, PENDING
+}
+
+// completed reports if the flow run will not change state anymore
+func completed(s *state) bool {
+	return s != nil && slices.Contains([]string{"COMPLETED", "FAILED", "CRASHED", "CANCELLED"}, s.Type)
+}
+
+// Link to the flow run in the Prefect UI, empty without sources.prefect.ui_url
+func runUrl(ui string, run flowRun) string {
+	if ui == "" {
+		return ""
+	}
+	return strings.TrimSuffix(ui, "/") + "/flow-runs/flow-run/" + run.ID
+}
+
+func micros(t *time.Time) int64 {
+	if t == nil {
+		return 0 //otherwise will send the zero value date, which is not null
+	}
+	return t.UnixMicro()
+}
+
+// timeOf is the zero time for a nil time
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// Build the event for a flow run and publish it
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, run flowRun, flowName string) (string, error) {
+	e := &Event{
+		Id:                run.ID,
+		Name:              run.Name,
+		FlowId:            run.FlowID,
+		FlowName:          flowName,
+		DeploymentId:      run.DeploymentID,
+		Url:               runUrl(cfg.Sources.Prefect.UIURL, run),
+		State:             commonState(run.State),
+		Tags:              map[string]string{},
+		ExpectedStartTime: micros(run.ExpectedStartTime),
+		StartTime:         micros(run.StartTime),
+		EndTime:           micros(run.EndTime),
+		TotalRunTime:      run.TotalRunTime,
+		RunCount:          run.RunCount,
+	}
+	if run.State != nil {
+		e.StateType, e.StateName = run.State.Type, run.State.Name
+	}
+	// Prefect tags are a list, keep them as keys like the labels of the other sources
+	for _, t := range run.Tags {
+		k, v, _ := strings.Cut(t, ":")
+		e.Tags[k] = v
+	}
+	for name, v := range run.Parameters {
+		b, _ := json.Marshal(v)
+		e.Parameters = append(e.Parameters, &farmv1.Parameter{Name: name, Value: string(b)})
+	}
+	slices.SortFunc(e.Parameters, func(a, b *farmv1.Parameter) int { return strings.Compare(a.Name, b.Name) })
+	env := event.New("prefect", run.ID, e.StateType, cfg.Sources.Prefect.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "prefect",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.prefect.flowrun.state_changed",
+		Source:     cfg.Sources.Prefect.URL,
+		Subject:    flowName + "/" + run.Name,
+	})
+}
+
+// Publish the flow runs whose state changed and trace the completed ones, returns the publish errors and those of the task runs
+// A run is only cached once published, so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, cli *Client, em *source.Emitter, runs []flowRun, names map[string]string, cache *ttlcache.Cache[string, string]) error {
+	var errs []error
+	for _, run := range runs {
+		flowName := names[run.FlowID]
+		if !cfg.Sources.Prefect.Filter.Match(flowName) {
+			continue
+		}
+		stateType := ""
+		if run.State != nil {
+			stateType = run.State.Type
+		}
+		if cache.Has(run.ID) && cache.Get(run.ID).Value() == stateType {
+			continue
+		}
+		msgID, err := publish(ctx, cfg, em, run, flowName)
+		if err != nil {
+			em.Logger.Error("Prefect: Error publishing", "error", err, "flowRun", run.Name)
+			errs = append(errs, err)
+			continue
+		}
+		cache.Set(run.ID, stateType, 0)
+		em.Logger.Debug("pubsub.publish",
+			"type", "prefect",
+			"state", stateType,
+			"flow", flowName,
+			"flowRun", run.Name,
+			"msgID", msgID)
+		if completed(run.State) {
+			tasks, err := cli.taskRuns(ctx, run.ID)
+			if err != nil {
+				em.Logger.Error("Prefect: Error listing task runs", "error", err, "flowRun", run.Name)
+				errs = append(errs, err)
+			}
+			trace(run, flowName, tasks, cfg.Sources.Prefect.Tenant, runUrl(cfg.Sources.Prefect.UIURL, run), em.Completed(ctx, cfg, slo.Run{
+				Source:   "prefect",
+				Workflow: flowName,
+				Tenant:   cfg.Sources.Prefect.Tenant,
+				ID:       run.ID,
+				URL:      runUrl(cfg.Sources.Prefect.UIURL, run),
+				Start:    timeOf(run.StartTime),
+				End:      timeOf(run.EndTime),
+				Success:  run.State.Type == "COMPLETED",
+			}))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewClient of the API in the config
+func NewClient(cfg config.Prefect) *Client {
+	return &Client{URL: cfg.URL, APIKey: cfg.APIKey, HTTPClient: &http.Client{Timeout: time.Minute}}
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Prefect flow run events, sources.prefect in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "prefect"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Prefect.Enabled
+}
+
+// Run is the main loop for collecting Prefect events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	cache := ttlcache.New[string, string](ttlcache.WithTTL[string, string](time.Hour))
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, NewClient(cfg.Sources.Prefect), em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Prefect.Interval) {
+			return nil
+		}
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every flow run in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	if cfg.Sources.Prefect.URL == "" {
+		return errors.New("sources.prefect.url not set")
+	}
+	return cycle(ctx, cfg, NewClient(cfg.Sources.Prefect), em, ttlcache.New[string, string]())
+}
+
+// cycle is one poll of the Prefect API, returns the API and publish errors
+func cycle(ctx context.Context, cfg *config.Config, cli *Client, em *source.Emitter, cache *ttlcache.Cache[string, string]) error {
+	runs, err := cli.flowRuns(ctx, time.Now().Add(-cfg.Sources.Prefect.Lookback))
+	if err != nil {
+		em.Logger.Error("Prefect: Error listing flow runs", "error", err)
+		return err
+	}
+	var ids []string
+	for _, run := range runs {
+		if !slices.Contains(ids, run.FlowID) {
+			ids = append(ids, run.FlowID)
+		}
+	}
+	names, err := cli.flowNames(ctx, ids)
+	if err != nil {
+		em.Logger.Error("Prefect: Error listing flows", "error", err)
+		return err
+	}
+	return collect(ctx, cfg, cli, em, runs, names, cache)
+}
@@ -0,0 +1,93 @@
+package prefect
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"log/slog"
+	"time"
+)
+
+// statusToCode maps the state of a flow run to an HTTP status code
+// Makes the DataDog UI look nice
+func statusToCode(s *state) int {
+	switch commonState(s) {
+	case "success":
+		return 200
+	case "running", "queued":
+		return 102
+	default:
+		return 500
+	}
+}
+
+func orNow(t *time.Time) time.Time {
+	if t == nil {
+		return time.Now()
+	}
+	return *t
+}
+
+// setState tags the type of the state, e.g. COMPLETED, and its name, e.g. Cached
+func setState(span ddtrace.Span, s *state) {
+	if s == nil {
+		return
+	}
+	span.SetTag("state", s.Type)
+	span.SetTag("state_name", s.Name)
+}
+
+// Create a DataDog trace for a flow run with a span per task run, the same tree as an Airflow DAG run
+func trace(run flowRun, flowName string, tasks []taskRun, tenant string, url string, tags map[string]string) {
+	slog.Debug("trace",
+		"type", "prefect",
+		"state", run.State,
+		"flow", flowName,
+		"flowRun", run.Name)
+	start := orNow(run.StartTime)
+	rootSpan := tracer.StartSpan("prefect.flowrun",
+		tracer.StartTime(start),
+		tracer.ResourceName(flowName))
+	rootSpan.SetTag(ext.HTTPMethod, "PREFECT")
+	rootSpan.SetTag(ext.HTTPCode, statusToCode(run.State))
+	rootSpan.SetTag("tenant", tenant)
+	rootSpan.SetTag("url", url)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
+
+	flowRunSpan := tracer.StartSpan(run.Name,
+		tracer.ServiceName(flowName),
+		tracer.StartTime(start),
+		tracer.SpanType("prefect_flowrun"),
+		tracer.ChildOf(rootSpan.Context()))
+	flowRunSpan.SetTag("flow_run_id", run.ID)
+	flowRunSpan.SetTag("flow_name", flowName)
+	flowRunSpan.SetTag("deployment_id", run.DeploymentID)
+	if run.ExpectedStartTime != nil {
+		flowRunSpan.SetTag("expected_start_time", run.ExpectedStartTime.Format(time.RFC3339))
+	}
+	setState(flowRunSpan, run.State)
+	flowRunSpan.SetTag("run_count", run.RunCount)
+	flowRunSpan.SetTag("tags", run.Tags)
+	for _, task := range tasks {
+		if task.StartTime == nil {
+			continue //never ran, e.g. upstream failed
+		}
+		taskSpan := tracer.StartSpan(
+			task.TaskKey,
+			tracer.ChildOf(flowRunSpan.Context()),
+			tracer.StartTime(*task.StartTime),
+			tracer.ResourceName(task.Name))
+		taskSpan.SetTag("task_run_id", task.ID)
+		taskSpan.SetTag("dynamic_key", task.DynamicKey)
+		setState(taskSpan, task.State)
+		taskSpan.SetTag("run_count", task.RunCount)
+		taskSpan.SetTag("duration", task.TotalRunTime)
+		taskSpan.SetOperationName("flowTask")
+		taskSpan.Finish(tracer.FinishTime(orNow(task.EndTime)), tracer.WithError(nil))
+	}
+	finishOptions := []tracer.FinishOption{tracer.FinishTime(orNow(run.EndTime)), tracer.WithError(nil)}
+	flowRunSpan.Finish(finishOptions...)
+	rootSpan.Finish(finishOptions...)
+}
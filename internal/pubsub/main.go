@@ -3,6 +3,7 @@ package pubsub
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
+	"github.com/estecker/farm/internal/sink"
 	"log/slog"
 )
 
@@ -31,3 +32,25 @@ func Publish(msg []byte, topicProjectID string, topicID string, attributes map[s
 	id, err := res.Get(ctx)
 	return id, err
 }
+
+// Sink publishes to a Pub/Sub topic
+type Sink struct {
+	ProjectID   string
+	TopicID     string
+	Topics      map[string]string //Topic per event source, e.g. to validate against a schema per source
+	CloudEvents string            //sink.CloudEventsNone, sink.CloudEventsStructured or sink.CloudEventsBinary
+	Encoding    string            //sink.EncodingJSON or sink.EncodingBinary, must match the topic schema
+}
+
+func (s Sink) Publish(ctx context.Context, msg sink.Message) (string, error) {
+	// https://github.com/google/knative-gcp/blob/main/docs/spec/pubsub-protocol-binding.md
+	data, attributes, err := msg.Encode(s.CloudEvents, s.Encoding, "ce-")
+	if err != nil {
+		return "", err
+	}
+	topicID := s.TopicID
+	if t, ok := s.Topics[msg.Event.Source]; ok {
+		topicID = t
+	}
+	return Publish(data, s.ProjectID, topicID, attributes)
+}
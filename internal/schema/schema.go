@@ -0,0 +1,270 @@
+package schema
+
+//go:generate go run ../../cmd/farm schema --dir ../..
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"path"
+	"strings"
+)
+
+// Events of every source, the key names the generated files
+var Events = map[string]protoreflect.MessageDescriptor{
+	"argo":     (&farmv1.ArgoEvent{}).ProtoReflect().Descriptor(),
+	"airflow":  (&farmv1.AirflowEvent{}).ProtoReflect().Descriptor(),
+	"tekton":   (&farmv1.TektonEvent{}).ProtoReflect().Descriptor(),
+	"job":      (&farmv1.JobEvent{}).ProtoReflect().Descriptor(),
+	"prefect":  (&farmv1.PrefectEvent{}).ProtoReflect().Descriptor(),
+	"dagster":  (&farmv1.DagsterEvent{}).ProtoReflect().Descriptor(),
+	"temporal": (&farmv1.TemporalEvent{}).ProtoReflect().Descriptor(),
+	"slo":      (&farmv1.SloEvent{}).ProtoReflect().Descriptor(),
+	"missed":   (&farmv1.MissedEvent{}).ProtoReflect().Descriptor(),
+	"anomaly":  (&farmv1.AnomalyEvent{}).ProtoReflect().Descriptor(),
+	"try":      (&farmv1.TryEvent{}).ProtoReflect().Descriptor(),
+	"failure":  (&farmv1.FailureEvent{}).ProtoReflect().Descriptor(),
+}
+
+// Files are the generated schemas checked in to the repository, by path relative to its root
+func Files() (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for source, md := range Events {
+		table := BigQueryTable(md)
+		pretty, err := json.MarshalIndent(table, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		compact, err := json.Marshal(table)
+		if err != nil {
+			return nil, err
+		}
+		js, err := json.MarshalIndent(JSONSchema(md, source+"-event.schema.json"), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files[path.Join("deployments", source+"-schema.json")] = pretty
+		files[path.Join("deployments", source+"-event.schema.json")] = js
+		files[path.Join("deployments", "terraform", "farm-"+source+"-schema.json")] = compact
+		files[path.Join("deployments", "terraform", "farm-"+source+".proto")] = []byte(PubSubProto(md))
+	}
+	for name, b := range files {
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			files[name] = append(b, '\n')
+		}
+	}
+	return files, nil
+}
+
+// A BigQuery column, marshals to the JSON schema format of bq mk and Terraform
+type BigQueryField struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Mode   string          `json:"mode"`
+	Fields []BigQueryField `json:"fields,omitempty"`
+}
+
+// Columns the Pub/Sub BigQuery subscription adds with write_metadata
+var pubSubMetadata = []BigQueryField{
+	{Name: "subscription_name", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "message_id", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "publish_time", Type: "TIMESTAMP", Mode: "NULLABLE"},
+	{Name: "attributes", Type: "JSON", Mode: "NULLABLE"},
+}
+
+// BigQueryTable is the schema of the table a Pub/Sub BigQuery subscription writes the message to
+func BigQueryTable(md protoreflect.MessageDescriptor) []BigQueryField {
+	return append(append([]BigQueryField{}, pubSubMetadata...), BigQuery(md)...)
+}
+
+// BigQuery maps every field of the message to a column
+// The farm.v1.bigquery_type option overrides the type, e.g. TIMESTAMP for int64 micros
+func BigQuery(md protoreflect.MessageDescriptor) []BigQueryField {
+	var fields []BigQueryField
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		f := BigQueryField{Name: string(fd.Name()), Type: bigQueryType(fd), Mode: "NULLABLE"}
+		if fd.IsList() && f.Type != "JSON" { //A JSON column holds the whole list
+			f.Mode = "REPEATED"
+		}
+		if f.Type == "RECORD" {
+			f.Fields = BigQuery(fd.Message())
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// Row is the JSON encoding of v as a row of the columns, JSON columns hold their JSON text
+func Row(fields []BigQueryField, v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var row map[string]any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber() //int64 micros do not fit a float64
+	if err := d.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, jsonColumns(fields, row)
+}
+
+// jsonColumns replaces the values of JSON columns with their JSON text
+func jsonColumns(fields []BigQueryField, row map[string]any) error {
+	for _, f := range fields {
+		v, ok := row[f.Name]
+		if !ok {
+			continue
+		}
+		switch f.Type {
+		case "JSON":
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			row[f.Name] = string(b)
+		case "RECORD":
+			if m, ok := v.(map[string]any); ok {
+				if err := jsonColumns(f.Fields, m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func bigQueryType(fd protoreflect.FieldDescriptor) string {
+	if t := proto.GetExtension(fd.Options(), farmv1.E_BigqueryType).(string); t != "" {
+		return t
+	}
+	if fd.IsMap() {
+		return "JSON"
+	}
+	switch fd.Kind() {
+	case protoreflect.StringKind, protoreflect.EnumKind:
+		return "STRING"
+	case protoreflect.BoolKind:
+		return "BOOLEAN"
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return "FLOAT"
+	case protoreflect.BytesKind:
+		return "BYTES"
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "RECORD"
+	}
+	return "INTEGER"
+}
+
+// A JSON Schema, only the keywords FARM needs
+type JSONSchemaType struct {
+	Schema               string                     `json:"$schema,omitempty"`
+	ID                   string                     `json:"$id,omitempty"`
+	Title                string                     `json:"title,omitempty"`
+	Type                 string                     `json:"type"`
+	Properties           map[string]*JSONSchemaType `json:"properties,omitempty"`
+	Items                *JSONSchemaType            `json:"items,omitempty"`
+	AdditionalProperties any                        `json:"additionalProperties,omitempty"`
+}
+
+// JSONSchema describes the JSON encoding of the message, the one of the json encoding of the sinks
+// Timestamps are integers of micros since the epoch and zero values are omitted
+func JSONSchema(md protoreflect.MessageDescriptor, id string) *JSONSchemaType {
+	s := jsonSchemaMessage(md)
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.ID = "https://github.com/estecker/farm/deployments/" + id
+	s.Title = "FARM " + string(md.FullName())
+	return s
+}
+
+func jsonSchemaMessage(md protoreflect.MessageDescriptor) *JSONSchemaType {
+	s := &JSONSchemaType{Type: "object", Properties: map[string]*JSONSchemaType{}, AdditionalProperties: false}
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		switch {
+		case fd.IsMap():
+			s.Properties[string(fd.Name())] = &JSONSchemaType{Type: "object", AdditionalProperties: jsonSchemaField(fd.MapValue())}
+		case fd.IsList():
+			s.Properties[string(fd.Name())] = &JSONSchemaType{Type: "array", Items: jsonSchemaField(fd)}
+		default:
+			s.Properties[string(fd.Name())] = jsonSchemaField(fd)
+		}
+	}
+	return s
+}
+
+// jsonSchemaField is the type of a single value of the field
+func jsonSchemaField(fd protoreflect.FieldDescriptor) *JSONSchemaType {
+	switch fd.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind: //encoding/json sends bytes as base64
+		return &JSONSchemaType{Type: "string"}
+	case protoreflect.BoolKind:
+		return &JSONSchemaType{Type: "boolean"}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return &JSONSchemaType{Type: "number"}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return jsonSchemaMessage(fd.Message())
+	}
+	return &JSONSchemaType{Type: "integer"} //Also enums, encoding/json sends their number
+}
+
+// PubSubProto is a self-contained proto definition of the message for a Pub/Sub topic schema
+// Pub/Sub wants a single top-level message without imports, so the referenced messages are nested
+func PubSubProto(md protoreflect.MessageDescriptor) string {
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\n")
+	fmt.Fprintf(&b, "// Generated from proto/%s by farm schema, do not edit\n", md.ParentFile().Path())
+	fmt.Fprintf(&b, "message %s {\n", md.Name())
+	writeFields(&b, md, "  ")
+	seen := map[protoreflect.FullName]bool{md.FullName(): true}
+	for _, dep := range dependencies(md, seen) {
+		fmt.Fprintf(&b, "\n  message %s {\n", dep.Name())
+		writeFields(&b, dep, "    ")
+		b.WriteString("  }\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dependencies are the messages md references, depth first, excluding map entries
+func dependencies(md protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) []protoreflect.MessageDescriptor {
+	var deps []protoreflect.MessageDescriptor
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		if fd.Message() == nil || fd.IsMap() || seen[fd.Message().FullName()] {
+			continue
+		}
+		seen[fd.Message().FullName()] = true
+		deps = append(deps, fd.Message())
+		deps = append(deps, dependencies(fd.Message(), seen)...)
+	}
+	return deps
+}
+
+func writeFields(b *strings.Builder, md protoreflect.MessageDescriptor, indent string) {
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		label := ""
+		if fd.IsList() {
+			label = "repeated "
+		}
+		fmt.Fprintf(b, "%s%s%s %s = %d;\n", indent, label, protoType(fd), fd.Name(), fd.Number())
+	}
+}
+
+func protoType(fd protoreflect.FieldDescriptor) string {
+	if fd.IsMap() {
+		return fmt.Sprintf("map<%s, %s>", protoType(fd.MapKey()), protoType(fd.MapValue()))
+	}
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return string(fd.Message().Name())
+	case protoreflect.EnumKind:
+		return string(fd.Enum().Name())
+	}
+	return fd.Kind().String()
+}
@@ -0,0 +1,26 @@
+package schema
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFilesUpToDate fails when a checked-in schema does not match the event types, run farm schema to fix it
+func TestFilesUpToDate(t *testing.T) {
+	files, err := Files()
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join("..", "..", filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not match the event types, run farm schema", name)
+		}
+	}
+}
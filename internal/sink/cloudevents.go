@@ -0,0 +1,74 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CloudEvents 1.0 content modes, https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/spec.md#message
+const (
+	CloudEventsNone       = ""
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+)
+
+// Content types of the encoded messages
+const (
+	ContentTypeJSON       = "application/json"
+	ContentTypeProtobuf   = "application/protobuf"
+	ContentTypeCloudEvent = "application/cloudevents+json"
+)
+
+// CloudEventAttributes are the context attributes of the message, the Event is the data
+func (m Message) CloudEventAttributes(contentType string) map[string]string {
+	attrs := map[string]string{
+		"specversion":     "1.0",
+		"id":              m.Event.EventID,
+		"source":          m.Source,
+		"type":            m.Type,
+		"time":            time.UnixMicro(m.Event.EventTime).UTC().Format(time.RFC3339Nano),
+		"datacontenttype": contentType,
+	}
+	if m.Subject != "" {
+		attrs["subject"] = m.Subject
+	}
+	return attrs
+}
+
+// Encode returns the body and the transport attributes of the message for a content mode and data encoding
+// prefix is how the protocol binding names CloudEvents attributes, "ce-" for both HTTP and Pub/Sub
+// The returned attributes include the message attributes and, for CloudEvents, content-type
+func (m Message) Encode(mode string, encoding string, prefix string) ([]byte, map[string]string, error) {
+	attrs := map[string]string{}
+	for k, v := range m.Attributes {
+		attrs[k] = v
+	}
+	switch mode {
+	case CloudEventsNone:
+		data, _, err := m.Data(encoding)
+		return data, attrs, err
+	case CloudEventsBinary:
+		data, contentType, err := m.Data(encoding)
+		for k, v := range m.CloudEventAttributes(contentType) {
+			if k != "datacontenttype" {
+				attrs[prefix+k] = v
+			}
+		}
+		attrs["content-type"] = contentType
+		return data, attrs, err
+	case CloudEventsStructured:
+		if encoding == EncodingBinary {
+			return nil, nil, fmt.Errorf("structured cloudevents need the json encoding")
+		}
+		ce := map[string]any{}
+		for k, v := range m.CloudEventAttributes(ContentTypeJSON) {
+			ce[k] = v
+		}
+		ce["data"] = m.Event
+		data, err := json.Marshal(ce)
+		attrs["content-type"] = ContentTypeCloudEvent
+		return data, attrs, err
+	}
+	return nil, nil, fmt.Errorf("unknown cloudevents mode %q", mode)
+}
@@ -0,0 +1,56 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTP POSTs every message to a URL, e.g. a Knative broker
+type HTTP struct {
+	URL         string
+	CloudEvents string //CloudEventsNone, CloudEventsStructured or CloudEventsBinary
+	Encoding    string //EncodingJSON or EncodingBinary
+	Client      *http.Client
+}
+
+func (h HTTP) Publish(ctx context.Context, msg Message) (string, error) {
+	body, attrs, err := msg.Encode(h.CloudEvents, h.Encoding, "ce-")
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if h.Encoding == EncodingBinary {
+		req.Header.Set("Content-Type", ContentTypeProtobuf)
+	} else {
+		req.Header.Set("Content-Type", ContentTypeJSON)
+	}
+	// Only the CloudEvents attributes are headers, the rest are Pub/Sub attributes
+	for k, v := range attrs {
+		if k == "content-type" {
+			req.Header.Set("Content-Type", v)
+		} else if strings.HasPrefix(k, "ce-") {
+			req.Header.Set(k, v)
+		}
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("POST %s: %s", h.URL, resp.Status)
+	}
+	return msg.Event.EventID, nil
+}
@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/estecker/farm/internal/event"
+	"github.com/jellydator/ttlcache/v3"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Message to publish, sinks decide how to encode the Event
+type Message struct {
+	Event      event.Envelope
+	Attributes map[string]string
+	Type       string //CloudEvents type, e.g. io.farm.argo.workflow.phase_changed
+	Source     string //CloudEvents source, the cluster/namespace or Airflow host
+	Subject    string //CloudEvents subject, the run
+}
+
+// Encodings of the event, both follow proto/farm/v1/events.proto
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary" //Protobuf wire format
+)
+
+// Data is the encoded event and its content type
+func (m Message) Data(encoding string) ([]byte, string, error) {
+	switch encoding {
+	case EncodingJSON, "":
+		data, err := json.Marshal(m.Event)
+		return data, ContentTypeJSON, err
+	case EncodingBinary:
+		pb, err := m.Event.Proto()
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := proto.Marshal(pb)
+		return data, ContentTypeProtobuf, err
+	}
+	return nil, "", fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// Sink is where collectors publish events to
+type Sink interface {
+	// Publish returns an ID of the published message if the sink has one
+	Publish(ctx context.Context, msg Message) (string, error)
+}
+
+// Multi publishes to every sink, the ID is the one of the first sink
+// A collector publishes an event again when a sink failed, the sinks that already have it are skipped
+type Multi struct {
+	Sinks     []Sink
+	once      sync.Once
+	delivered *ttlcache.Cache[string, string] //Message ID by sink index and event ID, as long as the collectors cache
+}
+
+func (m *Multi) Publish(ctx context.Context, msg Message) (string, error) {
+	m.once.Do(func() {
+		m.delivered = ttlcache.New[string, string](ttlcache.WithTTL[string, string](time.Hour), ttlcache.WithDisableTouchOnHit[string, string]())
+	})
+	m.delivered.DeleteExpired()
+	var id string
+	var errs []error
+	for i, s := range m.Sinks {
+		key := strconv.Itoa(i) + "/" + msg.Event.EventID
+		var sid string
+		if item := m.delivered.Get(key); item != nil {
+			sid = item.Value()
+		} else {
+			var err error
+			if sid, err = s.Publish(ctx, msg); err != nil {
+				errs = append(errs, err)
+			} else {
+				m.delivered.Set(key, sid, 0)
+			}
+		}
+		if i == 0 {
+			id = sid
+		}
+	}
+	return id, errors.Join(errs...)
+}
+
+// Close closes every sink
+func (m *Multi) Close() error {
+	var errs []error
+	for _, s := range m.Sinks {
+		errs = append(errs, Close(s))
+	}
+	return errors.Join(errs...)
+}
+
+// Close flushes and closes the sink if it buffers messages or holds connections
+func Close(s Sink) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Discard drops every message, used when no sink is enabled
+type Discard struct{}
+
+func (Discard) Publish(ctx context.Context, msg Message) (string, error) {
+	return "", nil
+}
+
+// Writer prints every message as a JSON line, used by farm once
+type Writer struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (w *Writer) Publish(ctx context.Context, msg Message) (string, error) {
+	line, err := json.Marshal(struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       event.Envelope    `json:"data"`
+	}{msg.Attributes, msg.Event})
+	if err != nil {
+		return "", err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.W.Write(append(line, '\n'))
+	return "", err
+}
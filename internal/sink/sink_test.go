@@ -0,0 +1,53 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/event"
+	"testing"
+)
+
+// fake counts the messages it got, failing while fail is set
+type fake struct {
+	id    string
+	fail  bool
+	calls int
+}
+
+func (f *fake) Publish(ctx context.Context, msg Message) (string, error) {
+	f.calls++
+	if f.fail {
+		return "", errors.New("unavailable")
+	}
+	return f.id, nil
+}
+
+func TestMultiRetriesOnlyTheFailedSink(t *testing.T) {
+	ok, down := &fake{id: "1"}, &fake{fail: true}
+	m := &Multi{Sinks: []Sink{ok, down}}
+	msg := Message{Event: event.New("argo", "uid", "Succeeded", "", "", nil)}
+
+	if _, err := m.Publish(context.Background(), msg); err == nil {
+		t.Fatal("Publish() error = nil, want the error of the failed sink")
+	}
+	down.fail = false
+	id, err := m.Publish(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if id != "1" {
+		t.Errorf("Publish() id = %q, want the one of the first sink", id)
+	}
+	if ok.calls != 1 || down.calls != 2 {
+		t.Errorf("calls = %d, %d, want 1, 2", ok.calls, down.calls)
+	}
+
+	// Another state is another event
+	msg.Event = event.New("argo", "uid", "Failed", "", "", nil)
+	if _, err := m.Publish(context.Background(), msg); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if ok.calls != 2 || down.calls != 3 {
+		t.Errorf("calls = %d, %d, want 2, 3", ok.calls, down.calls)
+	}
+}
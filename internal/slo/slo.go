@@ -0,0 +1,338 @@
+package slo
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/state"
+	"github.com/estecker/farm/internal/stats"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Objectives of an SLO
+const (
+	Deadline    = "deadline"
+	Duration    = "duration"
+	SuccessRate = "success_rate"
+)
+
+// Run is a completed run of a workflow, whatever the source
+type Run struct {
+	Source   string
+	Workflow string //Same name the filters match
+	Tenant   string
+	ID       string
+	URL      string
+	Start    time.Time
+	End      time.Time
+	Success  bool
+}
+
+// record of a run in the state store
+type record struct {
+	ID       string  `json:"id"`
+	End      int64   `json:"end"`      //micros
+	Duration float64 `json:"duration"` //seconds
+	Success  bool    `json:"success"`
+}
+
+// history of an SLO in the state store, under slo/<name>
+type history struct {
+	Runs     []record        `json:"runs"`
+	Breached map[string]bool `json:"breached"` //By objective, to publish a breach once until it recovers
+	Deadline int64           `json:"deadline"` //micros of the last deadline checked
+}
+
+// Engine evaluates the SLOs of the config against the completed runs of every source
+// Breaches are published to the sink like the runs, with the Pub/Sub attribute type=slo
+type Engine struct {
+	Sink      sink.Sink
+	ProjectID string
+	SAEmail   string
+	State     *state.Store //Keeps the runs of the window
+	Logger    *slog.Logger
+	Metrics   statsd.ClientInterface
+	mu        sync.Mutex
+	started   time.Time //Deadlines before are not checked, the runs before may be missing
+}
+
+// matches reports if the SLO is about the run
+func matches(s config.SLO, r Run) bool {
+	return s.Source == r.Source && s.Workflow == r.Workflow && (s.Tenant == "" || s.Tenant == r.Tenant)
+}
+
+// retention is how long runs are kept, at least a day for the deadline
+func retention(s config.SLO) time.Duration {
+	return max(s.Window, 48*time.Hour)
+}
+
+func (e *Engine) load(name string) history {
+	h := history{Breached: map[string]bool{}}
+	if _, err := e.State.Get("slo/"+name, &h); err != nil {
+		e.Logger.Error("SLO: Error reading state", "error", err, "slo", name)
+	}
+	if h.Breached == nil {
+		h.Breached = map[string]bool{}
+	}
+	return h
+}
+
+func (e *Engine) save(name string, h history) {
+	if err := e.State.Put("slo/"+name, h); err != nil {
+		e.Logger.Error("SLO: Error writing state", "error", err, "slo", name)
+	}
+}
+
+// Observe adds a completed run to the SLOs of its workflow and publishes the breaches
+// Returns the tags for the trace of the run, slo.breached lists the SLOs it breached
+func (e *Engine) Observe(ctx context.Context, cfg *config.Config, r Run) map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.start()
+	if r.End.IsZero() {
+		r.End = time.Now()
+	}
+	if r.Start.IsZero() {
+		r.Start = r.End //Never started
+	}
+	var breached []string
+	for _, s := range cfg.SLOs {
+		if !matches(s, r) {
+			continue
+		}
+		h := e.load(s.Name)
+		if slices.ContainsFunc(h.Runs, func(rec record) bool { return rec.ID == r.ID }) {
+			continue //Seen before a restart
+		}
+		h.Runs = append(h.Runs, record{ID: r.ID, End: r.End.UnixMicro(), Duration: r.End.Sub(r.Start).Seconds(), Success: r.Success})
+		h.Runs = trim(h.Runs, time.Now().Add(-retention(s)))
+		if e.evaluate(ctx, cfg, s, &h, &r) {
+			breached = append(breached, s.Name)
+		}
+		e.save(s.Name, h)
+	}
+	if len(breached) == 0 {
+		return nil
+	}
+	return map[string]string{"slo.breached": strings.Join(breached, ",")}
+}
+
+// evaluate the duration and success rate objectives, and if the run was late for its deadline
+// r is nil when only the metrics are refreshed, reports if the run breached an objective
+func (e *Engine) evaluate(ctx context.Context, cfg *config.Config, s config.SLO, h *history, r *Run) bool {
+	now := time.Now()
+	inWindow := trim(h.Runs, now.Add(-s.Window))
+	runBreached := false
+	if s.MaxDuration > 0 {
+		var durations []float64
+		for _, rec := range inWindow {
+			if rec.Success {
+				durations = append(durations, rec.Duration)
+			}
+		}
+		if len(durations) > 0 {
+			value := stats.Percentile(durations, s.Percentile)
+			e.status(ctx, cfg, s, h, Duration, value, s.MaxDuration.Seconds(), value > s.MaxDuration.Seconds(), len(inWindow), r)
+		}
+		if r != nil && r.Success && r.End.Sub(r.Start) > s.MaxDuration {
+			runBreached = true
+		}
+	}
+	if s.SuccessRate > 0 && len(inWindow) > 0 {
+		var ok int
+		for _, rec := range inWindow {
+			if rec.Success {
+				ok++
+			}
+		}
+		value := float64(ok) / float64(len(inWindow))
+		breached := value < s.SuccessRate
+		e.status(ctx, cfg, s, h, SuccessRate, value, s.SuccessRate, breached, len(inWindow), r)
+		if r != nil && !r.Success && breached {
+			runBreached = true
+		}
+	}
+	if s.Deadline != "" && r != nil && r.Success {
+		// Late if the last deadline was missed and this is the first run to succeed since
+		d := LastDeadline(s, r.End)
+		first := !slices.ContainsFunc(h.Runs, func(rec record) bool {
+			return rec.ID != r.ID && rec.Success && rec.End > d.UnixMicro() && rec.End <= r.End.UnixMicro()
+		})
+		if d.After(e.started) && first && !succeeded(h.Runs, d.Add(-24*time.Hour), d) {
+			runBreached = true
+		}
+	}
+	return runBreached
+}
+
+// status sends the metrics of an objective and publishes a breach when it starts
+func (e *Engine) status(ctx context.Context, cfg *config.Config, s config.SLO, h *history, objective string, value, target float64, breached bool, runs int, r *Run) {
+	tags := []string{"slo:" + s.Name, "objective:" + objective, "source:" + s.Source, "workflow:" + s.Workflow}
+	_ = e.Metrics.Gauge("slo.value", value, tags, 1)
+	_ = e.Metrics.Gauge("slo.target", target, tags, 1)
+	_ = e.Metrics.Gauge("slo.breached", boolToFloat(breached), tags, 1)
+	was := h.Breached[objective]
+	h.Breached[objective] = breached
+	if !breached || was {
+		if was && !breached {
+			e.Logger.Info("SLO: Recovered", "slo", s.Name, "objective", objective, "value", value, "target", target)
+		}
+		return
+	}
+	b := &farmv1.SloBreach{
+		Slo:         s.Name,
+		Objective:   objective,
+		Source:      s.Source,
+		Workflow:    s.Workflow,
+		Value:       value,
+		Target:      target,
+		WindowStart: time.Now().Add(-s.Window).UnixMicro(),
+		WindowEnd:   time.Now().UnixMicro(),
+		Runs:        int32(runs),
+	}
+	key := strconv.FormatInt(b.WindowEnd, 10)
+	if r != nil {
+		b.RunId, b.Url, key = r.ID, r.URL, r.ID
+	}
+	e.publish(ctx, cfg, s, b, key, r)
+}
+
+// publish a breach, key makes the event ID unique per breach
+func (e *Engine) publish(ctx context.Context, cfg *config.Config, s config.SLO, b *farmv1.SloBreach, key string, r *Run) {
+	tenant := s.Tenant
+	if tenant == "" && r != nil {
+		tenant = r.Tenant
+	}
+	if tenant == "" {
+		tenant = cfg.Tenant
+	}
+	env := event.New("slo", s.Name+"/"+b.Objective+"/"+key, "breached", tenant, cfg.Environment, b)
+	attributes := map[string]string{
+		"project_id":     e.ProjectID,
+		"sa_email":       e.SAEmail,
+		"type":           "slo",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	msgID, err := e.Sink.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.slo.breached",
+		Source:     "slo/" + s.Source,
+		Subject:    s.Name,
+	})
+	if err != nil {
+		e.Logger.Error("SLO: Error publishing", "error", err, "slo", s.Name, "objective", b.Objective)
+		return
+	}
+	_ = e.Metrics.Incr("slo.breaches", []string{"slo:" + s.Name, "objective:" + b.Objective, "source:" + s.Source, "workflow:" + s.Workflow}, 1)
+	e.Logger.Info("SLO: Breached",
+		"slo", s.Name,
+		"objective", b.Objective,
+		"value", b.Value,
+		"target", b.Target,
+		"runId", b.RunId,
+		"msgID", msgID)
+}
+
+// Run checks the deadlines and refreshes the metrics every minute, until ctx is done
+func (e *Engine) Run(ctx context.Context) {
+	e.mu.Lock()
+	e.start()
+	e.mu.Unlock()
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			e.check(ctx, config.Get(), time.Now())
+		}
+	}
+}
+
+// start remembers when the engine started, the first time it is called
+func (e *Engine) start() {
+	if e.started.IsZero() {
+		e.started = time.Now()
+	}
+}
+
+// check the deadlines that passed since the last check
+func (e *Engine) check(ctx context.Context, cfg *config.Config, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range cfg.SLOs {
+		h := e.load(s.Name)
+		h.Runs = trim(h.Runs, now.Add(-retention(s)))
+		e.evaluate(ctx, cfg, s, &h, nil)
+		if s.Deadline != "" {
+			d := LastDeadline(s, now)
+			missed := !succeeded(h.Runs, d.Add(-24*time.Hour), d)
+			if d.After(e.started) && d.UnixMicro() > h.Deadline {
+				h.Deadline = d.UnixMicro()
+				if missed {
+					e.publish(ctx, cfg, s, &farmv1.SloBreach{
+						Slo:         s.Name,
+						Objective:   Deadline,
+						Source:      s.Source,
+						Workflow:    s.Workflow,
+						Deadline:    d.UnixMicro(),
+						WindowStart: d.Add(-24 * time.Hour).UnixMicro(),
+						WindowEnd:   d.UnixMicro(),
+					}, strconv.FormatInt(d.Unix(), 10), nil)
+				}
+			}
+			tags := []string{"slo:" + s.Name, "objective:" + Deadline, "source:" + s.Source, "workflow:" + s.Workflow}
+			_ = e.Metrics.Gauge("slo.breached", boolToFloat(missed), tags, 1)
+		}
+		e.save(s.Name, h)
+	}
+}
+
+// LastDeadline is the latest deadline of the SLO at or before t
+func LastDeadline(s config.SLO, t time.Time) time.Time {
+	hm, _ := time.Parse("15:04", s.Deadline)
+	t = t.In(s.Location())
+	d := time.Date(t.Year(), t.Month(), t.Day(), hm.Hour(), hm.Minute(), 0, 0, t.Location())
+	if d.After(t) {
+		d = d.AddDate(0, 0, -1)
+	}
+	return d
+}
+
+// succeeded reports if a run succeeded within (from, to]
+func succeeded(runs []record, from, to time.Time) bool {
+	return slices.ContainsFunc(runs, func(rec record) bool {
+		return rec.Success && rec.End > from.UnixMicro() && rec.End <= to.UnixMicro()
+	})
+}
+
+// trim returns the runs that ended after since
+func trim(runs []record, since time.Time) []record {
+	var kept []record
+	for _, rec := range runs {
+		if rec.End > since.UnixMicro() {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package slo
+
+import (
+	"bytes"
+	"context"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/state"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastDeadline(t *testing.T) {
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		name     string
+		deadline string
+		timezone string
+		at       string
+		want     string
+	}{
+		{"after", "06:00", "", "2026-10-19T07:00:00Z", "2026-10-19T06:00:00Z"},
+		{"before", "06:00", "", "2026-10-19T05:59:00Z", "2026-10-18T06:00:00Z"},
+		{"at", "06:00", "", "2026-10-19T06:00:00Z", "2026-10-19T06:00:00Z"},
+		{"midnight", "00:00", "", "2026-10-19T00:00:01Z", "2026-10-19T00:00:00Z"},
+		// 05:00 in New York, before the deadline of that day
+		{"timezone", "06:00", "America/New_York", "2026-10-19T09:00:00Z", "2026-10-18T10:00:00Z"},
+		// The clocks went back an hour that night, the deadline is 06:00 EST
+		{"dst", "06:00", "America/New_York", "2026-11-01T12:00:00Z", "2026-11-01T11:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := config.SLO{Deadline: tt.deadline, Timezone: tt.timezone}
+			if got := LastDeadline(s, utc(tt.at)); !got.Equal(utc(tt.want)) {
+				t.Errorf("LastDeadline(%s) = %v, want %s", tt.at, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func testEngine(t *testing.T, out io.Writer) *Engine {
+	store, err := state.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Engine{
+		Sink:    &sink.Writer{W: out},
+		State:   store,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: &statsd.NoOpClient{},
+		started: time.Now().Add(-30 * 24 * time.Hour),
+	}
+}
+
+// runs that ended hours ago, every hour, with the durations in minutes and a negative one for a failure
+func runs(now time.Time, minutes ...float64) []record {
+	var recs []record
+	for i, m := range minutes {
+		end := now.Add(-time.Duration(len(minutes)-i) * time.Hour)
+		recs = append(recs, record{ID: "r" + string(rune('a'+i)), End: end.UnixMicro(), Duration: max(m, -m) * 60, Success: m >= 0})
+	}
+	return recs
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	// The deadline was two hours ago, the run ended an hour ago
+	deadline := now.Add(-2 * time.Hour).In(time.UTC).Format("15:04")
+	tests := []struct {
+		name      string
+		slo       config.SLO
+		history   []record
+		breached  map[string]bool
+		run       *Run
+		want      bool
+		published []string //Objectives
+	}{
+		{
+			name:    "duration ok",
+			slo:     config.SLO{MaxDuration: time.Hour, Percentile: 95},
+			history: runs(now, 30, 35, 40),
+			run:     &Run{ID: "new", Start: now.Add(-50 * time.Minute), End: now, Success: true},
+		},
+		{
+			name:      "slow run",
+			slo:       config.SLO{MaxDuration: time.Hour, Percentile: 95},
+			history:   runs(now, 30, 35, 90),
+			run:       &Run{ID: "new", Start: now.Add(-2 * time.Hour), End: now, Success: true},
+			want:      true,
+			published: []string{Duration},
+		},
+		{
+			// Only the successful runs count for the duration
+			name:    "slow failure",
+			slo:     config.SLO{MaxDuration: time.Hour, Percentile: 95},
+			history: runs(now, 30, -600),
+			run:     &Run{ID: "new", Start: now.Add(-10 * time.Hour), End: now},
+		},
+		{
+			name:      "failure below the success rate",
+			slo:       config.SLO{SuccessRate: 0.9},
+			history:   runs(now, 10, 10, 10, 10, 10, 10, 10, 10, -10, -10),
+			run:       &Run{ID: "new", End: now},
+			want:      true,
+			published: []string{SuccessRate},
+		},
+		{
+			// The breach was published before, only the run is flagged
+			name:     "still below the success rate",
+			slo:      config.SLO{SuccessRate: 0.9},
+			history:  runs(now, 10, 10, 10, 10, 10, 10, 10, 10, -10, -10),
+			breached: map[string]bool{SuccessRate: true},
+			run:      &Run{ID: "new", End: now},
+			want:     true,
+		},
+		{
+			name:      "success below the success rate",
+			slo:       config.SLO{SuccessRate: 0.9},
+			history:   runs(now, 10, -10),
+			run:       &Run{ID: "new", End: now, Success: true},
+			published: []string{SuccessRate},
+		},
+		{
+			name:    "late",
+			slo:     config.SLO{Deadline: deadline},
+			history: runs(now, -10),
+			run:     &Run{ID: "new", Start: now.Add(-70 * time.Minute), End: now.Add(-time.Hour), Success: true},
+			want:    true,
+		},
+		{
+			name:    "on time",
+			slo:     config.SLO{Deadline: deadline},
+			history: runs(now, 10, 10, 10),
+			run:     &Run{ID: "new", Start: now.Add(-70 * time.Minute), End: now.Add(-time.Hour), Success: true},
+		},
+		{
+			// The deadline checks refresh the objectives without a run
+			name:      "no run",
+			slo:       config.SLO{MaxDuration: time.Hour, Percentile: 95, SuccessRate: 0.5},
+			history:   runs(now, 120, 120),
+			published: []string{Duration},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.slo.Name, tt.slo.Source, tt.slo.Workflow, tt.slo.Window = "nightly", "argo", "nightly", 7*24*time.Hour
+			var out bytes.Buffer
+			e := testEngine(t, &out)
+			h := history{Runs: tt.history, Breached: map[string]bool{}}
+			for k, v := range tt.breached {
+				h.Breached[k] = v
+			}
+			if tt.run != nil {
+				h.Runs = append(h.Runs, record{ID: tt.run.ID, End: tt.run.End.UnixMicro(), Duration: tt.run.End.Sub(tt.run.Start).Seconds(), Success: tt.run.Success})
+			}
+			if got := e.evaluate(context.Background(), &config.Config{}, tt.slo, &h, tt.run); got != tt.want {
+				t.Errorf("evaluate() = %v, want %v", got, tt.want)
+			}
+			var published []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				for _, objective := range []string{Duration, SuccessRate} {
+					if strings.Contains(line, `"objective":"`+objective+`"`) {
+						published = append(published, objective)
+					}
+				}
+			}
+			if strings.Join(published, ",") != strings.Join(tt.published, ",") {
+				t.Errorf("published %v, want %v", published, tt.published)
+			}
+			for _, objective := range tt.published {
+				if !h.Breached[objective] {
+					t.Errorf("breached = %v, want %s until it recovers", h.Breached, objective)
+				}
+			}
+		})
+	}
+}
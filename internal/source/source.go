@@ -0,0 +1,168 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/estecker/farm/internal/anomaly"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/state"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Source is a workflow orchestration system FARM collects from
+// Every collector package registers one in its init, serve runs the enabled ones
+type Source interface {
+	// Name is the key of the config section under sources and the type attribute of the events
+	Name() string
+	// Enabled reports if the config section turns the source on
+	Enabled(cfg *config.Config) bool
+	// Run collects until ctx is done, reading config.Get() every poll so a reloaded config takes effect
+	Run(ctx context.Context, em *Emitter) error
+	// Once runs a single collection cycle with cfg
+	Once(ctx context.Context, cfg *config.Config, em *Emitter) error
+}
+
+// Emitter has the services shared by every source
+// Spans go to the global Datadog tracer, started by serve or replaced by the mocktracer of once
+type Emitter struct {
+	Sink      sink.Sink
+	ProjectID string                 //Of the GCP metadata server, the project_id attribute
+	SAEmail   string                 //Of the GCP metadata server, the sa_email attribute
+	State     *state.Store           //Survives a restart when state.path is set
+	Logger    *slog.Logger           //Has a source attribute
+	Metrics   statsd.ClientInterface //DogStatsD, a no-op client unless metrics.dogstatsd.enabled
+	SLO       *slo.Engine            //Only set by serve
+	Anomaly   *anomaly.Detector      //Only set by serve
+	tags      []string
+}
+
+// For returns the Emitter of one source, its logs and metrics are tagged with the source name
+func (e *Emitter) For(name string) *Emitter {
+	em := *e
+	if em.Logger == nil {
+		em.Logger = slog.Default()
+	}
+	if em.Metrics == nil {
+		em.Metrics = &statsd.NoOpClient{}
+	}
+	if em.State == nil {
+		em.State, _ = state.Open("") //In memory, never fails
+	}
+	em.Logger = em.Logger.With("source", name)
+	em.tags = append(slices.Clip(e.tags), "source:"+name)
+	return &em
+}
+
+// Publish sends a message to the sink and counts it
+func (e *Emitter) Publish(ctx context.Context, msg sink.Message) (string, error) {
+	id, err := e.Sink.Publish(ctx, msg)
+	if err != nil {
+		_ = e.Metrics.Incr("events.errors", e.tags, 1)
+	} else {
+		_ = e.Metrics.Incr("events.published", e.tags, 1)
+	}
+	return id, err
+}
+
+// Cycle records how long a poll took and if it failed
+func (e *Emitter) Cycle(start time.Time, err error) {
+	_ = e.Metrics.Timing("cycle.duration", time.Since(start), e.tags, 1)
+	if err != nil {
+		_ = e.Metrics.Incr("cycle.errors", e.tags, 1)
+	}
+}
+
+// Gauge sends a metric of the source, tags are added to the source tag
+func (e *Emitter) Gauge(name string, value float64, tags ...string) {
+	_ = e.Metrics.Gauge(name, value, append(slices.Clip(e.tags), tags...), 1)
+}
+
+// Distribution sends a value of the source to aggregate server side, tags are added to the source tag
+func (e *Emitter) Distribution(name string, value float64, tags ...string) {
+	_ = e.Metrics.Distribution(name, value, append(slices.Clip(e.tags), tags...), 1)
+}
+
+// Incr counts a metric of the source, tags are added to the source tag
+func (e *Emitter) Incr(name string, tags ...string) {
+	_ = e.Metrics.Incr(name, append(slices.Clip(e.tags), tags...), 1)
+}
+
+// Completed evaluates the SLOs of a completed run, returns the tags for the root span of its trace
+func (e *Emitter) Completed(ctx context.Context, cfg *config.Config, run slo.Run) map[string]string {
+	if e.SLO == nil {
+		return nil
+	}
+	return e.SLO.Observe(ctx, cfg, run)
+}
+
+// Durations starts the anomaly check of a completed run, nil when there is nothing to check
+func (e *Emitter) Durations(cfg *config.Config, run slo.Run) *anomaly.Check {
+	if e.Anomaly == nil {
+		return nil
+	}
+	return e.Anomaly.Start(cfg, run)
+}
+
+// Sleep waits for d, reports false if ctx is done first
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Source{}
+)
+
+// Register makes a source available by its name, it panics on a duplicate name like database/sql drivers
+func Register(s Source) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := registry[s.Name()]; dup {
+		panic(fmt.Sprintf("source %q registered twice", s.Name()))
+	}
+	registry[s.Name()] = s
+}
+
+// Get returns the source registered with name
+func Get(name string) (Source, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	s, ok := registry[name]
+	return s, ok
+}
+
+// Names of the registered sources, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Enabled returns the sources cfg turns on, sorted by name
+func Enabled(cfg *config.Config) []Source {
+	var sources []Source
+	for _, name := range Names() {
+		if s, _ := Get(name); s.Enabled(cfg) {
+			sources = append(sources, s)
+		}
+	}
+	return sources
+}
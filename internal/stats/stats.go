@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"math"
+	"slices"
+)
+
+// Percentile p of the values, nearest rank
+func Percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// Median of the values, the mean of the two middle values for an even count
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[n/2]
+}
+
+// MAD is the median absolute deviation from the median, a spread measure outliers barely move
+func MAD(values []float64, median float64) float64 {
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	return Median(deviations)
+}
+
+// Score is the modified z-score of v, how many MADs it is above the median scaled to standard deviations
+// Iglewicz and Hoaglin consider more than 3.5 an outlier
+func Score(v, median, mad float64) float64 {
+	if mad == 0 {
+		return 0
+	}
+	return 0.6745 * (v - median) / mad
+}
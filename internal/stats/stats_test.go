@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	values := []float64{15, 20, 35, 40, 50}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 15},
+		{5, 15},
+		{30, 20},
+		{40, 20},
+		{50, 35},
+		{95, 50},
+		{100, 50},
+	}
+	for _, tt := range tests {
+		if got := Percentile(values, tt.p); got != tt.want {
+			t.Errorf("Percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := Percentile(nil, 95); got != 0 {
+		t.Errorf("Percentile(nil) = %v, want 0", got)
+	}
+	if values[0] != 15 || values[4] != 50 {
+		t.Errorf("Percentile() sorted the values in place: %v", values)
+	}
+}
+
+func TestMedianAndMAD(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		median float64
+		mad    float64
+	}{
+		{"empty", nil, 0, 0},
+		{"one", []float64{7}, 7, 0},
+		{"odd", []float64{9, 1, 5}, 5, 4},
+		{"even", []float64{4, 1, 3, 2}, 2.5, 1},
+		// An outlier moves neither much
+		{"outlier", []float64{60, 61, 59, 62, 58, 3600}, 60.5, 1.5},
+		{"identical", []float64{30, 30, 30}, 30, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			median := Median(tt.values)
+			if median != tt.median {
+				t.Errorf("Median() = %v, want %v", median, tt.median)
+			}
+			if mad := MAD(tt.values, median); mad != tt.mad {
+				t.Errorf("MAD() = %v, want %v", mad, tt.mad)
+			}
+		})
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name           string
+		v, median, mad float64
+		want           float64
+	}{
+		{"median", 60, 60, 2, 0},
+		{"above", 70, 60, 2, 3.3725},
+		{"below", 50, 60, 2, -3.3725},
+		{"no spread", 600, 60, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Score(tt.v, tt.median, tt.mad); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Score() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package tekton
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/event/farmv1"
+	"github.com/estecker/farm/internal/kube"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// List the PipelineRuns created or completed within the lookback
+func listPipelineRuns(ctx context.Context, cli dynamic.Interface, nameSpace string, lookback time.Duration) ([]pipelineRun, error) {
+	since := time.Now().Add(-lookback)
+	var runs []pipelineRun
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		list, err := cli.Resource(pipelineRuns).Namespace(nameSpace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		page, err := fromUnstructured[pipelineRun](list)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range page {
+			if pr.CreationTimestamp.After(since) || (pr.Status.CompletionTime != nil && pr.Status.CompletionTime.After(since)) {
+				runs = append(runs, pr)
+			}
+		}
+		if list.GetContinue() == "" {
+			return runs, nil
+		}
+		opts.Continue = list.GetContinue()
+	}
+}
+
+// List the TaskRuns of a PipelineRun
+func listTaskRuns(ctx context.Context, cli dynamic.Interface, pr pipelineRun) ([]taskRun, error) {
+	list, err := cli.Resource(taskRuns).Namespace(pr.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "tekton.dev/pipelineRun=" + pr.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured[taskRun](list)
+}
+
+// The "name" is not always the same, so we need to normalize it
+func normalizeName(pr pipelineRun) string {
+	if n, ok := pr.Labels["tekton.dev/pipeline"]; ok {
+		return n
+	} else if n := pr.GenerateName; n != "" {
+		before, _ := strings.CutSuffix(n, "-")
+		return before
+	}
+	return pr.Name
+}
+
+// Link to the PipelineRun in the Tekton Dashboard, empty without sources.tekton.dashboard_url
+func prUrl(dashboard string, pr pipelineRun) string {
+	if dashboard == "" {
+		return ""
+	}
+	return strings.TrimSuffix(dashboard, "/") + "/#/namespaces/" + pr.Namespace + "/pipelineruns/" + pr.Name
+}
+
+// Build the event for a PipelineRun and publish it
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, pr pipelineRun) (string, error) {
+	cond := succeeded(pr.Status.Conditions)
+	e := &Event{
+		Name:              pr.Name,
+		NormalizedName:    normalizeName(pr),
+		Namespace:         pr.Namespace,
+		Url:               prUrl(cfg.Sources.Tekton.DashboardURL, pr),
+		Phase:             cond.Reason,
+		Status:            cond.Status,
+		Labels:            pr.Labels,
+		Annotations:       pr.Annotations,
+		CreationTimestamp: pr.CreationTimestamp.UnixMicro(),
+	}
+	if pr.Spec.PipelineRef != nil {
+		e.Pipeline = pr.Spec.PipelineRef.Name
+	}
+	for _, p := range pr.Spec.Params {
+		e.Parameters = append(e.Parameters, &farmv1.Parameter{Name: p.Name, Value: p.value()})
+	}
+	// otherwise will send the zero value date, which is not null
+	if pr.Status.StartTime != nil {
+		e.StartedAt = pr.Status.StartTime.UnixMicro()
+	}
+	if pr.Status.CompletionTime != nil {
+		e.FinishedAt = pr.Status.CompletionTime.UnixMicro()
+	}
+	env := event.New("tekton", string(pr.UID), e.Phase, cfg.Sources.Tekton.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "tekton",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.tekton.pipelinerun.phase_changed",
+		Source:     ceSource(cfg.Sources.Tekton.Cluster, pr.Namespace),
+		Subject:    pr.Name,
+	})
+}
+
+// ceSource is the CloudEvents source of a PipelineRun, tekton/<cluster>/<namespace>
+func ceSource(cluster string, nameSpace string) string {
+	if cluster == "" {
+		return "tekton/" + nameSpace
+	}
+	return "tekton/" + cluster + "/" + nameSpace
+}
+
+// Publish the PipelineRuns whose phase changed and trace the completed ones, returns the publish and TaskRun errors
+// A PipelineRun is only cached once published, so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, cli dynamic.Interface, em *source.Emitter, runs []pipelineRun, cache *ttlcache.Cache[types.UID, string]) error {
+	var errs []error
+	for _, pr := range runs {
+		if !cfg.Sources.Tekton.Filter.Match(normalizeName(pr)) {
+			continue
+		}
+		phase := pr.phase()
+		if cache.Has(pr.UID) && cache.Get(pr.UID).Value() == phase {
+			continue
+		}
+		msgID, err := publish(ctx, cfg, em, pr)
+		if err != nil {
+			em.Logger.Error("Tekton: Error publishing", "error", err, "name", pr.Name)
+			errs = append(errs, err)
+			continue
+		}
+		cache.Set(pr.UID, phase, 0)
+		em.Logger.Debug("pubsub.publish",
+			"type", "tekton",
+			"phase", phase,
+			"name", pr.Name,
+			"msgID", msgID)
+		if pr.completed() {
+			trs, err := listTaskRuns(ctx, cli, pr)
+			if err != nil {
+				em.Logger.Error("Tekton: Error listing TaskRuns", "error", err, "name", pr.Name)
+				errs = append(errs, err)
+			}
+			trace(pr, trs, cfg.Sources.Tekton.Tenant, prUrl(cfg.Sources.Tekton.DashboardURL, pr), em.Completed(ctx, cfg, slo.Run{
+				Source:   "tekton",
+				Workflow: normalizeName(pr),
+				Tenant:   cfg.Sources.Tekton.Tenant,
+				ID:       string(pr.UID),
+				URL:      prUrl(cfg.Sources.Tekton.DashboardURL, pr),
+				Start:    timeOf(pr.Status.StartTime),
+				End:      timeOf(pr.Status.CompletionTime),
+				Success:  succeeded(pr.Status.Conditions).Status == "True",
+			}))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newClient is a dynamic client, the in-cluster config or the local kubeconfig
+func newClient() (dynamic.Interface, error) {
+	restConfig, err := kube.Config()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(restConfig)
+}
+
+// timeOf is the zero time for a nil time
+func timeOf(t *metav1.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Tekton PipelineRun events, sources.tekton in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "tekton"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Tekton.Enabled
+}
+
+// Run is the main loop for collecting Tekton events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	cache := ttlcache.New[types.UID, string](ttlcache.WithTTL[types.UID, string](time.Hour))
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, cli, em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Tekton.Interval) {
+			return nil
+		}
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every PipelineRun in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	return cycle(ctx, cfg, cli, em, ttlcache.New[types.UID, string]())
+}
+
+// cycle is one poll of the Kubernetes API, returns the API and publish errors
+func cycle(ctx context.Context, cfg *config.Config, cli dynamic.Interface, em *source.Emitter, cache *ttlcache.Cache[types.UID, string]) error {
+	runs, err := listPipelineRuns(ctx, cli, cfg.Sources.Tekton.Namespace, cfg.Sources.Tekton.Lookback)
+	if err != nil {
+		em.Logger.Error("Tekton: Error listing PipelineRuns", "error", err)
+		return err
+	}
+	return collect(ctx, cfg, cli, em, runs, cache)
+}
@@ -0,0 +1,266 @@
+package tekton
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhase(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []condition
+		phase      string
+		completed  bool
+	}{
+		{"no conditions", nil, "Pending", false},
+		{"running", []condition{{Type: "Succeeded", Status: "Unknown", Reason: "Running"}}, "Running", false},
+		{"succeeded", []condition{{Type: "Succeeded", Status: "True", Reason: "Succeeded"}}, "Succeeded", true},
+		{"cancelled", []condition{{Type: "Succeeded", Status: "False", Reason: "Cancelled"}}, "Cancelled", true},
+		{"other condition first", []condition{{Type: "Ready", Status: "True", Reason: "Ready"}, {Type: "Succeeded", Status: "False", Reason: "Failed"}}, "Failed", true},
+		{"only other conditions", []condition{{Type: "Ready", Status: "False", Reason: "NotReady"}}, "Pending", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pr pipelineRun
+			pr.Status.Conditions = tt.conditions
+			if pr.phase() != tt.phase || pr.completed() != tt.completed {
+				t.Errorf("phase() = %s, completed() = %v, want %s, %v", pr.phase(), pr.completed(), tt.phase, tt.completed)
+			}
+		})
+	}
+}
+
+// object parses the JSON of a Kubernetes object
+func object(t *testing.T, s string) *unstructured.Unstructured {
+	t.Helper()
+	u := &unstructured.Unstructured{}
+	if err := json.Unmarshal([]byte(s), &u.Object); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestFromUnstructured(t *testing.T) {
+	list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*object(t, `{
+		"apiVersion": "tekton.dev/v1", "kind": "PipelineRun",
+		"metadata": {"name": "build-x7k2p", "generateName": "build-", "namespace": "ci", "uid": "a1", "creationTimestamp": "2026-10-19T09:00:00Z"},
+		"spec": {
+			"pipelineRef": {"name": "build"},
+			"params": [
+				{"name": "revision", "value": "main"},
+				{"name": "platforms", "value": ["linux/amd64", "linux/arm64"]},
+				{"name": "image", "value": {"registry": "ghcr.io"}}
+			]
+		},
+		"status": {
+			"conditions": [{"type": "Succeeded", "status": "True", "reason": "Succeeded", "message": "Tasks Completed: 2"}],
+			"startTime": "2026-10-19T09:00:05Z",
+			"completionTime": "2026-10-19T09:04:00Z",
+			"childReferences": [{"name": "build-x7k2p-compile"}]
+		}
+	}`)}}
+	runs, err := fromUnstructured[pipelineRun](list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("fromUnstructured() = %d runs, want 1", len(runs))
+	}
+	pr := runs[0]
+	if pr.Name != "build-x7k2p" || pr.UID != "a1" || pr.Spec.PipelineRef.Name != "build" || normalizeName(pr) != "build" {
+		t.Errorf("pipelineRun = %+v", pr)
+	}
+	if d := pr.Status.CompletionTime.Sub(pr.Status.StartTime.Time); d != 235*time.Second || pr.phase() != "Succeeded" {
+		t.Errorf("ran %v, phase %s", d, pr.phase())
+	}
+	tests := []struct {
+		name, value string
+	}{
+		{"revision", "main"},
+		{"platforms", `["linux/amd64","linux/arm64"]`},
+		{"image", `{"registry":"ghcr.io"}`},
+	}
+	for i, tt := range tests {
+		if p := pr.Spec.Params[i]; p.Name != tt.name || p.value() != tt.value {
+			t.Errorf("params[%d] = %s=%s, want %s=%s", i, p.Name, p.value(), tt.name, tt.value)
+		}
+	}
+
+	// A field of the wrong type fails the whole list
+	list.Items = append(list.Items, *object(t, `{"apiVersion": "tekton.dev/v1", "kind": "PipelineRun", "metadata": {"name": "broken"}, "status": {"startTime": 12}}`))
+	if _, err := fromUnstructured[pipelineRun](list); err == nil {
+		t.Error("fromUnstructured() of a broken item error = nil")
+	}
+}
+
+// fakeDynamic lists the objects by resource, a page of one object per request
+// The other methods of dynamic.Interface are not implemented
+type fakeDynamic struct {
+	dynamic.Interface
+	objects map[schema.GroupVersionResource][]*unstructured.Unstructured
+	lists   int
+}
+
+type fakeResource struct {
+	dynamic.NamespaceableResourceInterface
+	f         *fakeDynamic
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+func (f *fakeDynamic) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeResource{f: f, gvr: gvr}
+}
+
+func (r *fakeResource) Namespace(namespace string) dynamic.ResourceInterface {
+	return &fakeResource{f: r.f, gvr: r.gvr, namespace: namespace}
+}
+
+func (r *fakeResource) List(_ context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	r.f.lists++
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var matching []*unstructured.Unstructured
+	for _, u := range r.f.objects[r.gvr] {
+		if (r.namespace == "" || u.GetNamespace() == r.namespace) && selector.Matches(labels.Set(u.GetLabels())) {
+			matching = append(matching, u)
+		}
+	}
+	list := &unstructured.UnstructuredList{}
+	i, _ := strconv.Atoi(opts.Continue)
+	if i < len(matching) {
+		list.Items = append(list.Items, *matching[i])
+	}
+	if i+1 < len(matching) {
+		list.SetContinue(strconv.Itoa(i + 1))
+	}
+	return list, nil
+}
+
+// failing is a sink that never takes an event
+type failing struct{}
+
+func (failing) Publish(context.Context, sink.Message) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestCycle(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	ago := func(d time.Duration) string {
+		return time.Now().Add(-d).UTC().Format(time.RFC3339)
+	}
+	runs := []*unstructured.Unstructured{
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "PipelineRun",
+			"metadata": {"name": "build-1", "namespace": "ci", "uid": "a1", "labels": {"tekton.dev/pipeline": "build"}, "creationTimestamp": "`+ago(time.Hour)+`"},
+			"status": {"conditions": [{"type": "Succeeded", "status": "False", "reason": "Failed"}], "startTime": "`+ago(time.Hour)+`", "completionTime": "`+ago(50*time.Minute)+`"}}`),
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "PipelineRun",
+			"metadata": {"name": "build-2", "namespace": "ci", "uid": "a2", "labels": {"tekton.dev/pipeline": "build"}, "creationTimestamp": "`+ago(time.Minute)+`"},
+			"status": {"conditions": [{"type": "Succeeded", "status": "Unknown", "reason": "Running"}], "startTime": "`+ago(time.Minute)+`"}}`),
+		// Out of the lookback
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "PipelineRun",
+			"metadata": {"name": "build-0", "namespace": "ci", "uid": "a0", "labels": {"tekton.dev/pipeline": "build"}, "creationTimestamp": "`+ago(48*time.Hour)+`"},
+			"status": {"conditions": [{"type": "Succeeded", "status": "True", "reason": "Succeeded"}], "completionTime": "`+ago(47*time.Hour)+`"}}`),
+		// Of another namespace
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "PipelineRun",
+			"metadata": {"name": "deploy-1", "namespace": "cd", "uid": "b1", "creationTimestamp": "`+ago(time.Minute)+`"}}`),
+	}
+	trs := []*unstructured.Unstructured{
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "TaskRun",
+			"metadata": {"name": "build-1-compile", "namespace": "ci", "labels": {"tekton.dev/pipelineRun": "build-1", "tekton.dev/pipelineTask": "compile"}},
+			"status": {"conditions": [{"type": "Succeeded", "status": "False", "reason": "Failed"}], "podName": "build-1-compile-pod", "startTime": "`+ago(59*time.Minute)+`", "completionTime": "`+ago(51*time.Minute)+`",
+				"steps": [
+					{"name": "fetch", "container": "step-fetch", "terminated": {"exitCode": 0, "reason": "Completed", "startedAt": "`+ago(59*time.Minute)+`", "finishedAt": "`+ago(58*time.Minute)+`"}},
+					{"name": "make", "container": "step-make", "terminated": {"exitCode": 2, "reason": "Error", "startedAt": "`+ago(58*time.Minute)+`", "finishedAt": "`+ago(51*time.Minute)+`"}},
+					{"name": "upload", "container": "step-upload"}
+				]}}`),
+		// Never started, has no span
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "TaskRun",
+			"metadata": {"name": "build-1-publish", "namespace": "ci", "labels": {"tekton.dev/pipelineRun": "build-1", "tekton.dev/pipelineTask": "publish"}},
+			"status": {"conditions": [{"type": "Succeeded", "status": "False", "reason": "TaskRunCancelled"}]}}`),
+		object(t, `{"apiVersion": "tekton.dev/v1", "kind": "TaskRun",
+			"metadata": {"name": "build-2-compile", "namespace": "ci", "labels": {"tekton.dev/pipelineRun": "build-2", "tekton.dev/pipelineTask": "compile"}},
+			"status": {"startTime": "`+ago(time.Minute)+`"}}`),
+	}
+	cli := &fakeDynamic{objects: map[schema.GroupVersionResource][]*unstructured.Unstructured{pipelineRuns: runs, taskRuns: trs}}
+	cfg := &config.Config{Sources: config.Sources{Tekton: config.Tekton{Namespace: "ci", Lookback: 24 * time.Hour, DashboardURL: "https://tekton.example.com/"}}}
+	cache := ttlcache.New[types.UID, string]()
+
+	// Nothing is cached while the sink fails
+	if err := cycle(context.Background(), cfg, cli, (&source.Emitter{Sink: failing{}}).For("tekton"), cache); err == nil {
+		t.Error("cycle() with a failing sink error = nil")
+	}
+	if cache.Len() != 0 || len(mt.FinishedSpans()) != 0 {
+		t.Fatalf("cached %v and traced %d spans without publishing", cache.Keys(), len(mt.FinishedSpans()))
+	}
+
+	var out bytes.Buffer
+	em := (&source.Emitter{Sink: &sink.Writer{W: &out}}).For("tekton")
+	cli.lists = 0
+	if err := cycle(context.Background(), cfg, cli, em, cache); err != nil {
+		t.Fatalf("cycle() error = %v", err)
+	}
+	// A page per PipelineRun of the namespace and the TaskRuns of the completed one
+	if cli.lists != 4 {
+		t.Errorf("lists = %d, want 4", cli.lists)
+	}
+	type published struct {
+		Data struct {
+			Payload *Event `json:"payload"`
+		} `json:"data"`
+	}
+	var events []*Event
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e published
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e.Data.Payload)
+	}
+	if len(events) != 2 {
+		t.Fatalf("published %d events, want 2", len(events))
+	}
+	if e := events[0]; e.Name != "build-1" || e.Phase != "Failed" || e.Status != "False" || e.NormalizedName != "build" || e.Url != "https://tekton.example.com/#/namespaces/ci/pipelineruns/build-1" || e.FinishedAt == 0 {
+		t.Errorf("events[0] = %+v", e)
+	}
+	if e := events[1]; e.Phase != "Running" || e.FinishedAt != 0 {
+		t.Errorf("events[1] = %+v", e)
+	}
+
+	// Only the completed PipelineRun is traced, with its started TaskRun and terminated steps
+	counts := map[string]int{}
+	for _, s := range mt.FinishedSpans() {
+		counts[s.OperationName()+" "+s.Tag(ext.ResourceName).(string)]++
+	}
+	for name, want := range map[string]int{"tekton_pipelinerun build": 1, "build build": 1, "taskrun compile": 1, "taskrun publish": 0, "step fetch": 1, "step make": 1, "step upload": 0} {
+		if counts[name] != want {
+			t.Errorf("spans %s = %d, want %d in %v", name, counts[name], want, counts)
+		}
+	}
+
+	// Nothing changed, nothing is published again
+	out.Reset()
+	if err := cycle(context.Background(), cfg, cli, em, cache); err != nil || out.Len() != 0 {
+		t.Errorf("second cycle() = %v, published %s", err, out.String())
+	}
+}
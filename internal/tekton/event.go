@@ -0,0 +1,6 @@
+package tekton
+
+import "github.com/estecker/farm/internal/event/farmv1"
+
+// A Tekton event to publish, defined in proto/farm/v1/events.proto
+type Event = farmv1.TektonPipelineRun
@@ -0,0 +1,106 @@
+package tekton
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"log/slog"
+	"time"
+)
+
+// statusToCode maps the Succeeded condition to an HTTP status code
+// Makes the DataDog UI look nice
+func statusToCode(status string) int {
+	switch status {
+	case "True":
+		return 200
+	default:
+		return 500
+	}
+}
+
+// Create a DataDog trace for a PipelineRun, with a span per TaskRun and per step
+func trace(pr pipelineRun, trs []taskRun, tenant string, url string, tags map[string]string) {
+	slog.Debug("trace",
+		"phase", pr.phase(),
+		"name", pr.Name)
+	name := normalizeName(pr)
+	started, finished := pr.CreationTimestamp.Time, time.Now()
+	if pr.Status.StartTime != nil {
+		started = pr.Status.StartTime.Time
+	}
+	if pr.Status.CompletionTime != nil {
+		finished = pr.Status.CompletionTime.Time
+	}
+	cond := succeeded(pr.Status.Conditions)
+	rootSpan := tracer.StartSpan("tekton_pipelinerun",
+		tracer.StartTime(pr.CreationTimestamp.Time),
+		tracer.ResourceName(name))
+	rootSpan.SetTag(ext.HTTPCode, statusToCode(cond.Status))
+	rootSpan.SetTag(ext.HTTPMethod, "TEKTON")
+	rootSpan.SetTag("tenant", tenant)
+	rootSpan.SetTag("url", url)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
+
+	prSpan := tracer.StartSpan(name,
+		tracer.ServiceName(name),
+		tracer.StartTime(started),
+		tracer.SpanType("tekton_pipelinerun"),
+		tracer.ChildOf(rootSpan.Context()))
+	prSpan.SetTag("component", "tekton")
+	prSpan.SetTag("namespace", pr.Namespace)
+	prSpan.SetTag("phase", cond.Reason)
+	prSpan.SetTag("message", cond.Message)
+	prSpan.SetTag("name", pr.Name)
+	prSpan.SetTag("pipelinerun", pr.UID)
+
+	for _, tr := range trs {
+		traceTaskRun(tr, name, prSpan.Context())
+	}
+	finishOptions := []tracer.FinishOption{tracer.FinishTime(finished), tracer.WithError(nil)}
+	prSpan.Finish(finishOptions...)
+	rootSpan.Finish(finishOptions...)
+}
+
+// traceTaskRun adds the span of a TaskRun and its steps, TaskRuns that never started have no span
+func traceTaskRun(tr taskRun, component string, parent ddtrace.SpanContext) {
+	if tr.Status.StartTime == nil {
+		return
+	}
+	task := tr.Labels["tekton.dev/pipelineTask"]
+	if task == "" {
+		task = tr.Name
+	}
+	cond := succeeded(tr.Status.Conditions)
+	trSpan := tracer.StartSpan("taskrun",
+		tracer.ResourceName(task),
+		tracer.ChildOf(parent),
+		tracer.StartTime(tr.Status.StartTime.Time))
+	trSpan.SetTag("span.kind", "consumer")
+	trSpan.SetTag("component", component)
+	trSpan.SetTag("name", tr.Name)
+	trSpan.SetTag("pod", tr.Status.PodName)
+	trSpan.SetTag("phase", cond.Reason)
+	trSpan.SetTag(ext.HTTPCode, statusToCode(cond.Status))
+
+	for _, s := range tr.Status.Steps {
+		if s.Terminated == nil {
+			continue
+		}
+		stepSpan := tracer.StartSpan("step",
+			tracer.ResourceName(s.Name),
+			tracer.ChildOf(trSpan.Context()),
+			tracer.StartTime(s.Terminated.StartedAt.Time))
+		stepSpan.SetTag("container", s.Container)
+		stepSpan.SetTag("exit_code", s.Terminated.ExitCode)
+		stepSpan.SetTag("reason", s.Terminated.Reason)
+		stepSpan.Finish(tracer.FinishTime(s.Terminated.FinishedAt.Time), tracer.WithError(nil))
+	}
+	finished := time.Now()
+	if tr.Status.CompletionTime != nil {
+		finished = tr.Status.CompletionTime.Time
+	}
+	trSpan.Finish(tracer.FinishTime(finished), tracer.WithError(nil))
+}
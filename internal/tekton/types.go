@@ -0,0 +1,109 @@
+package tekton
+
+import (
+	"encoding/json"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Only the fields of the Tekton v1 API FARM reads, so FARM does not depend on the Tekton module
+// https://tekton.dev/docs/pipelines/pipeline-api/
+var (
+	pipelineRuns = schema.GroupVersionResource{Group: "tekton.dev", Version: "v1", Resource: "pipelineruns"}
+	taskRuns     = schema.GroupVersionResource{Group: "tekton.dev", Version: "v1", Resource: "taskruns"}
+)
+
+type condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"` //True, False or Unknown
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type param struct {
+	Name  string `json:"name"`
+	Value any    `json:"value"` //A string, an array or an object
+}
+
+type pipelineRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		PipelineRef *struct {
+			Name string `json:"name"`
+		} `json:"pipelineRef"`
+		Params []param `json:"params"`
+	} `json:"spec"`
+	Status struct {
+		Conditions     []condition  `json:"conditions"`
+		StartTime      *metav1.Time `json:"startTime"`
+		CompletionTime *metav1.Time `json:"completionTime"`
+	} `json:"status"`
+}
+
+type step struct {
+	Name       string `json:"name"`
+	Container  string `json:"container"`
+	Terminated *struct {
+		ExitCode   int32       `json:"exitCode"`
+		Reason     string      `json:"reason"`
+		StartedAt  metav1.Time `json:"startedAt"`
+		FinishedAt metav1.Time `json:"finishedAt"`
+	} `json:"terminated"`
+}
+
+type taskRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Status            struct {
+		Conditions     []condition  `json:"conditions"`
+		PodName        string       `json:"podName"`
+		StartTime      *metav1.Time `json:"startTime"`
+		CompletionTime *metav1.Time `json:"completionTime"`
+		Steps          []step       `json:"steps"`
+	} `json:"status"`
+}
+
+// succeeded is the Succeeded condition, Unknown while running
+func succeeded(conditions []condition) condition {
+	for _, c := range conditions {
+		if c.Type == "Succeeded" {
+			return c
+		}
+	}
+	return condition{Type: "Succeeded", Status: "Unknown", Reason: "Pending"}
+}
+
+// completed reports if the run finished, whatever the outcome
+func (pr pipelineRun) completed() bool {
+	return succeeded(pr.Status.Conditions).Status != "Unknown"
+}
+
+// phase is the reason of the Succeeded condition, e.g. Running, Succeeded, Failed, Cancelled
+func (pr pipelineRun) phase() string {
+	return succeeded(pr.Status.Conditions).Reason
+}
+
+// value of the param as a string, arrays and objects as JSON
+func (p param) value() string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(p.Value)
+	return string(b)
+}
+
+// fromUnstructured converts every item of a list
+func fromUnstructured[T any](list *unstructured.UnstructuredList) ([]T, error) {
+	items := make([]T, 0, len(list.Items))
+	for _, u := range list.Items {
+		var item T
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,77 @@
+package temporal
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/estecker/farm/internal/config"
+	commonpb "go.temporal.io/api/common/v1"
+	historypb "go.temporal.io/api/history/v1"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"time"
+)
+
+// Executions and history events fetched per API call
+const pageSize = 500
+
+// dial the Temporal frontend, with TLS and an API key for Temporal Cloud
+func dial(cfg config.Temporal) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if cfg.TLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.APIKey != "" {
+		opts = append(opts, grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+cfg.APIKey, "temporal-namespace", cfg.Namespace)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))
+	}
+	return grpc.NewClient(cfg.HostPort, opts...)
+}
+
+// listClosed lists the workflow executions closed after since with the visibility API
+func listClosed(ctx context.Context, cli workflowservice.WorkflowServiceClient, nameSpace string, since time.Time) ([]*workflowpb.WorkflowExecutionInfo, error) {
+	var executions []*workflowpb.WorkflowExecutionInfo
+	req := &workflowservice.ListWorkflowExecutionsRequest{
+		Namespace: nameSpace,
+		PageSize:  pageSize,
+		Query:     `CloseTime > "` + since.UTC().Format(time.RFC3339Nano) + `"`,
+	}
+	for {
+		resp, err := cli.ListWorkflowExecutions(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		executions = append(executions, resp.Executions...)
+		if len(resp.NextPageToken) == 0 {
+			return executions, nil
+		}
+		req.NextPageToken = resp.NextPageToken
+	}
+}
+
+// history of a workflow execution, every event from the start to the close
+func history(ctx context.Context, cli workflowservice.WorkflowServiceClient, nameSpace string, execution *commonpb.WorkflowExecution) ([]*historypb.HistoryEvent, error) {
+	var events []*historypb.HistoryEvent
+	req := &workflowservice.GetWorkflowExecutionHistoryRequest{
+		Namespace:       nameSpace,
+		Execution:       execution,
+		MaximumPageSize: pageSize,
+	}
+	for {
+		resp, err := cli.GetWorkflowExecutionHistory(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, resp.GetHistory().GetEvents()...)
+		if len(resp.NextPageToken) == 0 {
+			return events, nil
+		}
+		req.NextPageToken = resp.NextPageToken
+	}
+}
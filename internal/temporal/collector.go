@@ -0,0 +1,205 @@
+package temporal
+
+import (
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/event"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/slo"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	enumspb "go.temporal.io/api/enums/v1"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commonState maps a Temporal execution status to the Airflow DAG run states, queued, running, success or failed
+func commonState(status enumspb.WorkflowExecutionStatus) string {
+	switch status {
+	case enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED, enumspb.WORKFLOW_EXECUTION_STATUS_CONTINUED_AS_NEW:
+		return "success"
+	case enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING:
+		return "running"
+	}
+	return "failed" //Failed, Canceled, Terminated, TimedOut
+}
+
+// Link to the workflow execution in the Temporal UI, empty without sources.temporal.ui_url
+func runUrl(ui string, nameSpace string, w *workflowpb.WorkflowExecutionInfo) string {
+	if ui == "" {
+		return ""
+	}
+	return strings.TrimSuffix(ui, "/") + "/namespaces/" + url.PathEscape(nameSpace) +
+		"/workflows/" + url.PathEscape(w.GetExecution().GetWorkflowId()) + "/" + w.GetExecution().GetRunId() + "/history"
+}
+
+// searchAttributes keeps the JSON encoded search attributes, the default encoding of the SDKs
+func searchAttributes(w *workflowpb.WorkflowExecutionInfo) map[string]string {
+	attrs := map[string]string{}
+	for k, p := range w.GetSearchAttributes().GetIndexedFields() {
+		if string(p.GetMetadata()["encoding"]) == "json/plain" {
+			attrs[k] = string(p.GetData())
+		}
+	}
+	return attrs
+}
+
+// Build the event for a workflow execution and publish it
+func publish(ctx context.Context, cfg *config.Config, em *source.Emitter, w *workflowpb.WorkflowExecutionInfo, all []*step) (string, error) {
+	t := cfg.Sources.Temporal
+	e := &Event{
+		WorkflowId:       w.GetExecution().GetWorkflowId(),
+		RunId:            w.GetExecution().GetRunId(),
+		WorkflowType:     w.GetType().GetName(),
+		Namespace:        t.Namespace,
+		TaskQueue:        w.GetTaskQueue(),
+		Url:              runUrl(t.UIURL, t.Namespace, w),
+		State:            commonState(w.GetStatus()),
+		Status:           w.GetStatus().String(),
+		ParentWorkflowId: w.GetParentExecution().GetWorkflowId(),
+		ParentRunId:      w.GetParentExecution().GetRunId(),
+		SearchAttributes: searchAttributes(w),
+		HistoryLength:    w.GetHistoryLength(),
+		Activities:       count(all, "activity"),
+		ChildWorkflows:   count(all, "child_workflow"),
+		Timers:           count(all, "timer"),
+	}
+	// otherwise will send the zero value date, which is not null
+	if w.StartTime != nil {
+		e.StartTime = w.StartTime.AsTime().UnixMicro()
+	}
+	if w.ExecutionTime != nil {
+		e.ExecutionTime = w.ExecutionTime.AsTime().UnixMicro()
+	}
+	if w.CloseTime != nil {
+		e.CloseTime = w.CloseTime.AsTime().UnixMicro()
+	}
+	env := event.New("temporal", e.RunId, e.Status, t.Tenant, cfg.Environment, e)
+	attributes := map[string]string{
+		"project_id":     em.ProjectID,
+		"sa_email":       em.SAEmail,
+		"type":           "temporal",
+		"tenant":         env.Tenant,
+		"environment":    env.Environment,
+		"event_id":       env.EventID,
+		"schema_version": strconv.Itoa(env.SchemaVersion),
+	}
+	return em.Publish(ctx, sink.Message{
+		Event:      env,
+		Attributes: attributes,
+		Type:       "io.farm.temporal.workflow.closed",
+		Source:     ceSource(t.HostPort, t.Namespace),
+		Subject:    e.WorkflowId + "/" + e.RunId,
+	})
+}
+
+// ceSource is the CloudEvents source of a workflow execution, temporal/<host:port>/<namespace>
+func ceSource(hostPort string, nameSpace string) string {
+	return "temporal/" + hostPort + "/" + nameSpace
+}
+
+// Publish and trace the workflow executions not seen yet, they are closed so never change again
+// Returns the history and publish errors, an execution is only cached once published so it is tried again on the next poll
+func collect(ctx context.Context, cfg *config.Config, cli workflowservice.WorkflowServiceClient, em *source.Emitter, executions []*workflowpb.WorkflowExecutionInfo, cache *ttlcache.Cache[string, string]) error {
+	var errs []error
+	t := cfg.Sources.Temporal
+	for _, w := range executions {
+		runID := w.GetExecution().GetRunId()
+		if !t.Filter.Match(w.GetType().GetName()) || cache.Has(runID) {
+			continue
+		}
+		events, err := history(ctx, cli, t.Namespace, w.GetExecution())
+		if err != nil {
+			em.Logger.Error("Temporal: Error getting history", "error", err, "workflowId", w.GetExecution().GetWorkflowId(), "runId", runID)
+			errs = append(errs, err)
+			continue
+		}
+		all := steps(events)
+		msgID, err := publish(ctx, cfg, em, w, all)
+		if err != nil {
+			em.Logger.Error("Temporal: Error publishing", "error", err, "runId", runID)
+			errs = append(errs, err)
+			continue
+		}
+		cache.Set(runID, w.GetStatus().String(), 0)
+		em.Logger.Debug("pubsub.publish",
+			"type", "temporal",
+			"status", w.GetStatus().String(),
+			"workflowId", w.GetExecution().GetWorkflowId(),
+			"runId", runID,
+			"msgID", msgID)
+		trace(w, all, t.Tenant, runUrl(t.UIURL, t.Namespace, w), em.Completed(ctx, cfg, slo.Run{
+			Source:   "temporal",
+			Workflow: w.GetType().GetName(),
+			Tenant:   t.Tenant,
+			ID:       runID,
+			URL:      runUrl(t.UIURL, t.Namespace, w),
+			Start:    w.GetStartTime().AsTime(),
+			End:      w.GetCloseTime().AsTime(),
+			Success:  statusToCode(w.GetStatus()) == 200,
+		}))
+	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	source.Register(Source{})
+}
+
+// Source of Temporal workflow execution events, sources.temporal in the config
+type Source struct{}
+
+func (Source) Name() string {
+	return "temporal"
+}
+
+func (Source) Enabled(cfg *config.Config) bool {
+	return cfg.Sources.Temporal.Enabled
+}
+
+// Run is the main loop for collecting Temporal events, until ctx is done
+// Reads the config every iteration so a reloaded config file takes effect on the next poll
+func (Source) Run(ctx context.Context, em *source.Emitter) error {
+	// Closed executions are seen every poll for as long as the lookback, keep them longer than that
+	cache := ttlcache.New[string, string](ttlcache.WithTTL[string, string](max(time.Hour, 2*config.Get().Sources.Temporal.Lookback)))
+	conn, err := dial(config.Get().Sources.Temporal)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cli := workflowservice.NewWorkflowServiceClient(conn)
+	for {
+		cfg := config.Get()
+		start := time.Now()
+		em.Cycle(start, cycle(ctx, cfg, cli, em, cache))
+		if !source.Sleep(ctx, cfg.Sources.Temporal.Interval) {
+			return nil
+		}
+		cache.DeleteExpired()
+	}
+}
+
+// Once runs a single collection cycle, every workflow execution closed in the lookback window is published
+func (Source) Once(ctx context.Context, cfg *config.Config, em *source.Emitter) error {
+	conn, err := dial(cfg.Sources.Temporal)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return cycle(ctx, cfg, workflowservice.NewWorkflowServiceClient(conn), em, ttlcache.New[string, string]())
+}
+
+// cycle is one poll of the Temporal visibility API, returns the API, history and publish errors
+func cycle(ctx context.Context, cfg *config.Config, cli workflowservice.WorkflowServiceClient, em *source.Emitter, cache *ttlcache.Cache[string, string]) error {
+	executions, err := listClosed(ctx, cli, cfg.Sources.Temporal.Namespace, time.Now().Add(-cfg.Sources.Temporal.Lookback))
+	if err != nil {
+		em.Logger.Error("Temporal: Error listing workflow executions", "error", err)
+		return err
+	}
+	return collect(ctx, cfg, cli, em, executions, cache)
+}
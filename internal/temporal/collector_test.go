@@ -0,0 +1,213 @@
+package temporal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/estecker/farm/internal/config"
+	"github.com/estecker/farm/internal/sink"
+	"github.com/estecker/farm/internal/source"
+	"github.com/jellydator/ttlcache/v3"
+	commonpb "go.temporal.io/api/common/v1"
+	enumspb "go.temporal.io/api/enums/v1"
+	historypb "go.temporal.io/api/history/v1"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+// at is a history event time, seconds after t0
+func at(seconds int) *timestamppb.Timestamp {
+	return timestamppb.New(t0.Add(time.Duration(seconds) * time.Second))
+}
+
+// history of a workflow execution with a retried activity, a child workflow that failed to start and a canceled timer
+func testHistory() []*historypb.HistoryEvent {
+	return []*historypb.HistoryEvent{
+		{EventId: 5, EventTime: at(1), EventType: enumspb.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED, Attributes: &historypb.HistoryEvent_ActivityTaskScheduledEventAttributes{
+			ActivityTaskScheduledEventAttributes: &historypb.ActivityTaskScheduledEventAttributes{ActivityId: "1", ActivityType: &commonpb.ActivityType{Name: "Extract"}},
+		}},
+		// Retries are not in the history, only the start of the last attempt
+		{EventId: 6, EventTime: at(30), EventType: enumspb.EVENT_TYPE_ACTIVITY_TASK_STARTED, Attributes: &historypb.HistoryEvent_ActivityTaskStartedEventAttributes{
+			ActivityTaskStartedEventAttributes: &historypb.ActivityTaskStartedEventAttributes{ScheduledEventId: 5, Attempt: 3},
+		}},
+		{EventId: 7, EventTime: at(40), EventType: enumspb.EVENT_TYPE_ACTIVITY_TASK_COMPLETED, Attributes: &historypb.HistoryEvent_ActivityTaskCompletedEventAttributes{
+			ActivityTaskCompletedEventAttributes: &historypb.ActivityTaskCompletedEventAttributes{ScheduledEventId: 5, StartedEventId: 6},
+		}},
+		{EventId: 11, EventTime: at(41), EventType: enumspb.EVENT_TYPE_START_CHILD_WORKFLOW_EXECUTION_INITIATED, Attributes: &historypb.HistoryEvent_StartChildWorkflowExecutionInitiatedEventAttributes{
+			StartChildWorkflowExecutionInitiatedEventAttributes: &historypb.StartChildWorkflowExecutionInitiatedEventAttributes{WorkflowId: "load-2026-10-19", WorkflowType: &commonpb.WorkflowType{Name: "Load"}},
+		}},
+		{EventId: 12, EventTime: at(42), EventType: enumspb.EVENT_TYPE_START_CHILD_WORKFLOW_EXECUTION_FAILED, Attributes: &historypb.HistoryEvent_StartChildWorkflowExecutionFailedEventAttributes{
+			StartChildWorkflowExecutionFailedEventAttributes: &historypb.StartChildWorkflowExecutionFailedEventAttributes{InitiatedEventId: 11, WorkflowId: "load-2026-10-19"},
+		}},
+		{EventId: 16, EventTime: at(43), EventType: enumspb.EVENT_TYPE_TIMER_STARTED, Attributes: &historypb.HistoryEvent_TimerStartedEventAttributes{
+			TimerStartedEventAttributes: &historypb.TimerStartedEventAttributes{TimerId: "backoff"},
+		}},
+		{EventId: 17, EventTime: at(50), EventType: enumspb.EVENT_TYPE_TIMER_CANCELED, Attributes: &historypb.HistoryEvent_TimerCanceledEventAttributes{
+			TimerCanceledEventAttributes: &historypb.TimerCanceledEventAttributes{TimerId: "backoff", StartedEventId: 16},
+		}},
+		// Closes a step that is not in the history, e.g. of an earlier page that was not fetched
+		{EventId: 18, EventTime: at(51), EventType: enumspb.EVENT_TYPE_ACTIVITY_TASK_FAILED, Attributes: &historypb.HistoryEvent_ActivityTaskFailedEventAttributes{
+			ActivityTaskFailedEventAttributes: &historypb.ActivityTaskFailedEventAttributes{ScheduledEventId: 99},
+		}},
+	}
+}
+
+func TestSteps(t *testing.T) {
+	all := steps(testHistory())
+	tests := []struct {
+		kind, name, id, outcome string
+		scheduled, started      int //Seconds after t0, -1 for never
+		closed                  int
+		attempt                 int32
+	}{
+		{"activity", "Extract", "1", "Completed", 1, 30, 40, 3},
+		{"child_workflow", "Load", "load-2026-10-19", "StartFailed", 41, -1, 42, 0},
+		{"timer", "backoff", "backoff", "Canceled", 43, 43, 50, 0},
+	}
+	if len(all) != len(tests) {
+		t.Fatalf("steps() = %d steps, want %d", len(all), len(tests))
+	}
+	when := func(seconds int) time.Time {
+		if seconds < 0 {
+			return time.Time{}
+		}
+		return at(seconds).AsTime()
+	}
+	for i, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			s := all[i]
+			if s.kind != tt.kind || s.name != tt.name || s.id != tt.id || s.outcome != tt.outcome || s.attempt != tt.attempt {
+				t.Errorf("step = %+v", s)
+			}
+			if !s.scheduled.Equal(when(tt.scheduled)) || !s.started.Equal(when(tt.started)) || !s.closed.Equal(when(tt.closed)) {
+				t.Errorf("scheduled %v, started %v, closed %v", s.scheduled, s.started, s.closed)
+			}
+		})
+	}
+	if n := count(all, "timer"); n != 1 {
+		t.Errorf("count(timer) = %d, want 1", n)
+	}
+}
+
+// fakeService serves the executions and the history of each in pages of one
+type fakeService struct {
+	workflowservice.WorkflowServiceClient
+	executions []*workflowpb.WorkflowExecutionInfo
+	history    []*historypb.HistoryEvent
+	lists      []*workflowservice.ListWorkflowExecutionsRequest
+	histories  []*workflowservice.GetWorkflowExecutionHistoryRequest
+	historyErr error
+}
+
+// page of one item at the token, and the token of the next page
+func page(token []byte, n int) (int, []byte) {
+	i := 0
+	if len(token) > 0 {
+		i = int(token[0])
+	}
+	if i+1 < n {
+		return i, []byte{byte(i + 1)}
+	}
+	return i, nil
+}
+
+func (f *fakeService) ListWorkflowExecutions(ctx context.Context, req *workflowservice.ListWorkflowExecutionsRequest, opts ...grpc.CallOption) (*workflowservice.ListWorkflowExecutionsResponse, error) {
+	f.lists = append(f.lists, req)
+	i, next := page(req.GetNextPageToken(), len(f.executions))
+	return &workflowservice.ListWorkflowExecutionsResponse{Executions: f.executions[i : i+1], NextPageToken: next}, nil
+}
+
+func (f *fakeService) GetWorkflowExecutionHistory(ctx context.Context, req *workflowservice.GetWorkflowExecutionHistoryRequest, opts ...grpc.CallOption) (*workflowservice.GetWorkflowExecutionHistoryResponse, error) {
+	f.histories = append(f.histories, req)
+	if f.historyErr != nil {
+		return nil, f.historyErr
+	}
+	i, next := page(req.GetNextPageToken(), len(f.history))
+	return &workflowservice.GetWorkflowExecutionHistoryResponse{History: &historypb.History{Events: f.history[i : i+1]}, NextPageToken: next}, nil
+}
+
+func execution(id string, workflowType string, status enumspb.WorkflowExecutionStatus) *workflowpb.WorkflowExecutionInfo {
+	return &workflowpb.WorkflowExecutionInfo{
+		Execution: &commonpb.WorkflowExecution{WorkflowId: id, RunId: id + "-run"},
+		Type:      &commonpb.WorkflowType{Name: workflowType},
+		Status:    status,
+		TaskQueue: "etl",
+		StartTime: at(0),
+		CloseTime: at(60),
+	}
+}
+
+func TestCycle(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	f := &fakeService{
+		executions: []*workflowpb.WorkflowExecutionInfo{
+			execution("nightly", "Nightly", enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED),
+			execution("scratch", "Scratch", enumspb.WORKFLOW_EXECUTION_STATUS_FAILED),
+			execution("hourly", "Nightly", enumspb.WORKFLOW_EXECUTION_STATUS_TIMED_OUT),
+		},
+		history: testHistory(),
+	}
+	var out bytes.Buffer
+	em := (&source.Emitter{Sink: &sink.Writer{W: &out}}).For("temporal")
+	cfg := &config.Config{Sources: config.Sources{Temporal: config.Temporal{Namespace: "prod", Lookback: time.Hour}}}
+	cache := ttlcache.New[string, string]()
+
+	// Nothing is published or cached without the history, the errors are returned
+	f.historyErr = errors.New("unavailable")
+	if err := cycle(context.Background(), cfg, f, em, cache); err == nil || out.Len() != 0 || cache.Len() != 0 {
+		t.Fatalf("cycle() without history error = %v, published %s", err, out.String())
+	}
+	f.historyErr, f.lists, f.histories = nil, nil, nil
+
+	if err := cycle(context.Background(), cfg, f, em, cache); err != nil {
+		t.Fatalf("cycle() error = %v", err)
+	}
+	if len(f.lists) != 3 {
+		t.Errorf("list requests = %d, want 3 pages", len(f.lists))
+	}
+	for _, req := range f.lists {
+		if req.GetNamespace() != "prod" || !strings.HasPrefix(req.GetQuery(), `CloseTime > "`) {
+			t.Errorf("list request = %v", req)
+		}
+	}
+	// Every page of the history of each execution
+	if want := 3 * len(f.history); len(f.histories) != want {
+		t.Errorf("history requests = %d, want %d", len(f.histories), want)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 3 {
+		t.Errorf("published %d events, want 3", n)
+	}
+	for _, name := range []string{`"workflow_id":"nightly"`, `"workflow_id":"scratch"`, `"workflow_id":"hourly"`, `"activities":1`, `"child_workflows":1`, `"timers":1`} {
+		if !strings.Contains(out.String(), name) {
+			t.Errorf("no %s in %s", name, out.String())
+		}
+	}
+	counts := map[string]int{}
+	for _, s := range mt.FinishedSpans() {
+		counts[s.OperationName()+" "+s.Tag(ext.ResourceName).(string)]++
+	}
+	for name, want := range map[string]int{"temporal.workflow Nightly": 2, "temporal.workflow Scratch": 1, "activity Extract": 3, "child_workflow Load": 3, "timer backoff": 3} {
+		if counts[name] != want {
+			t.Errorf("spans %s = %d, want %d in %v", name, counts[name], want, counts)
+		}
+	}
+
+	// Closed executions never change, the next cycle publishes nothing
+	out.Reset()
+	if err := cycle(context.Background(), cfg, f, em, cache); err != nil {
+		t.Fatalf("second cycle() error = %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("second cycle published %s", out.String())
+	}
+}
@@ -0,0 +1,184 @@
+package temporal
+
+import (
+	enumspb "go.temporal.io/api/enums/v1"
+	historypb "go.temporal.io/api/history/v1"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// step is an activity, child workflow or timer of a workflow execution, rebuilt from its history events
+type step struct {
+	kind      string //activity, child_workflow or timer
+	name      string //Activity type, child workflow type or timer ID
+	id        string //Activity ID, child workflow ID or timer ID
+	scheduled time.Time
+	started   time.Time //Zero if it never started
+	closed    time.Time //Zero if it never closed
+	outcome   string    //e.g. Completed, Failed, TimedOut, Canceled, Fired
+	attempt   int32
+	runID     string //Of a child workflow
+}
+
+// steps pairs the scheduled, started and closed history events, in the order they were scheduled
+func steps(events []*historypb.HistoryEvent) []*step {
+	var ordered []*step
+	byEvent := map[int64]*step{} //Activities and child workflows by the ID of the scheduling event
+	timers := map[string]*step{} //Timers by timer ID
+	closeEvent := func(id int64, at time.Time, outcome string) {
+		if s, ok := byEvent[id]; ok {
+			s.closed, s.outcome = at, outcome
+		}
+	}
+	for _, e := range events {
+		at := e.GetEventTime().AsTime()
+		switch e.GetEventType() {
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_SCHEDULED:
+			a := e.GetActivityTaskScheduledEventAttributes()
+			s := &step{kind: "activity", name: a.GetActivityType().GetName(), id: a.GetActivityId(), scheduled: at}
+			byEvent[e.GetEventId()] = s
+			ordered = append(ordered, s)
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_STARTED:
+			a := e.GetActivityTaskStartedEventAttributes()
+			if s, ok := byEvent[a.GetScheduledEventId()]; ok {
+				s.started, s.attempt = at, a.GetAttempt()
+			}
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_COMPLETED:
+			closeEvent(e.GetActivityTaskCompletedEventAttributes().GetScheduledEventId(), at, "Completed")
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_FAILED:
+			closeEvent(e.GetActivityTaskFailedEventAttributes().GetScheduledEventId(), at, "Failed")
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_TIMED_OUT:
+			closeEvent(e.GetActivityTaskTimedOutEventAttributes().GetScheduledEventId(), at, "TimedOut")
+		case enumspb.EVENT_TYPE_ACTIVITY_TASK_CANCELED:
+			closeEvent(e.GetActivityTaskCanceledEventAttributes().GetScheduledEventId(), at, "Canceled")
+		case enumspb.EVENT_TYPE_START_CHILD_WORKFLOW_EXECUTION_INITIATED:
+			a := e.GetStartChildWorkflowExecutionInitiatedEventAttributes()
+			s := &step{kind: "child_workflow", name: a.GetWorkflowType().GetName(), id: a.GetWorkflowId(), scheduled: at}
+			byEvent[e.GetEventId()] = s
+			ordered = append(ordered, s)
+		case enumspb.EVENT_TYPE_START_CHILD_WORKFLOW_EXECUTION_FAILED:
+			closeEvent(e.GetStartChildWorkflowExecutionFailedEventAttributes().GetInitiatedEventId(), at, "StartFailed")
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_STARTED:
+			a := e.GetChildWorkflowExecutionStartedEventAttributes()
+			if s, ok := byEvent[a.GetInitiatedEventId()]; ok {
+				s.started, s.runID = at, a.GetWorkflowExecution().GetRunId()
+			}
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_COMPLETED:
+			closeEvent(e.GetChildWorkflowExecutionCompletedEventAttributes().GetInitiatedEventId(), at, "Completed")
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_FAILED:
+			closeEvent(e.GetChildWorkflowExecutionFailedEventAttributes().GetInitiatedEventId(), at, "Failed")
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_TIMED_OUT:
+			closeEvent(e.GetChildWorkflowExecutionTimedOutEventAttributes().GetInitiatedEventId(), at, "TimedOut")
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_CANCELED:
+			closeEvent(e.GetChildWorkflowExecutionCanceledEventAttributes().GetInitiatedEventId(), at, "Canceled")
+		case enumspb.EVENT_TYPE_CHILD_WORKFLOW_EXECUTION_TERMINATED:
+			closeEvent(e.GetChildWorkflowExecutionTerminatedEventAttributes().GetInitiatedEventId(), at, "Terminated")
+		case enumspb.EVENT_TYPE_TIMER_STARTED:
+			id := e.GetTimerStartedEventAttributes().GetTimerId()
+			s := &step{kind: "timer", name: id, id: id, scheduled: at, started: at}
+			timers[id] = s
+			ordered = append(ordered, s)
+		case enumspb.EVENT_TYPE_TIMER_FIRED:
+			if s, ok := timers[e.GetTimerFiredEventAttributes().GetTimerId()]; ok {
+				s.closed, s.outcome = at, "Fired"
+			}
+		case enumspb.EVENT_TYPE_TIMER_CANCELED:
+			if s, ok := timers[e.GetTimerCanceledEventAttributes().GetTimerId()]; ok {
+				s.closed, s.outcome = at, "Canceled"
+			}
+		}
+	}
+	return ordered
+}
+
+// count the steps of a kind
+func count(all []*step, kind string) int32 {
+	var n int32
+	for _, s := range all {
+		if s.kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// statusToCode maps the status of a workflow execution to an HTTP status code
+// Makes the DataDog UI look nice
+func statusToCode(status enumspb.WorkflowExecutionStatus) int {
+	switch status {
+	case enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED, enumspb.WORKFLOW_EXECUTION_STATUS_CONTINUED_AS_NEW:
+		return 200
+	case enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING:
+		return 102
+	default:
+		return 500
+	}
+}
+
+// Create a DataDog trace for a workflow execution, with a span per activity, child workflow and timer
+func trace(w *workflowpb.WorkflowExecutionInfo, all []*step, tenant string, url string, tags map[string]string) {
+	slog.Debug("trace",
+		"type", "temporal",
+		"status", w.GetStatus().String(),
+		"workflowId", w.GetExecution().GetWorkflowId(),
+		"runId", w.GetExecution().GetRunId())
+	name := w.GetType().GetName()
+	start, closed := w.GetStartTime().AsTime(), w.GetCloseTime().AsTime()
+	rootSpan := tracer.StartSpan("temporal.workflow",
+		tracer.StartTime(start),
+		tracer.ResourceName(name))
+	rootSpan.SetTag(ext.HTTPMethod, "TEMPORAL")
+	rootSpan.SetTag(ext.HTTPCode, statusToCode(w.GetStatus()))
+	rootSpan.SetTag("tenant", tenant)
+	rootSpan.SetTag("url", url)
+	for k, v := range tags {
+		rootSpan.SetTag(k, v)
+	}
+
+	workflowSpan := tracer.StartSpan(w.GetExecution().GetWorkflowId(),
+		tracer.ServiceName(name),
+		tracer.StartTime(start),
+		tracer.SpanType("temporal_workflow"),
+		tracer.ChildOf(rootSpan.Context()))
+	workflowSpan.SetTag("workflow_id", w.GetExecution().GetWorkflowId())
+	workflowSpan.SetTag("run_id", w.GetExecution().GetRunId())
+	workflowSpan.SetTag("workflow_type", name)
+	workflowSpan.SetTag("task_queue", w.GetTaskQueue())
+	workflowSpan.SetTag("status", w.GetStatus().String())
+	workflowSpan.SetTag("history_length", w.GetHistoryLength())
+	if p := w.GetParentExecution(); p != nil {
+		workflowSpan.SetTag("parent_workflow_id", p.GetWorkflowId())
+		workflowSpan.SetTag("parent_run_id", p.GetRunId())
+	}
+	slices.SortStableFunc(all, func(a, b *step) int { return a.scheduled.Compare(b.scheduled) })
+	for _, s := range all {
+		end := s.closed
+		if end.IsZero() {
+			end = closed //still open when the workflow closed, e.g. canceled with it
+		}
+		span := tracer.StartSpan(s.kind,
+			tracer.ChildOf(workflowSpan.Context()),
+			tracer.StartTime(s.scheduled),
+			tracer.ResourceName(s.name))
+		span.SetTag("id", s.id)
+		span.SetTag("outcome", s.outcome)
+		if !s.started.IsZero() && s.kind != "timer" {
+			// Time waiting for a worker, or for the child workflow to start
+			span.SetTag("schedule_to_start", s.started.Sub(s.scheduled).Seconds())
+		}
+		if s.kind == "activity" {
+			span.SetTag("attempt", s.attempt)
+		}
+		if s.runID != "" {
+			span.SetTag("run_id", s.runID)
+		}
+		span.Finish(tracer.FinishTime(end), tracer.WithError(nil))
+	}
+	finishOptions := []tracer.FinishOption{tracer.FinishTime(closed), tracer.WithError(nil)}
+	workflowSpan.Finish(finishOptions...)
+	rootSpan.Finish(finishOptions...)
+}